@@ -15,6 +15,12 @@ def go_dependencies():
         sum = "h1:cTp8I5+VIoKjsnZuH8vjyaysT/ses3EvZeaV/1UkF2M=",
         version = "v0.0.0-20190825152654-46b345b51c96",
     )
+    go_repository(
+        name = "com_github_andybalholm_brotli",
+        importpath = "github.com/andybalholm/brotli",
+        sum = "h1:PR2pgnyFznKEugtsUo0xLdDop5SKXd5Qf5ysW+7XdTA=",
+        version = "v1.1.1",
+    )
     go_repository(
         name = "com_github_armon_consul_api",
         importpath = "github.com/armon/consul-api",
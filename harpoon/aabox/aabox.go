@@ -135,3 +135,82 @@ func RayTestAABox(r ray.RaySegment, b AABox) ray.Span {
 
 	return cover
 }
+
+// packetEpsilon is the relative error allowed for in PacketTestAABox's float32
+// arithmetic.
+const packetEpsilon = 2e-6
+
+// packetSlab converts a span of b to float32, relative to origin, widened to
+// cover rounding.
+func packetSlab(s ray.Span, origin float64, slack float32) (float32, float32) {
+	lo := float32(s.Lo - origin)
+	hi := float32(s.Hi - origin)
+	lo -= float32(math.Abs(float64(lo)))*packetEpsilon + slack
+	hi += float32(math.Abs(float64(hi)))*packetEpsilon + slack
+	return lo, hi
+}
+
+// PacketTestAABox returns the subset of the active rays in p whose segments
+// pass through b.  The test is conservative: it may keep rays that narrowly
+// miss the box, but it never drops a ray that hits it.
+func PacketTestAABox(p *ray.Packet, b AABox, active uint32) uint32 {
+	loX, hiX := packetSlab(b.X, p.Origin[0], p.Slack)
+	loY, hiY := packetSlab(b.Y, p.Origin[1], p.Slack)
+	loZ, hiZ := packetSlab(b.Z, p.Origin[2], p.Slack)
+
+	result := uint32(0)
+	for i := 0; i < ray.PacketWidth; i++ {
+		if active&(1<<i) == 0 {
+			continue
+		}
+
+		// A ray lying exactly in a slab's plane gives a NaN for that
+		// plane.  The comparisons below are false for NaNs, so the plane is
+		// ignored, which is the conservative choice.
+		tNear, tFar := p.Lo[i], p.Hi[i]
+
+		t0 := (loX - p.Point.X[i]) * p.InvSlope.X[i]
+		t1 := (hiX - p.Point.X[i]) * p.InvSlope.X[i]
+		if t0 > t1 {
+			t0, t1 = t1, t0
+		}
+		if t0 > tNear {
+			tNear = t0
+		}
+		if t1 < tFar {
+			tFar = t1
+		}
+
+		t0 = (loY - p.Point.Y[i]) * p.InvSlope.Y[i]
+		t1 = (hiY - p.Point.Y[i]) * p.InvSlope.Y[i]
+		if t0 > t1 {
+			t0, t1 = t1, t0
+		}
+		if t0 > tNear {
+			tNear = t0
+		}
+		if t1 < tFar {
+			tFar = t1
+		}
+
+		t0 = (loZ - p.Point.Z[i]) * p.InvSlope.Z[i]
+		t1 = (hiZ - p.Point.Z[i]) * p.InvSlope.Z[i]
+		if t0 > t1 {
+			t0, t1 = t1, t0
+		}
+		if t0 > tNear {
+			tNear = t0
+		}
+		if t1 < tFar {
+			tFar = t1
+		}
+
+		// Allow for the rounding of the multiplications by the inverse
+		// slopes.
+		tFar += float32(math.Abs(float64(tFar))) * packetEpsilon
+		if tNear <= tFar {
+			result |= 1 << i
+		}
+	}
+	return result
+}
@@ -0,0 +1,67 @@
+package aabox
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// TestPacketTestAABoxIsConservative checks that the float32 packet test keeps
+// every ray that the float64 test says hits the box within its segment.
+func TestPacketTestAABoxIsConservative(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	span := func() ray.Span {
+		lo := rng.Float64()*20 - 10
+		return ray.Span{Lo: lo, Hi: lo + rng.Float64()*5}
+	}
+
+	kept, hits := 0, 0
+	for trial := 0; trial < 10000; trial++ {
+		b := AABox{X: span(), Y: span(), Z: span()}
+
+		// Rays from nearby points, aimed roughly the same way.
+		origin := vec3.T{rng.Float64()*40 - 20, rng.Float64()*40 - 20, rng.Float64()*40 - 20}
+		aim := vec3.SubVV(vec3.T{rng.Float64()*20 - 10, rng.Float64()*20 - 10, rng.Float64()*20 - 10}, origin)
+		segs := make([]ray.RaySegment, ray.PacketWidth)
+		for i := range segs {
+			slope := vec3.AddVV(aim, vec3.T{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()})
+			if i == 0 {
+				// Exercise rays parallel to a slab.
+				slope[rng.Intn(3)] = 0
+			}
+			segs[i] = ray.RaySegment{
+				TheRay: ray.Ray{
+					Point: vec3.AddVV(origin, vec3.MulVS(vec3.T{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()}, 0.01)),
+					Slope: vec3.Normalize(slope),
+				},
+				TheSegment: ray.Span{Lo: 0, Hi: math.Inf(1)},
+			}
+			if rng.Intn(2) == 0 {
+				segs[i].TheSegment.Hi = rng.Float64() * 40
+			}
+		}
+
+		p := ray.NewPacket(segs)
+		got := PacketTestAABox(&p, b, p.Active)
+		for i, seg := range segs {
+			cover := RayTestAABox(seg, b)
+			hit := !cover.IsNaN() && ray.SpanOverlaps(cover, seg.TheSegment)
+			if hit {
+				hits++
+			}
+			if got&(1<<i) != 0 {
+				kept++
+			} else if hit {
+				t.Fatalf("trial %d: packet test dropped ray %d (%+v), which hits %+v over %+v", trial, i, seg, b, cover)
+			}
+		}
+	}
+
+	// Being conservative shouldn't mean keeping everything.
+	if kept > hits+hits/10 {
+		t.Errorf("packet test kept %d rays, but only %d hit", kept, hits)
+	}
+}
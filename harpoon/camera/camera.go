@@ -37,54 +37,53 @@ func (c *PinholeCamera) ImageToRay(curRow, imgRows, curCol, imgCols int, rng *ra
 }
 
 func (c *PinholeCamera) Eye() vec3.T {
-	return vec3.T{
-		c.ApertureToWorld[0],
-		c.ApertureToWorld[3],
-		c.ApertureToWorld[6],
-	}
+	return frameEye(c.ApertureToWorld)
 }
 
 func (c *PinholeCamera) Left() vec3.T {
-	return vec3.T{
-		c.ApertureToWorld[1],
-		c.ApertureToWorld[4],
-		c.ApertureToWorld[7],
-	}
+	return frameLeft(c.ApertureToWorld)
 }
 
 func (c *PinholeCamera) Up() vec3.T {
-	return vec3.T{
-		c.ApertureToWorld[2],
-		c.ApertureToWorld[5],
-		c.ApertureToWorld[8],
-	}
+	return frameUp(c.ApertureToWorld)
 }
 
 func (c *PinholeCamera) SetEye(newEye vec3.T) {
-	c.setEyeDirect(vec3.Normalize(newEye))
-	c.setUpDirect(vec3.Normalize(vec3.Reject(c.Eye(), c.Up())))
-	c.setLeftDirect(vec3.CProd(c.Up(), c.Eye()))
+	setFrameEye(&c.ApertureToWorld, newEye)
 }
 
 func (c *PinholeCamera) SetUp(newUp vec3.T) {
-	c.setUpDirect(vec3.Normalize(vec3.Reject(c.Eye(), newUp)))
-	c.setLeftDirect(vec3.CProd(c.Up(), c.Eye()))
+	setFrameUp(&c.ApertureToWorld, newUp)
+}
+
+// The aperture-to-world matrix of a camera holds its eye, left, and up vectors
+// in its columns.
+
+func frameEye(m mat33.T) vec3.T {
+	return vec3.T{m[0], m[3], m[6]}
+}
+
+func frameLeft(m mat33.T) vec3.T {
+	return vec3.T{m[1], m[4], m[7]}
+}
+
+func frameUp(m mat33.T) vec3.T {
+	return vec3.T{m[2], m[5], m[8]}
 }
 
-func (c *PinholeCamera) setEyeDirect(newEye vec3.T) {
-	c.ApertureToWorld[0] = newEye[0]
-	c.ApertureToWorld[3] = newEye[1]
-	c.ApertureToWorld[6] = newEye[2]
+func setFrameEye(m *mat33.T, newEye vec3.T) {
+	setFrameColumn(m, 0, vec3.Normalize(newEye))
+	setFrameColumn(m, 2, vec3.Normalize(vec3.Reject(frameEye(*m), frameUp(*m))))
+	setFrameColumn(m, 1, vec3.CProd(frameUp(*m), frameEye(*m)))
 }
 
-func (c *PinholeCamera) setLeftDirect(newLeft vec3.T) {
-	c.ApertureToWorld[1] = newLeft[0]
-	c.ApertureToWorld[4] = newLeft[1]
-	c.ApertureToWorld[7] = newLeft[2]
+func setFrameUp(m *mat33.T, newUp vec3.T) {
+	setFrameColumn(m, 2, vec3.Normalize(vec3.Reject(frameEye(*m), newUp)))
+	setFrameColumn(m, 1, vec3.CProd(frameUp(*m), frameEye(*m)))
 }
 
-func (c *PinholeCamera) setUpDirect(newUp vec3.T) {
-	c.ApertureToWorld[2] = newUp[0]
-	c.ApertureToWorld[5] = newUp[1]
-	c.ApertureToWorld[8] = newUp[2]
+func setFrameColumn(m *mat33.T, col int, v vec3.T) {
+	m[col] = v[0]
+	m[3+col] = v[1]
+	m[6+col] = v[2]
 }
@@ -0,0 +1,459 @@
+package camera
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+
+	"row-major/harpoon/densesignal"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/mat33"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// SpectralCamera is a Camera whose rays depend on the wavelength being
+// sampled, like a lens with chromatic aberration.
+type SpectralCamera interface {
+	Camera
+
+	// ImageToRaySpectral returns a ray for the given pixel at the given
+	// wavelength (in nm), along with the weight of the sample.  A weight of
+	// zero means the ray was blocked inside the camera; it still counts as
+	// a sample, of no light.
+	ImageToRaySpectral(curRow, imgRows, curCol, imgCols int, wavelength float64, rng *rand.Rand) (ray.Ray, float64)
+}
+
+// ReferenceWavelength is the wavelength (in nm) that a LensSystem uses when
+// the caller doesn't specify one.
+const ReferenceWavelength = 550.0
+
+// LensSurface is one spherical surface of a lens prescription.  Lengths are in
+// millimeters, as in published lens designs.
+type LensSurface struct {
+	// Radius is the radius of curvature.  Positive radii have their center
+	// of curvature behind the surface, toward the film.  Zero is a flat
+	// surface; a flat surface with air on both sides is an aperture stop.
+	Radius float64
+
+	// Thickness is the distance along the optical axis to the next surface.
+	// The last surface's thickness is ignored; see LensSystem.FilmDistance.
+	Thickness float64
+
+	// Glass is the refractive index, by wavelength, of the medium between
+	// this surface and the next.  Nil is air.
+	Glass *densesignal.DenseSignal
+
+	// Aperture is the diameter of the surface.  Rays outside it are blocked.
+	Aperture float64
+}
+
+// LensSystem is a camera that traces rays from the film through a real lens,
+// surface by surface.  The lens blocks and bends rays the way the glass would,
+// so the image shows the lens's vignetting, distortion, and chromatic
+// aberration.
+//
+// The lens forms an image on the film in the usual camera coordinates: its
+// optical axis is the eye vector, and the film's center is at Center.
+//
+// Set up the prescription and focus before rendering; the camera works out its
+// exit pupil on first use, and Focus must not race with it.
+type LensSystem struct {
+	Center          vec3.T
+	ApertureToWorld mat33.T
+
+	// Surfaces is the lens prescription, from the front of the lens (facing
+	// the scene) to the back.
+	Surfaces []LensSurface
+
+	// FilmDistance is the distance (in mm) from the last surface to the
+	// film.  Focus sets it.
+	FilmDistance float64
+
+	// FilmWidth and FilmHeight are the size of the film (in mm).  They
+	// should have the same aspect ratio as the rendered image.
+	FilmWidth  float64
+	FilmHeight float64
+
+	// SceneUnitsPerMillimeter converts lengths in the lens to lengths in the
+	// scene.  Zero means 0.001, for scenes measured in meters.
+	SceneUnitsPerMillimeter float64
+
+	prepare sync.Once
+
+	// pupils bound the exit pupil, in rings of increasing distance from the
+	// center of the film.  See findExitPupil.
+	pupils     []pupilBounds
+	filmRadius float64
+
+	// axialIrradiance is the irradiance that a uniform unit radiance
+	// produces at the center of the film, which weights are relative to.
+	axialIrradiance float64
+}
+
+// pupilBounds is a rectangle on the plane of the last surface's vertex that
+// holds every point that rays from one ring of the film can pass through.  The
+// rectangle is for film points on the positive X axis; other points in the ring
+// rotate it with them.
+type pupilBounds struct {
+	lo, hi [2]float64
+}
+
+func (b pupilBounds) empty() bool {
+	return b.hi[0] < b.lo[0] || b.hi[1] < b.lo[1]
+}
+
+func (b pupilBounds) area() float64 {
+	if b.empty() {
+		return 0
+	}
+	return (b.hi[0] - b.lo[0]) * (b.hi[1] - b.lo[1])
+}
+
+func (l *LensSystem) Eye() vec3.T {
+	return frameEye(l.ApertureToWorld)
+}
+
+func (l *LensSystem) Left() vec3.T {
+	return frameLeft(l.ApertureToWorld)
+}
+
+func (l *LensSystem) Up() vec3.T {
+	return frameUp(l.ApertureToWorld)
+}
+
+func (l *LensSystem) SetEye(newEye vec3.T) {
+	setFrameEye(&l.ApertureToWorld, newEye)
+}
+
+func (l *LensSystem) SetUp(newUp vec3.T) {
+	setFrameUp(&l.ApertureToWorld, newUp)
+}
+
+func (l *LensSystem) sceneUnits() float64 {
+	if l.SceneUnitsPerMillimeter == 0 {
+		return 0.001
+	}
+	return l.SceneUnitsPerMillimeter
+}
+
+// ImageToRay is ImageToRaySpectral at the reference wavelength.  A ray blocked
+// by the lens is retried, so the result shows the lens's distortion, but not
+// its vignetting.
+func (l *LensSystem) ImageToRay(curRow, imgRows, curCol, imgCols int, rng *rand.Rand) ray.Ray {
+	var r ray.Ray
+	for i := 0; i < 16; i++ {
+		var weight float64
+		r, weight = l.ImageToRaySpectral(curRow, imgRows, curCol, imgCols, ReferenceWavelength, rng)
+		if weight != 0 {
+			break
+		}
+	}
+	return r
+}
+
+// ImageToRaySpectral traces a ray from a random point in the pixel, through a
+// random point of the exit pupil, out the front of the lens.
+//
+// The weight accounts for how much light reaches the film point along the
+// ray, relative to the center of the film.  In an image of a uniformly bright
+// scene, the center is as bright as the scene, and the corners fall off with
+// the lens's vignetting.
+func (l *LensSystem) ImageToRaySpectral(curRow, imgRows, curCol, imgCols int, wavelength float64, rng *rand.Rand) (ray.Ray, float64) {
+	l.prepare.Do(l.findExitPupil)
+
+	// The lens forms an upside-down image, so the film is flipped relative to
+	// PinholeCamera's aperture.
+	film := vec3.T{
+		-(1.0 - 2.0*(float64(curCol)+rng.Float64())/float64(imgCols)) * l.FilmWidth / 2,
+		-(1.0 - 2.0*(float64(curRow)+rng.Float64())/float64(imgRows)) * l.FilmHeight / 2,
+		0,
+	}
+
+	blocked := ray.Ray{Point: l.Center, Slope: l.Eye()}
+
+	radius := math.Hypot(film[0], film[1])
+	ring := int(radius / l.filmRadius * float64(len(l.pupils)))
+	if ring >= len(l.pupils) {
+		ring = len(l.pupils) - 1
+	}
+	bounds := l.pupils[ring]
+	if bounds.empty() {
+		return blocked, 0
+	}
+
+	u := bounds.lo[0] + rng.Float64()*(bounds.hi[0]-bounds.lo[0])
+	v := bounds.lo[1] + rng.Float64()*(bounds.hi[1]-bounds.lo[1])
+	cos, sin := 1.0, 0.0
+	if radius > 0 {
+		cos, sin = film[0]/radius, film[1]/radius
+	}
+	pupil := vec3.T{u*cos - v*sin, u*sin + v*cos, l.FilmDistance}
+
+	slope := vec3.Normalize(vec3.SubVV(pupil, film))
+	out, ok := l.trace(ray.Ray{Point: film, Slope: slope}, true, wavelength)
+	if !ok {
+		return blocked, 0
+	}
+
+	// Irradiance from a patch of the pupil falls off with the fourth power of
+	// the cosine: once for the film, once for the pupil, and twice for the
+	// distance between them.
+	cosTheta := slope[2]
+	weight := cosTheta * cosTheta * cosTheta * cosTheta * bounds.area() / l.axialIrradiance
+
+	return l.toWorld(out), weight
+}
+
+// toWorld moves a ray from lens coordinates (in mm, with the film at the origin
+// and the optical axis along Z) to the scene.
+func (l *LensSystem) toWorld(r ray.Ray) ray.Ray {
+	point := vec3.MulVS(vec3.T{r.Point[2], r.Point[0], r.Point[1]}, l.sceneUnits())
+	slope := vec3.T{r.Slope[2], r.Slope[0], r.Slope[1]}
+	return ray.Ray{
+		Point: vec3.AddVV(l.Center, mat33.MulMV(l.ApertureToWorld, point)),
+		Slope: vec3.Normalize(mat33.MulMV(l.ApertureToWorld, slope)),
+	}
+}
+
+// frontVertex is the position of the first surface on the optical axis.
+func (l *LensSystem) frontVertex() float64 {
+	z := l.FilmDistance
+	for _, s := range l.Surfaces[:len(l.Surfaces)-1] {
+		z += s.Thickness
+	}
+	return z
+}
+
+// glassIOR is the refractive index of glass (nil for air) at the wavelength.
+func glassIOR(glass *densesignal.DenseSignal, wavelength float64) float64 {
+	if glass == nil {
+		return 1
+	}
+	x := math.Min(math.Max(wavelength, float64(glass.SrcX)), float64(glass.LimX))
+	return float64(glass.Interpolate(float32(x)))
+}
+
+// trace carries r, in lens coordinates, through every surface of the lens:
+// toward the scene if toScene, and toward the film otherwise.  It reports false
+// if the ray misses a surface, falls outside its aperture, or is totally
+// internally reflected.
+func (l *LensSystem) trace(r ray.Ray, toScene bool, wavelength float64) (ray.Ray, bool) {
+	n := len(l.Surfaces)
+
+	i, step := 0, 1
+	z := l.frontVertex()
+	if toScene {
+		i, step = n-1, -1
+		z = l.FilmDistance
+	}
+
+	for ; 0 <= i && i < n; i += step {
+		s := &l.Surfaces[i]
+
+		var t float64
+		var normal vec3.T
+		if s.Radius == 0 {
+			t = (z - r.Point[2]) / r.Slope[2]
+			normal = vec3.T{0, 0, 1}
+		} else {
+			center := vec3.T{0, 0, z - s.Radius}
+			oc := vec3.SubVV(r.Point, center)
+			b := vec3.IProd(oc, r.Slope)
+			disc := b*b - (vec3.IProd(oc, oc) - s.Radius*s.Radius)
+			if disc < 0 {
+				return r, false
+			}
+
+			// The surface is the half of the sphere around the vertex.
+			// Heading toward the center of curvature, that's the near
+			// crossing.
+			if (r.Slope[2] > 0) == (s.Radius < 0) {
+				t = -b - math.Sqrt(disc)
+			} else {
+				t = -b + math.Sqrt(disc)
+			}
+			normal = vec3.Normalize(vec3.SubVV(vec3.AddVV(r.Point, vec3.MulVS(r.Slope, t)), center))
+		}
+		if !(t > 0) {
+			return r, false
+		}
+
+		p := vec3.AddVV(r.Point, vec3.MulVS(r.Slope, t))
+		if p[0]*p[0]+p[1]*p[1] > s.Aperture*s.Aperture/4 {
+			return r, false
+		}
+
+		// The media on the scene and film sides of the surface.
+		outer := 1.0
+		if i > 0 {
+			outer = glassIOR(l.Surfaces[i-1].Glass, wavelength)
+		}
+		inner := glassIOR(s.Glass, wavelength)
+
+		eta := outer / inner
+		if toScene {
+			eta = inner / outer
+		}
+
+		slope, ok := refract(r.Slope, normal, eta)
+		if !ok {
+			return r, false
+		}
+		r = ray.Ray{Point: p, Slope: slope}
+
+		if toScene {
+			if i > 0 {
+				z += l.Surfaces[i-1].Thickness
+			}
+		} else {
+			z -= s.Thickness
+		}
+	}
+
+	return r, true
+}
+
+// refract bends the unit vector d through a surface with normal n, where eta
+// is the ratio of the refractive indices on the incident and transmitted
+// sides.  It reports false for total internal reflection.
+func refract(d, n vec3.T, eta float64) (vec3.T, bool) {
+	if eta == 1 {
+		return d, true
+	}
+
+	cosI := -vec3.IProd(n, d)
+	if cosI < 0 {
+		n = vec3.MulVS(n, -1)
+		cosI = -cosI
+	}
+
+	sin2T := eta * eta * (1 - cosI*cosI)
+	if sin2T > 1 {
+		return d, false
+	}
+	cosT := math.Sqrt(1 - sin2T)
+
+	return vec3.Normalize(vec3.AddVV(vec3.MulVS(d, eta), vec3.MulVS(n, eta*cosI-cosT))), true
+}
+
+// findExitPupil bounds the region of the last surface's plane that rays from
+// each ring of the film can get through the lens from, so that
+// ImageToRaySpectral doesn't waste samples on rays the lens blocks.  It also
+// measures the irradiance at the center of the film that weights are relative
+// to.
+func (l *LensSystem) findExitPupil() {
+	const (
+		rings = 64
+		grid  = 32
+	)
+
+	l.filmRadius = math.Hypot(l.FilmWidth, l.FilmHeight) / 2
+	rear := l.Surfaces[len(l.Surfaces)-1].Aperture / 2
+
+	passes := func(filmX, u, v float64) bool {
+		film := vec3.T{filmX, 0, 0}
+		slope := vec3.Normalize(vec3.SubVV(vec3.T{u, v, l.FilmDistance}, film))
+		_, ok := l.trace(ray.Ray{Point: film, Slope: slope}, true, ReferenceWavelength)
+		return ok
+	}
+
+	cell := 2 * rear / grid
+	l.pupils = make([]pupilBounds, rings)
+	for k := range l.pupils {
+		b := pupilBounds{lo: [2]float64{rear, rear}, hi: [2]float64{-rear, -rear}}
+		for _, f := range []float64{0, 0.5, 1} {
+			filmX := (float64(k) + f) / rings * l.filmRadius
+			for gy := 0; gy < grid; gy++ {
+				for gx := 0; gx < grid; gx++ {
+					u := -rear + (float64(gx)+0.5)*cell
+					v := -rear + (float64(gy)+0.5)*cell
+					if !passes(filmX, u, v) {
+						continue
+					}
+					b.lo = [2]float64{math.Min(b.lo[0], u), math.Min(b.lo[1], v)}
+					b.hi = [2]float64{math.Max(b.hi[0], u), math.Max(b.hi[1], v)}
+				}
+			}
+		}
+
+		// The grid only samples the pupil, and other wavelengths bend
+		// differently, so leave a cell of slack around it.
+		if !b.empty() {
+			for a := 0; a < 2; a++ {
+				b.lo[a] = math.Max(b.lo[a]-cell, -rear)
+				b.hi[a] = math.Min(b.hi[a]+cell, rear)
+			}
+		}
+		l.pupils[k] = b
+	}
+
+	// The same integral ImageToRaySpectral estimates, on a finer grid.
+	const fine = 4 * grid
+	cell = 2 * rear / fine
+	for gy := 0; gy < fine; gy++ {
+		for gx := 0; gx < fine; gx++ {
+			u := -rear + (float64(gx)+0.5)*cell
+			v := -rear + (float64(gy)+0.5)*cell
+			if !passes(0, u, v) {
+				continue
+			}
+			cosTheta := l.FilmDistance / math.Sqrt(u*u+v*v+l.FilmDistance*l.FilmDistance)
+			l.axialIrradiance += cosTheta * cosTheta * cosTheta * cosTheta * cell * cell
+		}
+	}
+	if l.axialIrradiance == 0 {
+		// Nothing gets through to the center; leave the weights unscaled
+		// rather than infinite.
+		l.axialIrradiance = 1
+	}
+}
+
+// Focus moves the film so that points at the given distance (in scene units) in
+// front of the first surface are in focus at the reference wavelength.  A
+// distance of math.Inf(1) focuses at infinity.
+func (l *LensSystem) Focus(distance float64) error {
+	if len(l.Surfaces) == 0 {
+		return fmt.Errorf("lens has no surfaces")
+	}
+
+	// Trace a ray close to the optical axis, from the object to its image.
+	h := l.Surfaces[0].Aperture / 200
+	front := l.frontVertex()
+	r := ray.Ray{Point: vec3.T{h, 0, front + 1}, Slope: vec3.T{0, 0, -1}}
+	if !math.IsInf(distance, 1) {
+		object := vec3.T{0, 0, front + distance/l.sceneUnits()}
+		r = ray.Ray{Point: object, Slope: vec3.Normalize(vec3.SubVV(vec3.T{h, 0, front}, object))}
+	}
+
+	out, ok := l.trace(r, false, ReferenceWavelength)
+	if !ok {
+		return fmt.Errorf("an axial ray doesn't make it through the lens")
+	}
+	if out.Slope[0]*out.Point[0] >= 0 {
+		return fmt.Errorf("lens doesn't form a real image at distance %v", distance)
+	}
+
+	image := out.Point[2] - out.Point[0]*out.Slope[2]/out.Slope[0]
+	if l.FilmDistance-image <= 0 {
+		return fmt.Errorf("lens forms its image of distance %v inside itself", distance)
+	}
+	l.FilmDistance -= image
+
+	// The exit pupil moved with the film.
+	l.prepare = sync.Once{}
+	l.pupils = nil
+	l.axialIrradiance = 0
+	return nil
+}
+
+// FocalLength is the effective focal length of the lens (in mm) at the given
+// wavelength.
+func (l *LensSystem) FocalLength(wavelength float64) float64 {
+	h := l.Surfaces[0].Aperture / 200
+	out, ok := l.trace(ray.Ray{Point: vec3.T{h, 0, l.frontVertex() + 1}, Slope: vec3.T{0, 0, -1}}, false, wavelength)
+	if !ok {
+		return math.NaN()
+	}
+	return h * out.Slope[2] / out.Slope[0]
+}
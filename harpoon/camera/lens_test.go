@@ -0,0 +1,139 @@
+package camera
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"row-major/harpoon/vmath/mat33"
+	"row-major/harpoon/vmath/vec3"
+)
+
+func builtinLensSystem(t *testing.T, name string) *LensSystem {
+	t.Helper()
+	surfaces, ok := BuiltinLens(name)
+	if !ok {
+		t.Fatalf("no builtin lens %q", name)
+	}
+	l := &LensSystem{
+		ApertureToWorld: mat33.T{1, 0, 0, 0, 1, 0, 0, 0, 1},
+		Surfaces:        surfaces,
+		FilmWidth:       36,
+		FilmHeight:      24,
+	}
+	if err := l.Focus(math.Inf(1)); err != nil {
+		t.Fatalf("%s: Focus: %v", name, err)
+	}
+	return l
+}
+
+func TestBuiltinLensFocalLengths(t *testing.T) {
+	for name, want := range map[string]float64{
+		"double-gauss-50mm":  50,
+		"cooke-triplet-50mm": 50,
+		"achromat-100mm":     100,
+		"singlet-50mm":       50,
+	} {
+		l := builtinLensSystem(t, name)
+		if got := l.FocalLength(ReferenceWavelength); math.Abs(got-want) > 0.02*want {
+			t.Errorf("%s: got focal length %v, want about %v", name, got, want)
+		}
+	}
+}
+
+func TestLensSystemFocus(t *testing.T) {
+	l := builtinLensSystem(t, "cooke-triplet-50mm")
+	rng := rand.New(rand.NewSource(1))
+
+	// Shrink the film, so that every ray starts from its center.
+	l.FilmWidth, l.FilmHeight = 1e-6, 1e-6
+
+	// Focused at infinity, every ray from the center of the film leaves
+	// parallel to the optical axis.
+	for i := 0; i < 100; i++ {
+		r, weight := l.ImageToRaySpectral(50, 100, 75, 150, ReferenceWavelength, rng)
+		if weight == 0 {
+			continue
+		}
+		if vec3.SubVV(r.Slope, vec3.T{1, 0, 0}).Norm() > 2e-3 {
+			t.Fatalf("ray from the center of the film has slope %v, want the eye vector", r.Slope)
+		}
+	}
+
+	// Rays from the center of the film should converge on a point 2 m in
+	// front of the lens, up to the lens's spherical aberration.  Focused at
+	// infinity, they stay as far apart as the pupil is wide.
+	meanMiss := func() float64 {
+		target := vec3.T{2 + l.frontVertex()*0.001, 0, 0}
+		sum, n := 0.0, 0
+		for i := 0; i < 1000; i++ {
+			r, weight := l.ImageToRaySpectral(50, 100, 75, 150, ReferenceWavelength, rng)
+			if weight == 0 {
+				continue
+			}
+			sum += vec3.Reject(r.Slope, vec3.SubVV(target, r.Point)).Norm()
+			n++
+		}
+		return sum / float64(n)
+	}
+
+	atInfinity := meanMiss()
+	if err := l.Focus(2); err != nil {
+		t.Fatalf("Focus: %v", err)
+	}
+	if at2m := meanMiss(); at2m > atInfinity/4 {
+		t.Errorf("focused at 2 m, rays pass %v from the focus on average, against %v focused at infinity", at2m, atInfinity)
+	}
+}
+
+func TestLensSystemImageOrientation(t *testing.T) {
+	l := builtinLensSystem(t, "double-gauss-50mm")
+	rng := rand.New(rand.NewSource(1))
+
+	// The lens flips the image on the film, and the film is read flipped
+	// back, so the top-left of the image looks up and to the left.
+	r := l.ImageToRay(0, 100, 0, 150, rng)
+	if r.Slope[1] <= 0 || r.Slope[2] <= 0 {
+		t.Errorf("top-left ray has slope %v, want one toward left and up", r.Slope)
+	}
+}
+
+func TestLensSystemVignetting(t *testing.T) {
+	l := builtinLensSystem(t, "double-gauss-50mm")
+	rng := rand.New(rand.NewSource(1))
+
+	meanWeight := func(row, col int) float64 {
+		sum := 0.0
+		const n = 20000
+		for i := 0; i < n; i++ {
+			_, weight := l.ImageToRaySpectral(row, 100, col, 150, ReferenceWavelength, rng)
+			sum += weight
+		}
+		return sum / n
+	}
+
+	center, edge, corner := meanWeight(50, 75), meanWeight(50, 149), meanWeight(99, 149)
+	if math.Abs(center-1) > 0.02 {
+		t.Errorf("center of the film has mean weight %v, want 1", center)
+	}
+	if !(corner < edge && edge < center) {
+		t.Errorf("weights at center, edge, and corner are %v, %v, %v; want them falling off", center, edge, corner)
+	}
+}
+
+func TestLensSystemChromaticAberration(t *testing.T) {
+	// A singlet focuses blue shorter than red.  The achromat, for all that it
+	// is twice as long, brings them much closer.
+	shift := func(name string) float64 {
+		l := builtinLensSystem(t, name)
+		return l.FocalLength(650) - l.FocalLength(450)
+	}
+
+	singlet, achromat := shift("singlet-50mm"), shift("achromat-100mm")
+	if singlet <= 0 {
+		t.Errorf("singlet focal lengths differ by %v from blue to red, want positive", singlet)
+	}
+	if math.Abs(achromat) > singlet/5 {
+		t.Errorf("achromat focal lengths differ by %v from blue to red, want much less than the singlet's %v", achromat, singlet)
+	}
+}
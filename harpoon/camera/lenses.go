@@ -0,0 +1,94 @@
+package camera
+
+import (
+	"sort"
+
+	"row-major/harpoon/densesignal"
+)
+
+// builtinLenses are the bundled lens prescriptions, in millimeters.  Glasses
+// are catalog glasses matching the designs' indices, with their Abbe numbers.
+var builtinLenses = map[string]func() []LensSurface{
+	// A 50 mm f/2 double Gauss, the classic normal lens: Tronnier's US patent
+	// 2,673,491, from Smith's Modern Lens Design, scaled from 100 mm.
+	"double-gauss-50mm": func() []LensSurface {
+		baf10 := densesignal.Glass(1.670, 47.1)
+		sf15 := densesignal.Glass(1.699, 30.1)
+		f5 := densesignal.Glass(1.603, 38.0)
+		ssk5 := densesignal.Glass(1.658, 50.9)
+		laf3 := densesignal.Glass(1.717, 48.0)
+		return []LensSurface{
+			{Radius: 29.475, Thickness: 3.76, Glass: baf10, Aperture: 25.2},
+			{Radius: 84.83, Thickness: 0.12, Aperture: 25.2},
+			{Radius: 19.275, Thickness: 4.025, Glass: baf10, Aperture: 23},
+			{Radius: 40.77, Thickness: 3.275, Glass: sf15, Aperture: 23},
+			{Radius: 12.75, Thickness: 5.705, Aperture: 18},
+			{Radius: 0, Thickness: 4.5, Aperture: 17.1},
+			{Radius: -14.495, Thickness: 1.18, Glass: f5, Aperture: 17},
+			{Radius: 40.77, Thickness: 6.065, Glass: ssk5, Aperture: 20},
+			{Radius: -20.385, Thickness: 0.19, Aperture: 20},
+			{Radius: 437.065, Thickness: 3.22, Glass: laf3, Aperture: 20},
+			{Radius: -39.73, Aperture: 20},
+		}
+	},
+
+	// A 50 mm f/5 Cooke triplet: two crown positive elements around a flint
+	// negative one, the simplest lens that corrects all the primary
+	// aberrations.
+	"cooke-triplet-50mm": func() []LensSurface {
+		sk16 := densesignal.Glass(1.620, 60.3)
+		f2 := densesignal.Glass(1.620, 36.4)
+		return []LensSurface{
+			{Radius: 22.01359, Thickness: 3.25896, Glass: sk16, Aperture: 20},
+			{Radius: -435.7604, Thickness: 6.00755, Aperture: 20},
+			{Radius: -22.21328, Thickness: 0.99997, Glass: f2, Aperture: 12},
+			{Radius: 20.29192, Thickness: 2, Aperture: 12},
+			{Radius: 0, Thickness: 2.75041, Aperture: 9},
+			{Radius: 79.6836, Thickness: 2.95208, Glass: sk16, Aperture: 15},
+			{Radius: -18.3783, Aperture: 15},
+		}
+	},
+
+	// A 100 mm f/5 cemented achromatic doublet behind a stop, as sold for
+	// optics benches.  It brings red and blue to the same focus.
+	"achromat-100mm": func() []LensSurface {
+		bk7 := densesignal.Glass(1.517, 64.2)
+		sf5 := densesignal.Glass(1.673, 32.2)
+		return []LensSurface{
+			{Radius: 0, Thickness: 2, Aperture: 20},
+			{Radius: 62.8, Thickness: 4, Glass: bk7, Aperture: 25.4},
+			{Radius: -45.7, Thickness: 2.5, Glass: sf5, Aperture: 25.4},
+			{Radius: -128.2, Aperture: 25.4},
+		}
+	},
+
+	// A 50 mm f/4 plano-convex singlet of N-BK7 behind a stop.  It has
+	// uncorrected chromatic aberration, for comparison with the achromat.
+	"singlet-50mm": func() []LensSurface {
+		bk7 := densesignal.Glass(1.517, 64.2)
+		return []LensSurface{
+			{Radius: 0, Thickness: 2, Aperture: 12.5},
+			{Radius: 25.84, Thickness: 5, Glass: bk7, Aperture: 20},
+			{Radius: 0, Aperture: 20},
+		}
+	},
+}
+
+// BuiltinLensNames lists the bundled lens prescriptions.
+func BuiltinLensNames() []string {
+	names := []string{}
+	for name := range builtinLenses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BuiltinLens returns the bundled lens prescription with the given name.
+func BuiltinLens(name string) ([]LensSurface, bool) {
+	f, ok := builtinLenses[name]
+	if !ok {
+		return nil, false
+	}
+	return f(), true
+}
@@ -1,8 +1,132 @@
+// Command build-cornell-box writes a scenepack containing a Cornell box, lit by
+// a rectangular light in the ceiling.
 package main
 
-import "row-major/harpoon/scenepack/headerproto"
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"row-major/harpoon/scenepack/headerproto"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	outputFile      = flag.String("output-file", "cornell-box.scenepack", "Output scenepack")
+	lightSpectrum   = flag.String("light-spectrum", "cie-a", "Built-in spectrum for the ceiling light (see the Spectrum message)")
+	lightPower      = flag.Float64("light-power", 10000, "Integrated power of the ceiling light's radiance")
+	lightTempKelvin = flag.Float64("light-temperature", 0, "If nonzero, make the ceiling light a black body at this temperature instead")
+	lightIESFile    = flag.String("light-ies-file", "", "Optional IES profile for the ceiling light")
+)
 
 func main() {
-	scene := &headerproto.Scene{}
+	flag.Parse()
+
+	if err := do(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+func identity() *headerproto.Transform {
+	return &headerproto.Transform{
+		Linear: &headerproto.Mat33{E00: 1, E11: 1, E22: 1},
+		Offset: &headerproto.Vec3{},
+	}
+}
+
+func box(xLo, xHi, yLo, yHi, zLo, zHi float64) *headerproto.Geometry {
+	return &headerproto.Geometry{
+		Kind: &headerproto.Geometry_Box{
+			Box: &headerproto.Box{XLo: xLo, XHi: xHi, YLo: yLo, YHi: yHi, ZLo: zLo, ZHi: zHi},
+		},
+	}
+}
+
+func do() error {
+	spectrum := &headerproto.Spectrum{
+		Kind:  &headerproto.Spectrum_Named{Named: *lightSpectrum},
+		Power: *lightPower,
+	}
+	if *lightTempKelvin != 0 {
+		spectrum.Kind = &headerproto.Spectrum_BlackbodyTemperature{BlackbodyTemperature: *lightTempKelvin}
+	}
+
+	// The room spans [0, 5.5] on each axis, with z up, and is open on the y=0
+	// side, where the camera sits.
+	const size = 5.5
+	const wall = 0.1
+
+	s := &headerproto.Scene{
+		Geometry: []*headerproto.Geometry{
+			box(0, size, 0, size, -wall, 0),        // Floor
+			box(0, size, 0, size, size, size+wall), // Ceiling
+			box(0, size, size, size+wall, 0, size), // Back wall
+			box(-wall, 0, 0, size, 0, size),        // Left wall
+			box(size, size+wall, 0, size, 0, size), // Right wall
+			box(1.3, 2.9, 2.6, 4.2, 0, 3.3),        // Tall block
+			box(3.0, 4.6, 1.0, 2.6, 0, 1.65),       // Short block
+			{Kind: &headerproto.Geometry_Sphere{Sphere: &headerproto.Sphere{}}},
+		},
+		Material: []*headerproto.Material{
+			// Black surroundings, so that the ceiling light is the only
+			// source.
+			{Kind: &headerproto.Material_Emitter{Emitter: &headerproto.Emitter{
+				Emissivity: &headerproto.Spectrum{
+					Kind:  &headerproto.Spectrum_Named{Named: "cie-d65"},
+					Power: 1e-6,
+				},
+			}}},
+			{Kind: &headerproto.Material_GaussianRoughNonConductive{GaussianRoughNonConductive: &headerproto.GaussianRoughNonConductive{}}},
+			{Kind: &headerproto.Material_NonConductiveSmooth{NonConductiveSmooth: &headerproto.NonConductiveSmooth{}}},
+		},
+		InfinityMaterialIndex: 0,
+		Camera: []*headerproto.Camera{
+			{Kind: &headerproto.Camera_PinholeCamera{PinholeCamera: &headerproto.PinholeCamera{
+				Center:   &headerproto.Vec3{E0: size / 2, E1: -8, E2: size / 2},
+				Eye:      &headerproto.Vec3{E0: 0, E1: 1, E2: 0},
+				Up:       &headerproto.Vec3{E0: 0, E1: 0, E2: 1},
+				Aperture: &headerproto.Vec3{E0: 0.02, E1: 0.018, E2: 0.012},
+			}}},
+		},
+		Light: []*headerproto.Light{
+			// Just below the ceiling, facing down.
+			{Kind: &headerproto.Light_RectLight{RectLight: &headerproto.RectLight{
+				Corner:   &headerproto.Vec3{E0: 2.0, E1: 2.0, E2: size - 0.01},
+				Edge1:    &headerproto.Vec3{E0: 0, E1: 1.5, E2: 0},
+				Edge2:    &headerproto.Vec3{E0: 1.5, E1: 0, E2: 0},
+				Radiance: spectrum,
+				IesFile:  *lightIESFile,
+			}}},
+		},
+	}
+
+	// Every wall and block is matte; the sphere is glass.
+	for g := 0; g < 7; g++ {
+		s.Element = append(s.Element, &headerproto.Element{
+			GeometryIndex: int32(g),
+			MaterialIndex: 1,
+			ModelToWorld:  identity(),
+		})
+	}
+	s.Element = append(s.Element, &headerproto.Element{
+		GeometryIndex: 7,
+		MaterialIndex: 2,
+		ModelToWorld: &headerproto.Transform{
+			Linear: &headerproto.Mat33{E00: 0.8, E11: 0.8, E22: 0.8},
+			Offset: &headerproto.Vec3{E0: 1.6, E1: 1.2, E2: 0.8},
+		},
+	})
+
+	data, err := proto.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("while marshaling scene: %w", err)
+	}
+
+	if err := os.WriteFile(*outputFile, data, 0644); err != nil {
+		return fmt.Errorf("while writing scenepack: %w", err)
+	}
 
+	return nil
 }
@@ -0,0 +1,93 @@
+// Command expose simulates photographing a rendered spectral image with a
+// digital camera, and writes the raw sensor data as a DNG file that raw
+// converters can develop.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+
+	"row-major/harpoon/densesignal"
+	"row-major/harpoon/sensor"
+	"row-major/harpoon/spectralimage"
+)
+
+var (
+	inputFile  = flag.String("input-file", "output.spectral", "Spectral sample db to expose")
+	outputFile = flag.String("output-file", "output.dng", "Output DNG file")
+
+	sensorProfile = flag.String("sensor", "generic-cmos", "Sensor to simulate: one of the built-in (stylized) sensors ("+strings.Join(sensor.BuiltinNames(), ", ")+"), or a CSV file of measured (wavelength, red, green, blue) quantum efficiencies")
+	colorChecker  = flag.String("color-checker", "", "CSV file of measured ColorChecker reflectances to fit the DNG color matrix over; if empty, use patches upsampled from the chart's sRGB colors")
+
+	iso           = flag.Float64("iso", 100, "Sensor ISO")
+	shutter       = flag.Float64("shutter", 0, "Shutter time, in seconds; if zero, chosen to keep highlights just below clipping")
+	fNumber       = flag.Float64("f-number", 4, "Lens f-number")
+	radianceScale = flag.Float64("radiance-scale", 1, "Spectral radiance, in W / (sr m^2 nm), of a power density of 1 in the input")
+
+	noise = flag.Bool("noise", true, "Should shot noise and read noise be simulated?")
+	seed  = flag.Int64("seed", 1, "Seed for the noise")
+)
+
+func main() {
+	flag.Parse()
+
+	if err := do(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+func do() error {
+	s, ok := sensor.Builtin(*sensorProfile)
+	if !ok {
+		var err error
+		s, err = sensor.LoadProfileFile(*sensorProfile)
+		if err != nil {
+			return fmt.Errorf("while loading sensor profile: %w", err)
+		}
+	}
+
+	if *colorChecker != "" {
+		patches, err := densesignal.LoadColorCheckerFile(*colorChecker)
+		if err != nil {
+			return fmt.Errorf("while loading color checker: %w", err)
+		}
+		s.CalibrationPatches = patches
+	}
+
+	img, err := spectralimage.ReadSpectralImageFromFile(*inputFile)
+	if err != nil {
+		return fmt.Errorf("while reading input file: %w", err)
+	}
+
+	exp := sensor.Exposure{
+		ISO:            *iso,
+		ShutterSeconds: *shutter,
+		FNumber:        *fNumber,
+		RadianceScale:  *radianceScale,
+	}
+	if exp.ShutterSeconds == 0 {
+		exp.ShutterSeconds = s.AutoShutter(img, exp)
+		log.Printf("Chose a shutter time of %g s", exp.ShutterSeconds)
+	}
+
+	var rng *rand.Rand
+	if *noise {
+		rng = rand.New(rand.NewSource(*seed))
+	}
+	mosaic := s.Expose(img, exp, rng)
+
+	out, err := os.Create(*outputFile)
+	if err != nil {
+		return fmt.Errorf("while opening output file: %w", err)
+	}
+	defer out.Close()
+
+	if err := sensor.WriteDNG(mosaic, out); err != nil {
+		return err
+	}
+	return out.Close()
+}
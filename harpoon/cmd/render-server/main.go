@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"row-major/harpoon/renderqueue"
+)
+
+var (
+	listen               = flag.String("listen", "127.0.0.1:8080", "Where should we listen for incoming connections?")
+	jobDir               = flag.String("job-dir", "render-jobs", "Directory that holds uploaded scenes, job records, and rendered output")
+	concurrency          = flag.Int("concurrency", 1, "Number of jobs to render at once (each render already uses every CPU)")
+	checkpointSubsamples = flag.Int("checkpoint-subsamples", 1, "Number of subsamples to collect between checkpoints of a job's output")
+	maxOutputRows        = flag.Int("max-output-rows", renderqueue.DefaultLimits().MaxOutputRows, "Largest output_rows a job may ask for")
+	maxOutputCols        = flag.Int("max-output-cols", renderqueue.DefaultLimits().MaxOutputCols, "Largest output_cols a job may ask for")
+	maxWavelengthBins    = flag.Int("max-wavelength-bins", renderqueue.DefaultLimits().MaxWavelengthBins, "Largest wavelength_bins a job may ask for")
+	maxPhotonsPerPass    = flag.Int("max-photons-per-pass", renderqueue.DefaultLimits().MaxPhotonsPerPass, "Largest photons_per_pass a job may ask for")
+)
+
+func main() {
+	flag.Parse()
+
+	if err := do(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+func do() error {
+	queue, err := renderqueue.New(*jobDir, *concurrency)
+	if err != nil {
+		return err
+	}
+	queue.CheckpointSubsamples = *checkpointSubsamples
+	queue.Limits = renderqueue.Limits{
+		MaxOutputRows:     *maxOutputRows,
+		MaxOutputCols:     *maxOutputCols,
+		MaxWavelengthBins: *maxWavelengthBins,
+		MaxPhotonsPerPass: *maxPhotonsPerPass,
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	server := &http.Server{
+		Addr:    *listen,
+		Handler: queue.Handler(),
+
+		// Scene uploads can be large, so there's no overall read timeout.
+		ReadHeaderTimeout: 30 * time.Second,
+		MaxHeaderBytes:    1 << 20,
+	}
+
+	queueDone := make(chan struct{})
+	go func() {
+		defer close(queueDone)
+		queue.Run(ctx)
+	}()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	log.Printf("Serving on %s", *listen)
+
+	select {
+	case <-ctx.Done():
+	case err := <-serverErr:
+		cancel()
+		<-queueDone
+		return err
+	}
+
+	log.Printf("Shutting down; running jobs will resume on restart")
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Error shutting down server: %v", err)
+	}
+
+	// Wait for the running jobs to checkpoint.
+	<-queueDone
+	return nil
+}
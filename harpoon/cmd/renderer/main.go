@@ -3,20 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"image/png"
 	"log"
 	"os"
 	"runtime/pprof"
 
-	"row-major/harpoon/affinetransform"
-	"row-major/harpoon/camera"
-	"row-major/harpoon/densesignal"
-	"row-major/harpoon/geometry"
-	"row-major/harpoon/material"
-	"row-major/harpoon/ray"
 	"row-major/harpoon/scene"
+	"row-major/harpoon/sceneload"
 	"row-major/harpoon/spectralimage"
-	"row-major/harpoon/vmath/mat33"
-	"row-major/harpoon/vmath/vec3"
 )
 
 var (
@@ -27,8 +21,23 @@ var (
 	wavelengthMin  = flag.Float64("wavelength-min", 390.0, "Output wavelength min")
 	wavelengthMax  = flag.Float64("wavelength-max", 935.0, "Output wavelength max")
 
+	sceneFile = flag.String("scene-file", "", "Scene to render: a scenepack, or a glTF file (.gltf or .glb); if empty, render the built-in demo scene")
+
 	renderTargetSubsamples = flag.Int("render-target-subsamples", 4, "Number of subsamples to collect from each pixel and frequency bin")
 	renderMaxDepth         = flag.Int("render-max-depth", 8, "Maximum number of bounces to consider")
+	renderHeroWavelength   = flag.Bool("render-hero-wavelength", false, "Should each path carry a wavelength from every bin (hero-wavelength sampling)?")
+	renderPacketTraversal  = flag.Bool("render-packet-traversal", false, "Should camera rays be traced in packets?  (Only affects hero-wavelength path tracing)")
+	renderPolarized        = flag.Bool("render-polarized", false, "Should paths carry the polarization state of light?  (Only affects path tracing; traces one wavelength at a time)")
+	renderIntegrator       = flag.String("render-integrator", "path", "Light transport algorithm to use: \"path\" (path tracing) or \"photon\" (progressive photon mapping)")
+
+	photonsPerPass      = flag.Int("photons-per-pass", 100000, "Number of photons to trace in each photon mapping pass")
+	photonInitialRadius = flag.Float64("photon-initial-radius", 0.1, "Photon gather radius for the first photon mapping pass")
+	photonRadiusAlpha   = flag.Float64("photon-radius-alpha", 0.7, "Rate at which the photon gather radius shrinks; in (0, 1), smaller is faster")
+
+	debugMode       = flag.String("debug-mode", "", "If set, draw a debug visualization instead of rendering: \"node-visits\", \"intersection-tests\", \"path-depth\", \"normals\", or \"stats\" (print a report on the scene)")
+	debugOutputFile = flag.String("debug-output-file", "debug.png", "Output PNG for debug visualizations")
+
+	stokesOutputFilePrefix = flag.String("stokes-output-file-prefix", "", "If set (requires --render-polarized), also record the polarization state seen by the camera, as Q, U, and V spectral sample dbs in PREFIX-q.spectral, PREFIX-u.spectral, and PREFIX-v.spectral")
 
 	resume = flag.Bool("resume", false, "Should we re-open the output file to add more samples?")
 
@@ -51,7 +60,11 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	if err := do(); err != nil {
+	run := do
+	if *debugMode != "" {
+		run = doDebug
+	}
+	if err := run(); err != nil {
 		log.Fatalf("Error: %v", err)
 	}
 
@@ -70,8 +83,30 @@ func main() {
 
 func do() error {
 	options := &scene.RenderOptions{
-		MaxDepth:         *renderMaxDepth,
-		TargetSubsamples: *renderTargetSubsamples,
+		MaxDepth:            *renderMaxDepth,
+		TargetSubsamples:    *renderTargetSubsamples,
+		HeroWavelength:      *renderHeroWavelength,
+		PacketTraversal:     *renderPacketTraversal,
+		Polarized:           *renderPolarized,
+		PhotonsPerPass:      *photonsPerPass,
+		PhotonInitialRadius: *photonInitialRadius,
+		PhotonRadiusAlpha:   *photonRadiusAlpha,
+	}
+
+	switch *renderIntegrator {
+	case "path":
+		options.Integrator = scene.IntegratorPathTracing
+	case "photon":
+		options.Integrator = scene.IntegratorPhotonMapping
+	default:
+		return fmt.Errorf("unknown integrator %q", *renderIntegrator)
+	}
+
+	if *renderPolarized && options.Integrator != scene.IntegratorPathTracing {
+		return fmt.Errorf("polarized rendering is only supported by the path tracing integrator")
+	}
+	if *stokesOutputFilePrefix != "" && !*renderPolarized {
+		return fmt.Errorf("--stokes-output-file-prefix requires --render-polarized")
 	}
 
 	var sampleDB *spectralimage.SpectralImage
@@ -116,86 +151,25 @@ func do() error {
 		sampleDB.Resize(*outputRows, *outputCols, *wavelengthBins)
 	}
 
-	theScene := &scene.Scene{}
-
-	cieD65Emitter := theScene.AddMaterial(&material.Emitter{
-		Emissivity: material.ConstantSpectrum(densesignal.CIED65Emission(300)),
-	})
-	cieAEmitter := theScene.AddMaterial(&material.Emitter{
-		Emissivity: material.ConstantSpectrum(densesignal.CIEAEmission(100)),
-	})
-	matte := theScene.AddMaterial(&material.GaussianRoughNonConductive{
-		Variance: material.ConstantScalar(0.5),
-	})
-	matte2 := theScene.AddMaterial(&material.GaussianRoughNonConductive{
-		Variance: material.ConstantScalar(0.05),
-	})
-	glass := theScene.AddMaterial(&material.NonConductiveSmooth{
-		InteriorIndexOfRefraction: material.ConstantSpectrum(densesignal.VisibleSpectrumRamp(1.7, 1.5)),
-		ExteriorIndexOfRefraction: material.ConstantScalar(1.0),
-	})
-
-	sphere := theScene.AddGeometry(&geometry.Sphere{})
-	centerBox := theScene.AddGeometry(&geometry.Box{[3]ray.Span{ray.Span{0, 0.5}, ray.Span{0, 0.5}, ray.Span{0, 0.5}}})
-	ground := theScene.AddGeometry(&geometry.Box{[3]ray.Span{ray.Span{0, 10.1}, ray.Span{0, 10.1}, ray.Span{-0.5, 0}}})
-	roof := theScene.AddGeometry(&geometry.Box{[3]ray.Span{ray.Span{0, 10.1}, ray.Span{0, 10.1}, ray.Span{10, 10.1}}})
-	wallN := theScene.AddGeometry(&geometry.Box{[3]ray.Span{ray.Span{0, 10}, ray.Span{10, 10.1}, ray.Span{0, 10}}})
-	wallW := theScene.AddGeometry(&geometry.Box{[3]ray.Span{ray.Span{-0.1, 0}, ray.Span{0, 10}, ray.Span{0, 10}}})
-	wallS := theScene.AddGeometry(&geometry.Box{[3]ray.Span{ray.Span{0, 10}, ray.Span{-0.1, 0}, ray.Span{0, 10}}})
-
-	theScene.InfinityMaterialIndex = cieD65Emitter
-	theScene.Elements = []*scene.SceneElement{
-		{
-			GeometryIndex: sphere,
-			MaterialIndex: cieAEmitter,
-			ModelToWorld:  affinetransform.Compose(affinetransform.Translate(vec3.T{5, 4, 0}), affinetransform.Scale(1)),
-		},
-		{
-			GeometryIndex: sphere,
-			MaterialIndex: matte,
-			ModelToWorld:  affinetransform.Compose(affinetransform.Translate(vec3.T{5, 6, 0}), affinetransform.Scale(1)),
-		},
-		{
-			GeometryIndex: ground,
-			MaterialIndex: matte2,
-			ModelToWorld:  affinetransform.Identity(),
-		},
-		{
-			GeometryIndex: roof,
-			MaterialIndex: matte2,
-			ModelToWorld:  affinetransform.Identity(),
-		},
-		{
-			GeometryIndex: wallN,
-			MaterialIndex: matte2,
-			ModelToWorld:  affinetransform.Identity(),
-		},
-		{
-			GeometryIndex: wallW,
-			MaterialIndex: matte2,
-			ModelToWorld:  affinetransform.Identity(),
-		},
-		{
-			GeometryIndex: wallS,
-			MaterialIndex: matte2,
-			ModelToWorld:  affinetransform.Identity(),
-		},
-		{
-			GeometryIndex: centerBox,
-			MaterialIndex: glass,
-			ModelToWorld:  affinetransform.Translate(vec3.T{3, 3, 0}),
-		},
+	stokesFiles := []string{}
+	if *stokesOutputFilePrefix != "" {
+		for i, component := range []string{"q", "u", "v"} {
+			fileName := *stokesOutputFilePrefix + "-" + component + ".spectral"
+			db, err := openStokesDB(fileName, sampleDB)
+			if err != nil {
+				return fmt.Errorf("while opening Stokes output file: %w", err)
+			}
+			options.StokesDBs[i] = db
+			stokesFiles = append(stokesFiles, fileName)
+		}
 	}
 
-	theScene.Crush(0.0)
-
-	camera := &camera.PinholeCamera{
-		Center:          vec3.T{1, 1, 2},
-		ApertureToWorld: mat33.T{1, 0, 0, 0, 1, 0, 0, 0, 1},
-		Aperture:        vec3.T{0.02, 0.018, 0.012},
+	theScene, err := loadScene()
+	if err != nil {
+		return fmt.Errorf("while loading scene: %w", err)
 	}
-	camera.SetEye(vec3.SubVV(vec3.T{5, 5, 1}, camera.Center))
-	theScene.AddCamera(camera)
+
+	theScene.Crush(0.0)
 
 	progress := func(cur, tot int) {
 		fmt.Fprintf(os.Stderr, "\r%d/%d %d%%", cur, tot, 100*cur/tot)
@@ -214,5 +188,122 @@ func do() error {
 		return fmt.Errorf("while writing spectral image: %w", err)
 	}
 
+	for i, fileName := range stokesFiles {
+		if err := writeSpectralImageFile(fileName, options.StokesDBs[i]); err != nil {
+			return fmt.Errorf("while writing Stokes output file: %w", err)
+		}
+	}
+
 	return nil
 }
+
+// openStokesDB opens (when resuming) or creates a Stokes parameter sample db
+// that matches sampleDB.
+func openStokesDB(fileName string, sampleDB *spectralimage.SpectralImage) (*spectralimage.SpectralImage, error) {
+	if !*resume {
+		if _, err := os.Stat(fileName); err == nil {
+			return nil, fmt.Errorf("resumption not requested, but %s exists", fileName)
+		}
+
+		db := &spectralimage.SpectralImage{
+			WavelengthMin: sampleDB.WavelengthMin,
+			WavelengthMax: sampleDB.WavelengthMax,
+		}
+		db.Resize(sampleDB.RowSize, sampleDB.ColSize, sampleDB.WavelengthSize)
+		return db, nil
+	}
+
+	db, err := spectralimage.ReadSpectralImageFromFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("resumption requested, but encountered error loading %s: %w", fileName, err)
+	}
+	if db.RowSize != sampleDB.RowSize || db.ColSize != sampleDB.ColSize || db.WavelengthSize != sampleDB.WavelengthSize {
+		return nil, fmt.Errorf("resumption requested, but %s doesn't have the same shape as the output file", fileName)
+	}
+	if db.WavelengthMin != sampleDB.WavelengthMin || db.WavelengthMax != sampleDB.WavelengthMax {
+		return nil, fmt.Errorf("resumption requested, but %s doesn't have the same wavelength range as the output file", fileName)
+	}
+	return db, nil
+}
+
+func writeSpectralImageFile(fileName string, im *spectralimage.SpectralImage) error {
+	out, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := spectralimage.WriteSpectralImage(im, out); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func doDebug() error {
+	var mode scene.DebugMode
+	switch *debugMode {
+	case "node-visits":
+		mode = scene.DebugNodeVisits
+	case "intersection-tests":
+		mode = scene.DebugIntersectionTests
+	case "path-depth":
+		mode = scene.DebugPathDepth
+	case "normals":
+		mode = scene.DebugNormals
+	case "stats":
+	default:
+		return fmt.Errorf("unknown debug mode %q", *debugMode)
+	}
+
+	theScene, err := loadScene()
+	if err != nil {
+		return fmt.Errorf("while loading scene: %w", err)
+	}
+
+	theScene.Crush(0.0)
+
+	if *debugMode == "stats" {
+		theScene.WriteStats(os.Stdout)
+		return nil
+	}
+
+	d := scene.RenderDebug(theScene, mode, *outputRows, *outputCols, *renderTargetSubsamples, *renderMaxDepth)
+
+	fmt.Printf("%s: mean %.3f, max %.3f\n", *debugMode, d.Mean(), d.Max())
+	if mode == scene.DebugPathDepth {
+		total := 0
+		for _, count := range d.DepthHistogram {
+			total += count
+		}
+		for depth, count := range d.DepthHistogram {
+			fmt.Printf("  depth %2d: %6.2f%% of paths\n", depth, 100*float64(count)/float64(total))
+		}
+	}
+
+	out, err := os.Create(*debugOutputFile)
+	if err != nil {
+		return fmt.Errorf("while opening debug output file: %w", err)
+	}
+	defer out.Close()
+
+	if err := png.Encode(out, d.Image()); err != nil {
+		return fmt.Errorf("while writing debug image: %w", err)
+	}
+
+	return nil
+}
+
+func loadScene() (*scene.Scene, error) {
+	if *sceneFile == "" {
+		return scene.DemoScene(), nil
+	}
+
+	s, warnings, err := sceneload.LoadFile(*sceneFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range warnings {
+		log.Printf("Loading scene: %s", w)
+	}
+	return s, nil
+}
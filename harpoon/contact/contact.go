@@ -16,6 +16,14 @@ type Contact struct {
 	N    vec3.T
 	Mtl2 vec2.T
 	Mtl3 vec3.T
+
+	// Unit vectors that, with N, make an orthonormal frame on the surface.
+	// Tangent points in the direction of increasing Mtl2[0], and Bitangent
+	// in the direction of increasing Mtl2[1] (as nearly as it can while
+	// staying perpendicular to Tangent).  Both are zero for contacts that
+	// aren't on a surface.
+	Tangent   vec3.T
+	Bitangent vec3.T
 }
 
 func ContactNaN() Contact {
@@ -43,5 +51,33 @@ func (c Contact) Transform(t affinetransform.AffineTransform, nm mat33.T) Contac
 	result.P = vec3.AddVV(mat33.MulMV(t.Linear, result.P), t.Offset)
 	result.N = vec3.Normalize(mat33.MulMV(nm, result.N))
 
+	// Tangents are directions along the surface, so they transform like
+	// slopes.  The linear part of the transform might not be a rotation, so
+	// rebuild the frame around the new normal.
+	if result.Tangent != (vec3.T{}) {
+		tangent := mat33.MulMV(t.Linear, result.Tangent)
+		bitangent := mat33.MulMV(t.Linear, result.Bitangent)
+		result.Tangent, result.Bitangent = TangentFrame(result.N, tangent, bitangent)
+	}
+
 	return result
 }
+
+// TangentFrame makes tangent and bitangent into unit vectors that are
+// perpendicular to each other and to the unit normal n, disturbing them as
+// little as possible.  Bitangent stays on the same side of the tangent that it
+// started on.
+func TangentFrame(n, tangent, bitangent vec3.T) (vec3.T, vec3.T) {
+	tangent = vec3.Reject(n, tangent)
+	if tangent.Norm() < 1e-12 {
+		// The tangent was along the normal; any tangent will do.
+		tangent, _ = vec3.OrthonormalBasis(n)
+	}
+	tangent = vec3.Normalize(tangent)
+
+	b := vec3.CProd(n, tangent)
+	if vec3.IProd(b, bitangent) < 0 {
+		b = vec3.MulVS(b, -1)
+	}
+	return tangent, b
+}
@@ -1,3 +1,10 @@
+// Package densesignal holds spectra sampled at even spacing over a range of
+// wavelengths, and a library of standard ones.
+//
+// The library doesn't bundle measured ColorChecker reflectances or the CIE
+// LED-B illuminants.  Those come from the published tables, read with
+// LoadColorCheckerFile and LoadTabulatedFile; ColorCheckerFromSRGB and the
+// PhosphorLED illuminants are synthetic stand-ins.
 package densesignal
 
 type DenseSignal struct {
@@ -14,7 +21,12 @@ func (d *DenseSignal) Interpolate(x float32) float32 {
 	if x < d.SrcX || d.LimX < x {
 		return 0.0
 	}
-	return d.Samples[int((x-d.SrcX)/d.StepX())]
+	i := int((x - d.SrcX) / d.StepX())
+	if i >= len(d.Samples) {
+		// x == LimX, or rounding pushed us just past the last sample.
+		i = len(d.Samples) - 1
+	}
+	return d.Samples[i]
 }
 
 func (d *DenseSignal) Integrate(from, to float32) float32 {
@@ -0,0 +1,33 @@
+package densesignal
+
+// Wavelengths (in nm) of the Fraunhofer lines that glass catalogs quote
+// refractive indices at.
+const (
+	FraunhoferF = 486.13
+	FraunhoferD = 587.56
+	FraunhoferC = 656.27
+)
+
+// Glass returns the refractive index of an optical glass from its catalog
+// index nd (at the helium d line) and Abbe number vd.  The dispersion follows
+// Cauchy's equation, n = A + B / lambda^2, fitted so that
+// vd = (nd - 1) / (nF - nC).
+//
+// The signal covers 300 nm to 1100 nm, wider than the visible spectrum, so that
+// lenses keep working for sensors that see into the infrared.
+func Glass(nd, vd float64) *DenseSignal {
+	invSq := func(lambda float64) float64 {
+		micrometers := lambda / 1000
+		return 1 / (micrometers * micrometers)
+	}
+
+	b := (nd - 1) / (vd * (invSq(FraunhoferF) - invSq(FraunhoferC)))
+	a := nd - b*invSq(FraunhoferD)
+
+	s := &DenseSignal{SrcX: 300, LimX: 1100, Samples: make([]float32, 160)}
+	for i := range s.Samples {
+		lambda := float64(s.SrcX) + (float64(i)+0.5)*float64(s.StepX())
+		s.Samples[i] = float32(a + b*invSq(lambda))
+	}
+	return s
+}
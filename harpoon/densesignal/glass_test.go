@@ -0,0 +1,26 @@
+package densesignal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGlass(t *testing.T) {
+	// N-BK7.
+	g := Glass(1.5168, 64.17)
+
+	nd := float64(g.Interpolate(FraunhoferD))
+	if math.Abs(nd-1.5168) > 1e-3 {
+		t.Errorf("got nd=%v, want 1.5168", nd)
+	}
+
+	nF := float64(g.Interpolate(FraunhoferF))
+	nC := float64(g.Interpolate(FraunhoferC))
+	if vd := (nd - 1) / (nF - nC); math.Abs(vd-64.17) > 2 {
+		t.Errorf("got vd=%v, want 64.17", vd)
+	}
+
+	if g.Interpolate(400) <= g.Interpolate(700) {
+		t.Errorf("blue index %v isn't above red index %v", g.Interpolate(400), g.Interpolate(700))
+	}
+}
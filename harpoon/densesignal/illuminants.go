@@ -0,0 +1,135 @@
+package densesignal
+
+import "math"
+
+// Planck returns the spectral radiance of a black body at the given
+// temperature (in kelvin) and wavelength (in nm).
+//
+// Units are W / (sr m^2 nm).
+func Planck(temperature, wavelength float64) float64 {
+	const (
+		planck    = 6.62607015e-34
+		boltzmann = 1.380649e-23
+		lightC    = 299792458.0
+	)
+
+	lambda := wavelength * 1e-9
+	radiance := 2 * planck * lightC * lightC / math.Pow(lambda, 5) / (math.Exp(planck*lightC/(lambda*boltzmann*temperature)) - 1)
+
+	// Per meter to per nanometer.
+	return radiance * 1e-9
+}
+
+// Blackbody returns the spectral radiance of a black body at the given
+// temperature (in kelvin), over the visible spectrum.
+//
+// Units are W / (sr m^2 nm), with wavelengths in nanometers.
+func Blackbody(temperature float32) *DenseSignal {
+	s := VisibleSpectrumSignal()
+	for i := range s.Samples {
+		// Evaluate at the center of each sample.
+		lambda := s.SrcX + (float32(i)+0.5)*s.StepX()
+		s.Samples[i] = float32(Planck(float64(temperature), float64(lambda)))
+	}
+	return s
+}
+
+// BlackbodyEmission is Blackbody, but normalized so that it has an integrated
+// power of x.
+func BlackbodyEmission(temperature, x float32) *DenseSignal {
+	sig := Blackbody(temperature)
+	sig.Normalize()
+	sig.MulS(x)
+	return sig
+}
+
+// cieFSeries wraps one of the CIE F-series tables, which are tabulated at 5nm
+// intervals from 380nm to 780nm.
+func cieFSeries(samples []float32) *DenseSignal {
+	return &DenseSignal{
+		SrcX:    377.5,
+		LimX:    782.5,
+		Samples: samples,
+	}
+}
+
+// CIEF2 is the CIE F2 illuminant: a cool white fluorescent lamp.
+func CIEF2() *DenseSignal {
+	return cieFSeries([]float32{
+		1.18, 1.48, 1.84, 2.15, 3.44, 15.69, 3.85, 3.74, 4.19, 4.62,
+		5.06, 34.98, 11.81, 6.27, 6.63, 6.93, 7.19, 7.40, 7.54, 7.62,
+		7.65, 7.62, 7.62, 7.45, 7.28, 7.15, 7.05, 7.04, 7.16, 7.47,
+		8.04, 8.88, 10.01, 24.88, 16.64, 14.59, 16.16, 17.56, 18.62, 21.47,
+		22.79, 19.29, 18.66, 17.73, 16.54, 15.21, 13.80, 12.36, 10.95, 9.65,
+		8.40, 7.32, 6.31, 5.43, 4.68, 4.02, 3.45, 2.96, 2.55, 2.19,
+		1.89, 1.64, 1.53, 1.27, 1.10, 0.99, 0.88, 0.76, 0.68, 0.61,
+		0.56, 0.54, 0.51, 0.47, 0.47, 0.43, 0.46, 0.47, 0.40, 0.33,
+		0.27,
+	})
+}
+
+// CIEF7 is the CIE F7 illuminant: a broadband fluorescent lamp that simulates
+// D65.
+func CIEF7() *DenseSignal {
+	return cieFSeries([]float32{
+		2.56, 3.18, 3.84, 4.53, 6.15, 19.37, 7.37, 7.05, 7.71, 8.41,
+		9.15, 44.14, 17.52, 11.35, 12.00, 12.58, 13.08, 13.45, 13.71, 13.88,
+		13.95, 13.93, 13.82, 13.64, 13.43, 13.25, 13.08, 12.93, 12.78, 12.60,
+		12.44, 12.33, 12.26, 29.52, 17.05, 12.44, 12.58, 12.72, 12.83, 15.46,
+		16.75, 12.83, 12.67, 12.45, 12.19, 11.89, 11.60, 11.35, 11.12, 10.95,
+		10.76, 10.42, 10.11, 10.04, 10.02, 10.11, 9.87, 8.65, 7.27, 6.44,
+		5.83, 5.41, 5.04, 4.57, 4.12, 3.77, 3.46, 3.08, 2.73, 2.47,
+		2.25, 2.06, 1.90, 1.75, 1.62, 1.54, 1.45, 1.32, 1.17, 0.99,
+		0.81,
+	})
+}
+
+// CIEF11 is the CIE F11 illuminant: a narrow tri-band fluorescent lamp.
+func CIEF11() *DenseSignal {
+	return cieFSeries([]float32{
+		0.91, 0.63, 0.46, 0.37, 1.29, 12.68, 1.59, 1.79, 2.46, 3.33,
+		4.49, 33.94, 12.13, 6.95, 7.19, 7.12, 6.72, 6.13, 5.46, 4.79,
+		5.66, 14.29, 14.96, 8.97, 4.72, 2.33, 1.47, 1.10, 0.89, 0.83,
+		1.18, 4.90, 39.59, 72.84, 32.61, 7.52, 2.83, 1.96, 1.67, 4.43,
+		11.28, 14.76, 12.73, 9.74, 7.33, 9.72, 55.27, 42.58, 13.18, 13.16,
+		12.26, 5.11, 2.07, 2.34, 3.58, 3.01, 2.48, 2.14, 1.54, 1.33,
+		1.46, 1.94, 2.00, 1.20, 1.35, 4.10, 5.58, 2.51, 0.57, 0.27,
+		0.23, 0.21, 0.24, 0.24, 0.20, 0.24, 0.32, 0.26, 0.16, 0.12,
+		0.09,
+	})
+}
+
+// PhosphorLED models a white LED: a narrow blue pump peak, plus a broad
+// phosphor peak that re-emits some of the pump's power at longer wavelengths.
+// Both peaks are gaussian, with the given centers and standard deviations (in
+// nm).  pumpFraction is the fraction of the total power left in the pump peak.
+//
+// This is a synthetic model, not measured data, but it captures the blue
+// spike and the cyan dip that make LED lighting look the way it does.  For a
+// measured LED, such as the CIE LED-B series from CIE 15:2018, load its table
+// with LoadTabulatedFile.
+func PhosphorLED(pumpCenter, pumpWidth, phosphorCenter, phosphorWidth, pumpFraction float32) *DenseSignal {
+	gaussian := func(x, center, width float32) float32 {
+		d := float64((x - center) / width)
+		return float32(math.Exp(-d*d/2) / (float64(width) * math.Sqrt(2*math.Pi)))
+	}
+
+	s := VisibleSpectrumSignal()
+	for i := range s.Samples {
+		x := s.SrcX + (float32(i)+0.5)*s.StepX()
+		s.Samples[i] = pumpFraction*gaussian(x, pumpCenter, pumpWidth) + (1-pumpFraction)*gaussian(x, phosphorCenter, phosphorWidth)
+	}
+	return s
+}
+
+// LEDCoolWhite is a synthetic PhosphorLED with a correlated color temperature
+// of about 6000K.  It isn't any particular lamp.
+func LEDCoolWhite() *DenseSignal {
+	return PhosphorLED(450, 10, 565, 60, 0.215)
+}
+
+// LEDWarmWhite is a synthetic PhosphorLED with a correlated color temperature
+// of about 3000K.  It isn't any particular lamp.
+func LEDWarmWhite() *DenseSignal {
+	return PhosphorLED(450, 10, 595, 55, 0.09)
+}
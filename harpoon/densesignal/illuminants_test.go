@@ -0,0 +1,49 @@
+package densesignal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBlackbodyPeak(t *testing.T) {
+	// Wien's displacement law puts the peak of a 5000K black body at 579.6nm.
+	sig := Blackbody(5000)
+
+	peak := 0
+	for i := range sig.Samples {
+		if sig.Samples[i] > sig.Samples[peak] {
+			peak = i
+		}
+	}
+
+	peakLo := sig.SrcX + float32(peak)*sig.StepX()
+	if peakLo > 579.6 || 579.6 >= peakLo+sig.StepX() {
+		t.Errorf("Got peak in [%v, %v), want it to contain 579.6", peakLo, peakLo+sig.StepX())
+	}
+}
+
+func TestFSeriesChromaticity(t *testing.T) {
+	// Published chromaticities are for the CIE 1931 observer, which differs a
+	// little from the CIE 2006 one used by Chromaticity.
+	cases := []struct {
+		name  string
+		sig   *DenseSignal
+		wantX float64
+		wantY float64
+	}{
+		{"F2", CIEF2(), 0.3721, 0.3751},
+		{"F7", CIEF7(), 0.3129, 0.3292},
+		{"F11", CIEF11(), 0.3805, 0.3769},
+	}
+
+	for _, c := range cases {
+		if len(c.sig.Samples) != 81 {
+			t.Errorf("%s: got %d samples, want 81", c.name, len(c.sig.Samples))
+		}
+
+		x, y := Chromaticity(c.sig)
+		if math.Abs(x-c.wantX) > 0.01 || math.Abs(y-c.wantY) > 0.01 {
+			t.Errorf("%s: got chromaticity (%.4f, %.4f), want (%.4f, %.4f)", c.name, x, y, c.wantX, c.wantY)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package densesignal
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// XYZ integrates a spectrum against the CIE 2006 color matching functions.
+func XYZ(d *DenseSignal) (x, y, z float64) {
+	cmfX := CIE2006X()
+	cmfY := CIE2006Y()
+	cmfZ := CIE2006Z()
+
+	// The color matching functions are all sampled on the same grid.
+	for i := range cmfX.Samples {
+		lambda := cmfX.SrcX + (float32(i)+0.5)*cmfX.StepX()
+		val := float64(d.Interpolate(lambda) * cmfX.StepX())
+		x += val * float64(cmfX.Samples[i])
+		y += val * float64(cmfY.Samples[i])
+		z += val * float64(cmfZ.Samples[i])
+	}
+	return x, y, z
+}
+
+// Chromaticity returns the CIE xy chromaticity of a spectrum.
+func Chromaticity(d *DenseSignal) (float64, float64) {
+	x, y, z := XYZ(d)
+	return x / (x + y + z), y / (x + y + z)
+}
+
+// SRGBToLinear removes the sRGB transfer function from an encoded component.
+func SRGBToLinear(c float64) float64 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// linearRGB converts XYZ to linear sRGB primaries.
+func linearRGB(x, y, z float64) [3]float64 {
+	return [3]float64{
+		3.2404542*x - 1.5371385*y - 0.4985314*z,
+		-0.9692660*x + 1.8760108*y + 0.0415560*z,
+		0.0556434*x - 0.2040259*y + 1.0572252*z,
+	}
+}
+
+// reflectanceColor computes the linear sRGB color of a reflectance spectrum
+// under D65, white balanced so that a perfect reflector is (1, 1, 1).
+type reflectanceColor struct {
+	lambdas []float64
+	// Per-sample weights of D65 times each color matching function, already
+	// transformed to linear sRGB and white balanced.
+	weights [][3]float64
+}
+
+func newReflectanceColor() *reflectanceColor {
+	cmfX := CIE2006X()
+	cmfY := CIE2006Y()
+	cmfZ := CIE2006Z()
+	d65 := CIED65()
+
+	rc := &reflectanceColor{}
+	white := [3]float64{}
+	for i := range cmfX.Samples {
+		lambda := cmfX.SrcX + (float32(i)+0.5)*cmfX.StepX()
+		illum := float64(d65.Interpolate(lambda))
+		w := linearRGB(
+			illum*float64(cmfX.Samples[i]),
+			illum*float64(cmfY.Samples[i]),
+			illum*float64(cmfZ.Samples[i]),
+		)
+		rc.lambdas = append(rc.lambdas, float64(lambda))
+		rc.weights = append(rc.weights, w)
+		for c := 0; c < 3; c++ {
+			white[c] += w[c]
+		}
+	}
+
+	for i := range rc.weights {
+		for c := 0; c < 3; c++ {
+			rc.weights[i][c] /= white[c]
+		}
+	}
+	return rc
+}
+
+func (rc *reflectanceColor) color(reflectance func(lambda float64) float64) [3]float64 {
+	rgb := [3]float64{}
+	for i, lambda := range rc.lambdas {
+		r := reflectance(lambda)
+		for c := 0; c < 3; c++ {
+			rgb[c] += r * rc.weights[i][c]
+		}
+	}
+	return rgb
+}
+
+// sigmoidSpectrum is the spectrum model of Jakob and Hanika, "A Low-Dimensional
+// Function Space for Efficient Spectral Upsampling": a quadratic in wavelength,
+// squashed into (0, 1) by a sigmoid.  The wavelength is rescaled to [0, 1]
+// over the visible spectrum to keep the coefficients well conditioned.
+func sigmoidSpectrum(coeffs [3]float64, lambda float64) float64 {
+	t := (lambda - 390.0) / (835.0 - 390.0)
+	x := (coeffs[0]*t+coeffs[1])*t + coeffs[2]
+	return 0.5 + x/(2*math.Sqrt(1+x*x))
+}
+
+// labDistance is the CIE76 difference between two linear sRGB colors.
+func labDistance(a, b [3]float64) [3]float64 {
+	la := linearToLab(a)
+	lb := linearToLab(b)
+	return [3]float64{la[0] - lb[0], la[1] - lb[1], la[2] - lb[2]}
+}
+
+func linearToLab(rgb [3]float64) [3]float64 {
+	// Back to XYZ, relative to a white of (1, 1, 1).
+	x := 0.4124564*rgb[0] + 0.3575761*rgb[1] + 0.1804375*rgb[2]
+	y := 0.2126729*rgb[0] + 0.7151522*rgb[1] + 0.0721750*rgb[2]
+	z := 0.0193339*rgb[0] + 0.1191920*rgb[1] + 0.9503041*rgb[2]
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389.0 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27.0*t + 16.0) / 116.0
+	}
+	fx := f(x / 0.95047)
+	fy := f(y / 1.0)
+	fz := f(z / 1.08883)
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+// fitSigmoid finds sigmoid coefficients whose spectrum has the given linear
+// sRGB color, using Gauss-Newton iteration on the Lab difference.
+//
+// Saturated colors are hard to reach from a cold start, so the target is
+// walked out from gray in steps, starting each step from the last solution.
+func fitSigmoid(rc *reflectanceColor, target [3]float64) [3]float64 {
+	coeffs := [3]float64{}
+
+	residual := func(coeffs [3]float64, target [3]float64) [3]float64 {
+		got := rc.color(func(lambda float64) float64 {
+			return sigmoidSpectrum(coeffs, lambda)
+		})
+		return labDistance(got, target)
+	}
+
+	const steps = 8
+	for step := 1; step <= steps; step++ {
+		t := float64(step) / steps
+		stepTarget := [3]float64{}
+		for c := 0; c < 3; c++ {
+			stepTarget[c] = (1-t)*0.5 + t*target[c]
+		}
+
+		for iter := 0; iter < 30; iter++ {
+			r := residual(coeffs, stepTarget)
+			if r[0]*r[0]+r[1]*r[1]+r[2]*r[2] < 1e-8 {
+				break
+			}
+
+			// Numerical Jacobian.
+			jac := [3][3]float64{}
+			for j := 0; j < 3; j++ {
+				const h = 1e-5
+				bumped := coeffs
+				bumped[j] += h
+				rb := residual(bumped, stepTarget)
+				for i := 0; i < 3; i++ {
+					jac[i][j] = (rb[i] - r[i]) / h
+				}
+			}
+
+			delta, ok := solve3(jac, r)
+			if !ok {
+				break
+			}
+
+			// Don't let one step run off too far.
+			norm := math.Sqrt(delta[0]*delta[0] + delta[1]*delta[1] + delta[2]*delta[2])
+			if norm > 20 {
+				for j := 0; j < 3; j++ {
+					delta[j] *= 20 / norm
+				}
+			}
+
+			for j := 0; j < 3; j++ {
+				coeffs[j] -= delta[j]
+			}
+		}
+	}
+
+	return coeffs
+}
+
+// solve3 solves the linear system m x = b by Cramer's rule.
+func solve3(m [3][3]float64, b [3]float64) ([3]float64, bool) {
+	det := func(m [3][3]float64) float64 {
+		return m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+			m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+			m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	}
+
+	d := det(m)
+	if d == 0 || math.IsNaN(d) {
+		return [3]float64{}, false
+	}
+
+	x := [3]float64{}
+	for j := 0; j < 3; j++ {
+		mj := m
+		for i := 0; i < 3; i++ {
+			mj[i][j] = b[i]
+		}
+		x[j] = det(mj) / d
+	}
+	return x, true
+}
+
+// SRGBReflectance returns a smooth reflectance spectrum that, under D65, has
+// the given sRGB color.  The components are sRGB-encoded, in [0, 1].
+//
+// Red, Green and Blue give a spectrum per component, which is fine for
+// emitters but produces reflectances with sharp edges and odd
+// interreflections.  SRGBReflectance gives a single smooth spectrum, bounded
+// in [0, 1], so it's physically plausible as a reflectance.
+func SRGBReflectance(r, g, b float32) *DenseSignal {
+	return LinearRGBReflectance(
+		float32(SRGBToLinear(float64(r))),
+		float32(SRGBToLinear(float64(g))),
+		float32(SRGBToLinear(float64(b))),
+	)
+}
+
+// LinearRGBReflectance is SRGBReflectance, for components that have already
+// had the sRGB transfer function removed (as in glTF and most renderers).
+func LinearRGBReflectance(r, g, b float32) *DenseSignal {
+	target := [3]float64{float64(r), float64(g), float64(b)}
+
+	coeffs := fitSigmoid(newReflectanceColor(), target)
+
+	s := VisibleSpectrumSignal()
+	for i := range s.Samples {
+		lambda := float64(s.SrcX + (float32(i)+0.5)*s.StepX())
+		s.Samples[i] = float32(sigmoidSpectrum(coeffs, lambda))
+	}
+	return s
+}
+
+// ColorCheckerSRGB are the published sRGB colors of the 24 patches of the
+// Macbeth ColorChecker, in the usual order (dark skin, light skin, blue sky,
+// ..., neutral 3.5, black).
+var ColorCheckerSRGB = [24][3]uint8{
+	{115, 82, 68}, {194, 150, 130}, {98, 122, 157}, {87, 108, 67}, {133, 128, 177}, {103, 189, 170},
+	{214, 126, 44}, {80, 91, 166}, {193, 90, 99}, {94, 60, 108}, {157, 188, 64}, {224, 163, 46},
+	{56, 61, 150}, {70, 148, 73}, {175, 54, 60}, {231, 199, 31}, {187, 86, 149}, {8, 133, 161},
+	{243, 243, 242}, {200, 200, 200}, {160, 160, 160}, {122, 122, 121}, {85, 85, 85}, {52, 52, 52},
+}
+
+// ColorCheckerFromSRGB returns reflectance spectra for the patches of the
+// Macbeth ColorChecker, in the same order as ColorCheckerSRGB.
+//
+// These aren't measured spectra: they're SRGBReflectance fits to the
+// published colors, so they match the chart under D65 but not its
+// metamerism under other illuminants.  Comparisons across illuminants should
+// use measured spectra, read with ReadColorChecker.
+func ColorCheckerFromSRGB() []*DenseSignal {
+	patches := make([]*DenseSignal, len(ColorCheckerSRGB))
+	for i, c := range ColorCheckerSRGB {
+		patches[i] = SRGBReflectance(float32(c[0])/255, float32(c[1])/255, float32(c[2])/255)
+	}
+	return patches
+}
+
+// ReadColorChecker reads measured reflectance spectra of the ColorChecker's
+// patches, from a table with a wavelength column followed by one column per
+// patch, in the same order as ColorCheckerSRGB.  This is the layout of the
+// spectral data published by BabelColor and X-Rite.  The table may be in any
+// format ReadTabulatedColumns accepts.
+func ReadColorChecker(r io.Reader) ([]*DenseSignal, error) {
+	patches, err := ReadTabulatedColumns(r, len(ColorCheckerSRGB))
+	if err != nil {
+		return nil, err
+	}
+	for i, patch := range patches {
+		for _, v := range patch.Samples {
+			if v < 0 || v > 1 {
+				return nil, fmt.Errorf("patch %d has reflectance %v, outside [0, 1]", i, v)
+			}
+		}
+	}
+	return patches, nil
+}
+
+// LoadColorCheckerFile reads measured ColorChecker spectra from a file, as
+// ReadColorChecker does.
+func LoadColorCheckerFile(path string) ([]*DenseSignal, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("while opening file: %w", err)
+	}
+	defer f.Close()
+
+	patches, err := ReadColorChecker(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s: %w", path, err)
+	}
+	return patches, nil
+}
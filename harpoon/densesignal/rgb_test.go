@@ -0,0 +1,102 @@
+package densesignal
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestSRGBReflectanceRoundTrip(t *testing.T) {
+	rc := newReflectanceColor()
+
+	for i, c := range ColorCheckerSRGB {
+		r, g, b := float32(c[0])/255, float32(c[1])/255, float32(c[2])/255
+		sig := SRGBReflectance(r, g, b)
+
+		for j, s := range sig.Samples {
+			if s < 0 || s > 1 {
+				t.Errorf("Patch %d: sample %d is %v, outside [0, 1]", i, j, s)
+			}
+		}
+
+		got := rc.color(func(lambda float64) float64 {
+			return float64(sig.Interpolate(float32(lambda)))
+		})
+		want := [3]float64{
+			SRGBToLinear(float64(r)),
+			SRGBToLinear(float64(g)),
+			SRGBToLinear(float64(b)),
+		}
+
+		d := labDistance(got, want)
+		if deltaE := math.Sqrt(d[0]*d[0] + d[1]*d[1] + d[2]*d[2]); deltaE > 0.01 {
+			t.Errorf("Patch %d: got linear color %v, want %v (delta E %v)", i, got, want, deltaE)
+		}
+	}
+}
+
+func TestSRGBReflectanceGrayIsFlat(t *testing.T) {
+	sig := SRGBReflectance(0.5, 0.5, 0.5)
+	want := float32(SRGBToLinear(0.5))
+	for i, s := range sig.Samples {
+		if math.Abs(float64(s-want)) > 1e-3 {
+			t.Errorf("Sample %d: got %v, want %v", i, s, want)
+		}
+	}
+}
+
+// colorCheckerTable writes patches as a BabelColor-style table, sampled every
+// 10 nm.
+func colorCheckerTable(patches []*DenseSignal) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "nm")
+	for i := range patches {
+		fmt.Fprintf(b, ",patch%d", i+1)
+	}
+	fmt.Fprintln(b)
+	for lambda := 380; lambda <= 730; lambda += 10 {
+		fmt.Fprintf(b, "%d", lambda)
+		for _, p := range patches {
+			fmt.Fprintf(b, ",%.4f", p.Interpolate(float32(lambda)))
+		}
+		fmt.Fprintln(b)
+	}
+	return b.String()
+}
+
+func TestReadColorChecker(t *testing.T) {
+	want := ColorCheckerFromSRGB()
+	got, err := ReadColorChecker(strings.NewReader(colorCheckerTable(want)))
+	if err != nil {
+		t.Fatalf("ReadColorChecker: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d patches, want %d", len(got), len(want))
+	}
+	for i := range want {
+		for _, lambda := range []float32{400, 550, 700} {
+			if g, w := got[i].Interpolate(lambda), want[i].Interpolate(lambda); math.Abs(float64(g-w)) > 0.01 {
+				t.Errorf("patch %d at %vnm: got %v, want %v", i, lambda, g, w)
+			}
+		}
+	}
+}
+
+func TestReadColorCheckerErrors(t *testing.T) {
+	patches := ColorCheckerFromSRGB()
+	bright := *patches[0]
+	bright.Samples = append([]float32(nil), bright.Samples...)
+	for i := range bright.Samples {
+		bright.Samples[i] *= 10
+	}
+
+	for name, table := range map[string]string{
+		"too few patches": colorCheckerTable(patches[:12]),
+		"out of range":    colorCheckerTable(append([]*DenseSignal{&bright}, patches[1:]...)),
+	} {
+		if _, err := ReadColorChecker(strings.NewReader(table)); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package densesignal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ReadTabulated reads a measured spectrum, given as a table of (wavelength,
+// value) rows.  This covers both CSV files and the whitespace-separated SPD
+// files used by other renderers.
+//
+// Columns may be separated by commas, semicolons, tabs, or spaces; columns
+// past the second are ignored.  Blank lines and lines starting with '#' are
+// skipped, as is a header row at the top of the table.
+//
+// Wavelengths must be in nanometers and strictly increasing.  Each row becomes
+// a sample centered on its wavelength.  If the rows aren't evenly spaced, the
+// table is linearly interpolated at the smallest spacing.
+func ReadTabulated(r io.Reader) (*DenseSignal, error) {
+	sigs, err := ReadTabulatedColumns(r, 1)
+	if err != nil {
+		return nil, err
+	}
+	return sigs[0], nil
+}
+
+// ReadTabulatedColumns is ReadTabulated for tables with several spectra
+// sharing the wavelength column, such as the red, green, and blue
+// sensitivities of a camera.  It reads the given number of value columns
+// after the wavelength.
+func ReadTabulatedColumns(r io.Reader, columns int) ([]*DenseSignal, error) {
+	xs := []float64{}
+	ys := make([][]float64, columns)
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ';' || r == ' ' || r == '\t'
+		})
+		if len(fields) < columns+1 {
+			return nil, fmt.Errorf("line %d: want at least %d columns, got %d", lineNum, columns+1, len(fields))
+		}
+
+		vals := make([]float64, columns+1)
+		var parseErr error
+		for i := range vals {
+			vals[i], parseErr = strconv.ParseFloat(fields[i], 64)
+			if parseErr != nil {
+				break
+			}
+		}
+		if parseErr != nil {
+			if len(xs) == 0 {
+				// Assume it's a header.
+				continue
+			}
+			return nil, fmt.Errorf("line %d: couldn't parse %q as a wavelength and %d values", lineNum, line, columns)
+		}
+
+		x := vals[0]
+		if len(xs) != 0 && x <= xs[len(xs)-1] {
+			return nil, fmt.Errorf("line %d: wavelength %v doesn't increase from %v", lineNum, x, xs[len(xs)-1])
+		}
+
+		xs = append(xs, x)
+		for i := range ys {
+			ys[i] = append(ys[i], vals[i+1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("while reading table: %w", err)
+	}
+
+	if len(xs) < 2 {
+		return nil, fmt.Errorf("want at least 2 rows, got %d", len(xs))
+	}
+
+	step := math.Inf(1)
+	for i := 1; i < len(xs); i++ {
+		step = math.Min(step, xs[i]-xs[i-1])
+	}
+
+	// Rounding up keeps the interpolated table from being coarser than the
+	// finest spacing in the input.  For evenly-spaced input, this lands back
+	// on the input rows.
+	count := int(math.Ceil((xs[len(xs)-1]-xs[0])/step-1e-6)) + 1
+	step = (xs[len(xs)-1] - xs[0]) / float64(count-1)
+
+	sigs := []*DenseSignal{}
+	for _, col := range ys {
+		sig := &DenseSignal{
+			SrcX:    float32(xs[0] - step/2),
+			LimX:    float32(xs[len(xs)-1] + step/2),
+			Samples: make([]float32, count),
+		}
+
+		j := 0
+		for i := range sig.Samples {
+			x := xs[0] + float64(i)*step
+			for j < len(xs)-2 && xs[j+1] < x {
+				j++
+			}
+			t := (x - xs[j]) / (xs[j+1] - xs[j])
+			t = math.Max(0, math.Min(1, t))
+			sig.Samples[i] = float32((1-t)*col[j] + t*col[j+1])
+		}
+		sigs = append(sigs, sig)
+	}
+
+	return sigs, nil
+}
+
+// LoadTabulatedFile reads a measured spectrum from a file, in any format that
+// ReadTabulated accepts.
+func LoadTabulatedFile(path string) (*DenseSignal, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("while opening file: %w", err)
+	}
+	defer f.Close()
+
+	sig, err := ReadTabulated(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s: %w", path, err)
+	}
+	return sig, nil
+}
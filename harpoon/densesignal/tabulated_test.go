@@ -0,0 +1,70 @@
+package densesignal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadTabulatedCSV(t *testing.T) {
+	in := `# A measured spectrum.
+wavelength,value
+400,0.1
+410,0.2
+420,0.4
+`
+	sig, err := ReadTabulated(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if sig.SrcX != 395 || sig.LimX != 425 {
+		t.Errorf("Got span [%v, %v), want [395, 425)", sig.SrcX, sig.LimX)
+	}
+
+	want := []float32{0.1, 0.2, 0.4}
+	if len(sig.Samples) != len(want) {
+		t.Fatalf("Got %d samples, want %d", len(sig.Samples), len(want))
+	}
+	for i := range want {
+		if sig.Samples[i] != want[i] {
+			t.Errorf("Sample %d: got %v, want %v", i, sig.Samples[i], want[i])
+		}
+	}
+}
+
+func TestReadTabulatedSPDUneven(t *testing.T) {
+	// Whitespace-separated, with a gap that needs to be filled in.
+	in := "500 1.0\n505\t2.0\n515   4.0\n"
+	sig, err := ReadTabulated(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := []float32{1.0, 2.0, 3.0, 4.0}
+	if len(sig.Samples) != len(want) {
+		t.Fatalf("Got %d samples, want %d", len(sig.Samples), len(want))
+	}
+	for i := range want {
+		if sig.Samples[i] != want[i] {
+			t.Errorf("Sample %d: got %v, want %v", i, sig.Samples[i], want[i])
+		}
+	}
+
+	if got := sig.Interpolate(510); got != 3.0 {
+		t.Errorf("Interpolate(510): got %v, want 3", got)
+	}
+}
+
+func TestReadTabulatedErrors(t *testing.T) {
+	cases := map[string]string{
+		"single row":     "400,1\n",
+		"decreasing":     "400,1\n390,2\n",
+		"garbage row":    "400,1\nfoo,bar\n",
+		"missing column": "400,1\n410\n",
+	}
+	for name, in := range cases {
+		if _, err := ReadTabulated(strings.NewReader(in)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package geometry
+
+import (
+	"row-major/harpoon/aabox"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// bvh is a bounding volume hierarchy over the primitives of a geometry, like
+// the triangles of a mesh.  Primitives are referred to by index.
+type bvh struct {
+	nodes []bvhNode
+	order []int
+}
+
+// bvhNode is a node of a bvh.  Leaves cover order[start:start+count]; interior
+// nodes have count 0, and their children are at the next index and at index
+// second, split along axis.
+type bvhNode struct {
+	bounds aabox.AABox
+	start  int
+	count  int
+	second int
+	axis   int
+}
+
+// buildBVH builds a hierarchy over n primitives with the given bounds, placing
+// at most leafSize primitives in a leaf.  Nodes are split at the median
+// centroid (of the primitives' bounds) along their longest axis.
+func buildBVH(n, leafSize int, bounds func(i int) aabox.AABox) bvh {
+	b := bvh{order: make([]int, n)}
+	if n == 0 {
+		return b
+	}
+
+	primBounds := make([]aabox.AABox, n)
+	centroids := make([]vec3.T, n)
+	for i := range b.order {
+		b.order[i] = i
+		primBounds[i] = bounds(i)
+		centroids[i] = vec3.T{
+			(primBounds[i].X.Lo + primBounds[i].X.Hi) / 2,
+			(primBounds[i].Y.Lo + primBounds[i].Y.Hi) / 2,
+			(primBounds[i].Z.Lo + primBounds[i].Z.Hi) / 2,
+		}
+	}
+
+	var build func(lo, hi int) int
+	build = func(lo, hi int) int {
+		nodeBounds := aabox.AccumZeroAABox()
+		for _, p := range b.order[lo:hi] {
+			nodeBounds = aabox.MinContainingAABox(nodeBounds, primBounds[p])
+		}
+
+		index := len(b.nodes)
+		b.nodes = append(b.nodes, bvhNode{bounds: nodeBounds, start: lo, count: hi - lo})
+		if hi-lo <= leafSize {
+			return index
+		}
+
+		extents := [3]float64{
+			nodeBounds.X.Hi - nodeBounds.X.Lo,
+			nodeBounds.Y.Hi - nodeBounds.Y.Lo,
+			nodeBounds.Z.Hi - nodeBounds.Z.Lo,
+		}
+		axis := 0
+		for i := 1; i < 3; i++ {
+			if extents[i] > extents[axis] {
+				axis = i
+			}
+		}
+
+		mid := (lo + hi) / 2
+		selectNth(b.order[lo:hi], mid-lo, func(p int) float64 { return centroids[p][axis] })
+		b.nodes[index].count = 0
+		b.nodes[index].axis = axis
+		build(lo, mid)
+		second := build(mid, hi)
+		b.nodes[index].second = second
+		return index
+	}
+	build(0, n)
+
+	return b
+}
+
+// bounds is the box around every primitive in the hierarchy.
+func (b *bvh) bounds() aabox.AABox {
+	if len(b.nodes) == 0 {
+		return aabox.AABox{}
+	}
+	return b.nodes[0].bounds
+}
+
+// traverse calls visit for every primitive in a leaf that query passes
+// through, visiting the nearer child of each node first.  visit may shorten
+// segment (to the nearest hit so far), which prunes the rest of the walk.
+func (b *bvh) traverse(query ray.RaySegment, visit func(prim int, segment *ray.RaySegment)) {
+	if len(b.nodes) == 0 {
+		return
+	}
+
+	segment := query
+	stack := []int{0}
+	for len(stack) != 0 {
+		index := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		cur := &b.nodes[index]
+		cover := aabox.RayTestAABox(segment, cur.bounds)
+		if cover.IsNaN() || !ray.SpanOverlaps(cover, segment.TheSegment) {
+			continue
+		}
+
+		if cur.count == 0 {
+			if query.TheRay.Slope[cur.axis] < 0 {
+				stack = append(stack, index+1, cur.second)
+			} else {
+				stack = append(stack, cur.second, index+1)
+			}
+			continue
+		}
+
+		for _, p := range b.order[cur.start : cur.start+cur.count] {
+			visit(p, &segment)
+		}
+	}
+}
+
+// selectNth partially sorts part by key, so that the element at index k is the
+// one that a full sort would put there, with none greater before it and none
+// less after it.  It's quicker than sorting, which makes a difference for
+// geometries with millions of primitives.
+func selectNth(part []int, k int, key func(int) float64) {
+	lo, hi := 0, len(part)-1
+	for lo < hi {
+		pivot := key(part[(lo+hi)/2])
+		i, j := lo, hi
+		for i <= j {
+			for key(part[i]) < pivot {
+				i++
+			}
+			for key(part[j]) > pivot {
+				j--
+			}
+			if i <= j {
+				part[i], part[j] = part[j], part[i]
+				i++
+				j--
+			}
+		}
+
+		switch {
+		case k <= j:
+			hi = j
+		case k >= i:
+			lo = i
+		default:
+			return
+		}
+	}
+}
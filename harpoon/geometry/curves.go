@@ -0,0 +1,584 @@
+package geometry
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"row-major/harpoon/aabox"
+	"row-major/harpoon/contact"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec2"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// CurveKind is the shape swept out along a curve.
+type CurveKind int
+
+const (
+	// CurveFlat is a ribbon that always turns to face the ray.  It's the
+	// cheapest way to draw strands too fine to see the shape of, like hair
+	// and fur.
+	CurveFlat CurveKind = iota
+
+	// CurveRibbon is a ribbon whose orientation is given by normals along
+	// the curve, like a blade of grass.  Seen edge-on, it disappears.
+	CurveRibbon
+
+	// CurveCylinder is a tube.  Its normals curve around the strand, so it
+	// looks round up close.
+	CurveCylinder
+)
+
+// Curves is a Geometry made of many thin strands, each a chain of cubic Bezier
+// segments.  Holding every strand of a head of hair or a patch of grass in one
+// Curves keeps them out of the scene's query accelerator, behind a bounding
+// volume hierarchy of their own.
+//
+// Curves are surfaces, like a TriangleMesh: RayInto reports every crossing.
+//
+// The first material coordinate of a contact runs from 0 at the root of its
+// strand to 1 at the tip, and the second from 0 to 1 across the strand's width.
+// The contact's tangent runs along the strand, toward the tip.
+type Curves struct {
+	Kind    CurveKind
+	Strands []CurveStrand
+
+	crushed   bool
+	segments  []curveSegment
+	hierarchy bvh
+}
+
+// CurveStrand is one strand of a Curves.
+type CurveStrand struct {
+	// Points are the control points of the strand's segments: 3n+1 points
+	// for n segments, with each segment starting at the last point of the one
+	// before.
+	Points []vec3.T
+
+	// Widths are the widths of the strand at the ends of its segments (n+1
+	// of them).  The width varies linearly along each segment.  A single
+	// width applies to the whole strand.
+	Widths []float64
+
+	// Normals orient a CurveRibbon at the ends of its segments (n+1 of them),
+	// interpolated in between.  Other kinds ignore them.
+	Normals []vec3.T
+}
+
+// curveSegment is one Bezier segment of a strand, ready to intersect.
+type curveSegment struct {
+	points  [4]vec3.T
+	widths  [2]float64
+	normals [2]vec3.T
+
+	// The span of the strand's material coordinate that the segment covers.
+	u0, u1 float64
+}
+
+// curveLeafSize is the most segments that will be placed in a leaf.
+const curveLeafSize = 4
+
+func (s *curveSegment) width(u float64) float64 {
+	return (1-u)*s.widths[0] + u*s.widths[1]
+}
+
+func (s *curveSegment) bounds() aabox.AABox {
+	b := aabox.AccumZeroAABox()
+	for _, p := range s.points {
+		b = aabox.MinContainingAABox(b, aabox.AABox{
+			X: ray.Span{Lo: p[0], Hi: p[0]},
+			Y: ray.Span{Lo: p[1], Hi: p[1]},
+			Z: ray.Span{Lo: p[2], Hi: p[2]},
+		})
+	}
+
+	// The curve stays within the hull of its control points, and the width
+	// extends it by at most half the widest end.
+	pad := math.Max(s.widths[0], s.widths[1]) / 2
+	b.X.Lo, b.X.Hi = b.X.Lo-pad, b.X.Hi+pad
+	b.Y.Lo, b.Y.Hi = b.Y.Lo-pad, b.Y.Hi+pad
+	b.Z.Lo, b.Z.Hi = b.Z.Lo-pad, b.Z.Hi+pad
+	return b
+}
+
+func (c *Curves) GetAABox() aabox.AABox {
+	c.Crush(0)
+	return c.hierarchy.bounds()
+}
+
+// Crush splits the strands into segments, and builds a bounding volume
+// hierarchy over them.  Curves don't change over time, so this only happens
+// once.  Control points left over past the last whole segment of a strand are
+// ignored.
+func (c *Curves) Crush(time float64) {
+	if c.crushed {
+		return
+	}
+	c.crushed = true
+
+	c.segments = nil
+	for _, strand := range c.Strands {
+		n := (len(strand.Points) - 1) / 3
+		width := func(k int) float64 {
+			if len(strand.Widths) == 0 {
+				return 0
+			}
+			return strand.Widths[clampInt(k, 0, len(strand.Widths)-1)]
+		}
+		normal := func(k int) vec3.T {
+			if len(strand.Normals) == 0 {
+				return vec3.T{}
+			}
+			return vec3.Normalize(strand.Normals[clampInt(k, 0, len(strand.Normals)-1)])
+		}
+
+		for k := 0; k < n; k++ {
+			seg := curveSegment{
+				widths:  [2]float64{width(k), width(k + 1)},
+				normals: [2]vec3.T{normal(k), normal(k + 1)},
+				u0:      float64(k) / float64(n),
+				u1:      float64(k+1) / float64(n),
+			}
+			copy(seg.points[:], strand.Points[3*k:3*k+4])
+			c.segments = c.appendPieces(c.segments, seg, curveSplitDepth)
+		}
+	}
+
+	c.hierarchy = buildBVH(len(c.segments), curveLeafSize, func(i int) aabox.AABox {
+		return c.segments[i].bounds()
+	})
+}
+
+// curveSplitDepth is the most times a segment is split in half for the
+// bounding volume hierarchy.
+const curveSplitDepth = 2
+
+// appendPieces appends seg to segments, split into pieces short enough that
+// their bounding boxes fit them well.  A long, thin segment running
+// diagonally has a box much bigger than itself, which rays would have to
+// test it for.
+func (c *Curves) appendPieces(segments []curveSegment, seg curveSegment, depth int) []curveSegment {
+	length := vec3.SubVV(seg.points[3], seg.points[0]).Norm()
+	if depth == 0 || length <= 8*math.Max(seg.widths[0], seg.widths[1]) {
+		return append(segments, seg)
+	}
+
+	left, right := seg, seg
+	left.points, right.points = splitBezier(seg.points)
+	midWidth := seg.width(0.5)
+	left.widths[1], right.widths[0] = midWidth, midWidth
+	midNormal := vec3.AddVV(seg.normals[0], seg.normals[1])
+	if midNormal.Norm() != 0 {
+		midNormal = vec3.Normalize(midNormal)
+	}
+	left.normals[1], right.normals[0] = midNormal, midNormal
+	midU := (seg.u0 + seg.u1) / 2
+	left.u1, right.u0 = midU, midU
+
+	segments = c.appendPieces(segments, left, depth-1)
+	return c.appendPieces(segments, right, depth-1)
+}
+
+// evalBezier returns the point at u along a cubic Bezier curve, and the
+// derivative there.
+func evalBezier(cp [4]vec3.T, u float64) (vec3.T, vec3.T) {
+	lerp := func(a, b vec3.T) vec3.T {
+		return vec3.AddVV(vec3.MulVS(a, 1-u), vec3.MulVS(b, u))
+	}
+	a := [3]vec3.T{lerp(cp[0], cp[1]), lerp(cp[1], cp[2]), lerp(cp[2], cp[3])}
+	b := [2]vec3.T{lerp(a[0], a[1]), lerp(a[1], a[2])}
+
+	d := vec3.MulVS(vec3.SubVV(b[1], b[0]), 3)
+	if d.Norm() == 0 {
+		// The derivative vanishes where control points coincide; the
+		// chord still has the right direction.
+		d = vec3.SubVV(cp[3], cp[0])
+	}
+	return lerp(b[0], b[1]), d
+}
+
+// splitBezier splits a cubic Bezier curve in half.
+func splitBezier(cp [4]vec3.T) ([4]vec3.T, [4]vec3.T) {
+	mid := func(a, b vec3.T) vec3.T {
+		return vec3.MulVS(vec3.AddVV(a, b), 0.5)
+	}
+	a := [3]vec3.T{mid(cp[0], cp[1]), mid(cp[1], cp[2]), mid(cp[2], cp[3])}
+	b := [2]vec3.T{mid(a[0], a[1]), mid(a[1], a[2])}
+	c := mid(b[0], b[1])
+	return [4]vec3.T{cp[0], a[0], b[0], c}, [4]vec3.T{c, b[1], a[2], cp[3]}
+}
+
+// curveQuery is a ray set up for intersecting curve segments: in ray
+// coordinates, the ray starts at the origin and runs along +Z, so a curve is
+// hit where it passes within half its width of the Z axis.
+type curveQuery struct {
+	r      ray.Ray
+	norm   float64
+	dir    vec3.T
+	ex, ey vec3.T
+
+	// The range of depths (distances along dir) being searched.  zHi
+	// shrinks to the nearest hit.
+	zLo, zHi float64
+
+	// The nearest hit: its segment, parameter along the segment, and width
+	// there.
+	segment int
+	u       float64
+	width   float64
+}
+
+func (q *curveQuery) toRaySpace(p vec3.T) vec3.T {
+	d := vec3.SubVV(p, q.r.Point)
+	return vec3.T{vec3.IProd(d, q.ex), vec3.IProd(d, q.ey), vec3.IProd(d, q.dir)}
+}
+
+// mayHit reports whether the ray could hit a curve with control points cp (in
+// ray coordinates) and the given maximum width: whether the box around the
+// control points, padded by half the width, holds part of the ray.
+func (q *curveQuery) mayHit(cp [4]vec3.T, maxWidth float64) bool {
+	pad := maxWidth / 2
+	lo, hi := cp[0], cp[0]
+	for _, p := range cp[1:] {
+		for a := 0; a < 3; a++ {
+			lo[a] = math.Min(lo[a], p[a])
+			hi[a] = math.Max(hi[a], p[a])
+		}
+	}
+	return lo[0]-pad <= 0 && 0 <= hi[0]+pad &&
+		lo[1]-pad <= 0 && 0 <= hi[1]+pad &&
+		lo[2]-pad <= q.zHi && q.zLo <= hi[2]+pad
+}
+
+// intersect tests segment s against the query, updating the nearest hit.
+//
+// The test follows Nakamaru and Ohno's "Ray Tracing for Curves Primitive":
+// the curve is split in half until each piece is nearly straight, and each
+// piece is tested as a line segment against the Z axis.
+func (c *Curves) intersect(q *curveQuery, s int) {
+	seg := &c.segments[s]
+
+	var cp [4]vec3.T
+	for i, p := range seg.points {
+		cp[i] = q.toRaySpace(p)
+	}
+	if !q.mayHit(cp, math.Max(seg.widths[0], seg.widths[1])) {
+		return
+	}
+
+	// Split until the pieces deviate from straight by a small fraction of
+	// the curve's width.
+	l0 := 0.0
+	for i := 0; i < 2; i++ {
+		for a := 0; a < 3; a++ {
+			l0 = math.Max(l0, math.Abs(cp[i][a]-2*cp[i+1][a]+cp[i+2][a]))
+		}
+	}
+	depth := 0
+	if eps := math.Max(seg.widths[0], seg.widths[1]) / 20; eps > 0 && l0 > 0 {
+		depth = int(math.Log2(math.Sqrt2*6*l0/(8*eps)) / 2)
+		depth = clampInt(depth, 0, 10)
+	}
+
+	c.intersectPiece(q, s, cp, 0, 1, depth)
+}
+
+func (c *Curves) intersectPiece(q *curveQuery, s int, cp [4]vec3.T, u0, u1 float64, depth int) {
+	seg := &c.segments[s]
+
+	if !q.mayHit(cp, math.Max(seg.width(u0), seg.width(u1))) {
+		return
+	}
+
+	if depth > 0 {
+		left, right := splitBezier(cp)
+		mid := (u0 + u1) / 2
+		c.intersectPiece(q, s, left, u0, mid, depth-1)
+		c.intersectPiece(q, s, right, mid, u1, depth-1)
+		return
+	}
+
+	// The piece is nearly straight.  Reject hits past the perpendiculars at
+	// its ends, so that neighboring pieces don't both report them.
+	if (cp[1][1]-cp[0][1])*-cp[0][1]+cp[0][0]*(cp[0][0]-cp[1][0]) < 0 {
+		return
+	}
+	if (cp[2][1]-cp[3][1])*-cp[3][1]+cp[3][0]*(cp[3][0]-cp[2][0]) < 0 {
+		return
+	}
+
+	// The closest approach of the piece's chord to the Z axis.
+	chord := vec2.T{cp[3][0] - cp[0][0], cp[3][1] - cp[0][1]}
+	denom := chord[0]*chord[0] + chord[1]*chord[1]
+	if denom == 0 {
+		return
+	}
+	w := -(cp[0][0]*chord[0] + cp[0][1]*chord[1]) / denom
+	w = math.Max(0, math.Min(w, 1))
+	u := u0 + w*(u1-u0)
+
+	width := seg.width(u)
+	if c.Kind == CurveRibbon {
+		// A ribbon looks narrower as it turns away.
+		width *= math.Abs(vec3.IProd(c.ribbonNormal(seg, u), q.dir))
+	}
+
+	p, _ := evalBezier(cp, w)
+	dist2 := p[0]*p[0] + p[1]*p[1]
+	if dist2 > width*width/4 {
+		return
+	}
+
+	z := p[2]
+	if c.Kind == CurveCylinder {
+		// The near side of the tube.
+		z -= math.Sqrt(width*width/4 - dist2)
+	}
+	if z < q.zLo || z > q.zHi {
+		return
+	}
+
+	q.zHi = z
+	q.segment, q.u, q.width = s, u, width
+}
+
+func (c *Curves) ribbonNormal(seg *curveSegment, u float64) vec3.T {
+	n := vec3.AddVV(vec3.MulVS(seg.normals[0], 1-u), vec3.MulVS(seg.normals[1], u))
+	if n.Norm() == 0 {
+		return n
+	}
+	return vec3.Normalize(n)
+}
+
+func (c *Curves) RayInto(query ray.RaySegment) contact.Contact {
+	c.Crush(0)
+
+	norm := query.TheRay.Slope.Norm()
+	if norm == 0 {
+		return contact.ContactNaN()
+	}
+	q := &curveQuery{
+		r:       query.TheRay,
+		norm:    norm,
+		dir:     vec3.DivVS(query.TheRay.Slope, norm),
+		zLo:     query.TheSegment.Lo * norm,
+		zHi:     query.TheSegment.Hi * norm,
+		segment: -1,
+	}
+	q.ex, q.ey = vec3.OrthonormalBasis(q.dir)
+
+	c.hierarchy.traverse(query, func(s int, segment *ray.RaySegment) {
+		c.intersect(q, s)
+		if q.segment != -1 {
+			// zHi is at least zLo, but may have rounded below Lo.
+			segment.TheSegment.Hi = math.Max(q.zHi/norm, segment.TheSegment.Lo)
+		}
+	})
+
+	if q.segment == -1 {
+		return contact.ContactNaN()
+	}
+
+	t := q.zHi / norm
+	if t < query.TheSegment.Lo || t >= query.TheSegment.Hi {
+		return contact.ContactNaN()
+	}
+	return c.surfaceContact(q, t)
+}
+
+// surfaceContact fills in the contact for the nearest hit of q, at t along the
+// ray.
+func (c *Curves) surfaceContact(q *curveQuery, t float64) contact.Contact {
+	seg := &c.segments[q.segment]
+	center, dpdu := evalBezier(seg.points, q.u)
+	dpdu = vec3.Normalize(dpdu)
+	p := q.r.Eval(t)
+
+	// The normal of a flat curve faces back along the ray, as far as it can
+	// while staying perpendicular to the strand.
+	facing := vec3.Reject(dpdu, vec3.MulVS(q.dir, -1))
+	if facing.Norm() < 1e-12 {
+		// Looking straight down the strand.
+		facing, _ = vec3.OrthonormalBasis(dpdu)
+	}
+	facing = vec3.Normalize(facing)
+	side := vec3.CProd(dpdu, facing)
+
+	// How far across the strand the hit is, from -1 to 1.
+	offset := vec3.Reject(dpdu, vec3.SubVV(p, center))
+	h := 0.0
+	if q.width > 0 {
+		h = math.Max(-1, math.Min(vec3.IProd(offset, side)/(q.width/2), 1))
+	}
+
+	n := facing
+	switch c.Kind {
+	case CurveRibbon:
+		if rn := c.ribbonNormal(seg, q.u); rn.Norm() != 0 {
+			n = rn
+			if vec3.IProd(n, q.dir) > 0 {
+				n = vec3.MulVS(n, -1)
+			}
+		}
+	case CurveCylinder:
+		n = vec3.AddVV(vec3.MulVS(facing, math.Sqrt(1-h*h)), vec3.MulVS(side, h))
+	}
+
+	tangent, bitangent := contact.TangentFrame(n, dpdu, side)
+	return contact.Contact{
+		T:         t,
+		R:         q.r,
+		P:         p,
+		N:         n,
+		Mtl2:      vec2.T{seg.u0 + q.u*(seg.u1-seg.u0), (h + 1) / 2},
+		Mtl3:      p,
+		Tangent:   tangent,
+		Bitangent: bitangent,
+	}
+}
+
+// RayExit never reports anything.  Curves have no interior, so RayInto already
+// reports the ray leaving through the surface.
+func (c *Curves) RayExit(query ray.RaySegment) contact.Contact {
+	return contact.ContactNaN()
+}
+
+// cyHairHeader is the 128-byte header of a cyHair file.
+type cyHairHeader struct {
+	Signature    [4]byte
+	Hairs        uint32
+	Points       uint32
+	Arrays       uint32
+	Segments     uint32
+	Thickness    float32
+	Transparency float32
+	Color        [3]float32
+	Info         [88]byte
+}
+
+// The arrays present in a cyHair file, in the order they're stored.
+const (
+	cyHairSegments = 1 << iota
+	cyHairPoints
+	cyHairThickness
+	cyHairTransparency
+	cyHairColor
+)
+
+// ReadCyHair reads strands from a cyHair (".hair") file, the format of Cem
+// Yuksel's hair models.  Each strand is a polyline in the file; it's smoothed
+// into Bezier segments passing through every point, as a Catmull-Rom spline.
+// The file's thickness becomes the strands' width.  Transparency and color
+// are ignored.
+//
+// The Curves are flat, which suits hair; set Kind to change that.
+func ReadCyHair(r io.Reader) (*Curves, error) {
+	var header cyHairHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("while reading header: %w", err)
+	}
+	if string(header.Signature[:]) != "HAIR" {
+		return nil, fmt.Errorf("signature is %q, not \"HAIR\"", header.Signature[:])
+	}
+	if header.Arrays&cyHairPoints == 0 {
+		return nil, fmt.Errorf("file has no points")
+	}
+
+	segments := make([]uint16, header.Hairs)
+	if header.Arrays&cyHairSegments != 0 {
+		if err := binary.Read(r, binary.LittleEndian, segments); err != nil {
+			return nil, fmt.Errorf("while reading segment counts: %w", err)
+		}
+	} else {
+		for i := range segments {
+			segments[i] = uint16(header.Segments)
+		}
+	}
+
+	total := 0
+	for _, n := range segments {
+		total += int(n) + 1
+	}
+	if total != int(header.Points) {
+		return nil, fmt.Errorf("strands have %d points in all, but the header says %d", total, header.Points)
+	}
+
+	points := make([]float32, 3*header.Points)
+	if err := binary.Read(r, binary.LittleEndian, points); err != nil {
+		return nil, fmt.Errorf("while reading points: %w", err)
+	}
+
+	thickness := make([]float32, header.Points)
+	if header.Arrays&cyHairThickness != 0 {
+		if err := binary.Read(r, binary.LittleEndian, thickness); err != nil {
+			return nil, fmt.Errorf("while reading thickness: %w", err)
+		}
+	} else {
+		for i := range thickness {
+			thickness[i] = header.Thickness
+		}
+	}
+
+	c := &Curves{Kind: CurveFlat, Strands: make([]CurveStrand, 0, len(segments))}
+	first := 0
+	for _, n := range segments {
+		count := int(n) + 1
+		polyline := make([]vec3.T, count)
+		for i := range polyline {
+			k := 3 * (first + i)
+			polyline[i] = vec3.T{float64(points[k]), float64(points[k+1]), float64(points[k+2])}
+		}
+
+		strand := CurveStrand{Widths: make([]float64, count)}
+		for i := range strand.Widths {
+			strand.Widths[i] = float64(thickness[first+i])
+		}
+		first += count
+
+		if count < 2 {
+			continue
+		}
+		strand.Points = catmullRom(polyline)
+		c.Strands = append(c.Strands, strand)
+	}
+
+	return c, nil
+}
+
+// catmullRom returns the control points of Bezier segments that pass through
+// every point of polyline, with the tangent at each point parallel to the
+// line between its neighbors.  The end points are their own neighbors.
+func catmullRom(polyline []vec3.T) []vec3.T {
+	at := func(i int) vec3.T {
+		return polyline[clampInt(i, 0, len(polyline)-1)]
+	}
+
+	result := []vec3.T{polyline[0]}
+	for i := 0; i+1 < len(polyline); i++ {
+		result = append(result,
+			vec3.AddVV(at(i), vec3.DivVS(vec3.SubVV(at(i+1), at(i-1)), 6)),
+			vec3.SubVV(at(i+1), vec3.DivVS(vec3.SubVV(at(i+2), at(i)), 6)),
+			at(i+1),
+		)
+	}
+	return result
+}
+
+// LoadCyHairFile loads strands from a cyHair file.
+func LoadCyHairFile(path string) (*Curves, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("while opening file: %w", err)
+	}
+	defer f.Close()
+
+	c, err := ReadCyHair(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s: %w", path, err)
+	}
+	return c, nil
+}
@@ -0,0 +1,213 @@
+package geometry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// straightStrand is a single straight segment from (0,0,0) to (1,0,0).
+func straightStrand(widths ...float64) CurveStrand {
+	return CurveStrand{
+		Points: []vec3.T{{0, 0, 0}, {1.0 / 3, 0, 0}, {2.0 / 3, 0, 0}, {1, 0, 0}},
+		Widths: widths,
+	}
+}
+
+func TestCurvesFlat(t *testing.T) {
+	c := &Curves{Kind: CurveFlat, Strands: []CurveStrand{straightStrand(0.2)}}
+
+	hit := c.RayInto(query(vec3.T{0.5, 0.05, 5}, vec3.T{0, 0, -1}))
+	checkContact(t, "flat", hit, 5, vec3.T{0.5, 0.05, 0}, vec3.T{0, 0, 1})
+	if math.Abs(hit.Mtl2[0]-0.5) > 1e-9 || math.Abs(hit.Mtl2[1]-0.25) > 1e-9 {
+		t.Errorf("got material coordinates %v, want [0.5 0.25]", hit.Mtl2)
+	}
+	if vec3.SubVV(hit.Tangent, vec3.T{1, 0, 0}).Norm() > 1e-9 {
+		t.Errorf("got tangent %v, want one along the strand", hit.Tangent)
+	}
+
+	// The ribbon turns to face a ray from any side.
+	checkContact(t, "flat, from the side", c.RayInto(query(vec3.T{0.5, -5, 0.05}, vec3.T{0, 1, 0})), 5, vec3.T{0.5, 0, 0.05}, vec3.T{0, -1, 0})
+
+	checkMiss(t, "beside", c.RayInto(query(vec3.T{0.5, 0.15, 5}, vec3.T{0, 0, -1})))
+	checkMiss(t, "past the end", c.RayInto(query(vec3.T{1.2, 0, 5}, vec3.T{0, 0, -1})))
+	checkMiss(t, "exit", c.RayExit(query(vec3.T{0.5, 0, 5}, vec3.T{0, 0, -1})))
+}
+
+func TestCurvesCylinder(t *testing.T) {
+	c := &Curves{Kind: CurveCylinder, Strands: []CurveStrand{straightStrand(0.2)}}
+
+	// Halfway to the edge of the tube, the surface is sqrt(3)/2 of its radius
+	// up, and the normal leans out by 30 degrees.
+	z := 0.1 * math.Sqrt(3) / 2
+	hit := c.RayInto(query(vec3.T{0.5, 0.05, 5}, vec3.T{0, 0, -1}))
+	checkContact(t, "cylinder", hit, 5-z, vec3.T{0.5, 0.05, z}, vec3.T{0, 0.5, math.Sqrt(3) / 2})
+}
+
+func TestCurvesVaryingWidth(t *testing.T) {
+	// Tapering from 0.2 to nothing, the strand is 0.05 wide at x = 0.75.
+	c := &Curves{Strands: []CurveStrand{straightStrand(0.2, 0)}}
+	if hit := c.RayInto(query(vec3.T{0.75, 0.02, 5}, vec3.T{0, 0, -1})); math.IsNaN(hit.T) {
+		t.Errorf("missed the strand inside its width")
+	}
+	checkMiss(t, "outside the width", c.RayInto(query(vec3.T{0.75, 0.03, 5}, vec3.T{0, 0, -1})))
+}
+
+func TestCurvesBezier(t *testing.T) {
+	// A quarter circle of radius 1, to within a few parts in 10,000.
+	k := 4 * (math.Sqrt2 - 1) / 3
+	c := &Curves{Strands: []CurveStrand{{
+		Points: []vec3.T{{1, 0, 0}, {1, k, 0}, {k, 1, 0}, {0, 1, 0}},
+		Widths: []float64{0.002},
+	}}}
+
+	for _, theta := range []float64{0.1, 0.4, 0.785, 1.2, 1.5} {
+		p := vec3.T{math.Cos(theta), math.Sin(theta), 0}
+		hit := c.RayInto(query(vec3.T{p[0], p[1], 5}, vec3.T{0, 0, -1}))
+		if math.IsNaN(hit.T) {
+			t.Errorf("theta=%v: missed the arc", theta)
+			continue
+		}
+		want := vec3.T{-math.Sin(theta), math.Cos(theta), 0}
+		if vec3.SubVV(hit.Tangent, want).Norm() > 1e-2 {
+			t.Errorf("theta=%v: got tangent %v, want %v", theta, hit.Tangent, want)
+		}
+
+		out := vec3.MulVS(p, 1.01)
+		checkMiss(t, "outside the arc", c.RayInto(query(vec3.T{out[0], out[1], 5}, vec3.T{0, 0, -1})))
+	}
+}
+
+func TestCurvesRibbon(t *testing.T) {
+	strand := straightStrand(0.2)
+	strand.Normals = []vec3.T{{0, 0, 1}}
+	c := &Curves{Kind: CurveRibbon, Strands: []CurveStrand{strand}}
+
+	checkContact(t, "face-on", c.RayInto(query(vec3.T{0.5, 0.05, 5}, vec3.T{0, 0, -1})), 5, vec3.T{0.5, 0.05, 0}, vec3.T{0, 0, 1})
+	checkContact(t, "from behind", c.RayInto(query(vec3.T{0.5, 0.05, -5}, vec3.T{0, 0, 1})), 5, vec3.T{0.5, 0.05, 0}, vec3.T{0, 0, -1})
+	checkMiss(t, "edge-on", c.RayInto(query(vec3.T{0.5, -5, 0.05}, vec3.T{0, 1, 0})))
+}
+
+func TestReadCyHair(t *testing.T) {
+	// Two strands: a straight one with two segments, and one with a single
+	// segment, sharing a default thickness.
+	var buf bytes.Buffer
+	header := cyHairHeader{
+		Hairs:     2,
+		Points:    5,
+		Arrays:    cyHairSegments | cyHairPoints,
+		Thickness: 0.1,
+	}
+	copy(header.Signature[:], "HAIR")
+	binary.Write(&buf, binary.LittleEndian, header)
+	binary.Write(&buf, binary.LittleEndian, []uint16{2, 1})
+	binary.Write(&buf, binary.LittleEndian, []float32{
+		0, 0, 0, 1, 0, 0, 2, 0, 0,
+		0, 1, 0, 0, 1, 1,
+	})
+
+	c, err := ReadCyHair(&buf)
+	if err != nil {
+		t.Fatalf("ReadCyHair: %v", err)
+	}
+	if len(c.Strands) != 2 {
+		t.Fatalf("got %d strands, want 2", len(c.Strands))
+	}
+	if got := len(c.Strands[0].Points); got != 7 {
+		t.Errorf("got %d control points for two segments, want 7", got)
+	}
+	for i, want := range []vec3.T{{0, 0, 0}, {1, 0, 0}, {2, 0, 0}} {
+		if got := c.Strands[0].Points[3*i]; vec3.SubVV(got, want).Norm() > 1e-9 {
+			t.Errorf("segment end %d is %v, want %v", i, got, want)
+		}
+	}
+
+	// The smoothed strand still passes through its points.
+	hit := c.RayInto(query(vec3.T{1.5, 0.01, 5}, vec3.T{0, 0, -1}))
+	checkContact(t, "cyHair strand", hit, 5, vec3.T{1.5, 0.01, 0}, vec3.T{0, 0, 1})
+
+	buf.Reset()
+	buf.WriteString("NOPE")
+	if _, err := ReadCyHair(&buf); err == nil {
+		t.Errorf("ReadCyHair accepted a file without a header")
+	}
+}
+
+// furball is n strands sprouting from the unit sphere, each two segments long.
+func furball(n int, rng *rand.Rand) *Curves {
+	c := &Curves{Kind: CurveCylinder}
+	for i := 0; i < n; i++ {
+		root := vec3.UniformUnitDistribution(rng)
+		bend := vec3.MulVS(vec3.UniformUnitDistribution(rng), 0.05)
+		strand := CurveStrand{Widths: []float64{0.004, 0.002, 0}}
+		for j := 0; j <= 6; j++ {
+			s := float64(j) / 6
+			p := vec3.AddVV(vec3.MulVS(root, 1+0.3*s), vec3.MulVS(bend, s*s))
+			strand.Points = append(strand.Points, p)
+		}
+		c.Strands = append(c.Strands, strand)
+	}
+	return c
+}
+
+func TestCurvesMatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	c := furball(2000, rng)
+
+	hits := 0
+	for n := 0; n < 500; n++ {
+		q := query(vec3.MulVS(vec3.UniformUnitDistribution(rng), 3), vec3.T{})
+		q.TheRay.Slope = vec3.SubVV(vec3.MulVS(vec3.UniformUnitDistribution(rng), 1.2), q.TheRay.Point)
+
+		got := c.RayInto(q)
+
+		norm := q.TheRay.Slope.Norm()
+		brute := &curveQuery{
+			r:       q.TheRay,
+			norm:    norm,
+			dir:     vec3.DivVS(q.TheRay.Slope, norm),
+			zLo:     q.TheSegment.Lo * norm,
+			zHi:     math.Inf(1),
+			segment: -1,
+		}
+		brute.ex, brute.ey = vec3.OrthonormalBasis(brute.dir)
+		for s := range c.segments {
+			c.intersect(brute, s)
+		}
+
+		if brute.segment == -1 {
+			checkMiss(t, "random ray", got)
+			continue
+		}
+		hits++
+		if want := brute.zHi / norm; math.Abs(got.T-want) > 1e-9 {
+			t.Errorf("ray %v: got t=%v, want %v", q.TheRay, got.T, want)
+		}
+	}
+	if hits == 0 {
+		t.Errorf("no rays hit the fur")
+	}
+}
+
+func BenchmarkCurvesRayInto(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	c := furball(200000, rng)
+	c.Crush(0)
+
+	queries := []ray.RaySegment{}
+	for n := 0; n < 1024; n++ {
+		q := query(vec3.T{0, -4, 0}, vec3.T{})
+		q.TheRay.Slope = vec3.SubVV(vec3.MulVS(vec3.UniformUnitDistribution(rng), 1.2), q.TheRay.Point)
+		queries = append(queries, q)
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		c.RayInto(queries[n%len(queries)])
+	}
+}
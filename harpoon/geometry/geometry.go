@@ -2,6 +2,7 @@ package geometry
 
 import (
 	"math"
+	"math/rand"
 	"row-major/harpoon/aabox"
 	"row-major/harpoon/contact"
 	"row-major/harpoon/ray"
@@ -16,6 +17,15 @@ type Geometry interface {
 	RayExit(query ray.RaySegment) contact.Contact
 }
 
+// SurfaceSampler is implemented by geometries that can pick points uniformly
+// over their surface, for integrators that start paths on light sources.
+type SurfaceSampler interface {
+	// SampleSurface returns a contact at a uniformly-chosen point on the
+	// surface, along with the total surface area.  Only the position, normal,
+	// and material coordinates of the contact are meaningful.
+	SampleSurface(rng *rand.Rand) (contact.Contact, float64)
+}
+
 type MaterialCoordsMode int
 
 const (
@@ -40,6 +50,32 @@ func (s *Sphere) Crush(time float64) {
 	// Nothing to do.
 }
 
+// surfaceContact fills in the normal, material coordinates, and tangent frame
+// of the contact at point p on the sphere.
+//
+// The 2D material coordinates are the azimuth (measured from +Y towards +X)
+// and the polar angle (measured from +Z), in radians.
+func (s *Sphere) surfaceContact(p vec3.T) contact.Contact {
+	result := contact.Contact{
+		P:    p,
+		N:    vec3.Normalize(p),
+		Mtl3: p,
+	}
+
+	if s.TheMaterialCoordsMode == MaterialCoords2D {
+		result.Mtl2 = vec2.T{math.Atan2(p[0], p[1]), math.Acos(math.Max(-1, math.Min(1, p[2])))}
+	}
+
+	// The derivatives of p with respect to azimuth and polar angle.  At the
+	// poles the azimuth is degenerate, and TangentFrame picks an arbitrary
+	// tangent.
+	dAzimuth := vec3.T{p[1], -p[0], 0}
+	dPolar := vec3.T{p[0] * p[2], p[1] * p[2], -(p[0]*p[0] + p[1]*p[1])}
+	result.Tangent, result.Bitangent = contact.TangentFrame(result.N, dAzimuth, dPolar)
+
+	return result
+}
+
 func (s *Sphere) RayInto(query ray.RaySegment) contact.Contact {
 	b := vec3.IProd(query.TheRay.Slope, query.TheRay.Point)
 	c := vec3.IProd(query.TheRay.Point, query.TheRay.Point) - 1.0
@@ -50,20 +86,9 @@ func (s *Sphere) RayInto(query ray.RaySegment) contact.Contact {
 		return contact.ContactNaN()
 	}
 
-	p := query.TheRay.Eval(tMin)
-
-	result := contact.Contact{
-		T:    tMin,
-		P:    p,
-		N:    vec3.Normalize(p),
-		R:    query.TheRay,
-		Mtl3: p,
-	}
-
-	if s.TheMaterialCoordsMode == MaterialCoords2D {
-		result.Mtl2 = vec2.T{math.Atan2(p[0], p[1]), math.Acos(p[2])}
-	}
-
+	result := s.surfaceContact(query.TheRay.Eval(tMin))
+	result.T = tMin
+	result.R = query.TheRay
 	return result
 }
 
@@ -71,21 +96,20 @@ func (s *Sphere) RayExit(query ray.RaySegment) contact.Contact {
 	b := vec3.IProd(query.TheRay.Slope, query.TheRay.Point)
 	c := vec3.IProd(query.TheRay.Point, query.TheRay.Point) - 1.0
 
-	tMax := -b - math.Sqrt(b*b-c)
+	tMax := -b + math.Sqrt(b*b-c)
 
 	if tMax < query.TheSegment.Lo || query.TheSegment.Hi <= tMax {
 		return contact.ContactNaN()
 	}
 
-	p := query.TheRay.Eval(tMax)
-	return contact.Contact{
-		T:    tMax,
-		P:    p,
-		N:    vec3.Normalize(p),
-		Mtl2: vec2.T{math.Atan2(p[0], p[1]), math.Acos(p[2])},
-		Mtl3: p,
-		R:    query.TheRay,
-	}
+	result := s.surfaceContact(query.TheRay.Eval(tMax))
+	result.T = tMax
+	result.R = query.TheRay
+	return result
+}
+
+func (s *Sphere) SampleSurface(rng *rand.Rand) (contact.Contact, float64) {
+	return s.surfaceContact(vec3.UniformUnitDistribution(rng)), 4 * math.Pi
 }
 
 type Box struct {
@@ -102,6 +126,42 @@ func (b *Box) GetAABox() aabox.AABox {
 
 func (b *Box) Crush(time float64) {}
 
+// surfaceContact fills in the material coordinates and tangent frame of the
+// contact at point p, on the face with normal n.
+//
+// Each face is parameterized by distance from its low corner, along the two
+// axes in the plane of the face.  The axes are ordered so that the tangent,
+// bitangent, and normal are right-handed, so textures aren't mirrored when
+// viewed from outside the box.
+func (b *Box) surfaceContact(p, n vec3.T) contact.Contact {
+	axis := 0
+	for i := 1; i < 3; i++ {
+		if math.Abs(n[i]) > math.Abs(n[axis]) {
+			axis = i
+		}
+	}
+
+	u := (axis + 1) % 3
+	v := (axis + 2) % 3
+	if n[axis] < 0 {
+		u, v = v, u
+	}
+
+	tangent := vec3.T{}
+	tangent[u] = 1
+	bitangent := vec3.T{}
+	bitangent[v] = 1
+
+	return contact.Contact{
+		P:         p,
+		N:         n,
+		Mtl2:      vec2.T{p[u] - b.Spans[u].Lo, p[v] - b.Spans[v].Lo},
+		Mtl3:      p,
+		Tangent:   tangent,
+		Bitangent: bitangent,
+	}
+}
+
 func (b *Box) RayInto(query ray.RaySegment) contact.Contact {
 	cover := ray.Span{math.Inf(-1), math.Inf(1)}
 
@@ -134,18 +194,15 @@ func (b *Box) RayInto(query ray.RaySegment) contact.Contact {
 		}
 	}
 
-	if !ray.SpanOverlaps(cover, query.TheSegment) {
+	// The ray enters at cover.Lo.  If that's outside the segment (for
+	// example, because the ray starts inside the box), it doesn't count.
+	if cover.Lo < query.TheSegment.Lo || query.TheSegment.Hi <= cover.Lo {
 		return contact.ContactNaN()
 	}
 
-	val := contact.Contact{
-		T:    cover.Lo,
-		R:    query.TheRay,
-		P:    query.TheRay.Eval(cover.Lo),
-		N:    vec3.T{hitAxis[0], hitAxis[1], hitAxis[2]},
-		Mtl2: vec2.T{0, 0},
-		Mtl3: query.TheRay.Eval(cover.Lo),
-	}
+	val := b.surfaceContact(query.TheRay.Eval(cover.Lo), vec3.T{hitAxis[0], hitAxis[1], hitAxis[2]})
+	val.T = cover.Lo
+	val.R = query.TheRay
 	return val
 }
 
@@ -186,16 +243,51 @@ func (b *Box) RayExit(query ray.RaySegment) contact.Contact {
 		}
 	}
 
-	if !ray.SpanOverlaps(cover, query.TheSegment) {
+	if cover.Hi < query.TheSegment.Lo || query.TheSegment.Hi <= cover.Hi {
 		return contact.ContactNaN()
 	}
 
-	return contact.Contact{
-		T:    cover.Hi,
-		R:    query.TheRay,
-		P:    query.TheRay.Eval(cover.Hi),
-		N:    vec3.T{hitAxis[0], hitAxis[1], hitAxis[2]},
-		Mtl2: vec2.T{0, 0},
-		Mtl3: query.TheRay.Eval(cover.Hi),
+	val := b.surfaceContact(query.TheRay.Eval(cover.Hi), vec3.T{hitAxis[0], hitAxis[1], hitAxis[2]})
+	val.T = cover.Hi
+	val.R = query.TheRay
+	return val
+}
+
+func (b *Box) SampleSurface(rng *rand.Rand) (contact.Contact, float64) {
+	// Each axis contributes two faces, with the area of the span of the
+	// other two axes.
+	faceAreas := [3]float64{}
+	totalArea := 0.0
+	for i := 0; i < 3; i++ {
+		j := (i + 1) % 3
+		k := (i + 2) % 3
+		faceAreas[i] = (b.Spans[j].Hi - b.Spans[j].Lo) * (b.Spans[k].Hi - b.Spans[k].Lo)
+		totalArea += 2 * faceAreas[i]
+	}
+
+	axis := 2
+	sample := rng.Float64() * totalArea / 2
+	for i := 0; i < 3; i++ {
+		if sample < faceAreas[i] {
+			axis = i
+			break
+		}
+		sample -= faceAreas[i]
+	}
+
+	p := vec3.T{}
+	for i := 0; i < 3; i++ {
+		p[i] = b.Spans[i].Lo + rng.Float64()*(b.Spans[i].Hi-b.Spans[i].Lo)
 	}
+
+	n := vec3.T{}
+	if rng.Intn(2) == 0 {
+		p[axis] = b.Spans[axis].Lo
+		n[axis] = -1.0
+	} else {
+		p[axis] = b.Spans[axis].Hi
+		n[axis] = 1.0
+	}
+
+	return b.surfaceContact(p, n), totalArea
 }
@@ -0,0 +1,138 @@
+package geometry
+
+import (
+	"math"
+	"testing"
+
+	"row-major/harpoon/contact"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec2"
+	"row-major/harpoon/vmath/vec3"
+)
+
+func query(point, slope vec3.T) ray.RaySegment {
+	return ray.RaySegment{
+		TheRay:     ray.Ray{Point: point, Slope: vec3.Normalize(slope)},
+		TheSegment: ray.Span{Lo: 0, Hi: math.Inf(1)},
+	}
+}
+
+// checkContact checks that c is a hit at distance t, at point p, with normal n.
+func checkContact(t *testing.T, name string, c contact.Contact, wantT float64, wantP, wantN vec3.T) {
+	t.Helper()
+	if math.IsNaN(c.T) {
+		t.Errorf("%s: got no contact, want one at t=%v", name, wantT)
+		return
+	}
+	if math.Abs(c.T-wantT) > 1e-9 {
+		t.Errorf("%s: got t=%v, want %v", name, c.T, wantT)
+	}
+	if vec3.SubVV(c.P, wantP).Norm() > 1e-9 {
+		t.Errorf("%s: got point %v, want %v", name, c.P, wantP)
+	}
+	if vec3.SubVV(c.N, wantN).Norm() > 1e-9 {
+		t.Errorf("%s: got normal %v, want %v", name, c.N, wantN)
+	}
+
+	// The tangent frame has to be orthonormal, and agree with the normal.
+	if math.Abs(c.Tangent.Norm()-1) > 1e-9 || math.Abs(c.Bitangent.Norm()-1) > 1e-9 {
+		t.Errorf("%s: tangent %v and bitangent %v aren't unit vectors", name, c.Tangent, c.Bitangent)
+	}
+	if math.Abs(vec3.IProd(c.Tangent, c.N)) > 1e-9 || math.Abs(vec3.IProd(c.Bitangent, c.N)) > 1e-9 || math.Abs(vec3.IProd(c.Tangent, c.Bitangent)) > 1e-9 {
+		t.Errorf("%s: tangent %v, bitangent %v, and normal %v aren't orthogonal", name, c.Tangent, c.Bitangent, c.N)
+	}
+}
+
+func checkMiss(t *testing.T, name string, c contact.Contact) {
+	t.Helper()
+	if !math.IsNaN(c.T) {
+		t.Errorf("%s: got a contact at t=%v, want none", name, c.T)
+	}
+}
+
+func TestSphere(t *testing.T) {
+	s := &Sphere{TheMaterialCoordsMode: MaterialCoords2D}
+
+	outside := query(vec3.T{0, -3, 0}, vec3.T{0, 1, 0})
+	checkContact(t, "into from outside", s.RayInto(outside), 2, vec3.T{0, -1, 0}, vec3.T{0, -1, 0})
+	checkContact(t, "exit from outside", s.RayExit(outside), 4, vec3.T{0, 1, 0}, vec3.T{0, 1, 0})
+
+	// From inside, there's nothing to enter, but the ray leaves through the
+	// far side.
+	inside := query(vec3.T{0, 0, 0.5}, vec3.T{0, 0, 1})
+	checkMiss(t, "into from inside", s.RayInto(inside))
+	checkContact(t, "exit from inside", s.RayExit(inside), 0.5, vec3.T{0, 0, 1}, vec3.T{0, 0, 1})
+
+	// Off-center from inside, along a chord.
+	chord := query(vec3.T{0.6, 0, 0}, vec3.T{0, 1, 0})
+	checkContact(t, "exit along chord", s.RayExit(chord), 0.8, vec3.T{0.6, 0.8, 0}, vec3.T{0.6, 0.8, 0})
+
+	checkMiss(t, "miss", s.RayInto(query(vec3.T{0, -3, 1.5}, vec3.T{0, 1, 0})))
+
+	// The segment limits the hits that count.
+	short := outside
+	short.TheSegment.Hi = 1.5
+	checkMiss(t, "short segment", s.RayInto(short))
+	behind := query(vec3.T{0, 3, 0}, vec3.T{0, 1, 0})
+	checkMiss(t, "sphere behind the ray", s.RayInto(behind))
+	checkMiss(t, "sphere behind the ray (exit)", s.RayExit(behind))
+
+	// Azimuth is measured from +Y towards +X, and the polar angle from +Z.
+	c := s.RayExit(chord)
+	if want := (vec2.T{math.Atan2(0.6, 0.8), math.Pi / 2}); math.Abs(c.Mtl2[0]-want[0]) > 1e-9 || math.Abs(c.Mtl2[1]-want[1]) > 1e-9 {
+		t.Errorf("got material coordinates %v, want %v", c.Mtl2, want)
+	}
+}
+
+func TestBox(t *testing.T) {
+	b := &Box{Spans: [3]ray.Span{{Lo: -1, Hi: 1}, {Lo: -2, Hi: 2}, {Lo: 0, Hi: 1}}}
+
+	outside := query(vec3.T{-5, 0, 0.5}, vec3.T{1, 0, 0})
+	checkContact(t, "into from outside", b.RayInto(outside), 4, vec3.T{-1, 0, 0.5}, vec3.T{-1, 0, 0})
+	checkContact(t, "exit from outside", b.RayExit(outside), 6, vec3.T{1, 0, 0.5}, vec3.T{1, 0, 0})
+
+	inside := query(vec3.T{0, 0, 0.5}, vec3.T{0, 0, -1})
+	checkMiss(t, "into from inside", b.RayInto(inside))
+	checkContact(t, "exit from inside", b.RayExit(inside), 0.5, vec3.T{0, 0, 0}, vec3.T{0, 0, -1})
+
+	// Diagonally, through the edge-adjacent faces.
+	diagonal := query(vec3.T{0, -3, 3}, vec3.T{0, 1, -1})
+	checkContact(t, "into diagonally", b.RayInto(diagonal), 2*math.Sqrt2, vec3.T{0, -1, 1}, vec3.T{0, 0, 1})
+
+	checkMiss(t, "miss", b.RayInto(query(vec3.T{-5, 0, 2}, vec3.T{1, 0, 0})))
+
+	short := outside
+	short.TheSegment.Hi = 3
+	checkMiss(t, "short segment", b.RayInto(short))
+
+	// Material coordinates are distances from the low corner of the face.
+	c := b.RayInto(query(vec3.T{0.25, 0.5, 5}, vec3.T{0, 0, -1}))
+	if want := (vec2.T{1.25, 2.5}); c.Mtl2 != want {
+		t.Errorf("got material coordinates %v on the top face, want %v", c.Mtl2, want)
+	}
+}
+
+func TestTriangleMesh(t *testing.T) {
+	// A unit square in the XY plane, facing +Z, as two triangles.
+	m := &TriangleMesh{
+		Vertices:  []vec3.T{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}, {0, 1, 0}},
+		Triangles: [][3]int{{0, 1, 2}, {0, 2, 3}},
+		TexCoords: []vec2.T{{0, 0}, {2, 0}, {2, 2}, {0, 2}},
+	}
+
+	down := query(vec3.T{0.25, 0.75, 2}, vec3.T{0, 0, -1})
+	c := m.RayInto(down)
+	checkContact(t, "from above", c, 2, vec3.T{0.25, 0.75, 0}, vec3.T{0, 0, 1})
+	if want := (vec2.T{0.5, 1.5}); math.Abs(c.Mtl2[0]-want[0]) > 1e-9 || math.Abs(c.Mtl2[1]-want[1]) > 1e-9 {
+		t.Errorf("got texture coordinates %v, want %v", c.Mtl2, want)
+	}
+	if vec3.SubVV(c.Tangent, vec3.T{1, 0, 0}).Norm() > 1e-9 {
+		t.Errorf("got tangent %v, want +X (increasing u)", c.Tangent)
+	}
+
+	// The mesh is a surface, so it's hit from below as well.
+	checkContact(t, "from below", m.RayInto(query(vec3.T{0.5, 0.1, -1}, vec3.T{0, 0, 1})), 1, vec3.T{0.5, 0.1, 0}, vec3.T{0, 0, 1})
+
+	checkMiss(t, "miss", m.RayInto(query(vec3.T{1.5, 0.5, 1}, vec3.T{0, 0, -1})))
+	checkMiss(t, "exit", m.RayExit(down))
+}
@@ -0,0 +1,352 @@
+package geometry
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"row-major/harpoon/aabox"
+	"row-major/harpoon/contact"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec2"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// Heightfield is a Geometry made from a grid of elevations, like a terrain.
+//
+// Sample (i, j) is at X = i, Y = j, and Z = its elevation, so the grid covers
+// [0, Columns-1] by [0, Rows-1]; scale it into place with the element's
+// transform.  Each cell is split into two triangles, and shaded with normals
+// interpolated from the grid.  The 2D material coordinates run from 0 to 1
+// across the grid.
+//
+// Like a TriangleMesh, a heightfield is a surface rather than a solid, and
+// RayInto reports crossings from either side.  Normals always face +Z.
+//
+// Rays are traced through a min-max mipmap of the elevations: a quadtree
+// whose nodes bound the heights of the cells below them, so that a ray can
+// skip any stretch of terrain it passes over.
+type Heightfield struct {
+	Columns int
+	Rows    int
+
+	// Elevations[j*Columns+i] is the elevation of sample (i, j).
+	Elevations []float64
+
+	crushed bool
+
+	// levels[0] has an entry per cell, and each level above it merges 2x2
+	// blocks of the one below, up to a single root.
+	levels []heightfieldLevel
+}
+
+type heightfieldLevel struct {
+	columns int
+	rows    int
+	z       []ray.Span
+}
+
+// heightfieldSlack pads the bounds of each quadtree node, so that rays along
+// the grid lines don't fall between them.
+const heightfieldSlack = 1e-9
+
+// clampInt limits x to [lo, hi].
+func clampInt(x, lo, hi int) int {
+	if x < lo {
+		return lo
+	}
+	if x > hi {
+		return hi
+	}
+	return x
+}
+
+func (h *Heightfield) elevation(i, j int) float64 {
+	i = clampInt(i, 0, h.Columns-1)
+	j = clampInt(j, 0, h.Rows-1)
+	return h.Elevations[j*h.Columns+i]
+}
+
+func (h *Heightfield) GetAABox() aabox.AABox {
+	h.Crush(0)
+	if len(h.levels) == 0 {
+		return aabox.AABox{}
+	}
+	return h.nodeBounds(len(h.levels)-1, 0, 0)
+}
+
+// Crush builds the min-max mipmap.  The elevations don't change over time, so
+// this only happens once.
+func (h *Heightfield) Crush(time float64) {
+	if h.crushed {
+		return
+	}
+	h.crushed = true
+
+	h.levels = nil
+	if h.Columns < 2 || h.Rows < 2 || len(h.Elevations) != h.Columns*h.Rows {
+		return
+	}
+
+	base := heightfieldLevel{columns: h.Columns - 1, rows: h.Rows - 1}
+	for j := 0; j < base.rows; j++ {
+		for i := 0; i < base.columns; i++ {
+			a, b := h.elevation(i, j), h.elevation(i+1, j)
+			c, d := h.elevation(i, j+1), h.elevation(i+1, j+1)
+			base.z = append(base.z, ray.Span{
+				Lo: math.Min(math.Min(a, b), math.Min(c, d)),
+				Hi: math.Max(math.Max(a, b), math.Max(c, d)),
+			})
+		}
+	}
+	h.levels = append(h.levels, base)
+
+	for cur := base; cur.columns > 1 || cur.rows > 1; {
+		next := heightfieldLevel{columns: (cur.columns + 1) / 2, rows: (cur.rows + 1) / 2}
+		for j := 0; j < next.rows; j++ {
+			for i := 0; i < next.columns; i++ {
+				z := ray.Span{Lo: math.Inf(1), Hi: math.Inf(-1)}
+				for _, c := range [][2]int{{2 * i, 2 * j}, {2*i + 1, 2 * j}, {2 * i, 2*j + 1}, {2*i + 1, 2*j + 1}} {
+					if c[0] < cur.columns && c[1] < cur.rows {
+						z = ray.MinContainingSpan(z, cur.z[c[1]*cur.columns+c[0]])
+					}
+				}
+				next.z = append(next.z, z)
+			}
+		}
+		h.levels = append(h.levels, next)
+		cur = next
+	}
+}
+
+// nodeBounds is the box around node (i, j) of the given level of the
+// quadtree.
+func (h *Heightfield) nodeBounds(level, i, j int) aabox.AABox {
+	size := float64(int(1) << level)
+	lvl := &h.levels[level]
+	z := lvl.z[j*lvl.columns+i]
+	return aabox.AABox{
+		X: ray.Span{Lo: float64(i)*size - heightfieldSlack, Hi: math.Min(float64(i+1)*size, float64(h.Columns-1)) + heightfieldSlack},
+		Y: ray.Span{Lo: float64(j)*size - heightfieldSlack, Hi: math.Min(float64(j+1)*size, float64(h.Rows-1)) + heightfieldSlack},
+		Z: ray.Span{Lo: z.Lo - heightfieldSlack, Hi: z.Hi + heightfieldSlack},
+	}
+}
+
+// cellTriangles are the corners of the two triangles of each cell, as
+// offsets from its low corner.  Both wind counterclockwise seen from above.
+var cellTriangles = [2][3][2]int{
+	{{0, 0}, {1, 0}, {1, 1}},
+	{{0, 0}, {1, 1}, {0, 1}},
+}
+
+func (h *Heightfield) corner(i, j int) vec3.T {
+	return vec3.T{float64(i), float64(j), h.elevation(i, j)}
+}
+
+// normal is the shading normal at sample (i, j), from the slope of the grid
+// around it.
+func (h *Heightfield) normal(i, j int) vec3.T {
+	i0, i1 := clampInt(i-1, 0, h.Columns-1), clampInt(i+1, 0, h.Columns-1)
+	j0, j1 := clampInt(j-1, 0, h.Rows-1), clampInt(j+1, 0, h.Rows-1)
+	dzdx := (h.elevation(i1, j) - h.elevation(i0, j)) / float64(i1-i0)
+	dzdy := (h.elevation(i, j1) - h.elevation(i, j0)) / float64(j1-j0)
+	return vec3.Normalize(vec3.T{-dzdx, -dzdy, 1})
+}
+
+type heightfieldNode struct {
+	level, i, j int
+}
+
+func (h *Heightfield) RayInto(query ray.RaySegment) contact.Contact {
+	h.Crush(0)
+	if len(h.levels) == 0 {
+		return contact.ContactNaN()
+	}
+
+	best := math.Inf(1)
+	bestI, bestJ, bestTri := -1, -1, -1
+	var bestU, bestV float64
+
+	// Visit the children nearest the ray's origin first, so that the first
+	// hit prunes the rest.
+	stepI, stepJ := 0, 0
+	if query.TheRay.Slope[0] < 0 {
+		stepI = 1
+	}
+	if query.TheRay.Slope[1] < 0 {
+		stepJ = 1
+	}
+
+	segment := query
+	stack := []heightfieldNode{{level: len(h.levels) - 1}}
+	for len(stack) != 0 {
+		cur := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		cover := aabox.RayTestAABox(segment, h.nodeBounds(cur.level, cur.i, cur.j))
+		if cover.IsNaN() || !ray.SpanOverlaps(cover, segment.TheSegment) {
+			continue
+		}
+
+		if cur.level != 0 {
+			below := &h.levels[cur.level-1]
+			for k := 3; k >= 0; k-- {
+				ci := 2*cur.i + (k&1 ^ stepI)
+				cj := 2*cur.j + (k>>1 ^ stepJ)
+				if ci < below.columns && cj < below.rows {
+					stack = append(stack, heightfieldNode{level: cur.level - 1, i: ci, j: cj})
+				}
+			}
+			continue
+		}
+
+		for t, tri := range cellTriangles {
+			dist, u, v, ok := intersectTriangle(
+				query.TheRay,
+				h.corner(cur.i+tri[0][0], cur.j+tri[0][1]),
+				h.corner(cur.i+tri[1][0], cur.j+tri[1][1]),
+				h.corner(cur.i+tri[2][0], cur.j+tri[2][1]),
+			)
+			if !ok || dist < segment.TheSegment.Lo || dist >= segment.TheSegment.Hi {
+				continue
+			}
+			best, bestI, bestJ, bestTri, bestU, bestV = dist, cur.i, cur.j, t, u, v
+			segment.TheSegment.Hi = dist
+		}
+	}
+
+	if bestTri == -1 {
+		return contact.ContactNaN()
+	}
+
+	result := h.surfaceContact(query.TheRay.Eval(best), bestI, bestJ, bestTri, bestU, bestV)
+	result.T = best
+	result.R = query.TheRay
+	return result
+}
+
+// RayExit never reports anything.  A heightfield has no interior, so RayInto
+// already reports the ray leaving through the surface.
+func (h *Heightfield) RayExit(query ray.RaySegment) contact.Contact {
+	return contact.ContactNaN()
+}
+
+// surfaceContact fills in the contact at point p, which is at barycentric
+// coordinates (u, v) of triangle tri of cell (i, j).
+func (h *Heightfield) surfaceContact(p vec3.T, i, j, tri int, u, v float64) contact.Contact {
+	corners := cellTriangles[tri]
+	w := 1 - u - v
+	n := vec3.Normalize(vec3.AddVV(
+		vec3.MulVS(h.normal(i+corners[0][0], j+corners[0][1]), w),
+		vec3.AddVV(
+			vec3.MulVS(h.normal(i+corners[1][0], j+corners[1][1]), u),
+			vec3.MulVS(h.normal(i+corners[2][0], j+corners[2][1]), v),
+		),
+	))
+
+	tangent, bitangent := contact.TangentFrame(n, vec3.T{1, 0, 0}, vec3.T{0, 1, 0})
+	return contact.Contact{
+		P:         p,
+		N:         n,
+		Mtl2:      vec2.T{p[0] / float64(h.Columns-1), p[1] / float64(h.Rows-1)},
+		Mtl3:      p,
+		Tangent:   tangent,
+		Bitangent: bitangent,
+	}
+}
+
+// ReadHeightfieldImage reads a heightfield from a grayscale image, usually a
+// 16-bit PNG.  Black is elevation 0 and white is elevation 1.  The top row of
+// the image is the +Y edge of the heightfield, so it looks like the image
+// when seen from above.
+func ReadHeightfieldImage(r io.Reader) (*Heightfield, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("while decoding image: %w", err)
+	}
+
+	bounds := img.Bounds()
+	h := &Heightfield{
+		Columns:    bounds.Dx(),
+		Rows:       bounds.Dy(),
+		Elevations: make([]float64, bounds.Dx()*bounds.Dy()),
+	}
+	if h.Columns < 2 || h.Rows < 2 {
+		return nil, fmt.Errorf("image is %dx%d, but a heightfield needs at least 2x2 samples", h.Columns, h.Rows)
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		j := h.Rows - 1 - (y - bounds.Min.Y)
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gray := color.Gray16Model.Convert(img.At(x, y)).(color.Gray16)
+			h.Elevations[j*h.Columns+(x-bounds.Min.X)] = float64(gray.Y) / 0xffff
+		}
+	}
+
+	return h, nil
+}
+
+// ReadHeightfieldRaw reads a heightfield stored as little-endian float32
+// elevations, a row at a time, with the given number of columns.  As with
+// images, the first row is the +Y edge.
+func ReadHeightfieldRaw(r io.Reader, columns int) (*Heightfield, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file: %w", err)
+	}
+	if len(data)%4 != 0 {
+		return nil, fmt.Errorf("file is %d bytes, which isn't a whole number of float32s", len(data))
+	}
+
+	count := len(data) / 4
+	if columns <= 0 {
+		// Assume the grid is square, as terrain tools usually export it.
+		columns = int(math.Round(math.Sqrt(float64(count))))
+	}
+	if columns < 2 || count%columns != 0 || count/columns < 2 {
+		return nil, fmt.Errorf("%d elevations don't make a grid with %d columns", count, columns)
+	}
+
+	h := &Heightfield{
+		Columns:    columns,
+		Rows:       count / columns,
+		Elevations: make([]float64, count),
+	}
+	for k := 0; k < count; k++ {
+		row, col := k/columns, k%columns
+		j := h.Rows - 1 - row
+		h.Elevations[j*h.Columns+col] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[4*k:])))
+	}
+
+	return h, nil
+}
+
+// LoadHeightfieldFile loads a heightfield from a PNG, or from a raw float32
+// file (".r32", ".f32", or ".raw") with the given number of columns.  If
+// columns is zero, a raw file is assumed to be square.
+func LoadHeightfieldFile(path string, columns int) (*Heightfield, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("while opening file: %w", err)
+	}
+	defer f.Close()
+
+	var h *Heightfield
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".r32", ".f32", ".raw":
+		h, err = ReadHeightfieldRaw(f, columns)
+	default:
+		h, err = ReadHeightfieldImage(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s: %w", path, err)
+	}
+	return h, nil
+}
@@ -0,0 +1,163 @@
+package geometry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/rand"
+	"testing"
+
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec2"
+	"row-major/harpoon/vmath/vec3"
+)
+
+func TestHeightfieldRamp(t *testing.T) {
+	// A ramp rising half a unit per column.
+	h := &Heightfield{Columns: 5, Rows: 4, Elevations: make([]float64, 20)}
+	for j := 0; j < h.Rows; j++ {
+		for i := 0; i < h.Columns; i++ {
+			h.Elevations[j*h.Columns+i] = 0.5 * float64(i)
+		}
+	}
+
+	c := h.RayInto(query(vec3.T{2.3, 1.7, 10}, vec3.T{0, 0, -1}))
+	checkContact(t, "down onto the ramp", c, 10-1.15, vec3.T{2.3, 1.7, 1.15}, vec3.Normalize(vec3.T{-0.5, 0, 1}))
+	if want := (vec2.T{2.3 / 4, 1.7 / 3}); math.Abs(c.Mtl2[0]-want[0]) > 1e-9 || math.Abs(c.Mtl2[1]-want[1]) > 1e-9 {
+		t.Errorf("got material coordinates %v, want %v", c.Mtl2, want)
+	}
+
+	// Along a grid line, and from underneath.
+	checkContact(t, "along a grid line", h.RayInto(query(vec3.T{2, 1, 10}, vec3.T{0, 0, -1})), 9, vec3.T{2, 1, 1}, vec3.Normalize(vec3.T{-0.5, 0, 1}))
+	checkContact(t, "from below", h.RayInto(query(vec3.T{3, 2, -1}, vec3.T{0, 0, 1})), 2.5, vec3.T{3, 2, 1.5}, vec3.Normalize(vec3.T{-0.5, 0, 1}))
+
+	checkMiss(t, "off the edge", h.RayInto(query(vec3.T{4.5, 1, 10}, vec3.T{0, 0, -1})))
+	checkMiss(t, "over the top", h.RayInto(query(vec3.T{-1, 1, 2.5}, vec3.T{1, 0, 0})))
+	checkMiss(t, "exit", h.RayExit(query(vec3.T{2, 1, 10}, vec3.T{0, 0, -1})))
+}
+
+func TestHeightfieldMatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	h := &Heightfield{Columns: 37, Rows: 23}
+	for k := 0; k < h.Columns*h.Rows; k++ {
+		h.Elevations = append(h.Elevations, rng.Float64()*4)
+	}
+
+	for n := 0; n < 500; n++ {
+		q := query(
+			vec3.T{rng.Float64()*50 - 7, rng.Float64()*40 - 9, rng.Float64() * 8},
+			vec3.UniformUnitDistribution(rng),
+		)
+
+		want := math.Inf(1)
+		for j := 0; j < h.Rows-1; j++ {
+			for i := 0; i < h.Columns-1; i++ {
+				for _, tri := range cellTriangles {
+					dist, _, _, ok := intersectTriangle(
+						q.TheRay,
+						h.corner(i+tri[0][0], j+tri[0][1]),
+						h.corner(i+tri[1][0], j+tri[1][1]),
+						h.corner(i+tri[2][0], j+tri[2][1]),
+					)
+					if ok && dist >= 0 && dist < want {
+						want = dist
+					}
+				}
+			}
+		}
+
+		got := h.RayInto(q)
+		if math.IsInf(want, 1) {
+			checkMiss(t, "random ray", got)
+			continue
+		}
+		if math.Abs(got.T-want) > 1e-9 {
+			t.Errorf("ray %v: got t=%v, want %v", q.TheRay, got.T, want)
+		}
+	}
+}
+
+func TestReadHeightfieldImage(t *testing.T) {
+	img := image.NewGray16(image.Rect(0, 0, 3, 2))
+	img.SetGray16(0, 0, color.Gray16{Y: 0xffff})
+	img.SetGray16(2, 1, color.Gray16{Y: 0x8000})
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatalf("while encoding PNG: %v", err)
+	}
+
+	h, err := ReadHeightfieldImage(buf)
+	if err != nil {
+		t.Fatalf("ReadHeightfieldImage: %v", err)
+	}
+	if h.Columns != 3 || h.Rows != 2 {
+		t.Fatalf("got a %dx%d grid, want 3x2", h.Columns, h.Rows)
+	}
+
+	// The image's top row is the +Y edge.
+	if got := h.elevation(0, 1); got != 1 {
+		t.Errorf("top-left elevation is %v, want 1", got)
+	}
+	if got := h.elevation(2, 0); math.Abs(got-0.5) > 1e-4 {
+		t.Errorf("bottom-right elevation is %v, want 0.5", got)
+	}
+}
+
+func TestReadHeightfieldRaw(t *testing.T) {
+	buf := &bytes.Buffer{}
+	for k := 0; k < 9; k++ {
+		binary.Write(buf, binary.LittleEndian, float32(k))
+	}
+
+	h, err := ReadHeightfieldRaw(bytes.NewReader(buf.Bytes()), 0)
+	if err != nil {
+		t.Fatalf("ReadHeightfieldRaw: %v", err)
+	}
+	if h.Columns != 3 || h.Rows != 3 {
+		t.Fatalf("got a %dx%d grid, want 3x3", h.Columns, h.Rows)
+	}
+	if got := h.elevation(1, 2); got != 1 {
+		t.Errorf("elevation of the first row is %v, want 1", got)
+	}
+	if got := h.elevation(1, 0); got != 7 {
+		t.Errorf("elevation of the last row is %v, want 7", got)
+	}
+
+	if _, err := ReadHeightfieldRaw(bytes.NewReader(buf.Bytes()), 4); err == nil {
+		t.Errorf("ReadHeightfieldRaw accepted 9 elevations in rows of 4")
+	}
+
+	b := h.GetAABox()
+	if b.X.Lo > 0 || b.X.Hi < 2 || b.Z.Lo > 0 || b.Z.Hi < 8 {
+		t.Errorf("bounds %v don't cover the grid", b)
+	}
+}
+
+func BenchmarkHeightfieldRayInto(b *testing.B) {
+	h := &Heightfield{Columns: 1024, Rows: 1024}
+	for j := 0; j < h.Rows; j++ {
+		for i := 0; i < h.Columns; i++ {
+			x, y := float64(i)/64, float64(j)/64
+			h.Elevations = append(h.Elevations, 20*math.Sin(x)*math.Cos(y)+5*math.Sin(3*x+y))
+		}
+	}
+	h.Crush(0)
+
+	rng := rand.New(rand.NewSource(1))
+	queries := []ray.RaySegment{}
+	for n := 0; n < 1024; n++ {
+		// Low-angle views across the terrain, like a landscape camera's.
+		slope := vec3.T{rng.Float64() - 0.5, 1, -0.05 - 0.1*rng.Float64()}
+		queries = append(queries, query(vec3.T{512 + 256*(rng.Float64()-0.5), 0, 40}, slope))
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		h.RayInto(queries[n%len(queries)])
+	}
+}
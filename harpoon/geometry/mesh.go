@@ -0,0 +1,225 @@
+package geometry
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+
+	"row-major/harpoon/aabox"
+	"row-major/harpoon/contact"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec2"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// TriangleMesh is a Geometry made of triangles that share a vertex list.
+//
+// A mesh is a surface, not a solid, so it doesn't need to be closed.  Every
+// crossing of the surface is reported by RayInto, whether the ray is entering
+// or leaving.  Normals follow the winding of each triangle: counterclockwise
+// vertices face the viewer.
+type TriangleMesh struct {
+	Vertices  []vec3.T
+	Triangles [][3]int
+
+	// Optional per-vertex shading normals.  If empty, each triangle is flat
+	// shaded.
+	Normals []vec3.T
+
+	// Optional per-vertex texture coordinates, reported as the 2D material
+	// coordinates of a contact.  If empty, the barycentric coordinates of the
+	// contact within its triangle are reported instead.
+	TexCoords []vec2.T
+
+	crushed   bool
+	hierarchy bvh
+
+	// Running totals of triangle area, in the same order as Triangles, for
+	// SampleSurface.
+	cumulativeArea []float64
+}
+
+// meshLeafSize is the most triangles that will be placed in a leaf.
+const meshLeafSize = 4
+
+func (m *TriangleMesh) triangleBounds(t int) aabox.AABox {
+	b := aabox.AccumZeroAABox()
+	for _, v := range m.Triangles[t] {
+		p := m.Vertices[v]
+		b = aabox.MinContainingAABox(b, aabox.AABox{
+			X: ray.Span{Lo: p[0], Hi: p[0]},
+			Y: ray.Span{Lo: p[1], Hi: p[1]},
+			Z: ray.Span{Lo: p[2], Hi: p[2]},
+		})
+	}
+	return b
+}
+
+func (m *TriangleMesh) GetAABox() aabox.AABox {
+	m.Crush(0)
+	return m.hierarchy.bounds()
+}
+
+// Crush builds the mesh's bounding volume hierarchy.  The mesh doesn't change
+// over time, so this only happens once.
+func (m *TriangleMesh) Crush(time float64) {
+	if m.crushed {
+		return
+	}
+	m.crushed = true
+
+	m.hierarchy = buildBVH(len(m.Triangles), meshLeafSize, m.triangleBounds)
+
+	m.cumulativeArea = make([]float64, len(m.Triangles))
+	total := 0.0
+	for i, tri := range m.Triangles {
+		e1 := vec3.SubVV(m.Vertices[tri[1]], m.Vertices[tri[0]])
+		e2 := vec3.SubVV(m.Vertices[tri[2]], m.Vertices[tri[0]])
+		total += vec3.CProd(e1, e2).Norm() / 2
+		m.cumulativeArea[i] = total
+	}
+}
+
+// intersectTriangle is the Moller-Trumbore ray-triangle test.  It returns the
+// distance along the ray, and the barycentric coordinates of the hit relative
+// to the second and third vertices.
+func (m *TriangleMesh) intersectTriangle(r ray.Ray, t int) (dist, u, v float64, ok bool) {
+	tri := m.Triangles[t]
+	return intersectTriangle(r, m.Vertices[tri[0]], m.Vertices[tri[1]], m.Vertices[tri[2]])
+}
+
+func intersectTriangle(r ray.Ray, p0, p1, p2 vec3.T) (dist, u, v float64, ok bool) {
+	e1 := vec3.SubVV(p1, p0)
+	e2 := vec3.SubVV(p2, p0)
+
+	pvec := vec3.CProd(r.Slope, e2)
+	det := vec3.IProd(e1, pvec)
+	if det == 0.0 {
+		return 0, 0, 0, false
+	}
+	invDet := 1.0 / det
+
+	tvec := vec3.SubVV(r.Point, p0)
+	u = vec3.IProd(tvec, pvec) * invDet
+	if u < 0.0 || u > 1.0 {
+		return 0, 0, 0, false
+	}
+
+	qvec := vec3.CProd(tvec, e1)
+	v = vec3.IProd(r.Slope, qvec) * invDet
+	if v < 0.0 || u+v > 1.0 {
+		return 0, 0, 0, false
+	}
+
+	return vec3.IProd(e2, qvec) * invDet, u, v, true
+}
+
+// surfaceContact fills in the contact at barycentric coordinates (u, v) of
+// triangle t.
+func (m *TriangleMesh) surfaceContact(t int, u, v float64) contact.Contact {
+	tri := m.Triangles[t]
+	w := 1 - u - v
+
+	interp3 := func(a []vec3.T) vec3.T {
+		return vec3.AddVV(
+			vec3.MulVS(a[tri[0]], w),
+			vec3.AddVV(vec3.MulVS(a[tri[1]], u), vec3.MulVS(a[tri[2]], v)),
+		)
+	}
+
+	p := interp3(m.Vertices)
+
+	var n vec3.T
+	if len(m.Normals) != 0 {
+		n = vec3.Normalize(interp3(m.Normals))
+	} else {
+		e1 := vec3.SubVV(m.Vertices[tri[1]], m.Vertices[tri[0]])
+		e2 := vec3.SubVV(m.Vertices[tri[2]], m.Vertices[tri[0]])
+		n = vec3.Normalize(vec3.CProd(e1, e2))
+	}
+
+	// Without texture coordinates, the barycentric coordinates stand in.
+	t0, t1, t2 := vec2.T{0, 0}, vec2.T{1, 0}, vec2.T{0, 1}
+	if len(m.TexCoords) != 0 {
+		t0, t1, t2 = m.TexCoords[tri[0]], m.TexCoords[tri[1]], m.TexCoords[tri[2]]
+	}
+	mtl2 := vec2.T{
+		w*t0[0] + u*t1[0] + v*t2[0],
+		w*t0[1] + u*t1[1] + v*t2[1],
+	}
+
+	// Solve for the derivatives of position with respect to the material
+	// coordinates, which are constant over the triangle.
+	e1 := vec3.SubVV(m.Vertices[tri[1]], m.Vertices[tri[0]])
+	e2 := vec3.SubVV(m.Vertices[tri[2]], m.Vertices[tri[0]])
+	du1, dv1 := t1[0]-t0[0], t1[1]-t0[1]
+	du2, dv2 := t2[0]-t0[0], t2[1]-t0[1]
+	dPdu, dPdv := e1, e2
+	if det := du1*dv2 - du2*dv1; det != 0 {
+		dPdu = vec3.DivVS(vec3.SubVV(vec3.MulVS(e1, dv2), vec3.MulVS(e2, dv1)), det)
+		dPdv = vec3.DivVS(vec3.SubVV(vec3.MulVS(e2, du1), vec3.MulVS(e1, du2)), det)
+	}
+	tangent, bitangent := contact.TangentFrame(n, dPdu, dPdv)
+
+	return contact.Contact{
+		P:         p,
+		N:         n,
+		Mtl2:      mtl2,
+		Mtl3:      p,
+		Tangent:   tangent,
+		Bitangent: bitangent,
+	}
+}
+
+func (m *TriangleMesh) RayInto(query ray.RaySegment) contact.Contact {
+	m.Crush(0)
+
+	best := math.Inf(1)
+	bestTri := -1
+	var bestU, bestV float64
+
+	m.hierarchy.traverse(query, func(t int, segment *ray.RaySegment) {
+		dist, u, v, ok := m.intersectTriangle(query.TheRay, t)
+		if !ok || dist < segment.TheSegment.Lo || dist >= segment.TheSegment.Hi {
+			return
+		}
+		best, bestTri, bestU, bestV = dist, t, u, v
+		segment.TheSegment.Hi = dist
+	})
+
+	if bestTri == -1 {
+		return contact.ContactNaN()
+	}
+
+	result := m.surfaceContact(bestTri, bestU, bestV)
+	result.T = best
+	result.R = query.TheRay
+	result.P = query.TheRay.Eval(best)
+	return result
+}
+
+// RayExit never reports anything.  A mesh has no interior, so RayInto already
+// reports the ray leaving through the surface.
+func (m *TriangleMesh) RayExit(query ray.RaySegment) contact.Contact {
+	return contact.ContactNaN()
+}
+
+func (m *TriangleMesh) SampleSurface(rng *rand.Rand) (contact.Contact, float64) {
+	m.Crush(0)
+	if len(m.cumulativeArea) == 0 {
+		return contact.ContactNaN(), 0.0
+	}
+
+	total := m.cumulativeArea[len(m.cumulativeArea)-1]
+	t := sort.SearchFloat64s(m.cumulativeArea, rng.Float64()*total)
+	if t >= len(m.Triangles) {
+		t = len(m.Triangles) - 1
+	}
+
+	u, v := rng.Float64(), rng.Float64()
+	if u+v > 1.0 {
+		u, v = 1-u, 1-v
+	}
+
+	return m.surfaceContact(t, u, v), total
+}
@@ -0,0 +1,577 @@
+package geometry
+
+import (
+	"math"
+
+	"row-major/harpoon/aabox"
+	"row-major/harpoon/contact"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec2"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// SDFNode is a node of a signed distance field expression tree.
+type SDFNode interface {
+	// Distance estimates the distance from p to the surface.  It's negative
+	// inside the solid.
+	//
+	// The estimate may be off, as long as it changes no faster than
+	// Lipschitz() times the distance moved; the marcher divides by that
+	// bound to stay safe.
+	Distance(p vec3.T) float64
+
+	// Lipschitz bounds how fast Distance changes.  It's 1 for an exact
+	// distance field.
+	Lipschitz() float64
+
+	// Bounds contains the whole solid.
+	Bounds() aabox.AABox
+}
+
+// SDF is a Geometry whose solid is where an SDFNode is negative.  Rays are
+// intersected by sphere tracing: stepping along the ray by the distance to the
+// surface, which can't overshoot it.
+//
+// The 3D material coordinates are the contact point.  The 2D material
+// coordinates are the contact's X and Y, projecting textures down the Z axis.
+type SDF struct {
+	Root SDFNode
+
+	// A contact is reported when the ray gets within Epsilon of the surface.
+	// If zero, 1e-6 of the size of the bounding box is used.
+	Epsilon float64
+
+	// A ray that hasn't found the surface after MaxSteps steps is taken to
+	// miss.  If zero, 1024 is used.
+	MaxSteps int
+
+	crushed   bool
+	bounds    aabox.AABox
+	lipschitz float64
+	epsilon   float64
+	maxSteps  int
+}
+
+func (s *SDF) GetAABox() aabox.AABox {
+	s.Crush(0)
+	return s.bounds
+}
+
+func (s *SDF) Crush(time float64) {
+	if s.crushed {
+		return
+	}
+
+	s.bounds = s.Root.Bounds()
+	s.lipschitz = math.Max(1, s.Root.Lipschitz())
+
+	s.epsilon = s.Epsilon
+	if s.epsilon == 0 {
+		diagonal := vec3.T{
+			s.bounds.X.Hi - s.bounds.X.Lo,
+			s.bounds.Y.Hi - s.bounds.Y.Lo,
+			s.bounds.Z.Hi - s.bounds.Z.Lo,
+		}
+		s.epsilon = 1e-6 * diagonal.Norm()
+	}
+
+	s.maxSteps = s.MaxSteps
+	if s.maxSteps == 0 {
+		s.maxSteps = 1024
+	}
+
+	s.crushed = true
+}
+
+// gradient is the normalized gradient of the field at p, found by sampling
+// the corners of a small tetrahedron around it.
+func (s *SDF) gradient(p vec3.T) vec3.T {
+	h := s.epsilon
+	result := vec3.T{}
+	for _, k := range []vec3.T{{1, -1, -1}, {-1, -1, 1}, {-1, 1, -1}, {1, 1, 1}} {
+		d := s.Root.Distance(vec3.AddVV(p, vec3.MulVS(k, h)))
+		result = vec3.AddVV(result, vec3.MulVS(k, d))
+	}
+	return vec3.Normalize(result)
+}
+
+func (s *SDF) surfaceContact(query ray.RaySegment, t float64, entering bool) contact.Contact {
+	p := query.TheRay.Eval(t)
+
+	n := s.gradient(p)
+	if math.IsNaN(n[0]) {
+		// The field is flat here, which happens inside fractals whose
+		// estimate is zero throughout.  Face the ray instead.
+		n = vec3.Normalize(query.TheRay.Slope)
+		if entering {
+			n = vec3.MulVS(n, -1)
+		}
+	}
+
+	result := contact.Contact{
+		T:    t,
+		R:    query.TheRay,
+		P:    p,
+		N:    n,
+		Mtl2: vec2.T{p[0], p[1]},
+		Mtl3: p,
+	}
+	result.Tangent, result.Bitangent = contact.TangentFrame(n, vec3.T{1, 0, 0}, vec3.T{0, 1, 0})
+	return result
+}
+
+// march finds the first place along the query where the ray crosses the
+// surface going into the solid (entering is true) or out of it (entering is
+// false).
+//
+// A crossing only counts if the ray is heading towards the far side of the
+// surface.  That keeps a ray leaving a surface from hitting the surface it
+// just left: it creeps away instead.
+func (s *SDF) march(query ray.RaySegment, entering bool) contact.Contact {
+	s.Crush(0)
+
+	cover := aabox.RayTestAABox(query, s.bounds)
+	if cover.IsNaN() || !ray.SpanOverlaps(cover, query.TheSegment) {
+		return contact.ContactNaN()
+	}
+	lo := math.Max(cover.Lo, query.TheSegment.Lo)
+
+	// field is the distance from the surface, signed so that the marcher is
+	// looking for it to go negative.
+	field := func(t float64) float64 {
+		d := s.Root.Distance(query.TheRay.Eval(t))
+		if !entering {
+			return -d
+		}
+		return d
+	}
+
+	// Distances are measured in model space, but the ray's slope needn't be a
+	// unit vector.
+	speed := query.TheRay.Slope.Norm() * s.lipschitz
+	minStep := s.epsilon / speed
+
+	// The surface can touch the bounds, so don't stop marching right at
+	// them.
+	hi := math.Min(cover.Hi+minStep, query.TheSegment.Hi)
+
+	t := lo
+	d := field(t)
+	if entering && d < -s.epsilon {
+		// The ray starts inside the solid, so it has to leave before it can
+		// enter.
+		return contact.ContactNaN()
+	}
+
+	// Look just behind the start to tell which way the ray is going.
+	prevT := t - minStep
+	prevD := field(prevT)
+
+	for step := 0; step < s.maxSteps; step++ {
+		if d < s.epsilon && d < prevD {
+			if d < 0 && 0 < prevD {
+				// The step overshot, which only happens when the estimate
+				// isn't as conservative as it claims.  Back up to the
+				// surface.
+				for i := 0; i < 32; i++ {
+					mid := (prevT + t) / 2
+					if field(mid) > 0 {
+						prevT = mid
+					} else {
+						t = mid
+					}
+				}
+				t = prevT
+			}
+			if t < query.TheSegment.Lo || query.TheSegment.Hi <= t {
+				return contact.ContactNaN()
+			}
+			return s.surfaceContact(query, t, entering)
+		}
+
+		prevT, prevD = t, d
+		t += math.Max(math.Abs(d)/speed, minStep)
+		if hi < t {
+			break
+		}
+		d = field(t)
+	}
+
+	return contact.ContactNaN()
+}
+
+func (s *SDF) RayInto(query ray.RaySegment) contact.Contact {
+	return s.march(query, true)
+}
+
+func (s *SDF) RayExit(query ray.RaySegment) contact.Contact {
+	return s.march(query, false)
+}
+
+// SDFSphere is a sphere of the given radius, centered on the origin.
+type SDFSphere struct {
+	Radius float64
+}
+
+func (n *SDFSphere) Distance(p vec3.T) float64 {
+	return p.Norm() - n.Radius
+}
+
+func (n *SDFSphere) Lipschitz() float64 {
+	return 1
+}
+
+func (n *SDFSphere) Bounds() aabox.AABox {
+	return symmetricAABox(vec3.T{n.Radius, n.Radius, n.Radius})
+}
+
+// SDFBox is a box centered on the origin, with its edges rounded off by
+// Rounding.  HalfExtents includes the rounding.
+type SDFBox struct {
+	HalfExtents vec3.T
+	Rounding    float64
+}
+
+func (n *SDFBox) Distance(p vec3.T) float64 {
+	outside := 0.0
+	inside := math.Inf(-1)
+	for i := 0; i < 3; i++ {
+		q := math.Abs(p[i]) - (n.HalfExtents[i] - n.Rounding)
+		outside += math.Pow(math.Max(q, 0), 2)
+		inside = math.Max(inside, q)
+	}
+	return math.Sqrt(outside) + math.Min(inside, 0) - n.Rounding
+}
+
+func (n *SDFBox) Lipschitz() float64 {
+	return 1
+}
+
+func (n *SDFBox) Bounds() aabox.AABox {
+	return symmetricAABox(n.HalfExtents)
+}
+
+// SDFTorus is a torus around the Z axis.  Major is the radius of the ring,
+// and Minor is the radius of the tube.
+type SDFTorus struct {
+	Major float64
+	Minor float64
+}
+
+func (n *SDFTorus) Distance(p vec3.T) float64 {
+	ring := math.Hypot(p[0], p[1]) - n.Major
+	return math.Hypot(ring, p[2]) - n.Minor
+}
+
+func (n *SDFTorus) Lipschitz() float64 {
+	return 1
+}
+
+func (n *SDFTorus) Bounds() aabox.AABox {
+	r := n.Major + n.Minor
+	return symmetricAABox(vec3.T{r, r, n.Minor})
+}
+
+// SDFMandelbulb is the Mandelbulb fractal of the given power (8 is the
+// classic one), centered on the origin.
+//
+// Its distance estimate is only meaningful outside the fractal, so rays
+// should only be expected to hit it from outside; it suits opaque materials.
+type SDFMandelbulb struct {
+	Power      float64
+	Iterations int
+}
+
+func (n *SDFMandelbulb) Distance(p vec3.T) float64 {
+	z := p
+	dr := 1.0
+	r := z.Norm()
+	for i := 0; i < n.Iterations && 0 < r && r <= 2; i++ {
+		theta := math.Acos(math.Max(-1, math.Min(1, z[2]/r))) * n.Power
+		phi := math.Atan2(z[1], z[0]) * n.Power
+		dr = math.Pow(r, n.Power-1)*n.Power*dr + 1
+		zr := math.Pow(r, n.Power)
+		z = vec3.AddVV(vec3.MulVS(vec3.T{
+			math.Sin(theta) * math.Cos(phi),
+			math.Sin(theta) * math.Sin(phi),
+			math.Cos(theta),
+		}, zr), p)
+		r = z.Norm()
+	}
+	if r <= 2 {
+		// The orbit stayed bounded, so p is in the set.
+		return 0
+	}
+	return 0.5 * math.Log(r) * r / dr
+}
+
+func (n *SDFMandelbulb) Lipschitz() float64 {
+	return 1
+}
+
+func (n *SDFMandelbulb) Bounds() aabox.AABox {
+	// Any orbit that gets further than 2 from the origin escapes, so the set
+	// fits inside that sphere.
+	return symmetricAABox(vec3.T{2, 2, 2})
+}
+
+// SDFUnion is the union of its children.
+type SDFUnion struct {
+	Children []SDFNode
+}
+
+func (n *SDFUnion) Distance(p vec3.T) float64 {
+	result := math.Inf(1)
+	for _, c := range n.Children {
+		result = math.Min(result, c.Distance(p))
+	}
+	return result
+}
+
+func (n *SDFUnion) Lipschitz() float64 {
+	return maxLipschitz(n.Children)
+}
+
+func (n *SDFUnion) Bounds() aabox.AABox {
+	result := aabox.AccumZeroAABox()
+	for _, c := range n.Children {
+		result = aabox.MinContainingAABox(result, c.Bounds())
+	}
+	return result
+}
+
+// SDFSmoothUnion is the union of its children, blended together where they
+// come within K of each other.
+type SDFSmoothUnion struct {
+	Children []SDFNode
+	K        float64
+}
+
+// smoothMin is the polynomial smooth minimum, which is never more than k/4
+// below the true minimum.
+func smoothMin(a, b, k float64) float64 {
+	h := math.Max(k-math.Abs(a-b), 0) / k
+	return math.Min(a, b) - h*h*k/4
+}
+
+func (n *SDFSmoothUnion) Distance(p vec3.T) float64 {
+	result := math.Inf(1)
+	for i, c := range n.Children {
+		d := c.Distance(p)
+		if i == 0 || n.K <= 0 {
+			result = math.Min(result, d)
+		} else {
+			result = smoothMin(result, d, n.K)
+		}
+	}
+	return result
+}
+
+func (n *SDFSmoothUnion) Lipschitz() float64 {
+	return maxLipschitz(n.Children)
+}
+
+func (n *SDFSmoothUnion) Bounds() aabox.AABox {
+	result := aabox.AccumZeroAABox()
+	for _, c := range n.Children {
+		result = aabox.MinContainingAABox(result, c.Bounds())
+	}
+
+	// Each blend can pull the surface out by up to K/4.
+	grow := math.Max(n.K, 0) / 4 * float64(len(n.Children)-1)
+	return growAABox(result, grow)
+}
+
+// SDFIntersection is the intersection of its children.
+type SDFIntersection struct {
+	Children []SDFNode
+}
+
+func (n *SDFIntersection) Distance(p vec3.T) float64 {
+	result := math.Inf(-1)
+	for _, c := range n.Children {
+		result = math.Max(result, c.Distance(p))
+	}
+	return result
+}
+
+func (n *SDFIntersection) Lipschitz() float64 {
+	return maxLipschitz(n.Children)
+}
+
+func (n *SDFIntersection) Bounds() aabox.AABox {
+	result := n.Children[0].Bounds()
+	for _, c := range n.Children[1:] {
+		b := c.Bounds()
+		result = aabox.AABox{
+			X: ray.Span{Lo: math.Max(result.X.Lo, b.X.Lo), Hi: math.Min(result.X.Hi, b.X.Hi)},
+			Y: ray.Span{Lo: math.Max(result.Y.Lo, b.Y.Lo), Hi: math.Min(result.Y.Hi, b.Y.Hi)},
+			Z: ray.Span{Lo: math.Max(result.Z.Lo, b.Z.Lo), Hi: math.Min(result.Z.Hi, b.Z.Hi)},
+		}
+	}
+	return result
+}
+
+// SDFSubtraction is A with B carved out of it.
+type SDFSubtraction struct {
+	A SDFNode
+	B SDFNode
+}
+
+func (n *SDFSubtraction) Distance(p vec3.T) float64 {
+	return math.Max(n.A.Distance(p), -n.B.Distance(p))
+}
+
+func (n *SDFSubtraction) Lipschitz() float64 {
+	return math.Max(n.A.Lipschitz(), n.B.Lipschitz())
+}
+
+func (n *SDFSubtraction) Bounds() aabox.AABox {
+	return n.A.Bounds()
+}
+
+// SDFTranslate moves its child by Offset.
+type SDFTranslate struct {
+	Offset vec3.T
+	Child  SDFNode
+}
+
+func (n *SDFTranslate) Distance(p vec3.T) float64 {
+	return n.Child.Distance(vec3.SubVV(p, n.Offset))
+}
+
+func (n *SDFTranslate) Lipschitz() float64 {
+	return n.Child.Lipschitz()
+}
+
+func (n *SDFTranslate) Bounds() aabox.AABox {
+	b := n.Child.Bounds()
+	return aabox.AABox{
+		X: ray.Span{Lo: b.X.Lo + n.Offset[0], Hi: b.X.Hi + n.Offset[0]},
+		Y: ray.Span{Lo: b.Y.Lo + n.Offset[1], Hi: b.Y.Hi + n.Offset[1]},
+		Z: ray.Span{Lo: b.Z.Lo + n.Offset[2], Hi: b.Z.Hi + n.Offset[2]},
+	}
+}
+
+// SDFScale scales its child uniformly by Factor about the origin.
+type SDFScale struct {
+	Factor float64
+	Child  SDFNode
+}
+
+func (n *SDFScale) Distance(p vec3.T) float64 {
+	return n.Child.Distance(vec3.DivVS(p, n.Factor)) * n.Factor
+}
+
+func (n *SDFScale) Lipschitz() float64 {
+	return n.Child.Lipschitz()
+}
+
+func (n *SDFScale) Bounds() aabox.AABox {
+	b := n.Child.Bounds()
+	return aabox.AABox{
+		X: ray.Span{Lo: b.X.Lo * n.Factor, Hi: b.X.Hi * n.Factor},
+		Y: ray.Span{Lo: b.Y.Lo * n.Factor, Hi: b.Y.Hi * n.Factor},
+		Z: ray.Span{Lo: b.Z.Lo * n.Factor, Hi: b.Z.Hi * n.Factor},
+	}
+}
+
+// SDFTwist twists its child around the Z axis, by Rate radians per unit of
+// height.
+//
+// Twisting stretches the field, more so far from the axis, so twisted shapes
+// take smaller steps to trace.
+type SDFTwist struct {
+	Rate  float64
+	Child SDFNode
+}
+
+func (n *SDFTwist) Distance(p vec3.T) float64 {
+	angle := -n.Rate * p[2]
+	c, s := math.Cos(angle), math.Sin(angle)
+	return n.Child.Distance(vec3.T{c*p[0] - s*p[1], s*p[0] + c*p[1], p[2]})
+}
+
+func (n *SDFTwist) radius() float64 {
+	b := n.Child.Bounds()
+	x := math.Max(math.Abs(b.X.Lo), math.Abs(b.X.Hi))
+	y := math.Max(math.Abs(b.Y.Lo), math.Abs(b.Y.Hi))
+	return math.Hypot(x, y)
+}
+
+func (n *SDFTwist) Lipschitz() float64 {
+	return n.Child.Lipschitz() * (1 + math.Abs(n.Rate)*n.radius())
+}
+
+func (n *SDFTwist) Bounds() aabox.AABox {
+	r := n.radius()
+	b := n.Child.Bounds()
+	return aabox.AABox{
+		X: ray.Span{Lo: -r, Hi: r},
+		Y: ray.Span{Lo: -r, Hi: r},
+		Z: b.Z,
+	}
+}
+
+// SDFRepeat tiles copies of its child along each axis, Period apart, with
+// Count copies on either side of the original.  Axes with a zero Period
+// aren't repeated.
+//
+// The child should fit inside the cell around the origin, or the field will
+// miss the parts that spill into neighbouring cells.
+type SDFRepeat struct {
+	Period vec3.T
+	Count  [3]int
+	Child  SDFNode
+}
+
+func (n *SDFRepeat) Distance(p vec3.T) float64 {
+	q := p
+	for i := 0; i < 3; i++ {
+		if n.Period[i] == 0 {
+			continue
+		}
+		cell := math.Round(p[i] / n.Period[i])
+		cell = math.Max(-float64(n.Count[i]), math.Min(float64(n.Count[i]), cell))
+		q[i] = p[i] - n.Period[i]*cell
+	}
+	return n.Child.Distance(q)
+}
+
+func (n *SDFRepeat) Lipschitz() float64 {
+	return n.Child.Lipschitz()
+}
+
+func (n *SDFRepeat) Bounds() aabox.AABox {
+	b := n.Child.Bounds()
+	spans := [3]ray.Span{b.X, b.Y, b.Z}
+	for i := 0; i < 3; i++ {
+		reach := math.Abs(n.Period[i]) * float64(n.Count[i])
+		spans[i] = ray.Span{Lo: spans[i].Lo - reach, Hi: spans[i].Hi + reach}
+	}
+	return aabox.AABox{X: spans[0], Y: spans[1], Z: spans[2]}
+}
+
+func symmetricAABox(halfExtents vec3.T) aabox.AABox {
+	return aabox.AABox{
+		X: ray.Span{Lo: -halfExtents[0], Hi: halfExtents[0]},
+		Y: ray.Span{Lo: -halfExtents[1], Hi: halfExtents[1]},
+		Z: ray.Span{Lo: -halfExtents[2], Hi: halfExtents[2]},
+	}
+}
+
+func growAABox(b aabox.AABox, by float64) aabox.AABox {
+	return aabox.AABox{
+		X: ray.Span{Lo: b.X.Lo - by, Hi: b.X.Hi + by},
+		Y: ray.Span{Lo: b.Y.Lo - by, Hi: b.Y.Hi + by},
+		Z: ray.Span{Lo: b.Z.Lo - by, Hi: b.Z.Hi + by},
+	}
+}
+
+func maxLipschitz(children []SDFNode) float64 {
+	result := 1.0
+	for _, c := range children {
+		result = math.Max(result, c.Lipschitz())
+	}
+	return result
+}
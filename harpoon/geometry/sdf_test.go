@@ -0,0 +1,155 @@
+package geometry
+
+import (
+	"math"
+	"testing"
+
+	"row-major/harpoon/contact"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// checkNear checks that c is a hit close to point p with normal n.  Sphere
+// tracing stops short of the surface, so it can't be held to the analytic
+// geometries' precision.
+func checkNear(t *testing.T, name string, c contact.Contact, wantP, wantN vec3.T) {
+	t.Helper()
+	if math.IsNaN(c.T) {
+		t.Errorf("%s: got no contact, want one at %v", name, wantP)
+		return
+	}
+	if vec3.SubVV(c.P, wantP).Norm() > 1e-4 {
+		t.Errorf("%s: got point %v, want %v", name, c.P, wantP)
+	}
+	if vec3.SubVV(c.N, wantN).Norm() > 1e-3 {
+		t.Errorf("%s: got normal %v, want %v", name, c.N, wantN)
+	}
+}
+
+func TestSDFMatchesSphere(t *testing.T) {
+	sdf := &SDF{Root: &SDFSphere{Radius: 1}}
+	sphere := &Sphere{}
+
+	for _, q := range []struct {
+		name         string
+		point, slope vec3.T
+	}{
+		{"head-on", vec3.T{0, -3, 0}, vec3.T{0, 1, 0}},
+		{"oblique", vec3.T{2, -3, 1}, vec3.T{-2, 3, -0.5}},
+		{"from inside", vec3.T{0.2, 0.1, 0}, vec3.T{1, 1, 1}},
+		{"off-center", vec3.T{0.6, -5, 0}, vec3.T{0, 1, 0}},
+	} {
+		qq := query(q.point, q.slope)
+		for _, into := range []bool{true, false} {
+			want, got := sphere.RayInto(qq), sdf.RayInto(qq)
+			name := q.name + " (into)"
+			if !into {
+				want, got = sphere.RayExit(qq), sdf.RayExit(qq)
+				name = q.name + " (exit)"
+			}
+			if math.IsNaN(want.T) {
+				checkMiss(t, name, got)
+				continue
+			}
+			checkNear(t, name, got, want.P, want.N)
+		}
+	}
+
+	checkMiss(t, "miss", sdf.RayInto(query(vec3.T{0, -3, 1.5}, vec3.T{0, 1, 0})))
+}
+
+func TestSDFScaledRay(t *testing.T) {
+	// An element's transform can leave the model-space slope at any length.
+	sdf := &SDF{Root: &SDFSphere{Radius: 1}}
+	q := query(vec3.T{0, -3, 0}, vec3.T{0, 1, 0})
+	q.TheRay.Slope = vec3.T{0, 4, 0}
+	c := sdf.RayInto(q)
+	checkNear(t, "scaled slope", c, vec3.T{0, -1, 0}, vec3.T{0, -1, 0})
+	if math.Abs(c.T-0.5) > 1e-4 {
+		t.Errorf("got t=%v, want 0.5", c.T)
+	}
+}
+
+func TestSDFTorusHole(t *testing.T) {
+	sdf := &SDF{Root: &SDFTorus{Major: 1, Minor: 0.25}}
+
+	// Straight down the hole.
+	checkMiss(t, "through the hole", sdf.RayInto(query(vec3.T{0, 0, 3}, vec3.T{0, 0, -1})))
+
+	// Across the hole, the ray leaves the near side of the ring and enters the
+	// far side.
+	across := query(vec3.T{-3, 0, 0}, vec3.T{1, 0, 0})
+	checkNear(t, "near side", sdf.RayInto(across), vec3.T{-1.25, 0, 0}, vec3.T{-1, 0, 0})
+
+	inRing := query(vec3.T{-1, 0, 0}, vec3.T{1, 0, 0})
+	checkMiss(t, "into from inside the ring", sdf.RayInto(inRing))
+	exit := sdf.RayExit(inRing)
+	checkNear(t, "exit from inside the ring", exit, vec3.T{-0.75, 0, 0}, vec3.T{1, 0, 0})
+
+	// A ray leaving the surface it just exited doesn't hit it again, and finds
+	// the far side of the ring.
+	onward := query(exit.P, vec3.T{1, 0, 0})
+	checkNear(t, "far side", sdf.RayInto(onward), vec3.T{0.75, 0, 0}, vec3.T{-1, 0, 0})
+}
+
+func TestSDFSmoothUnion(t *testing.T) {
+	a := &SDFTranslate{Offset: vec3.T{-0.6, 0, 0}, Child: &SDFSphere{Radius: 0.5}}
+	b := &SDFTranslate{Offset: vec3.T{0.6, 0, 0}, Child: &SDFSphere{Radius: 0.5}}
+
+	// The spheres don't touch, so a ray between them misses the plain union,
+	// but the smooth union fills the gap.
+	gap := query(vec3.T{0, 0, 3}, vec3.T{0, 0, -1})
+	checkMiss(t, "union", (&SDF{Root: &SDFUnion{Children: []SDFNode{a, b}}}).RayInto(gap))
+
+	smooth := &SDF{Root: &SDFSmoothUnion{Children: []SDFNode{a, b}, K: 0.5}}
+	c := smooth.RayInto(gap)
+	if math.IsNaN(c.T) {
+		t.Fatalf("smooth union: got no contact between the spheres")
+	}
+	if c.N[2] < 0.999 {
+		t.Errorf("smooth union: got normal %v, want +Z by symmetry", c.N)
+	}
+	if b := smooth.GetAABox(); c.P[2] > b.Z.Hi {
+		t.Errorf("smooth union: contact %v is outside the bounds %v", c.P, b)
+	}
+}
+
+func TestSDFTwistAndRepeat(t *testing.T) {
+	// A slab lying along X, twisted half a turn per unit of height.  At the
+	// bottom it still lies along X; near the top it has turned almost onto Y.
+	twisted := &SDF{Root: &SDFTwist{
+		Rate:  math.Pi,
+		Child: &SDFBox{HalfExtents: vec3.T{1, 0.1, 0.5}},
+	}}
+	checkNear(t, "twist, middle", twisted.RayInto(query(vec3.T{0, -2, 0}, vec3.T{0, 1, 0})), vec3.T{0, -0.1, 0}, vec3.T{0, -1, 0})
+	checkMiss(t, "twist, top across Y", twisted.RayInto(query(vec3.T{0.8, -2, 0.45}, vec3.T{0, 1, 0})))
+
+	theta := math.Pi * 0.45
+	wantX := (math.Cos(theta)*0.8 - 0.1) / math.Sin(theta)
+	c := twisted.RayInto(query(vec3.T{-2, 0.8, 0.45}, vec3.T{1, 0, 0}))
+	if math.IsNaN(c.T) || math.Abs(c.P[0]-wantX) > 1e-4 {
+		t.Errorf("twist, top across X: got contact at %v, want x=%v", c.P, wantX)
+	}
+
+	// Three copies along X, and nothing beyond them.
+	row := &SDF{Root: &SDFRepeat{
+		Period: vec3.T{2, 0, 0},
+		Count:  [3]int{1, 0, 0},
+		Child:  &SDFSphere{Radius: 0.5},
+	}}
+	for _, x := range []float64{-2, 0, 2} {
+		checkNear(t, "repeat copy", row.RayInto(query(vec3.T{x, 0, 3}, vec3.T{0, 0, -1})), vec3.T{x, 0, 0.5}, vec3.T{0, 0, 1})
+	}
+	checkMiss(t, "beyond the last copy", row.RayInto(query(vec3.T{4, 0, 3}, vec3.T{0, 0, -1})))
+}
+
+func TestSDFMandelbulb(t *testing.T) {
+	bulb := &SDF{Root: &SDFMandelbulb{Power: 8, Iterations: 16}}
+
+	// Along the Z axis, the iteration is just z^8 + c, which stays bounded
+	// for c up to 7/8 * 8^(-1/7), or about 0.65.
+	c := bulb.RayInto(query(vec3.T{0, 0, 3}, vec3.T{0, 0, -1}))
+	if math.IsNaN(c.T) || math.Abs(c.P[2]-0.65) > 0.01 {
+		t.Errorf("got contact at %v, want one near the top of the bulb", c.P)
+	}
+	checkMiss(t, "miss", bulb.RayInto(query(vec3.T{0, -3, 1.8}, vec3.T{0, 1, 0})))
+}
@@ -0,0 +1,449 @@
+// Package gltf imports glTF 2.0 scenes (.gltf and .glb files) into harpoon.
+package gltf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The subset of the glTF 2.0 schema that the importer reads.  Anything else in
+// the file is ignored (and reported, where it matters).
+
+type document struct {
+	Asset struct {
+		Version string `json:"version"`
+	} `json:"asset"`
+
+	ExtensionsRequired []string `json:"extensionsRequired"`
+
+	Scene  *int       `json:"scene"`
+	Scenes []sceneDef `json:"scenes"`
+	Nodes  []node     `json:"nodes"`
+	Meshes []mesh     `json:"meshes"`
+
+	Materials []materialDef `json:"materials"`
+	Cameras   []cameraDef   `json:"cameras"`
+
+	Accessors   []accessor   `json:"accessors"`
+	BufferViews []bufferView `json:"bufferViews"`
+	Buffers     []buffer     `json:"buffers"`
+
+	Extensions struct {
+		LightsPunctual *struct {
+			Lights []lightDef `json:"lights"`
+		} `json:"KHR_lights_punctual"`
+	} `json:"extensions"`
+}
+
+type sceneDef struct {
+	Name  string `json:"name"`
+	Nodes []int  `json:"nodes"`
+}
+
+type node struct {
+	Name     string `json:"name"`
+	Children []int  `json:"children"`
+
+	Matrix      []float64 `json:"matrix"`
+	Translation []float64 `json:"translation"`
+	Rotation    []float64 `json:"rotation"`
+	Scale       []float64 `json:"scale"`
+
+	Mesh   *int `json:"mesh"`
+	Camera *int `json:"camera"`
+	Skin   *int `json:"skin"`
+
+	Extensions struct {
+		LightsPunctual *struct {
+			Light int `json:"light"`
+		} `json:"KHR_lights_punctual"`
+	} `json:"extensions"`
+}
+
+type mesh struct {
+	Name       string      `json:"name"`
+	Primitives []primitive `json:"primitives"`
+}
+
+type primitive struct {
+	Attributes map[string]int    `json:"attributes"`
+	Indices    *int              `json:"indices"`
+	Material   *int              `json:"material"`
+	Mode       *int              `json:"mode"`
+	Targets    []json.RawMessage `json:"targets"`
+}
+
+// Primitive modes.
+const (
+	modePoints        = 0
+	modeLines         = 1
+	modeLineLoop      = 2
+	modeLineStrip     = 3
+	modeTriangles     = 4
+	modeTriangleStrip = 5
+	modeTriangleFan   = 6
+)
+
+type textureInfo struct {
+	Index int `json:"index"`
+}
+
+type materialDef struct {
+	Name string `json:"name"`
+
+	PBRMetallicRoughness struct {
+		BaseColorFactor          []float64    `json:"baseColorFactor"`
+		BaseColorTexture         *textureInfo `json:"baseColorTexture"`
+		MetallicFactor           *float64     `json:"metallicFactor"`
+		RoughnessFactor          *float64     `json:"roughnessFactor"`
+		MetallicRoughnessTexture *textureInfo `json:"metallicRoughnessTexture"`
+	} `json:"pbrMetallicRoughness"`
+
+	NormalTexture    *textureInfo `json:"normalTexture"`
+	OcclusionTexture *textureInfo `json:"occlusionTexture"`
+	EmissiveTexture  *textureInfo `json:"emissiveTexture"`
+	EmissiveFactor   []float64    `json:"emissiveFactor"`
+	AlphaMode        string       `json:"alphaMode"`
+
+	Extensions struct {
+		EmissiveStrength *struct {
+			EmissiveStrength float64 `json:"emissiveStrength"`
+		} `json:"KHR_materials_emissive_strength"`
+		Transmission *struct {
+			TransmissionFactor float64 `json:"transmissionFactor"`
+		} `json:"KHR_materials_transmission"`
+		IOR *struct {
+			IOR float64 `json:"ior"`
+		} `json:"KHR_materials_ior"`
+	} `json:"extensions"`
+}
+
+type cameraDef struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Perspective *struct {
+		AspectRatio float64 `json:"aspectRatio"`
+		YFov        float64 `json:"yfov"`
+	} `json:"perspective"`
+}
+
+type lightDef struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Color     []float64 `json:"color"`
+	Intensity *float64  `json:"intensity"`
+	Range     float64   `json:"range"`
+	Spot      *struct {
+		InnerConeAngle float64  `json:"innerConeAngle"`
+		OuterConeAngle *float64 `json:"outerConeAngle"`
+	} `json:"spot"`
+}
+
+type accessor struct {
+	BufferView    *int            `json:"bufferView"`
+	ByteOffset    int             `json:"byteOffset"`
+	ComponentType int             `json:"componentType"`
+	Normalized    bool            `json:"normalized"`
+	Count         int             `json:"count"`
+	Type          string          `json:"type"`
+	Sparse        json.RawMessage `json:"sparse"`
+}
+
+// Accessor component types.
+const (
+	componentByte          = 5120
+	componentUnsignedByte  = 5121
+	componentShort         = 5122
+	componentUnsignedShort = 5123
+	componentUnsignedInt   = 5125
+	componentFloat         = 5126
+)
+
+type bufferView struct {
+	Buffer     int `json:"buffer"`
+	ByteOffset int `json:"byteOffset"`
+	ByteLength int `json:"byteLength"`
+	ByteStride int `json:"byteStride"`
+}
+
+type buffer struct {
+	URI        string `json:"uri"`
+	ByteLength int    `json:"byteLength"`
+}
+
+// file is a parsed glTF document, with its buffers loaded.
+type file struct {
+	doc     document
+	buffers [][]byte
+}
+
+// GLB container constants.
+const (
+	glbMagic     = 0x46546c67 // "glTF"
+	glbChunkJSON = 0x4e4f534a // "JSON"
+	glbChunkBin  = 0x004e4942 // "BIN\0"
+)
+
+// parseFile reads a .gltf or .glb file.  External buffers are resolved
+// relative to dir.
+func parseFile(data []byte, dir string) (*file, error) {
+	jsonChunk := data
+	var binChunk []byte
+
+	if len(data) >= 4 && binary.LittleEndian.Uint32(data) == glbMagic {
+		var err error
+		jsonChunk, binChunk, err = splitGLB(data)
+		if err != nil {
+			return nil, fmt.Errorf("while reading GLB container: %w", err)
+		}
+	}
+
+	f := &file{}
+	if err := json.Unmarshal(jsonChunk, &f.doc); err != nil {
+		return nil, fmt.Errorf("while parsing JSON: %w", err)
+	}
+
+	if !strings.HasPrefix(f.doc.Asset.Version, "2.") {
+		return nil, fmt.Errorf("unsupported glTF version %q", f.doc.Asset.Version)
+	}
+
+	for _, ext := range f.doc.ExtensionsRequired {
+		if !supportedExtensions[ext] {
+			return nil, fmt.Errorf("required extension %s is not supported", ext)
+		}
+	}
+
+	for i, b := range f.doc.Buffers {
+		var contents []byte
+		switch {
+		case b.URI == "":
+			// The GLB binary chunk.
+			if i != 0 || binChunk == nil {
+				return nil, fmt.Errorf("buffer %d has no URI, and there's no GLB binary chunk", i)
+			}
+			contents = binChunk
+		case strings.HasPrefix(b.URI, "data:"):
+			comma := strings.IndexByte(b.URI, ',')
+			if comma == -1 || !strings.HasSuffix(b.URI[:comma], ";base64") {
+				return nil, fmt.Errorf("buffer %d: only base64 data URIs are supported", i)
+			}
+			var err error
+			contents, err = base64.StdEncoding.DecodeString(b.URI[comma+1:])
+			if err != nil {
+				return nil, fmt.Errorf("while decoding buffer %d: %w", i, err)
+			}
+		default:
+			path, err := url.PathUnescape(b.URI)
+			if err != nil {
+				return nil, fmt.Errorf("buffer %d: bad URI: %w", i, err)
+			}
+			// Buffers must be next to the file, so that importing a file
+			// can't read anything else.
+			if !isLocal(filepath.FromSlash(path)) {
+				return nil, fmt.Errorf("buffer %d: URI %q is outside the file's directory", i, b.URI)
+			}
+			contents, err = os.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
+			if err != nil {
+				return nil, fmt.Errorf("while reading buffer %d: %w", i, err)
+			}
+		}
+
+		if len(contents) < b.ByteLength {
+			return nil, fmt.Errorf("buffer %d is %d bytes, want at least %d", i, len(contents), b.ByteLength)
+		}
+		f.buffers = append(f.buffers, contents)
+	}
+
+	return f, nil
+}
+
+// isLocal reports whether path, in the OS's syntax, stays within the directory
+// it's relative to: it isn't empty or rooted, and doesn't climb out with "..".
+func isLocal(path string) bool {
+	if path == "" || filepath.IsAbs(path) || filepath.VolumeName(path) != "" || strings.HasPrefix(path, string(filepath.Separator)) {
+		return false
+	}
+	clean := filepath.Clean(path)
+	return clean != ".." && !strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
+
+// supportedExtensions are the extensions that the importer understands well
+// enough that a file requiring them can be imported.
+var supportedExtensions = map[string]bool{
+	"KHR_lights_punctual":             true,
+	"KHR_materials_emissive_strength": true,
+	"KHR_materials_ior":               true,
+	"KHR_materials_transmission":      true,
+}
+
+func splitGLB(data []byte) (jsonChunk, binChunk []byte, err error) {
+	if len(data) < 12 {
+		return nil, nil, fmt.Errorf("truncated header")
+	}
+	if version := binary.LittleEndian.Uint32(data[4:]); version != 2 {
+		return nil, nil, fmt.Errorf("unsupported GLB version %d", version)
+	}
+	length := int(binary.LittleEndian.Uint32(data[8:]))
+	if length > len(data) {
+		return nil, nil, fmt.Errorf("header says %d bytes, but file has %d", length, len(data))
+	}
+
+	rest := data[12:length]
+	for len(rest) != 0 {
+		if len(rest) < 8 {
+			return nil, nil, fmt.Errorf("truncated chunk header")
+		}
+		chunkLength := int(binary.LittleEndian.Uint32(rest))
+		chunkType := binary.LittleEndian.Uint32(rest[4:])
+		if 8+chunkLength > len(rest) {
+			return nil, nil, fmt.Errorf("truncated chunk")
+		}
+		chunk := rest[8 : 8+chunkLength]
+		rest = rest[8+chunkLength:]
+
+		switch chunkType {
+		case glbChunkJSON:
+			jsonChunk = chunk
+		case glbChunkBin:
+			binChunk = chunk
+		}
+	}
+
+	if jsonChunk == nil {
+		return nil, nil, fmt.Errorf("no JSON chunk")
+	}
+	return bytes.TrimRight(jsonChunk, " \x00"), binChunk, nil
+}
+
+var componentCounts = map[string]int{
+	"SCALAR": 1,
+	"VEC2":   2,
+	"VEC3":   3,
+	"VEC4":   4,
+	"MAT2":   4,
+	"MAT3":   9,
+	"MAT4":   16,
+}
+
+var componentSizes = map[int]int{
+	componentByte:          1,
+	componentUnsignedByte:  1,
+	componentShort:         2,
+	componentUnsignedShort: 2,
+	componentUnsignedInt:   4,
+	componentFloat:         4,
+}
+
+// maxZeroAccessorCount is the most elements an accessor without a buffer view
+// can have.
+const maxZeroAccessorCount = 1 << 24
+
+// readAccessor returns the elements of an accessor, flattened, along with the
+// number of components per element.  Normalized integer components are mapped
+// to [0, 1] (or [-1, 1]).
+func (f *file) readAccessor(index int) ([]float64, int, error) {
+	if index < 0 || index >= len(f.doc.Accessors) {
+		return nil, 0, fmt.Errorf("accessor %d doesn't exist", index)
+	}
+	a := f.doc.Accessors[index]
+
+	if len(a.Sparse) != 0 {
+		return nil, 0, fmt.Errorf("accessor %d: sparse accessors are not supported", index)
+	}
+
+	components, ok := componentCounts[a.Type]
+	if !ok {
+		return nil, 0, fmt.Errorf("accessor %d: unknown type %q", index, a.Type)
+	}
+	size, ok := componentSizes[a.ComponentType]
+	if !ok {
+		return nil, 0, fmt.Errorf("accessor %d: unknown component type %d", index, a.ComponentType)
+	}
+
+	if a.Count < 0 || a.ByteOffset < 0 {
+		return nil, 0, fmt.Errorf("accessor %d: negative count or byte offset", index)
+	}
+
+	if a.BufferView == nil {
+		// All zeros.  There's no data to check the count against, so
+		// it's capped instead.
+		if a.Count > maxZeroAccessorCount {
+			return nil, 0, fmt.Errorf("accessor %d: count %d is too large for an accessor without a buffer view", index, a.Count)
+		}
+		return make([]float64, a.Count*components), components, nil
+	}
+
+	if *a.BufferView < 0 || *a.BufferView >= len(f.doc.BufferViews) {
+		return nil, 0, fmt.Errorf("accessor %d: buffer view %d doesn't exist", index, *a.BufferView)
+	}
+	view := f.doc.BufferViews[*a.BufferView]
+	if view.Buffer < 0 || view.Buffer >= len(f.buffers) {
+		return nil, 0, fmt.Errorf("accessor %d: buffer %d doesn't exist", index, view.Buffer)
+	}
+	if view.ByteOffset < 0 || view.ByteLength < 0 || view.ByteStride < 0 {
+		return nil, 0, fmt.Errorf("accessor %d: buffer view %d has a negative offset, length, or stride", index, *a.BufferView)
+	}
+	buffer := f.buffers[view.Buffer]
+	if view.ByteOffset > len(buffer) || view.ByteLength > len(buffer)-view.ByteOffset {
+		return nil, 0, fmt.Errorf("accessor %d: buffer view %d runs past the end of its buffer", index, *a.BufferView)
+	}
+	data := buffer[view.ByteOffset : view.ByteOffset+view.ByteLength]
+
+	stride := view.ByteStride
+	if stride == 0 {
+		stride = components * size
+	}
+	// Check the count against the view before allocating anything, in a way
+	// that can't overflow.
+	elementSize := components * size
+	if a.Count != 0 && (a.ByteOffset > len(data)-elementSize || a.Count-1 > (len(data)-elementSize-a.ByteOffset)/stride) {
+		return nil, 0, fmt.Errorf("accessor %d runs past the end of buffer view %d", index, *a.BufferView)
+	}
+
+	out := make([]float64, a.Count*components)
+
+	for i := 0; i < a.Count; i++ {
+		for c := 0; c < components; c++ {
+			b := data[a.ByteOffset+i*stride+c*size:]
+
+			var val float64
+			switch a.ComponentType {
+			case componentByte:
+				val = float64(int8(b[0]))
+				if a.Normalized {
+					val = math.Max(val/127, -1)
+				}
+			case componentUnsignedByte:
+				val = float64(b[0])
+				if a.Normalized {
+					val /= 255
+				}
+			case componentShort:
+				val = float64(int16(binary.LittleEndian.Uint16(b)))
+				if a.Normalized {
+					val = math.Max(val/32767, -1)
+				}
+			case componentUnsignedShort:
+				val = float64(binary.LittleEndian.Uint16(b))
+				if a.Normalized {
+					val /= 65535
+				}
+			case componentUnsignedInt:
+				val = float64(binary.LittleEndian.Uint32(b))
+			case componentFloat:
+				val = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+			}
+			out[i*components+c] = val
+		}
+	}
+
+	return out, components, nil
+}
@@ -0,0 +1,654 @@
+package gltf
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+
+	"row-major/harpoon/affinetransform"
+	"row-major/harpoon/camera"
+	"row-major/harpoon/densesignal"
+	"row-major/harpoon/geometry"
+	"row-major/harpoon/light"
+	"row-major/harpoon/material"
+	"row-major/harpoon/scene"
+	"row-major/harpoon/vmath/mat33"
+	"row-major/harpoon/vmath/vec2"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// Report lists the parts of a glTF file that couldn't be translated into a
+// harpoon scene.  The import still succeeds, but the scene won't look quite
+// like it does in other renderers.
+type Report struct {
+	Warnings []string
+}
+
+func (r *Report) warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// LoadScene imports a .gltf or .glb file.
+//
+// glTF is Y-up and harpoon is Z-up, so the whole scene is rotated to put glTF's
+// +Y along harpoon's +Z.
+//
+// Materials are mapped onto harpoon's materials:
+//
+//   - Emissive materials become emitters.  The emissive factor (times
+//     KHR_materials_emissive_strength) is taken to be the radiance, in W / (sr
+//     m^2).
+//   - Transmissive materials (KHR_materials_transmission) become smooth glass,
+//     with the index of refraction from KHR_materials_ior.
+//   - Smooth metals become mirrors.
+//   - Everything else becomes a Lambertian diffuser.
+//
+// Base colors are upsampled to smooth reflectance spectra.  Textures are not
+// supported; materials use their constant factors.
+//
+// Punctual lights (KHR_lights_punctual) become light.SpotLights, with
+// intensities converted from candela to W / sr at 683 lm / W.
+func LoadScene(fileName string) (*scene.Scene, *Report, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("while reading glTF file: %w", err)
+	}
+
+	s, report, err := ReadScene(data, filepath.Dir(fileName))
+	if err != nil {
+		return nil, nil, fmt.Errorf("while importing %s: %w", fileName, err)
+	}
+	return s, report, nil
+}
+
+// ReadScene imports a glTF file that has already been read into memory.
+// External buffers are resolved relative to dir.  See LoadScene for details.
+func ReadScene(data []byte, dir string) (*scene.Scene, *Report, error) {
+	f, err := parseFile(data, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	im := &importer{
+		f:               f,
+		s:               &scene.Scene{},
+		report:          &Report{},
+		primitives:      map[int][]primitiveElement{},
+		materials:       map[int]int{},
+		defaultMaterial: -1,
+	}
+
+	im.s.InfinityMaterialIndex = im.s.AddMaterial(&material.Emitter{
+		Emissivity: material.ConstantScalar(0),
+	})
+
+	roots, err := im.rootNodes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, root := range roots {
+		if err := im.visitNode(root, yUpToZUp(), map[int]bool{}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(im.s.Cameras) == 0 {
+		im.report.warnf("no cameras")
+	}
+
+	return im.s, im.report, nil
+}
+
+// primitiveElement is a mesh primitive that has been converted to a geometry
+// and material in the scene, ready to be instanced by nodes.
+type primitiveElement struct {
+	geometry int
+	material int
+}
+
+type importer struct {
+	f      *file
+	s      *scene.Scene
+	report *Report
+
+	// Converted mesh primitives, indexed by mesh.  Meshes that are
+	// instanced by several nodes share their geometries.
+	primitives map[int][]primitiveElement
+
+	// Scene material indices, by glTF material index.
+	materials       map[int]int
+	defaultMaterial int
+}
+
+// yUpToZUp takes glTF's Y-up coordinates to harpoon's Z-up coordinates.
+func yUpToZUp() affinetransform.AffineTransform {
+	return affinetransform.AffineTransform{
+		Linear: mat33.T{
+			1, 0, 0,
+			0, 0, -1,
+			0, 1, 0,
+		},
+	}
+}
+
+func (im *importer) rootNodes() ([]int, error) {
+	doc := &im.f.doc
+
+	if len(doc.Scenes) == 0 {
+		// Every node that isn't a child of another.
+		isChild := make([]bool, len(doc.Nodes))
+		for _, n := range doc.Nodes {
+			for _, c := range n.Children {
+				if c >= 0 && c < len(isChild) {
+					isChild[c] = true
+				}
+			}
+		}
+		roots := []int{}
+		for i := range doc.Nodes {
+			if !isChild[i] {
+				roots = append(roots, i)
+			}
+		}
+		return roots, nil
+	}
+
+	index := 0
+	if doc.Scene != nil {
+		index = *doc.Scene
+	}
+	if index < 0 || index >= len(doc.Scenes) {
+		return nil, fmt.Errorf("scene %d doesn't exist", index)
+	}
+	if len(doc.Scenes) > 1 {
+		im.report.warnf("file has %d scenes; only scene %d (%q) was imported", len(doc.Scenes), index, doc.Scenes[index].Name)
+	}
+	return doc.Scenes[index].Nodes, nil
+}
+
+// nodeTransform is the transform from a node's space to its parent's.
+func nodeTransform(n *node) affinetransform.AffineTransform {
+	if len(n.Matrix) == 16 {
+		// Column-major.
+		m := n.Matrix
+		return affinetransform.AffineTransform{
+			Linear: mat33.T{
+				m[0], m[4], m[8],
+				m[1], m[5], m[9],
+				m[2], m[6], m[10],
+			},
+			Offset: vec3.T{m[12], m[13], m[14]},
+		}
+	}
+
+	t := affinetransform.Identity()
+	if len(n.Translation) == 3 {
+		t.Offset = vec3.T{n.Translation[0], n.Translation[1], n.Translation[2]}
+	}
+	if len(n.Rotation) == 4 {
+		t.Linear = quaternionMat(n.Rotation[0], n.Rotation[1], n.Rotation[2], n.Rotation[3])
+	}
+	if len(n.Scale) == 3 {
+		t.Linear = mat33.MulMM(t.Linear, mat33.T{
+			n.Scale[0], 0, 0,
+			0, n.Scale[1], 0,
+			0, 0, n.Scale[2],
+		})
+	}
+	return t
+}
+
+// quaternionMat is the rotation matrix of the quaternion xi + yj + zk + w.
+func quaternionMat(x, y, z, w float64) mat33.T {
+	norm := math.Sqrt(x*x + y*y + z*z + w*w)
+	if norm == 0 {
+		return affinetransform.Identity().Linear
+	}
+	x, y, z, w = x/norm, y/norm, z/norm, w/norm
+
+	return mat33.T{
+		1 - 2*(y*y+z*z), 2 * (x*y - z*w), 2 * (x*z + y*w),
+		2 * (x*y + z*w), 1 - 2*(x*x+z*z), 2 * (y*z - x*w),
+		2 * (x*z - y*w), 2 * (y*z + x*w), 1 - 2*(x*x+y*y),
+	}
+}
+
+func (im *importer) visitNode(index int, parent affinetransform.AffineTransform, onPath map[int]bool) error {
+	doc := &im.f.doc
+	if index < 0 || index >= len(doc.Nodes) {
+		return fmt.Errorf("node %d doesn't exist", index)
+	}
+	if onPath[index] {
+		return fmt.Errorf("node %d is its own ancestor", index)
+	}
+	onPath[index] = true
+	defer delete(onPath, index)
+
+	n := &doc.Nodes[index]
+	world := affinetransform.Compose(parent, nodeTransform(n))
+
+	if n.Mesh != nil {
+		if n.Skin != nil {
+			im.report.warnf("node %d (%q): skinning ignored; the mesh is in its bind pose", index, n.Name)
+		}
+
+		elements, err := im.convertMesh(*n.Mesh)
+		if err != nil {
+			return fmt.Errorf("while converting mesh %d: %w", *n.Mesh, err)
+		}
+		for _, e := range elements {
+			im.s.AddElement(&scene.SceneElement{
+				GeometryIndex: e.geometry,
+				MaterialIndex: e.material,
+				ModelToWorld:  world,
+			})
+		}
+	}
+
+	if n.Camera != nil {
+		if err := im.convertCamera(*n.Camera, world); err != nil {
+			return fmt.Errorf("while converting camera %d: %w", *n.Camera, err)
+		}
+	}
+
+	if n.Extensions.LightsPunctual != nil {
+		l := n.Extensions.LightsPunctual.Light
+		if err := im.convertLight(l, world); err != nil {
+			return fmt.Errorf("while converting light %d: %w", l, err)
+		}
+	}
+
+	for _, c := range n.Children {
+		if err := im.visitNode(c, world, onPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (im *importer) convertMesh(index int) ([]primitiveElement, error) {
+	doc := &im.f.doc
+	if index < 0 || index >= len(doc.Meshes) {
+		return nil, fmt.Errorf("mesh doesn't exist")
+	}
+
+	if elements, ok := im.primitives[index]; ok {
+		return elements, nil
+	}
+
+	m := &doc.Meshes[index]
+	elements := []primitiveElement{}
+	for i := range m.Primitives {
+		p := &m.Primitives[i]
+
+		g, err := im.convertPrimitive(p)
+		if err != nil {
+			return nil, fmt.Errorf("while converting primitive %d: %w", i, err)
+		}
+		if g == nil {
+			im.report.warnf("mesh %d (%q) primitive %d: only triangles are supported", index, m.Name, i)
+			continue
+		}
+
+		for attr := range p.Attributes {
+			switch attr {
+			case "POSITION", "NORMAL", "TEXCOORD_0":
+			default:
+				im.report.warnf("mesh %d (%q) primitive %d: attribute %s ignored", index, m.Name, i, attr)
+			}
+		}
+		if len(p.Targets) != 0 {
+			im.report.warnf("mesh %d (%q) primitive %d: morph targets ignored", index, m.Name, i)
+		}
+
+		mtl, err := im.primitiveMaterial(p)
+		if err != nil {
+			return nil, err
+		}
+
+		elements = append(elements, primitiveElement{
+			geometry: im.s.AddGeometry(g),
+			material: mtl,
+		})
+	}
+
+	im.primitives[index] = elements
+	return elements, nil
+}
+
+// convertPrimitive builds the geometry of a mesh primitive.  It returns nil if
+// the primitive isn't made of triangles.
+func (im *importer) convertPrimitive(p *primitive) (*geometry.TriangleMesh, error) {
+	mode := modeTriangles
+	if p.Mode != nil {
+		mode = *p.Mode
+	}
+	if mode != modeTriangles && mode != modeTriangleStrip && mode != modeTriangleFan {
+		return nil, nil
+	}
+
+	posIndex, ok := p.Attributes["POSITION"]
+	if !ok {
+		return nil, fmt.Errorf("no POSITION attribute")
+	}
+	positions, err := im.readVec3s(posIndex)
+	if err != nil {
+		return nil, fmt.Errorf("while reading positions: %w", err)
+	}
+
+	mesh := &geometry.TriangleMesh{
+		Vertices: positions,
+	}
+
+	if normIndex, ok := p.Attributes["NORMAL"]; ok {
+		mesh.Normals, err = im.readVec3s(normIndex)
+		if err != nil {
+			return nil, fmt.Errorf("while reading normals: %w", err)
+		}
+		if len(mesh.Normals) != len(positions) {
+			return nil, fmt.Errorf("got %d normals for %d positions", len(mesh.Normals), len(positions))
+		}
+	}
+
+	if uvIndex, ok := p.Attributes["TEXCOORD_0"]; ok {
+		vals, components, err := im.f.readAccessor(uvIndex)
+		if err != nil {
+			return nil, fmt.Errorf("while reading texture coordinates: %w", err)
+		}
+		if components != 2 || len(vals)/2 != len(positions) {
+			return nil, fmt.Errorf("texture coordinates don't match positions")
+		}
+		for i := 0; i < len(vals); i += 2 {
+			mesh.TexCoords = append(mesh.TexCoords, vec2.T{vals[i], vals[i+1]})
+		}
+	}
+
+	var indices []int
+	if p.Indices != nil {
+		vals, components, err := im.f.readAccessor(*p.Indices)
+		if err != nil {
+			return nil, fmt.Errorf("while reading indices: %w", err)
+		}
+		if components != 1 {
+			return nil, fmt.Errorf("indices aren't scalars")
+		}
+		for _, v := range vals {
+			if v < 0 || int(v) >= len(positions) {
+				return nil, fmt.Errorf("index %v out of range", v)
+			}
+			indices = append(indices, int(v))
+		}
+	} else {
+		for i := range positions {
+			indices = append(indices, i)
+		}
+	}
+
+	switch mode {
+	case modeTriangles:
+		for i := 0; i+2 < len(indices); i += 3 {
+			mesh.Triangles = append(mesh.Triangles, [3]int{indices[i], indices[i+1], indices[i+2]})
+		}
+	case modeTriangleStrip:
+		// Every other triangle is flipped to keep the winding consistent.
+		for i := 0; i+2 < len(indices); i++ {
+			if i%2 == 0 {
+				mesh.Triangles = append(mesh.Triangles, [3]int{indices[i], indices[i+1], indices[i+2]})
+			} else {
+				mesh.Triangles = append(mesh.Triangles, [3]int{indices[i+1], indices[i], indices[i+2]})
+			}
+		}
+	case modeTriangleFan:
+		for i := 1; i+1 < len(indices); i++ {
+			mesh.Triangles = append(mesh.Triangles, [3]int{indices[i], indices[i+1], indices[0]})
+		}
+	}
+
+	return mesh, nil
+}
+
+func (im *importer) readVec3s(index int) ([]vec3.T, error) {
+	vals, components, err := im.f.readAccessor(index)
+	if err != nil {
+		return nil, err
+	}
+	if components != 3 {
+		return nil, fmt.Errorf("accessor %d isn't VEC3", index)
+	}
+
+	out := make([]vec3.T, len(vals)/3)
+	for i := range out {
+		out[i] = vec3.T{vals[3*i], vals[3*i+1], vals[3*i+2]}
+	}
+	return out, nil
+}
+
+func (im *importer) primitiveMaterial(p *primitive) (int, error) {
+	if p.Material == nil {
+		// glTF's default material is a rough white metal, which
+		// convertMaterial would turn into a white diffuser anyway.
+		if im.defaultMaterial == -1 {
+			im.defaultMaterial = im.s.AddMaterial(&material.MonteCarloLambert{
+				Reflectance: material.ConstantScalar(1.0),
+			})
+		}
+		return im.defaultMaterial, nil
+	}
+
+	if index, ok := im.materials[*p.Material]; ok {
+		return index, nil
+	}
+
+	doc := &im.f.doc
+	if *p.Material < 0 || *p.Material >= len(doc.Materials) {
+		return 0, fmt.Errorf("material %d doesn't exist", *p.Material)
+	}
+
+	m := im.convertMaterial(*p.Material, &doc.Materials[*p.Material])
+	index := im.s.AddMaterial(m)
+	im.materials[*p.Material] = index
+	return index, nil
+}
+
+// smoothRoughness is the roughest a material can be and still be imported as
+// perfectly smooth.
+const smoothRoughness = 0.2
+
+func (im *importer) convertMaterial(index int, m *materialDef) material.Material {
+	pbr := &m.PBRMetallicRoughness
+
+	for _, tex := range []struct {
+		name string
+		info *textureInfo
+	}{
+		{"baseColorTexture", pbr.BaseColorTexture},
+		{"metallicRoughnessTexture", pbr.MetallicRoughnessTexture},
+		{"normalTexture", m.NormalTexture},
+		{"occlusionTexture", m.OcclusionTexture},
+		{"emissiveTexture", m.EmissiveTexture},
+	} {
+		if tex.info != nil {
+			im.report.warnf("material %d (%q): %s ignored", index, m.Name, tex.name)
+		}
+	}
+	if m.AlphaMode != "" && m.AlphaMode != "OPAQUE" {
+		im.report.warnf("material %d (%q): alpha mode %s ignored; rendered as opaque", index, m.Name, m.AlphaMode)
+	}
+
+	baseColor := [3]float64{1, 1, 1}
+	if len(pbr.BaseColorFactor) >= 3 {
+		copy(baseColor[:], pbr.BaseColorFactor)
+	}
+	metallic := 1.0
+	if pbr.MetallicFactor != nil {
+		metallic = *pbr.MetallicFactor
+	}
+	roughness := 1.0
+	if pbr.RoughnessFactor != nil {
+		roughness = *pbr.RoughnessFactor
+	}
+
+	emissive := [3]float64{}
+	if len(m.EmissiveFactor) >= 3 {
+		copy(emissive[:], m.EmissiveFactor)
+	}
+	strength := 1.0
+	if m.Extensions.EmissiveStrength != nil {
+		strength = m.Extensions.EmissiveStrength.EmissiveStrength
+	}
+	if emissive[0] != 0 || emissive[1] != 0 || emissive[2] != 0 {
+		return &material.Emitter{
+			Emissivity: material.ConstantSpectrum(emissionSpectrum(emissive, strength)),
+		}
+	}
+
+	if m.Extensions.Transmission != nil && m.Extensions.Transmission.TransmissionFactor >= 0.5 {
+		ior := 1.5
+		if m.Extensions.IOR != nil {
+			ior = m.Extensions.IOR.IOR
+		}
+		if roughness > smoothRoughness {
+			im.report.warnf("material %d (%q): rough transmission approximated as smooth glass", index, m.Name)
+		}
+		return &material.NonConductiveSmooth{
+			InteriorIndexOfRefraction: material.ConstantScalar(ior),
+			ExteriorIndexOfRefraction: material.ConstantScalar(1.0),
+		}
+	}
+
+	reflectance := densesignal.LinearRGBReflectance(
+		float32(clamp01(baseColor[0])),
+		float32(clamp01(baseColor[1])),
+		float32(clamp01(baseColor[2])),
+	)
+
+	if metallic >= 0.5 {
+		if roughness <= smoothRoughness {
+			return &material.PerfectlyConductiveSmooth{
+				Reflectance: material.ConstantSpectrum(reflectance),
+			}
+		}
+		im.report.warnf("material %d (%q): rough metal approximated as diffuse", index, m.Name)
+	}
+
+	return &material.MonteCarloLambert{
+		Reflectance: material.ConstantSpectrum(reflectance),
+	}
+}
+
+func clamp01(x float64) float64 {
+	return math.Max(0, math.Min(1, x))
+}
+
+// emissionSpectrum converts a linear RGB color and a scale into an emission
+// spectrum.  The color's chromaticity comes from upsampling it as a
+// reflectance and lighting it with D65.  The spectrum's integrated power is the
+// scale times the largest component of the color.
+func emissionSpectrum(color [3]float64, scale float64) *densesignal.DenseSignal {
+	peak := math.Max(color[0], math.Max(color[1], color[2]))
+	if peak <= 0 {
+		return densesignal.VisibleSpectrumSignal()
+	}
+
+	sig := densesignal.LinearRGBReflectance(
+		float32(color[0]/peak),
+		float32(color[1]/peak),
+		float32(color[2]/peak),
+	)
+
+	d65 := densesignal.CIED65()
+	for i := range sig.Samples {
+		lambda := sig.SrcX + (float32(i)+0.5)*sig.StepX()
+		sig.Samples[i] *= d65.Interpolate(lambda)
+	}
+
+	sig.Normalize()
+	sig.MulS(float32(peak * scale))
+	return sig
+}
+
+func (im *importer) convertCamera(index int, world affinetransform.AffineTransform) error {
+	doc := &im.f.doc
+	if index < 0 || index >= len(doc.Cameras) {
+		return fmt.Errorf("camera doesn't exist")
+	}
+	c := &doc.Cameras[index]
+
+	if c.Type != "perspective" || c.Perspective == nil {
+		im.report.warnf("camera %d (%q): %s cameras are not supported", index, c.Name, c.Type)
+		return nil
+	}
+
+	aspect := c.Perspective.AspectRatio
+	if aspect == 0 {
+		// The renderer's default output is 768x512.
+		aspect = 1.5
+		im.report.warnf("camera %d (%q): no aspect ratio; assuming 3:2", index, c.Name)
+	}
+	halfHeight := math.Tan(c.Perspective.YFov / 2)
+
+	// glTF cameras look down their -Z axis, with +Y up.
+	realCamera := &camera.PinholeCamera{
+		Center:          world.Offset,
+		ApertureToWorld: affinetransform.Identity().Linear,
+		Aperture:        vec3.T{1, aspect * halfHeight, halfHeight},
+	}
+	realCamera.SetEye(mat33.MulMV(world.Linear, vec3.T{0, 0, -1}))
+	realCamera.SetUp(mat33.MulMV(world.Linear, vec3.T{0, 1, 0}))
+	im.s.AddCamera(realCamera)
+	return nil
+}
+
+// candelaToWattsPerSteradian converts luminous intensity to radiant intensity,
+// at the peak luminous efficacy.
+const candelaToWattsPerSteradian = 1.0 / 683
+
+func (im *importer) convertLight(index int, world affinetransform.AffineTransform) error {
+	doc := &im.f.doc
+	if doc.Extensions.LightsPunctual == nil || index < 0 || index >= len(doc.Extensions.LightsPunctual.Lights) {
+		return fmt.Errorf("light doesn't exist")
+	}
+	l := &doc.Extensions.LightsPunctual.Lights[index]
+
+	color := [3]float64{1, 1, 1}
+	if len(l.Color) >= 3 {
+		copy(color[:], l.Color)
+	}
+	intensity := 1.0
+	if l.Intensity != nil {
+		intensity = *l.Intensity
+	}
+	if l.Range != 0 {
+		im.report.warnf("light %d (%q): range ignored", index, l.Name)
+	}
+
+	spot := &light.SpotLight{
+		Position:   world.Offset,
+		Direction:  mat33.MulMV(world.Linear, vec3.T{0, 0, -1}),
+		InnerAngle: math.Pi,
+		OuterAngle: math.Pi,
+		Intensity:  material.ConstantSpectrum(emissionSpectrum(color, intensity*candelaToWattsPerSteradian)),
+	}
+
+	switch l.Type {
+	case "point":
+	case "spot":
+		spot.InnerAngle = 0
+		spot.OuterAngle = math.Pi / 4
+		if l.Spot != nil {
+			spot.InnerAngle = l.Spot.InnerConeAngle
+			if l.Spot.OuterConeAngle != nil {
+				spot.OuterAngle = *l.Spot.OuterConeAngle
+			}
+		}
+	default:
+		im.report.warnf("light %d (%q): %s lights are not supported", index, l.Name, l.Type)
+		return nil
+	}
+
+	im.s.AddLight(spot)
+	return nil
+}
@@ -0,0 +1,198 @@
+package gltf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"row-major/harpoon/camera"
+	"row-major/harpoon/light"
+	"row-major/harpoon/material"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// testGLTF builds a small glTF file: a triangle in the XZ plane (glTF is Y-up,
+// so it's a floor), lifted by a node transform, a camera looking down at it,
+// and a few lights.
+func testGLTF(t *testing.T) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, []float32{
+		-1, 0, 1,
+		1, 0, 1,
+		0, 0, -1,
+	})
+	binary.Write(buf, binary.LittleEndian, []uint16{0, 1, 2})
+	uri := "data:application/octet-stream;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	return []byte(fmt.Sprintf(`{
+  "asset": {"version": "2.0"},
+  "scene": 0,
+  "scenes": [{"nodes": [0, 2, 3, 4]}],
+  "nodes": [
+    {"translation": [0, 1, 0], "children": [1]},
+    {"mesh": 0},
+    {"camera": 0, "translation": [0, 5, 0], "rotation": [-0.7071068, 0, 0, 0.7071068]},
+    {"translation": [0, 3, 0], "extensions": {"KHR_lights_punctual": {"light": 0}}},
+    {"extensions": {"KHR_lights_punctual": {"light": 1}}}
+  ],
+  "meshes": [{"primitives": [{"attributes": {"POSITION": 0, "COLOR_0": 0}, "indices": 1, "material": 0}]}],
+  "materials": [{"name": "red", "pbrMetallicRoughness": {"baseColorFactor": [0.8, 0.1, 0.1, 1], "metallicFactor": 0}}],
+  "cameras": [{"type": "perspective", "perspective": {"yfov": 0.8, "aspectRatio": 1.5}}],
+  "extensions": {"KHR_lights_punctual": {"lights": [
+    {"type": "point", "intensity": 683},
+    {"type": "directional"}
+  ]}},
+  "accessors": [
+    {"bufferView": 0, "componentType": 5126, "count": 3, "type": "VEC3"},
+    {"bufferView": 1, "componentType": 5123, "count": 3, "type": "SCALAR"}
+  ],
+  "bufferViews": [
+    {"buffer": 0, "byteOffset": 0, "byteLength": 36},
+    {"buffer": 0, "byteOffset": 36, "byteLength": 6}
+  ],
+  "buffers": [{"byteLength": %d, "uri": %q}]
+}`, buf.Len(), uri))
+}
+
+func TestReadScene(t *testing.T) {
+	s, report, err := ReadScene(testGLTF(t), "")
+	if err != nil {
+		t.Fatalf("ReadScene: %v", err)
+	}
+
+	if got, want := len(s.Elements), 1; got != want {
+		t.Fatalf("got %d elements, want %d", got, want)
+	}
+	if _, ok := s.Materials[s.Elements[0].MaterialIndex].(*material.MonteCarloLambert); !ok {
+		t.Errorf("material is %T, want *material.MonteCarloLambert", s.Materials[s.Elements[0].MaterialIndex])
+	}
+
+	// glTF's Y-up floor, lifted by 1, is harpoon's Z-up floor at z = 1.
+	s.Crush(0)
+	c, hit := s.SceneRayIntersect(ray.RaySegment{
+		TheRay:     ray.Ray{Point: vec3.T{0, 0, 5}, Slope: vec3.T{0, 0, -1}},
+		TheSegment: ray.Span{Lo: 0, Hi: math.Inf(1)},
+	})
+	if hit == -1 {
+		t.Fatalf("ray missed the triangle")
+	}
+	if math.Abs(c.P[2]-1) > 1e-6 {
+		t.Errorf("hit at %v, want z = 1", c.P)
+	}
+	if c.N[2] < 0.999 {
+		t.Errorf("normal is %v, want +Z", c.N)
+	}
+
+	if got, want := len(s.Cameras), 1; got != want {
+		t.Fatalf("got %d cameras, want %d", got, want)
+	}
+	cam := s.Cameras[0].(*camera.PinholeCamera)
+	if eye := cam.Eye(); eye[2] > -0.999 {
+		t.Errorf("camera looks along %v, want -Z", eye)
+	}
+	if math.Abs(cam.Aperture[1]/cam.Aperture[2]-1.5) > 1e-9 {
+		t.Errorf("aperture %v doesn't have a 3:2 aspect ratio", cam.Aperture)
+	}
+
+	if got, want := len(s.Lights), 1; got != want {
+		t.Fatalf("got %d lights, want %d", got, want)
+	}
+	point := s.Lights[0].(*light.SpotLight)
+	if math.Abs(point.Position[2]-3) > 1e-9 {
+		t.Errorf("point light is at %v, want z = 3", point.Position)
+	}
+
+	wantWarnings := []string{"COLOR_0", "directional"}
+	for _, want := range wantWarnings {
+		found := false
+		for _, w := range report.Warnings {
+			if strings.Contains(w, want) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no warning mentioning %q in %q", want, report.Warnings)
+		}
+	}
+}
+
+func TestReadSceneRejectsRequiredExtensions(t *testing.T) {
+	data := strings.Replace(string(testGLTF(t)), `"asset"`, `"extensionsRequired": ["KHR_draco_mesh_compression"], "asset"`, 1)
+	if _, _, err := ReadScene([]byte(data), ""); err == nil {
+		t.Errorf("ReadScene accepted a file requiring an unsupported extension")
+	}
+}
+
+func TestReadSceneRejectsBadAccessors(t *testing.T) {
+	cases := []struct {
+		name     string
+		old, new string
+	}{
+		{"negative count", `"count": 3, "type": "VEC3"`, `"count": -1, "type": "VEC3"`},
+		{"huge count", `"count": 3, "type": "VEC3"`, `"count": 1099511627776, "type": "VEC3"`},
+		{"huge count without a buffer view", `"bufferView": 0, "componentType": 5126, "count": 3`, `"componentType": 5126, "count": 1099511627776`},
+		{"negative accessor offset", `"bufferView": 0, "componentType": 5126`, `"bufferView": 0, "byteOffset": -4, "componentType": 5126`},
+		{"negative view offset", `"byteOffset": 36, "byteLength": 6`, `"byteOffset": -2, "byteLength": 6`},
+		{"negative view length", `"byteOffset": 36, "byteLength": 6`, `"byteOffset": 36, "byteLength": -6`},
+		{"view past the buffer", `"byteOffset": 36, "byteLength": 6`, `"byteOffset": 36, "byteLength": 60`},
+	}
+
+	for _, tc := range cases {
+		data := string(testGLTF(t))
+		if !strings.Contains(data, tc.old) {
+			t.Fatalf("%s: test file doesn't contain %q", tc.name, tc.old)
+		}
+		data = strings.Replace(data, tc.old, tc.new, 1)
+		if _, _, err := ReadScene([]byte(data), ""); err == nil {
+			t.Errorf("%s: ReadScene accepted the file", tc.name)
+		}
+	}
+}
+
+func TestReadSceneRejectsBuffersOutsideDir(t *testing.T) {
+	dir := t.TempDir()
+	inside := filepath.Join(dir, "scene")
+	if err := os.Mkdir(inside, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(dir, "secret.bin")
+	if err := os.WriteFile(outside, make([]byte, 64), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, uri := range []string{"../secret.bin", "%2E%2E/secret.bin", outside} {
+		data := regexp.MustCompile(`"uri": "[^"]*"`).ReplaceAllString(string(testGLTF(t)), fmt.Sprintf(`"uri": %q`, uri))
+		if _, _, err := ReadScene([]byte(data), inside); err == nil {
+			t.Errorf("ReadScene read buffer %q from outside the file's directory", uri)
+		}
+	}
+}
+
+func TestReadSceneGLB(t *testing.T) {
+	doc := testGLTF(t)
+	for len(doc)%4 != 0 {
+		doc = append(doc, ' ')
+	}
+
+	glb := &bytes.Buffer{}
+	binary.Write(glb, binary.LittleEndian, []uint32{glbMagic, 2, uint32(12 + 8 + len(doc)), uint32(len(doc)), glbChunkJSON})
+	glb.Write(doc)
+
+	s, _, err := ReadScene(glb.Bytes(), "")
+	if err != nil {
+		t.Fatalf("ReadScene: %v", err)
+	}
+	if got, want := len(s.Elements), 1; got != want {
+		t.Errorf("got %d elements, want %d", got, want)
+	}
+}
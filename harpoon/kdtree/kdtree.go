@@ -50,16 +50,16 @@ func (cur *KDNode) refineViaSurfaceAreaHeuristic(splitCost, terminationThreshold
 		}
 
 		hiBox := aabox.AccumZeroAABox()
-		for _, element := range precedingElements {
+		for _, element := range succeedingElements {
 			hiBox = aabox.MinContainingAABox(hiBox, element.Bounds)
 		}
 
 		objective := 0.0
 		if len(precedingElements) != 0 {
-			objective += loBox.SurfaceArea()
+			objective += float64(len(precedingElements)) * loBox.SurfaceArea()
 		}
 		if len(succeedingElements) != 0 {
-			objective += hiBox.SurfaceArea()
+			objective += float64(len(succeedingElements)) * hiBox.SurfaceArea()
 		}
 
 		if objective < bestObjective {
@@ -91,16 +91,16 @@ func (cur *KDNode) refineViaSurfaceAreaHeuristic(splitCost, terminationThreshold
 		}
 
 		hiBox := aabox.AccumZeroAABox()
-		for _, element := range precedingElements {
+		for _, element := range succeedingElements {
 			hiBox = aabox.MinContainingAABox(hiBox, element.Bounds)
 		}
 
 		objective := 0.0
 		if len(precedingElements) != 0 {
-			objective += loBox.SurfaceArea()
+			objective += float64(len(precedingElements)) * loBox.SurfaceArea()
 		}
 		if len(succeedingElements) != 0 {
-			objective += hiBox.SurfaceArea()
+			objective += float64(len(succeedingElements)) * hiBox.SurfaceArea()
 		}
 
 		if objective < bestObjective {
@@ -132,16 +132,16 @@ func (cur *KDNode) refineViaSurfaceAreaHeuristic(splitCost, terminationThreshold
 		}
 
 		hiBox := aabox.AccumZeroAABox()
-		for _, element := range precedingElements {
+		for _, element := range succeedingElements {
 			hiBox = aabox.MinContainingAABox(hiBox, element.Bounds)
 		}
 
 		objective := 0.0
 		if len(precedingElements) != 0 {
-			objective += loBox.SurfaceArea()
+			objective += float64(len(precedingElements)) * loBox.SurfaceArea()
 		}
 		if len(succeedingElements) != 0 {
-			objective += hiBox.SurfaceArea()
+			objective += float64(len(succeedingElements)) * hiBox.SurfaceArea()
 		}
 
 		if objective < bestObjective {
@@ -154,9 +154,12 @@ func (cur *KDNode) refineViaSurfaceAreaHeuristic(splitCost, terminationThreshold
 	}
 
 	// Now we have a pretty good split, but we need to check that it's a
-	// good-enough improvement over just not splitting.
+	// good-enough improvement over just not splitting.  The objectives are
+	// the expected number of elements a ray has to test (scaled by the
+	// parent's surface area), and splitCost is the cost of visiting a node,
+	// relative to testing an element.
 	parentObjective := float64(len(cur.Elements)) * cur.Bounds.SurfaceArea()
-	if bestObjective+splitCost <= terminationThreshold+parentObjective {
+	if !(bestObjective+splitCost*cur.Bounds.SurfaceArea() < terminationThreshold*parentObjective) {
 		return
 	}
 
@@ -251,3 +254,113 @@ func (t *KDTree) Query(selector KDSelector, visitor KDVisitor) {
 		}
 	}
 }
+
+// KDPacketSelector returns the subset of active whose members might reach
+// elements in the box b.  Sets are bit masks, as in ray.Packet.
+type KDPacketSelector func(b aabox.AABox, active uint32) uint32
+
+// KDPacketVisitor is called with each element reached by a nonempty subset of
+// the packet.
+type KDPacketVisitor func(i int, active uint32)
+
+// QueryPacket is Query for a group of queries that mostly visit the same
+// nodes, like a packet of coherent rays.  The tree is walked once for the
+// whole group, carrying the subset of queries still interested in each node.
+// The selector is called once per node, rather than once per node and query.
+func (t *KDTree) QueryPacket(active uint32, selector KDPacketSelector, visitor KDPacketVisitor) {
+	type packetWork struct {
+		node   *KDNode
+		active uint32
+	}
+
+	workStack := []packetWork{{t.Root, active}}
+	for len(workStack) != 0 {
+		cur := workStack[len(workStack)-1]
+		workStack = workStack[:len(workStack)-1]
+
+		curActive := selector(cur.node.Bounds, cur.active)
+		if curActive == 0 {
+			continue
+		}
+
+		for i := range cur.node.Elements {
+			visitor(cur.node.Elements[i].Ref, curActive)
+		}
+
+		if cur.node.LoChild != nil {
+			workStack = append(workStack, packetWork{cur.node.LoChild, curActive})
+		}
+		if cur.node.HiChild != nil {
+			workStack = append(workStack, packetWork{cur.node.HiChild, curActive})
+		}
+	}
+}
+
+// KDStats describes the shape of a tree.
+type KDStats struct {
+	Nodes    int
+	Leaves   int
+	Elements int
+	MaxDepth int
+
+	// LeafSizes[n] is the number of leaves holding n elements.
+	LeafSizes []int
+
+	// SAHCost is the expected cost of a query by a random ray through the
+	// root's bounds, according to the surface area heuristic, in units of
+	// element tests.  Visiting an interior node costs splitCost.
+	SAHCost float64
+}
+
+// Stats walks the tree, and describes its shape.  splitCost should match the
+// one the tree was refined with.
+func (t *KDTree) Stats(splitCost float64) KDStats {
+	stats := KDStats{}
+
+	rootArea := t.Root.Bounds.SurfaceArea()
+
+	type statsWork struct {
+		node  *KDNode
+		depth int
+	}
+	workStack := []statsWork{{t.Root, 0}}
+	for len(workStack) != 0 {
+		cur := workStack[len(workStack)-1]
+		workStack = workStack[:len(workStack)-1]
+
+		stats.Nodes++
+		if cur.depth > stats.MaxDepth {
+			stats.MaxDepth = cur.depth
+		}
+
+		// The chance that a ray through the root also passes through this
+		// node is the ratio of their surface areas.
+		hitProbability := 1.0
+		if rootArea > 0 {
+			hitProbability = cur.node.Bounds.SurfaceArea() / rootArea
+		}
+
+		n := len(cur.node.Elements)
+		stats.Elements += n
+		stats.SAHCost += hitProbability * float64(n)
+
+		if cur.node.LoChild == nil && cur.node.HiChild == nil {
+			stats.Leaves++
+			for len(stats.LeafSizes) <= n {
+				stats.LeafSizes = append(stats.LeafSizes, 0)
+			}
+			stats.LeafSizes[n]++
+			continue
+		}
+
+		stats.SAHCost += hitProbability * splitCost
+		if cur.node.LoChild != nil {
+			workStack = append(workStack, statsWork{cur.node.LoChild, cur.depth + 1})
+		}
+		if cur.node.HiChild != nil {
+			workStack = append(workStack, statsWork{cur.node.HiChild, cur.depth + 1})
+		}
+	}
+
+	return stats
+}
@@ -0,0 +1,179 @@
+package kdtree
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"row-major/harpoon/aabox"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec3"
+)
+
+func randomElements(rng *rand.Rand, n int) []KDElement {
+	elements := []KDElement{}
+	for i := 0; i < n; i++ {
+		span := func() ray.Span {
+			lo := rng.Float64() * 10
+			return ray.Span{Lo: lo, Hi: lo + rng.Float64()}
+		}
+		elements = append(elements, KDElement{
+			Ref:    i,
+			Bounds: aabox.AABox{X: span(), Y: span(), Z: span()},
+		})
+	}
+	return elements
+}
+
+// TestQueryMatchesBruteForce checks that queries visit every element whose
+// bounds pass the selector, whatever shape the tree was refined into.
+func TestQueryMatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	elements := randomElements(rng, 200)
+
+	tree := NewKDTree(append([]KDElement{}, elements...))
+	tree.RefineViaSurfaceAreaHeuristic(1.0, 0.9)
+
+	for i := 0; i < 100; i++ {
+		query := ray.RaySegment{
+			TheRay: ray.Ray{
+				Point: vec3.T{rng.Float64() * 10, rng.Float64() * 10, -1},
+				Slope: vec3.Normalize(vec3.T{rng.Float64() - 0.5, rng.Float64() - 0.5, 1}),
+			},
+			TheSegment: ray.Span{Lo: 0, Hi: math.Inf(1)},
+		}
+		selector := func(b aabox.AABox) bool {
+			return !aabox.RayTestAABox(query, b).IsNaN()
+		}
+
+		want := []int{}
+		for _, e := range elements {
+			if selector(e.Bounds) {
+				want = append(want, e.Ref)
+			}
+		}
+
+		got := []int{}
+		seen := map[int]bool{}
+		tree.Query(selector, func(ref int) {
+			if seen[ref] {
+				return
+			}
+			seen[ref] = true
+			got = append(got, ref)
+		})
+
+		// The tree may visit extra elements (it only tests node bounds),
+		// but it can't skip any.
+		for _, ref := range want {
+			if !seen[ref] {
+				sort.Ints(got)
+				t.Fatalf("query %d: element %d was skipped (visited %v, want a superset of %v)", i, ref, got, want)
+			}
+		}
+	}
+}
+
+func TestQueryVisitsEachElementOnce(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	elements := randomElements(rng, 100)
+
+	tree := NewKDTree(elements)
+	tree.RefineViaSurfaceAreaHeuristic(1.0, 0.9)
+
+	counts := map[int]int{}
+	tree.Query(func(aabox.AABox) bool { return true }, func(ref int) {
+		counts[ref]++
+	})
+	for i := range elements {
+		if counts[i] != 1 {
+			t.Errorf("element %d visited %d times, want 1", i, counts[i])
+		}
+	}
+}
+
+// TestQueryPacketMatchesQuery checks that a packet query reaches each element
+// with exactly the rays that would reach it if they were queried one by one.
+func TestQueryPacketMatchesQuery(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	elements := randomElements(rng, 200)
+
+	tree := NewKDTree(elements)
+	tree.RefineViaSurfaceAreaHeuristic(1.0, 0.9)
+
+	for trial := 0; trial < 50; trial++ {
+		// Boxes are selected by an arbitrary per-ray predicate, so this only
+		// tests the traversal.
+		thresholds := [ray.PacketWidth]float64{}
+		for i := range thresholds {
+			thresholds[i] = rng.Float64() * 10
+		}
+		selects := func(i int, b aabox.AABox) bool {
+			return b.X.Lo <= thresholds[i] && thresholds[i] <= b.X.Hi+b.Y.Hi
+		}
+
+		want := map[int]uint32{}
+		for i := range thresholds {
+			tree.Query(func(b aabox.AABox) bool { return selects(i, b) }, func(ref int) {
+				want[ref] |= 1 << i
+			})
+		}
+
+		got := map[int]uint32{}
+		all := uint32(1)<<ray.PacketWidth - 1
+		tree.QueryPacket(all, func(b aabox.AABox, active uint32) uint32 {
+			result := uint32(0)
+			for i := range thresholds {
+				if active&(1<<i) != 0 && selects(i, b) {
+					result |= 1 << i
+				}
+			}
+			return result
+		}, func(ref int, active uint32) {
+			got[ref] |= active
+		})
+
+		if len(got) != len(want) {
+			t.Fatalf("trial %d: packet query reached %d elements, want %d", trial, len(got), len(want))
+		}
+		for ref, mask := range want {
+			if got[ref] != mask {
+				t.Fatalf("trial %d: element %d reached by rays %08b, want %08b", trial, ref, got[ref], mask)
+			}
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	elements := randomElements(rng, 100)
+
+	unrefined := NewKDTree(append([]KDElement{}, elements...))
+	before := unrefined.Stats(1.0)
+	if before.Nodes != 1 || before.Leaves != 1 || before.MaxDepth != 0 || before.SAHCost != 100 {
+		t.Errorf("unrefined tree: got %+v, want a single leaf with SAH cost 100", before)
+	}
+
+	tree := NewKDTree(elements)
+	tree.RefineViaSurfaceAreaHeuristic(1.0, 0.9)
+	after := tree.Stats(1.0)
+
+	if after.Elements != 100 {
+		t.Errorf("got %d elements, want 100", after.Elements)
+	}
+	if after.Leaves < 2 || after.Nodes <= after.Leaves {
+		t.Errorf("got %d nodes and %d leaves, want a refined tree", after.Nodes, after.Leaves)
+	}
+	leaves, elementsInLeaves := 0, 0
+	for n, count := range after.LeafSizes {
+		leaves += count
+		elementsInLeaves += n * count
+	}
+	if leaves != after.Leaves || elementsInLeaves != 100 {
+		t.Errorf("leaf size histogram %v accounts for %d leaves and %d elements, want %d and 100", after.LeafSizes, leaves, elementsInLeaves, after.Leaves)
+	}
+	if !(after.SAHCost < before.SAHCost) {
+		t.Errorf("refining didn't lower the SAH cost (before %v, after %v)", before.SAHCost, after.SAHCost)
+	}
+}
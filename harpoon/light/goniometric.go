@@ -0,0 +1,243 @@
+package light
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Goniometric is a table of relative intensity, over vertical angles (away from
+// the light's normal) and horizontal angles (around the normal).  This is how
+// IES photometric files describe luminaires.
+type Goniometric struct {
+	// In degrees, increasing.  Vertical angles run from 0 (along the normal)
+	// to 180.
+	VerticalAngles []float64
+
+	// In degrees, increasing from 0.  As in IES files, the last horizontal
+	// angle implies a symmetry:
+	//
+	//   0:   The distribution is the same at all horizontal angles.
+	//   90:  The distribution is symmetric in each quadrant.
+	//   180: The distribution is symmetric about the 0-180 plane.
+	//   360: There is no symmetry.
+	HorizontalAngles []float64
+
+	// Intensity[h][v] is the intensity at HorizontalAngles[h] and
+	// VerticalAngles[v].
+	Intensity [][]float64
+}
+
+// bracket finds the index i such that xs[i] <= x <= xs[i+1], and how far x is
+// between them.  If x is outside of xs, ok is false.
+func bracket(xs []float64, x float64) (i int, t float64, ok bool) {
+	if len(xs) == 1 {
+		return 0, 0.0, x == xs[0]
+	}
+	if x < xs[0] || x > xs[len(xs)-1] {
+		return 0, 0.0, false
+	}
+
+	i = sort.SearchFloat64s(xs, x)
+	if i > 0 {
+		i--
+	}
+	if i >= len(xs)-1 {
+		i = len(xs) - 2
+	}
+	return i, (x - xs[i]) / (xs[i+1] - xs[i]), true
+}
+
+// Eval returns the intensity at the given vertical and horizontal angles (in
+// radians), interpolating between the entries of the table.
+func (g *Goniometric) Eval(theta, phi float64) float64 {
+	vertical := theta * 180 / math.Pi
+
+	horizontal := math.Mod(phi*180/math.Pi, 360)
+	if horizontal < 0 {
+		horizontal += 360
+	}
+
+	// Fold the horizontal angle into the range covered by the table.
+	switch g.HorizontalAngles[len(g.HorizontalAngles)-1] {
+	case 0:
+		horizontal = 0
+	case 90:
+		if horizontal > 180 {
+			horizontal = 360 - horizontal
+		}
+		if horizontal > 90 {
+			horizontal = 180 - horizontal
+		}
+	case 180:
+		if horizontal > 180 {
+			horizontal = 360 - horizontal
+		}
+	}
+
+	v, vt, ok := bracket(g.VerticalAngles, vertical)
+	if !ok {
+		return 0.0
+	}
+
+	column := func(h int) float64 {
+		if len(g.VerticalAngles) == 1 {
+			return g.Intensity[h][0]
+		}
+		return (1-vt)*g.Intensity[h][v] + vt*g.Intensity[h][v+1]
+	}
+
+	if len(g.HorizontalAngles) == 1 {
+		return column(0)
+	}
+	h, ht, ok := bracket(g.HorizontalAngles, horizontal)
+	if !ok {
+		return 0.0
+	}
+	return (1-ht)*column(h) + ht*column(h+1)
+}
+
+// ReadIES reads the photometric data from an IES LM-63 file.  Only type C
+// photometry (the usual kind, for building lights) is supported.
+//
+// The returned distribution is normalized so that its peak is 1.
+func ReadIES(r io.Reader) (*Goniometric, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("while reading file: %w", err)
+	}
+
+	// Skip the keyword header, up to the TILT line.
+	lines := strings.Split(string(data), "\n")
+	tilt := ""
+	rest := []string{}
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "TILT=") {
+			tilt = strings.TrimPrefix(line, "TILT=")
+			rest = lines[i+1:]
+			break
+		}
+	}
+	if tilt == "" {
+		return nil, fmt.Errorf("no TILT line")
+	}
+	if tilt != "NONE" && tilt != "INCLUDE" {
+		return nil, fmt.Errorf("TILT=%s: tilt data in separate files is not supported", tilt)
+	}
+
+	// Everything after the TILT line is a stream of numbers.
+	tokens := strings.FieldsFunc(strings.Join(rest, "\n"), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	next := func(what string) (float64, error) {
+		if len(tokens) == 0 {
+			return 0, fmt.Errorf("while reading %s: unexpected end of file", what)
+		}
+		val, err := strconv.ParseFloat(tokens[0], 64)
+		if err != nil {
+			return 0, fmt.Errorf("while reading %s: %w", what, err)
+		}
+		tokens = tokens[1:]
+		return val, nil
+	}
+
+	if tilt == "INCLUDE" {
+		// Lamp-to-luminaire geometry, then pairs of angles and
+		// multipliers.  We don't model lamp tilt, so skip it.
+		if _, err := next("tilt geometry"); err != nil {
+			return nil, err
+		}
+		count, err := next("tilt count")
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < 2*int(count); i++ {
+			if _, err := next("tilt data"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	header := make([]float64, 13)
+	for i := range header {
+		val, err := next("photometric header")
+		if err != nil {
+			return nil, err
+		}
+		header[i] = val
+	}
+
+	verticalCount := int(header[3])
+	horizontalCount := int(header[4])
+	photometricType := int(header[5])
+	if photometricType != 1 {
+		return nil, fmt.Errorf("photometric type %d is not supported", photometricType)
+	}
+	if verticalCount < 1 || horizontalCount < 1 {
+		return nil, fmt.Errorf("bad angle counts: %d vertical, %d horizontal", verticalCount, horizontalCount)
+	}
+
+	g := &Goniometric{
+		VerticalAngles:   make([]float64, verticalCount),
+		HorizontalAngles: make([]float64, horizontalCount),
+		Intensity:        make([][]float64, horizontalCount),
+	}
+	for i := range g.VerticalAngles {
+		val, err := next("vertical angles")
+		if err != nil {
+			return nil, err
+		}
+		g.VerticalAngles[i] = val
+	}
+	for i := range g.HorizontalAngles {
+		val, err := next("horizontal angles")
+		if err != nil {
+			return nil, err
+		}
+		g.HorizontalAngles[i] = val
+	}
+
+	peak := 0.0
+	for h := range g.Intensity {
+		g.Intensity[h] = make([]float64, verticalCount)
+		for v := range g.Intensity[h] {
+			val, err := next("candela values")
+			if err != nil {
+				return nil, err
+			}
+			g.Intensity[h][v] = val
+			peak = math.Max(peak, val)
+		}
+	}
+
+	if peak == 0.0 {
+		return nil, fmt.Errorf("all candela values are zero")
+	}
+	for h := range g.Intensity {
+		for v := range g.Intensity[h] {
+			g.Intensity[h][v] /= peak
+		}
+	}
+
+	return g, nil
+}
+
+// LoadIESFile reads an IES photometric file.
+func LoadIESFile(path string) (*Goniometric, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("while opening file: %w", err)
+	}
+	defer f.Close()
+
+	g, err := ReadIES(f)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s: %w", path, err)
+	}
+	return g, nil
+}
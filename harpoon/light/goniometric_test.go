@@ -0,0 +1,80 @@
+package light
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+const testIES = `IESNA:LM-63-2002
+[TEST] test
+[MANUFAC] nobody
+TILT=NONE
+1 -1 1 3 3 1 2 0.5 0.5 0
+1 1 50
+0 45 90
+0, 90, 180
+200 100 0
+100 50 0
+50 25 0
+`
+
+func TestReadIES(t *testing.T) {
+	g, err := ReadIES(strings.NewReader(testIES))
+	if err != nil {
+		t.Fatalf("ReadIES: %v", err)
+	}
+
+	if got, want := len(g.VerticalAngles), 3; got != want {
+		t.Fatalf("got %d vertical angles, want %d", got, want)
+	}
+	if got, want := len(g.HorizontalAngles), 3; got != want {
+		t.Fatalf("got %d horizontal angles, want %d", got, want)
+	}
+
+	// Normalized to a peak of 1.
+	if got, want := g.Intensity[0][0], 1.0; got != want {
+		t.Errorf("Intensity[0][0] = %v, want %v", got, want)
+	}
+	if got, want := g.Intensity[2][1], 0.125; got != want {
+		t.Errorf("Intensity[2][1] = %v, want %v", got, want)
+	}
+}
+
+func TestReadIESRejectsTiltFile(t *testing.T) {
+	bad := strings.Replace(testIES, "TILT=NONE", "TILT=lamp.tlt", 1)
+	if _, err := ReadIES(strings.NewReader(bad)); err == nil {
+		t.Errorf("ReadIES accepted a file with separate tilt data")
+	}
+}
+
+func TestGoniometricEval(t *testing.T) {
+	g, err := ReadIES(strings.NewReader(testIES))
+	if err != nil {
+		t.Fatalf("ReadIES: %v", err)
+	}
+
+	deg := math.Pi / 180
+	testCases := []struct {
+		theta, phi float64
+		want       float64
+	}{
+		// On the table.
+		{0, 0, 1.0},
+		{45 * deg, 90 * deg, 0.25},
+		// Interpolated.
+		{22.5 * deg, 0, 0.75},
+		{0, 45 * deg, 0.75},
+		// The last horizontal angle is 180, so the table is mirrored across
+		// the 0-180 plane.
+		{45 * deg, 270 * deg, 0.25},
+		{45 * deg, -90 * deg, 0.25},
+		// Past the last vertical angle.
+		{120 * deg, 0, 0.0},
+	}
+	for _, tc := range testCases {
+		if got := g.Eval(tc.theta, tc.phi); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("Eval(%v, %v) = %v, want %v", tc.theta, tc.phi, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Package light contains light sources that integrators sample directly.
+//
+// Emitting geometry (an element with a material.Emitter) only contributes when
+// a path happens to hit it.  The lights in this package aren't part of the
+// scene's geometry, so rays never hit them; instead, integrators ask them for
+// illumination at each surface they shade.  That makes small and
+// infinitesimal lights (like SpotLight) practical.
+package light
+
+import (
+	"math"
+	"math/rand"
+
+	"row-major/harpoon/material"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// Light is a light source that can be sampled directly.
+//
+// The emission of every light factors into a spectrum, which depends only on
+// wavelength, and a weight, which depends only on geometry.  This lets
+// hero-wavelength sampling share one light sample between all wavelengths.
+type Light interface {
+	Crush(time float64)
+
+	// Spectrum returns the light's emission at freq.  Its units depend on the
+	// type of light.
+	Spectrum(freq float32) float32
+
+	// SampleIllumination picks a direction from p towards the light, and
+	// returns it (normalized) along with the distance to the light in that
+	// direction.
+	//
+	// The radiance arriving at p from the light is weight * Spectrum, divided
+	// by the pdf (with respect to solid angle) of picking dir.  A weight of 0
+	// means that the light doesn't illuminate p.
+	SampleIllumination(p vec3.T, rng *rand.Rand) (dir vec3.T, dist float64, weight float64)
+
+	// SampleEmission picks a ray leaving the light.  The power carried along
+	// it is weight * Spectrum, divided by the pdf of picking the ray.
+	SampleEmission(rng *rand.Rand) (r ray.Ray, weight float64)
+}
+
+// smoothstep is 0 below lo, 1 above hi, and smoothly interpolates between.
+func smoothstep(lo, hi, x float64) float64 {
+	if x <= lo {
+		return 0.0
+	}
+	if x >= hi {
+		return 1.0
+	}
+	t := (x - lo) / (hi - lo)
+	return t * t * (3 - 2*t)
+}
+
+// SpotLight is a point light that shines in a cone.
+//
+// Within InnerAngle of Direction, the light shines at full intensity.  Between
+// InnerAngle and OuterAngle, it falls off smoothly to zero.  An OuterAngle of
+// pi (or more) gives a point light that shines in all directions.
+type SpotLight struct {
+	Position  vec3.T
+	Direction vec3.T
+
+	// Half-angles of the cone, in radians.
+	InnerAngle float64
+	OuterAngle float64
+
+	// The radiant intensity along Direction, per unit wavelength.
+	Intensity material.MaterialMap
+
+	axis     vec3.T
+	cosInner float64
+	cosOuter float64
+}
+
+func (s *SpotLight) Crush(time float64) {
+	s.axis = vec3.Normalize(s.Direction)
+	s.cosInner = math.Cos(math.Min(s.InnerAngle, math.Pi))
+	s.cosOuter = math.Cos(math.Min(s.OuterAngle, math.Pi))
+}
+
+// falloff is the fraction of the full intensity emitted in direction dir.
+func (s *SpotLight) falloff(dir vec3.T) float64 {
+	cosine := vec3.IProd(dir, s.axis)
+	if s.cosOuter <= -1.0 {
+		return 1.0
+	}
+	if cosine >= s.cosInner {
+		return 1.0
+	}
+	return smoothstep(s.cosOuter, s.cosInner, cosine)
+}
+
+func (s *SpotLight) Spectrum(freq float32) float32 {
+	return float32(s.Intensity(material.MaterialCoords{Freq: freq}))
+}
+
+func (s *SpotLight) SampleIllumination(p vec3.T, rng *rand.Rand) (vec3.T, float64, float64) {
+	toLight := vec3.SubVV(s.Position, p)
+	dist := toLight.Norm()
+	if dist == 0.0 {
+		return vec3.T{}, 0.0, 0.0
+	}
+	dir := vec3.DivVS(toLight, dist)
+
+	// A point light is a delta distribution over directions, so there's no
+	// pdf to divide by.  Intensity falls off with the square of distance.
+	return dir, dist, s.falloff(vec3.MulVS(dir, -1.0)) / (dist * dist)
+}
+
+func (s *SpotLight) SampleEmission(rng *rand.Rand) (ray.Ray, float64) {
+	// Pick a direction uniformly within the outer cone.
+	cosTheta := 1.0 - rng.Float64()*(1.0-s.cosOuter)
+	sinTheta := math.Sqrt(math.Max(0.0, 1.0-cosTheta*cosTheta))
+	phi := 2 * math.Pi * rng.Float64()
+
+	u, v := vec3.OrthonormalBasis(s.axis)
+	dir := vec3.AddVV(
+		vec3.MulVS(s.axis, cosTheta),
+		vec3.AddVV(
+			vec3.MulVS(u, sinTheta*math.Cos(phi)),
+			vec3.MulVS(v, sinTheta*math.Sin(phi)),
+		),
+	)
+
+	solidAngle := 2 * math.Pi * (1.0 - s.cosOuter)
+	return ray.Ray{Point: s.Position, Slope: dir}, s.falloff(dir) * solidAngle
+}
+
+// RectLight is a one-sided rectangular area light.  It is the parallelogram
+// spanned by Edge1 and Edge2 from Corner, and emits on the side that Edge1 x
+// Edge2 points towards.
+type RectLight struct {
+	Corner vec3.T
+	Edge1  vec3.T
+	Edge2  vec3.T
+
+	// The radiance emitted by the light, per unit wavelength.
+	Radiance material.MaterialMap
+
+	// The light's relative intensity distribution.  If set, the radiance
+	// emitted at angle theta from the normal is Radiance * Profile / cos
+	// theta, so a profile of cos theta is the same as no profile.  If nil,
+	// the light is Lambertian (it emits Radiance in all directions).
+	Profile *Goniometric
+
+	normal vec3.T
+	area   float64
+}
+
+func (r *RectLight) Crush(time float64) {
+	cross := vec3.CProd(r.Edge1, r.Edge2)
+	r.area = cross.Norm()
+	r.normal = vec3.DivVS(cross, r.area)
+}
+
+// relativeIntensity is the intensity emitted in direction dir, relative to the
+// intensity of a Lambertian light.
+func (r *RectLight) relativeIntensity(dir vec3.T) float64 {
+	cosTheta := vec3.IProd(dir, r.normal)
+	if cosTheta <= 0.0 {
+		return 0.0
+	}
+	if r.Profile == nil {
+		return cosTheta
+	}
+
+	// Horizontal angles are measured around the normal, from Edge1.
+	u := vec3.Normalize(r.Edge1)
+	v := vec3.CProd(r.normal, u)
+	phi := math.Atan2(vec3.IProd(dir, v), vec3.IProd(dir, u))
+	return r.Profile.Eval(math.Acos(math.Min(cosTheta, 1.0)), phi)
+}
+
+func (r *RectLight) Spectrum(freq float32) float32 {
+	return float32(r.Radiance(material.MaterialCoords{Freq: freq}))
+}
+
+func (r *RectLight) SampleIllumination(p vec3.T, rng *rand.Rand) (vec3.T, float64, float64) {
+	point := vec3.AddVV(r.Corner, vec3.AddVV(
+		vec3.MulVS(r.Edge1, rng.Float64()),
+		vec3.MulVS(r.Edge2, rng.Float64()),
+	))
+
+	toLight := vec3.SubVV(point, p)
+	dist := toLight.Norm()
+	if dist == 0.0 {
+		return vec3.T{}, 0.0, 0.0
+	}
+	dir := vec3.DivVS(toLight, dist)
+
+	// The radiance leaving in direction -dir is relativeIntensity / cos
+	// (relative to Radiance).  Converting the uniform area pdf to solid
+	// angle multiplies by area * cos / dist^2, so the cosines cancel.
+	return dir, dist, r.relativeIntensity(vec3.MulVS(dir, -1.0)) * r.area / (dist * dist)
+}
+
+func (r *RectLight) SampleEmission(rng *rand.Rand) (ray.Ray, float64) {
+	point := vec3.AddVV(r.Corner, vec3.AddVV(
+		vec3.MulVS(r.Edge1, rng.Float64()),
+		vec3.MulVS(r.Edge2, rng.Float64()),
+	))
+
+	if r.Profile == nil {
+		// Lambertian, so cosine sampling matches the emission exactly.
+		dir := vec3.CosineUnitVec3Distribution(r.normal, rng)
+		return ray.Ray{Point: point, Slope: dir}, r.area * math.Pi
+	}
+
+	dir := vec3.HemisphereUnitVec3Distribution(r.normal, rng)
+	return ray.Ray{Point: point, Slope: dir}, r.relativeIntensity(dir) * r.area * 2 * math.Pi
+}
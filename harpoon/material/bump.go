@@ -0,0 +1,117 @@
+package material
+
+import (
+	"math/rand"
+	"row-major/harpoon/contact"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// bumpEpsilon is the step in surface coordinates used to take finite
+// differences of a height map.
+const bumpEpsilon = 1e-4
+
+// NormalPerturbation computes the shading normal for a contact that has a
+// tangent frame.  The result doesn't need to be normalized.
+type NormalPerturbation func(c contact.Contact, freq float32) vec3.T
+
+// BumpMap perturbs the shading normal as if the surface were displaced along
+// its normal by scale times height.  Height is differentiated with respect to
+// the surface coordinates (Mtl2), so it should be a surface map.
+func BumpMap(height MaterialMap, scale float64) NormalPerturbation {
+	return func(c contact.Contact, freq float32) vec3.T {
+		coords := MaterialCoords{c.Mtl2, c.Mtl3, freq}
+		h := height(coords)
+
+		du := coords
+		du.Mtl2[0] += bumpEpsilon
+		dv := coords
+		dv.Mtl2[1] += bumpEpsilon
+
+		dhdu := (height(du) - h) / bumpEpsilon
+		dhdv := (height(dv) - h) / bumpEpsilon
+
+		return vec3.SubVV(c.N, vec3.AddVV(
+			vec3.MulVS(c.Tangent, scale*dhdu),
+			vec3.MulVS(c.Bitangent, scale*dhdv),
+		))
+	}
+}
+
+// NormalMap sets the shading normal from three maps giving its components in
+// the contact's tangent frame (tangent, bitangent, normal).  The components are
+// used as-is; maps built from images stored in the usual [0, 1] encoding need
+// to be remapped to [-1, 1] first.
+func NormalMap(x, y, z MaterialMap) NormalPerturbation {
+	return func(c contact.Contact, freq float32) vec3.T {
+		coords := MaterialCoords{c.Mtl2, c.Mtl3, freq}
+		return vec3.AddVV(
+			vec3.MulVS(c.Tangent, x(coords)),
+			vec3.AddVV(
+				vec3.MulVS(c.Bitangent, y(coords)),
+				vec3.MulVS(c.N, z(coords)),
+			),
+		)
+	}
+}
+
+// PerturbNormal wraps a material so that it shades with a perturbed normal.
+// The geometric normal is unchanged; only the material sees the difference.
+//
+// The wrapper passes through SecondaryShader and BSDFEvaluator if the wrapped
+// material implements them.
+func PerturbNormal(base Material, perturb NormalPerturbation) Material {
+	p := &perturbed{base: base, perturb: perturb}
+	if _, ok := base.(BSDFEvaluator); ok {
+		return &perturbedEvaluator{p}
+	}
+	return p
+}
+
+type perturbed struct {
+	base    Material
+	perturb NormalPerturbation
+}
+
+// apply returns the contact with its normal and tangent frame perturbed.
+// Contacts without a tangent frame, or whose perturbed normal degenerates, are
+// left alone.
+func (p *perturbed) apply(c contact.Contact, freq float32) contact.Contact {
+	if c.Tangent == (vec3.T{}) {
+		return c
+	}
+
+	n := p.perturb(c, freq)
+	if norm := n.Norm(); norm < 1e-12 || norm != norm {
+		return c
+	}
+	c.N = vec3.Normalize(n)
+	c.Tangent, c.Bitangent = contact.TangentFrame(c.N, c.Tangent, c.Bitangent)
+	return c
+}
+
+func (p *perturbed) Crush(time float64) {
+	p.base.Crush(time)
+}
+
+func (p *perturbed) Shade(c contact.Contact, freq float32, rng *rand.Rand) ShadeInfo {
+	return p.base.Shade(p.apply(c, freq), freq, rng)
+}
+
+// ShadeSecondary perturbs the normal at the hero wavelength, so that a
+// wavelength-dependent normal map can't make the secondary wavelengths
+// disagree with the incident ray the hero chose.
+func (p *perturbed) ShadeSecondary(c contact.Contact, heroFreq float32, hero ShadeInfo, freq float32) (ShadeInfo, bool) {
+	s, ok := p.base.(SecondaryShader)
+	if !ok {
+		return ShadeInfo{}, false
+	}
+	return s.ShadeSecondary(p.apply(c, heroFreq), heroFreq, hero, freq)
+}
+
+type perturbedEvaluator struct {
+	*perturbed
+}
+
+func (p *perturbedEvaluator) EvalBSDF(c contact.Contact, incident vec3.T, freq float32) float32 {
+	return p.base.(BSDFEvaluator).EvalBSDF(p.apply(c, freq), incident, freq)
+}
@@ -0,0 +1,72 @@
+package material
+
+import (
+	"math/rand"
+	"testing"
+
+	"row-major/harpoon/contact"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// recordNormal is a material that remembers the normal it was shaded with.
+type recordNormal struct {
+	n vec3.T
+}
+
+func (r *recordNormal) Crush(time float64) {}
+
+func (r *recordNormal) Shade(c contact.Contact, freq float32, rng *rand.Rand) ShadeInfo {
+	r.n = c.N
+	return ShadeInfo{}
+}
+
+func flatContact() contact.Contact {
+	return contact.Contact{
+		N:         vec3.T{0, 0, 1},
+		Tangent:   vec3.T{1, 0, 0},
+		Bitangent: vec3.T{0, 1, 0},
+	}
+}
+
+func TestBumpMap(t *testing.T) {
+	cases := []struct {
+		name   string
+		height MaterialMap
+		want   vec3.T
+	}{
+		{"constant", ConstantScalar(3), vec3.T{0, 0, 1}},
+		// A ramp rising along u at 45 degrees tilts the normal back toward -u.
+		{"ramp", func(c MaterialCoords) float64 { return c.Mtl2[0] }, vec3.Normalize(vec3.T{-1, 0, 1})},
+	}
+	for _, tc := range cases {
+		base := &recordNormal{}
+		PerturbNormal(base, BumpMap(tc.height, 1)).Shade(flatContact(), 500, nil)
+		if d := vec3.SubVV(base.n, tc.want).Norm(); d > 1e-6 {
+			t.Errorf("%s: shaded with normal %v, want %v", tc.name, base.n, tc.want)
+		}
+	}
+}
+
+func TestNormalMap(t *testing.T) {
+	base := &recordNormal{}
+	m := PerturbNormal(base, NormalMap(ConstantScalar(0), ConstantScalar(1), ConstantScalar(1)))
+	m.Shade(flatContact(), 500, nil)
+	if want := vec3.Normalize(vec3.T{0, 1, 1}); vec3.SubVV(base.n, want).Norm() > 1e-9 {
+		t.Errorf("shaded with normal %v, want %v", base.n, want)
+	}
+
+	// Without a tangent frame, the normal is left alone.
+	c := flatContact()
+	c.Tangent, c.Bitangent = vec3.T{}, vec3.T{}
+	m.Shade(c, 500, nil)
+	if base.n != (vec3.T{0, 0, 1}) {
+		t.Errorf("shaded with normal %v without a tangent frame", base.n)
+	}
+
+	if _, ok := m.(BSDFEvaluator); ok {
+		t.Errorf("wrapper claims to be a BSDFEvaluator when the base isn't")
+	}
+	if _, ok := PerturbNormal(&MonteCarloLambert{}, NormalMap(nil, nil, nil)).(BSDFEvaluator); !ok {
+		t.Errorf("wrapper hides the base's BSDFEvaluator")
+	}
+}
@@ -0,0 +1,307 @@
+package material
+
+import (
+	"math"
+	"math/rand"
+	"row-major/harpoon/contact"
+	"row-major/harpoon/densesignal"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec3"
+	"sort"
+)
+
+// ReradiationMatrix describes how a fluorescent material re-emits the light it
+// absorbs.  Excitation and emission wavelengths share one grid of Size bins
+// spanning [SrcX, LimX).
+//
+// Entry M(excitation, emission) is the power re-emitted per unit of emission
+// wavelength, per unit of power absorbed at the excitation wavelength.
+// Integrating a column over emission wavelength gives the fraction of the
+// absorbed power that comes back out (the energy yield, at most 1).
+type ReradiationMatrix struct {
+	SrcX float32
+	LimX float32
+	Size int
+
+	// values[o*Size+i] is the entry for excitation bin i and emission bin o.
+	values []float32
+
+	// Cumulative sums along each row (over excitation) and each column (over
+	// emission), for sampling.
+	rowCDF []float32
+	colCDF []float32
+}
+
+// NewReradiationMatrix makes a matrix from its entries, in row-major order with
+// one row per emission bin and one column per excitation bin.
+func NewReradiationMatrix(srcX, limX float32, size int, values []float32) *ReradiationMatrix {
+	m := &ReradiationMatrix{
+		SrcX:   srcX,
+		LimX:   limX,
+		Size:   size,
+		values: values,
+		rowCDF: make([]float32, size*size),
+		colCDF: make([]float32, size*size),
+	}
+
+	for o := 0; o < size; o++ {
+		var sum float32
+		for i := 0; i < size; i++ {
+			sum += values[o*size+i]
+			m.rowCDF[o*size+i] = sum
+		}
+	}
+	for i := 0; i < size; i++ {
+		var sum float32
+		for o := 0; o < size; o++ {
+			sum += values[o*size+i]
+			m.colCDF[i*size+o] = sum
+		}
+	}
+
+	return m
+}
+
+// SeparableReradiation builds the common model of a fluorescent dye: the
+// fraction of light absorbed at each wavelength is given by absorption, and
+// the absorbed power is re-emitted with the shape of the emission spectrum,
+// scaled by yield.
+//
+// A photon can't gain energy by fluorescing, so nothing is re-emitted at
+// wavelengths shorter than the excitation wavelength.  The emission spectrum
+// is renormalized for each excitation wavelength to account for that.
+func SeparableReradiation(absorption, emission *densesignal.DenseSignal, yield float32) *ReradiationMatrix {
+	srcX := absorption.SrcX
+	if emission.SrcX < srcX {
+		srcX = emission.SrcX
+	}
+	limX := absorption.LimX
+	if emission.LimX > limX {
+		limX = emission.LimX
+	}
+	step := absorption.StepX()
+	if emission.StepX() < step {
+		step = emission.StepX()
+	}
+	size := int(math.Ceil(float64((limX - srcX) / step)))
+	step = (limX - srcX) / float32(size)
+
+	center := func(bin int) float32 {
+		return srcX + (float32(bin)+0.5)*step
+	}
+
+	values := make([]float32, size*size)
+	for i := 0; i < size; i++ {
+		a := absorption.Interpolate(center(i))
+		if a == 0 {
+			continue
+		}
+
+		var total float32
+		for o := i; o < size; o++ {
+			total += emission.Interpolate(center(o)) * step
+		}
+		if total == 0 {
+			continue
+		}
+
+		for o := i; o < size; o++ {
+			values[o*size+i] = yield * a * emission.Interpolate(center(o)) / total
+		}
+	}
+
+	return NewReradiationMatrix(srcX, limX, size, values)
+}
+
+func (m *ReradiationMatrix) step() float32 {
+	return (m.LimX - m.SrcX) / float32(m.Size)
+}
+
+// bin returns the bin containing wavelength x, or -1 if it's off the grid.
+func (m *ReradiationMatrix) bin(x float32) int {
+	if x < m.SrcX || m.LimX < x {
+		return -1
+	}
+	b := int((x - m.SrcX) / m.step())
+	if b >= m.Size {
+		b = m.Size - 1
+	}
+	return b
+}
+
+// Eval returns the matrix entry for the given wavelengths.
+func (m *ReradiationMatrix) Eval(excitation, emission float32) float32 {
+	i, o := m.bin(excitation), m.bin(emission)
+	if i == -1 || o == -1 {
+		return 0.0
+	}
+	return m.values[o*m.Size+i]
+}
+
+// ExcitationIntegral is the integral of the matrix over excitation wavelength,
+// at the given emission wavelength.
+func (m *ReradiationMatrix) ExcitationIntegral(emission float32) float32 {
+	o := m.bin(emission)
+	if o == -1 {
+		return 0.0
+	}
+	return m.rowCDF[o*m.Size+m.Size-1] * m.step()
+}
+
+// Yield is the integral of the matrix over emission wavelength, at the given
+// excitation wavelength.
+func (m *ReradiationMatrix) Yield(excitation float32) float32 {
+	i := m.bin(excitation)
+	if i == -1 {
+		return 0.0
+	}
+	return m.colCDF[i*m.Size+m.Size-1] * m.step()
+}
+
+// sampleCDF picks a wavelength in proportion to the entries of cdf (one
+// cumulative row or column of the matrix), returning it and its pdf per unit
+// wavelength.  It returns a pdf of 0 if the entries are all zero.
+func (m *ReradiationMatrix) sampleCDF(cdf []float32, u float32) (float32, float32) {
+	total := cdf[len(cdf)-1]
+	if total == 0 {
+		return 0.0, 0.0
+	}
+
+	target := u * total
+	b := sort.Search(len(cdf), func(k int) bool { return cdf[k] > target })
+	if b == len(cdf) {
+		b = len(cdf) - 1
+	}
+	lo := float32(0)
+	if b > 0 {
+		lo = cdf[b-1]
+	}
+
+	// Place the sample within the bin by how far past the bin's start the
+	// target is, which reuses the remaining randomness of u.
+	frac := (target - lo) / (cdf[b] - lo)
+	x := m.SrcX + (float32(b)+frac)*m.step()
+	return x, (cdf[b] - lo) / (total * m.step())
+}
+
+// SampleExcitation picks an excitation wavelength in proportion to how much of
+// it is re-emitted at the given emission wavelength.  It returns the
+// wavelength and its pdf per unit wavelength; the pdf is 0 if nothing is
+// re-emitted at emission.
+func (m *ReradiationMatrix) SampleExcitation(emission, u float32) (float32, float32) {
+	o := m.bin(emission)
+	if o == -1 {
+		return 0.0, 0.0
+	}
+	return m.sampleCDF(m.rowCDF[o*m.Size:(o+1)*m.Size], u)
+}
+
+// SampleEmission picks an emission wavelength in proportion to how much light
+// absorbed at the given excitation wavelength is re-emitted there.  It returns
+// the wavelength and its pdf per unit wavelength; the pdf is 0 if nothing
+// absorbed at excitation is re-emitted.
+func (m *ReradiationMatrix) SampleEmission(excitation, u float32) (float32, float32) {
+	i := m.bin(excitation)
+	if i == -1 {
+		return 0.0, 0.0
+	}
+	return m.sampleCDF(m.colCDF[i*m.Size:(i+1)*m.Size], u)
+}
+
+// Reradiator is implemented by materials that absorb light at one wavelength
+// and re-emit it at another.
+//
+// Shade handles reradiation for paths traced from the camera, by setting
+// ShadeInfo.IncidentFreq.  The methods here are for integrators that connect
+// to lights directly, or trace light forward from its source.
+type Reradiator interface {
+	// EvalReradiation is EvalBSDF for light that arrives from incident at
+	// the excitation wavelength and leaves back along the contact ray at
+	// freq.  It's a density over excitation wavelength.
+	EvalReradiation(globalContact contact.Contact, incident vec3.T, excitation, freq float32) float32
+
+	// SampleExcitation picks an excitation wavelength for light leaving at
+	// freq, returning it and its pdf per unit wavelength.  A pdf of 0 means
+	// nothing is re-emitted at freq.
+	SampleExcitation(globalContact contact.Contact, freq float32, rng *rand.Rand) (float32, float32)
+
+	// ShadePhoton is Shade for light travelling forward: it picks where light
+	// that arrives along the contact ray at freq goes next (returned as the
+	// IncidentRay), and at what wavelength.
+	ShadePhoton(globalContact contact.Contact, freq float32, rng *rand.Rand) ShadeInfo
+}
+
+// Fluorescent is a diffuse material that re-emits some of the light it absorbs
+// at longer wavelengths, like highlighter ink or paper with optical
+// brighteners.
+//
+// Reflectance is the fraction of light reflected without a change of
+// wavelength.  The reradiated light leaves with the same (Lambertian)
+// distribution of directions as the reflected light.
+type Fluorescent struct {
+	Reflectance MaterialMap
+	Reradiation *ReradiationMatrix
+}
+
+func (f *Fluorescent) Crush(time float64) {}
+
+// scatter picks between reflection and reradiation in proportion to their
+// weights, and a cosine-distributed direction.  Either way, the path's weight
+// is the sum of the two.
+func (f *Fluorescent) scatter(c contact.Contact, reflected, reradiated float32, sampleFreq func() float32, rng *rand.Rand) ShadeInfo {
+	total := reflected + reradiated
+	if total <= 0.0 {
+		return ShadeInfo{}
+	}
+
+	info := ShadeInfo{
+		IncidentRay: ray.Ray{
+			Point: c.P,
+			Slope: vec3.CosineUnitVec3Distribution(c.N, rng),
+		},
+		PropagationK: total,
+	}
+	if rng.Float32()*total < reradiated {
+		info.IncidentFreq = sampleFreq()
+		if info.IncidentFreq == 0.0 {
+			info.PropagationK = 0.0
+		}
+	}
+	return info
+}
+
+func (f *Fluorescent) Shade(c contact.Contact, freq float32, rng *rand.Rand) ShadeInfo {
+	reflectance := float32(f.Reflectance(MaterialCoords{c.Mtl2, c.Mtl3, freq}))
+	return f.scatter(c, reflectance, f.Reradiation.ExcitationIntegral(freq), func() float32 {
+		excitation, _ := f.Reradiation.SampleExcitation(freq, rng.Float32())
+		return excitation
+	}, rng)
+}
+
+func (f *Fluorescent) ShadePhoton(c contact.Contact, freq float32, rng *rand.Rand) ShadeInfo {
+	reflectance := float32(f.Reflectance(MaterialCoords{c.Mtl2, c.Mtl3, freq}))
+	return f.scatter(c, reflectance, f.Reradiation.Yield(freq), func() float32 {
+		emission, _ := f.Reradiation.SampleEmission(freq, rng.Float32())
+		return emission
+	}, rng)
+}
+
+// EvalBSDF covers only the light reflected without a change of wavelength.
+func (f *Fluorescent) EvalBSDF(c contact.Contact, incident vec3.T, freq float32) float32 {
+	if vec3.IProd(c.N, incident) <= 0.0 {
+		return 0.0
+	}
+	reflectance := f.Reflectance(MaterialCoords{c.Mtl2, c.Mtl3, freq})
+	return float32(reflectance / math.Pi)
+}
+
+func (f *Fluorescent) EvalReradiation(c contact.Contact, incident vec3.T, excitation, freq float32) float32 {
+	if vec3.IProd(c.N, incident) <= 0.0 {
+		return 0.0
+	}
+	return f.Reradiation.Eval(excitation, freq) / math.Pi
+}
+
+func (f *Fluorescent) SampleExcitation(c contact.Contact, freq float32, rng *rand.Rand) (float32, float32) {
+	return f.Reradiation.SampleExcitation(freq, rng.Float32())
+}
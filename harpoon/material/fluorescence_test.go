@@ -0,0 +1,67 @@
+package material
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"row-major/harpoon/densesignal"
+)
+
+func testReradiation() *ReradiationMatrix {
+	// Absorb blue, emit green, like highlighter ink.
+	absorption := densesignal.VisibleSpectrumPulse(420, 480, 0.9)
+	emission := densesignal.VisibleSpectrumPulse(500, 560, 1)
+	return SeparableReradiation(absorption, emission, 0.8)
+}
+
+func TestSeparableReradiation(t *testing.T) {
+	m := testReradiation()
+
+	if got := m.Yield(450); math.Abs(float64(got)-0.9*0.8) > 1e-4 {
+		t.Errorf("Yield(450) = %v, want %v", got, 0.9*0.8)
+	}
+	if got := m.Yield(600); got != 0 {
+		t.Errorf("Yield(600) = %v, want 0", got)
+	}
+	if got := m.Eval(530, 450); got != 0 {
+		t.Errorf("Eval(530, 450) = %v, want 0 (no anti-Stokes emission)", got)
+	}
+	if got := m.ExcitationIntegral(450); got != 0 {
+		t.Errorf("ExcitationIntegral(450) = %v, want 0", got)
+	}
+}
+
+func TestReradiationSampling(t *testing.T) {
+	m := testReradiation()
+	rng := rand.New(rand.NewSource(1))
+
+	// Averaging Eval / pdf over samples of the excitation wavelength has to
+	// recover the integral.
+	const n = 10000
+	var sum float64
+	for i := 0; i < n; i++ {
+		x, pdf := m.SampleExcitation(530, rng.Float32())
+		if pdf == 0 {
+			t.Fatalf("SampleExcitation(530) returned a zero pdf")
+		}
+		if x < 420 || x >= 480 {
+			t.Fatalf("SampleExcitation(530) = %v, outside the absorption band", x)
+		}
+		sum += float64(m.Eval(x, 530) / pdf)
+	}
+	if got, want := sum/n, float64(m.ExcitationIntegral(530)); math.Abs(got-want) > 1e-3*want {
+		t.Errorf("mean of Eval / pdf is %v, want %v", got, want)
+	}
+
+	for i := 0; i < 100; i++ {
+		x, pdf := m.SampleEmission(450, rng.Float32())
+		if pdf == 0 || x < 500 || x >= 560 {
+			t.Fatalf("SampleEmission(450) = %v (pdf %v), want a wavelength in the emission band", x, pdf)
+		}
+	}
+
+	if _, pdf := m.SampleEmission(600, 0.5); pdf != 0 {
+		t.Errorf("SampleEmission(600) has pdf %v, want 0", pdf)
+	}
+}
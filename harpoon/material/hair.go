@@ -0,0 +1,380 @@
+package material
+
+import (
+	"math"
+	"math/rand"
+
+	"row-major/harpoon/contact"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// Hair scatters light the way a hair or fur fiber does, following Chiang et
+// al., "A Practical and Controllable Hair and Fur Model for Production Path
+// Tracing".  Light reflects off the fiber's surface (R), passes through it (TT),
+// or reflects once inside it (TRT), and higher orders are lumped together.
+// Each lobe is spread out around the fiber (azimuthally) and along it
+// (longitudinally), and the lobes are shifted apart by the tilt of the
+// cuticle's scales.
+//
+// Hair is meant for Curves, whose contacts supply what it needs: the tangent
+// runs along the fiber, and the second material coordinate says where across
+// the fiber the ray hit, from 0 at one edge to 1 at the other.
+type Hair struct {
+	// Absorption is the absorption coefficient of the fiber's interior, in
+	// units of the inverse fiber radius.  MelaninAbsorption gives natural
+	// hair colors.
+	Absorption MaterialMap
+
+	// IndexOfRefraction of the fiber.  Keratin is about 1.55.
+	IndexOfRefraction MaterialMap
+
+	// LongitudinalRoughness and AzimuthalRoughness are in [0, 1].  Smooth
+	// human hair is about 0.3 for both; fur is rougher azimuthally.
+	LongitudinalRoughness float64
+	AzimuthalRoughness    float64
+
+	// ScaleAngle is the tilt of the cuticle's scales, in degrees.  Human hair
+	// is about 2.
+	ScaleAngle float64
+
+	// The longitudinal variance of each lobe, and the azimuthal logistic
+	// scale.
+	variance [hairLobes + 1]float64
+	scale    float64
+
+	// Sines and cosines of twice, four times, and eight times ScaleAngle,
+	// which shift the lobes.
+	sin2kAlpha, cos2kAlpha [3]float64
+}
+
+// hairLobes is the number of lobes modeled individually: R, TT, and TRT.
+const hairLobes = 3
+
+// MelaninAbsorption is the absorption coefficient of a hair fiber with the
+// given concentrations of eumelanin (brown-black) and pheomelanin (red-yellow),
+// for Hair.Absorption.  Concentrations of eumelanin run from about 0.05 for
+// blonde hair to 1.3 for brown and 8 for black; red hair has some of both.
+//
+// The spectra are power laws fitted to the d'Eon et al. absorption
+// coefficients that Chiang et al. give.
+func MelaninAbsorption(eumelanin, pheomelanin float64) MaterialMap {
+	return func(coords MaterialCoords) float64 {
+		lambda := float64(coords.Freq) / 550
+		return eumelanin*0.70*math.Pow(lambda, -3.2) + pheomelanin*0.40*math.Pow(lambda, -4.75)
+	}
+}
+
+// Crush works out the lobes' widths, which only depend on the roughnesses.
+func (h *Hair) Crush(time float64) {
+	bm := h.LongitudinalRoughness
+	h.variance[0] = sqr(0.726*bm + 0.812*bm*bm + 3.7*math.Pow(bm, 20))
+	h.variance[1] = 0.25 * h.variance[0]
+	h.variance[2] = 4 * h.variance[0]
+	h.variance[hairLobes] = h.variance[2]
+
+	bn := h.AzimuthalRoughness
+	h.scale = math.Sqrt(math.Pi/8) * (0.265*bn + 1.194*bn*bn + 5.372*math.Pow(bn, 22))
+
+	h.sin2kAlpha[0] = math.Sin(h.ScaleAngle * math.Pi / 180)
+	h.cos2kAlpha[0] = math.Sqrt(1 - sqr(h.sin2kAlpha[0]))
+	for i := 1; i < 3; i++ {
+		h.sin2kAlpha[i] = 2 * h.cos2kAlpha[i-1] * h.sin2kAlpha[i-1]
+		h.cos2kAlpha[i] = sqr(h.cos2kAlpha[i-1]) - sqr(h.sin2kAlpha[i-1])
+	}
+}
+
+func sqr(x float64) float64 {
+	return x * x
+}
+
+func safeSqrt(x float64) float64 {
+	return math.Sqrt(math.Max(0, x))
+}
+
+func safeAsin(x float64) float64 {
+	return math.Asin(math.Max(-1, math.Min(x, 1)))
+}
+
+// hairFrame is the fiber's coordinate frame at a contact: X runs along the
+// fiber, and Z is the contact normal.
+type hairFrame struct {
+	x, y, z vec3.T
+}
+
+func newHairFrame(c contact.Contact) hairFrame {
+	x := vec3.Normalize(c.Tangent)
+	z := vec3.Normalize(vec3.Reject(x, c.N))
+	return hairFrame{x: x, y: vec3.CProd(z, x), z: z}
+}
+
+// angles returns the sine and cosine of the longitudinal angle of v (from the
+// plane perpendicular to the fiber), and its azimuthal angle around the fiber.
+func (f hairFrame) angles(v vec3.T) (float64, float64, float64) {
+	sinTheta := vec3.IProd(v, f.x)
+	return sinTheta, safeSqrt(1 - sinTheta*sinTheta), math.Atan2(vec3.IProd(v, f.z), vec3.IProd(v, f.y))
+}
+
+// hairState is everything about a contact that the lobes depend on, at one
+// wavelength.
+type hairState struct {
+	frame hairFrame
+
+	sinThetaO, cosThetaO, phiO float64
+
+	// gammaO and gammaT are the angles of the ray off the fiber's axis,
+	// outside and inside the fiber.
+	gammaO, gammaT float64
+
+	// attenuation of each lobe.
+	attenuation [hairLobes + 1]float64
+}
+
+func (h *Hair) state(c contact.Contact, freq float32) hairState {
+	coords := MaterialCoords{c.Mtl2, c.Mtl3, freq}
+	eta := h.IndexOfRefraction(coords)
+	absorption := h.Absorption(coords)
+
+	s := hairState{frame: newHairFrame(c)}
+	s.sinThetaO, s.cosThetaO, s.phiO = s.frame.angles(vec3.MulVS(c.R.Slope, -1))
+
+	offset := math.Max(-1, math.Min(2*c.Mtl2[1]-1, 1))
+	s.gammaO = safeAsin(offset)
+
+	// The fiber's cross-section seen along the ray acts as if it had a
+	// modified index of refraction.
+	sinThetaT := s.sinThetaO / eta
+	cosThetaT := safeSqrt(1 - sinThetaT*sinThetaT)
+	etaP := safeSqrt(eta*eta-s.sinThetaO*s.sinThetaO) / s.cosThetaO
+	sinGammaT := offset / etaP
+	cosGammaT := safeSqrt(1 - sinGammaT*sinGammaT)
+	s.gammaT = safeAsin(sinGammaT)
+
+	transmittance := math.Exp(-absorption * 2 * cosGammaT / cosThetaT)
+
+	f := fresnelDielectric(s.cosThetaO*math.Cos(s.gammaO), eta)
+	s.attenuation[0] = f
+	s.attenuation[1] = sqr(1-f) * transmittance
+	s.attenuation[2] = s.attenuation[1] * transmittance * f
+	s.attenuation[hairLobes] = s.attenuation[2] * f * transmittance / (1 - transmittance*f)
+
+	return s
+}
+
+// fresnelDielectric is the reflectance of unpolarized light arriving at the
+// given cosine from outside a dielectric of index eta.
+func fresnelDielectric(cosI, eta float64) float64 {
+	sinT := safeSqrt(1-cosI*cosI) / eta
+	if sinT >= 1 {
+		return 1
+	}
+	cosT := safeSqrt(1 - sinT*sinT)
+	rs := (cosI - eta*cosT) / (cosI + eta*cosT)
+	rp := (eta*cosI - cosT) / (eta*cosI + cosT)
+	return (rs*rs + rp*rp) / 2
+}
+
+// tiltedOutgoing is the longitudinal angle of the outgoing direction, shifted
+// for lobe p by the cuticle's scales.
+func (h *Hair) tiltedOutgoing(s *hairState, p int) (float64, float64) {
+	sinThetaO, cosThetaO := s.sinThetaO, s.cosThetaO
+	switch p {
+	case 0:
+		return sinThetaO*h.cos2kAlpha[1] - cosThetaO*h.sin2kAlpha[1], math.Abs(cosThetaO*h.cos2kAlpha[1] + sinThetaO*h.sin2kAlpha[1])
+	case 1:
+		return sinThetaO*h.cos2kAlpha[0] + cosThetaO*h.sin2kAlpha[0], math.Abs(cosThetaO*h.cos2kAlpha[0] - sinThetaO*h.sin2kAlpha[0])
+	case 2:
+		return sinThetaO*h.cos2kAlpha[2] + cosThetaO*h.sin2kAlpha[2], math.Abs(cosThetaO*h.cos2kAlpha[2] - sinThetaO*h.sin2kAlpha[2])
+	}
+	return sinThetaO, cosThetaO
+}
+
+// longitudinal is the longitudinal scattering function M_p, with variance v.
+func longitudinal(cosThetaI, cosThetaO, sinThetaI, sinThetaO, v float64) float64 {
+	a := cosThetaI * cosThetaO / v
+	b := sinThetaI * sinThetaO / v
+	if v <= 0.1 {
+		// The direct form overflows for narrow lobes.
+		return math.Exp(logI0(a) - b - 1/v + math.Ln2 + math.Log(1/(2*v)))
+	}
+	return math.Exp(-b) * besselI0(a) / (math.Sinh(1/v) * 2 * v)
+}
+
+// besselI0 is the modified Bessel function of the first kind, of order zero.
+func besselI0(x float64) float64 {
+	val, x2i, ifact, i4 := 0.0, 1.0, 1.0, 1.0
+	for i := 0; i < 10; i++ {
+		if i > 1 {
+			ifact *= float64(i)
+		}
+		val += x2i / (i4 * ifact * ifact)
+		x2i *= x * x
+		i4 *= 4
+	}
+	return val
+}
+
+func logI0(x float64) float64 {
+	if x > 12 {
+		return x + 0.5*(-math.Log(2*math.Pi)+math.Log(1/x)+1/(8*x))
+	}
+	return math.Log(besselI0(x))
+}
+
+// azimuthalShift is the azimuthal angle that lobe p leaves the fiber at, for
+// perfectly smooth fibers.
+func azimuthalShift(p int, gammaO, gammaT float64) float64 {
+	return 2*float64(p)*gammaT - 2*gammaO + float64(p)*math.Pi
+}
+
+func logistic(x, s float64) float64 {
+	x = math.Abs(x)
+	return math.Exp(-x/s) / (s * sqr(1+math.Exp(-x/s)))
+}
+
+func logisticCDF(x, s float64) float64 {
+	return 1 / (1 + math.Exp(-x/s))
+}
+
+// trimmedLogistic is the logistic distribution with scale s, restricted to
+// [-pi, pi].
+func trimmedLogistic(x, s float64) float64 {
+	return logistic(x, s) / (logisticCDF(math.Pi, s) - logisticCDF(-math.Pi, s))
+}
+
+func sampleTrimmedLogistic(u, s float64) float64 {
+	k := logisticCDF(math.Pi, s) - logisticCDF(-math.Pi, s)
+	x := -s * math.Log(1/(u*k+logisticCDF(-math.Pi, s))-1)
+	return math.Max(-math.Pi, math.Min(x, math.Pi))
+}
+
+// azimuthal is the azimuthal scattering function N_p for lobe p, at the
+// difference phi between the incident and outgoing azimuths.
+func (h *Hair) azimuthal(phi float64, p int, s *hairState) float64 {
+	dphi := phi - azimuthalShift(p, s.gammaO, s.gammaT)
+	dphi = math.Remainder(dphi, 2*math.Pi)
+	return trimmedLogistic(dphi, h.scale)
+}
+
+// lobes returns the contribution of each lobe to the scattering of light
+// arriving from direction incident (before dividing by the cosine to the
+// normal).
+func (h *Hair) lobes(s *hairState, incident vec3.T) [hairLobes + 1]float64 {
+	sinThetaI, cosThetaI, phiI := s.frame.angles(incident)
+	phi := phiI - s.phiO
+
+	var result [hairLobes + 1]float64
+	for p := 0; p < hairLobes; p++ {
+		sinThetaO, cosThetaO := h.tiltedOutgoing(s, p)
+		result[p] = longitudinal(cosThetaI, cosThetaO, sinThetaI, sinThetaO, h.variance[p]) * h.azimuthal(phi, p, s)
+	}
+	result[hairLobes] = longitudinal(cosThetaI, s.cosThetaO, sinThetaI, s.sinThetaO, h.variance[hairLobes]) / (2 * math.Pi)
+	return result
+}
+
+// eval returns the scattering function for light arriving from direction
+// incident, times the cosine to the normal (so that it's independent of the
+// normal, as the fiber is), and the pdf with which sample picks incident.
+func (h *Hair) eval(s *hairState, incident vec3.T) (float64, float64) {
+	lobes := h.lobes(s, incident)
+	weights := h.lobeWeights(s)
+
+	f, pdf := 0.0, 0.0
+	for p := range lobes {
+		f += lobes[p] * s.attenuation[p]
+		pdf += lobes[p] * weights[p]
+	}
+	return f, pdf
+}
+
+// lobeWeights are the probabilities that sample picks each lobe: in
+// proportion to how much light the lobe carries.
+func (h *Hair) lobeWeights(s *hairState) [hairLobes + 1]float64 {
+	total := 0.0
+	for _, a := range s.attenuation {
+		total += a
+	}
+	var weights [hairLobes + 1]float64
+	for p, a := range s.attenuation {
+		weights[p] = a / total
+	}
+	return weights
+}
+
+// sample picks a direction for light to arrive from.
+func (h *Hair) sample(s *hairState, rng *rand.Rand) vec3.T {
+	weights := h.lobeWeights(s)
+	p := 0
+	for u := rng.Float64(); p < hairLobes && u >= weights[p]; p++ {
+		u -= weights[p]
+	}
+
+	// Sample the longitudinal lobe around the tilted mirror direction.
+	sinThetaO, cosThetaO := h.tiltedOutgoing(s, p)
+	v := h.variance[p]
+	u := math.Max(rng.Float64(), 1e-5)
+	cosTheta := 1 + v*math.Log(u+(1-u)*math.Exp(-2/v))
+	sinTheta := safeSqrt(1 - cosTheta*cosTheta)
+	cosPhi := math.Cos(2 * math.Pi * rng.Float64())
+	sinThetaI := -cosTheta*sinThetaO + sinTheta*cosPhi*cosThetaO
+	cosThetaI := safeSqrt(1 - sinThetaI*sinThetaI)
+
+	var dphi float64
+	if p < hairLobes {
+		dphi = azimuthalShift(p, s.gammaO, s.gammaT) + sampleTrimmedLogistic(rng.Float64(), h.scale)
+	} else {
+		dphi = 2 * math.Pi * rng.Float64()
+	}
+	phiI := s.phiO + dphi
+
+	return vec3.AddVV(vec3.MulVS(s.frame.x, sinThetaI), vec3.AddVV(
+		vec3.MulVS(s.frame.y, cosThetaI*math.Cos(phiI)),
+		vec3.MulVS(s.frame.z, cosThetaI*math.Sin(phiI)),
+	))
+}
+
+func (h *Hair) Shade(c contact.Contact, freq float32, rng *rand.Rand) ShadeInfo {
+	s := h.state(c, freq)
+	incident := h.sample(&s, rng)
+	f, pdf := h.eval(&s, incident)
+
+	k := 0.0
+	if pdf > 0 {
+		k = f / pdf
+	}
+	return ShadeInfo{
+		IncidentRay:  ray.Ray{Point: c.P, Slope: incident},
+		PropagationK: float32(k),
+	}
+}
+
+// EvalBSDF scatters light arriving from any direction, in front of the fiber
+// or behind it.
+func (h *Hair) EvalBSDF(c contact.Contact, incident vec3.T, freq float32) float32 {
+	cosine := math.Abs(vec3.IProd(c.N, incident))
+	if cosine == 0 {
+		return 0
+	}
+	s := h.state(c, freq)
+	f, _ := h.eval(&s, incident)
+	return float32(f / cosine)
+}
+
+// ShadeSecondary scatters freq along the hero's incident ray.  The choice of
+// lobe depends on wavelength, so the pdf is the hero's.
+func (h *Hair) ShadeSecondary(c contact.Contact, heroFreq float32, hero ShadeInfo, freq float32) (ShadeInfo, bool) {
+	heroState := h.state(c, heroFreq)
+	_, pdf := h.eval(&heroState, hero.IncidentRay.Slope)
+
+	s := h.state(c, freq)
+	f, _ := h.eval(&s, hero.IncidentRay.Slope)
+
+	k := 0.0
+	if pdf > 0 {
+		k = f / pdf
+	}
+	return ShadeInfo{
+		IncidentRay:  hero.IncidentRay,
+		PropagationK: float32(k),
+	}, true
+}
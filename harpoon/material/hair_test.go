@@ -0,0 +1,107 @@
+package material
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"row-major/harpoon/contact"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec2"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// hairContact is a contact with a fiber running along x, at offset h across it
+// (from -1 to 1), seen from direction view.
+func hairContact(h float64, view vec3.T) contact.Contact {
+	return contact.Contact{
+		R:       ray.Ray{Point: vec3.T{0, 0, 0}, Slope: vec3.MulVS(view, -1)},
+		N:       vec3.T{0, 0, 1},
+		Tangent: vec3.T{1, 0, 0},
+		Mtl2:    vec2.T{0.5, (h + 1) / 2},
+	}
+}
+
+// TestHairWhiteFurnace checks that a fiber that doesn't absorb anything
+// scatters all the light that hits it, once integrated across the fiber.
+func TestHairWhiteFurnace(t *testing.T) {
+	for _, roughness := range []float64{0.2, 0.5, 0.9} {
+		h := &Hair{
+			Absorption:            ConstantScalar(0),
+			IndexOfRefraction:     ConstantScalar(1.55),
+			LongitudinalRoughness: roughness,
+			AzimuthalRoughness:    roughness,
+			ScaleAngle:            2,
+		}
+		h.Crush(0)
+
+		rng := rand.New(rand.NewSource(1))
+		view := vec3.Normalize(vec3.T{0.3, 0.2, 1})
+
+		const samples = 400000
+		total := 0.0
+		for i := 0; i < samples; i++ {
+			c := hairContact(2*rng.Float64()-1, view)
+			dir := vec3.UniformUnitDistribution(rng)
+			f := float64(h.EvalBSDF(c, dir, 550))
+			total += f * math.Abs(vec3.IProd(c.N, dir)) * 4 * math.Pi
+		}
+		total /= samples
+
+		if math.Abs(total-1) > 0.05 {
+			t.Errorf("roughness %v: scatters %v, want 1", roughness, total)
+		}
+	}
+}
+
+// TestHairEvalBSDFMatchesShade is TestEvalBSDFMatchesShade for hair, which
+// scatters light in every direction, not just above the surface.
+func TestHairEvalBSDFMatchesShade(t *testing.T) {
+	h := &Hair{
+		Absorption:            MelaninAbsorption(1.3, 0),
+		IndexOfRefraction:     ConstantScalar(1.55),
+		LongitudinalRoughness: 0.3,
+		AzimuthalRoughness:    0.4,
+		ScaleAngle:            2,
+	}
+	h.Crush(0)
+
+	c := hairContact(0.3, vec3.Normalize(vec3.T{0.5, -0.2, 1}))
+	weight := func(dir vec3.T) float64 {
+		return 1 + dir[0] + dir[1]*dir[2]
+	}
+
+	const samples = 400000
+	rng := rand.New(rand.NewSource(1))
+
+	shaded := 0.0
+	for i := 0; i < samples; i++ {
+		info := h.Shade(c, 550, rng)
+		shaded += float64(info.PropagationK) * weight(info.IncidentRay.Slope)
+	}
+	shaded /= samples
+
+	evaluated := 0.0
+	for i := 0; i < samples; i++ {
+		dir := vec3.UniformUnitDistribution(rng)
+		f := float64(h.EvalBSDF(c, dir, 550))
+		evaluated += f * math.Abs(vec3.IProd(c.N, dir)) * weight(dir) * 4 * math.Pi
+	}
+	evaluated /= samples
+
+	if math.Abs(shaded-evaluated) > 0.03*evaluated {
+		t.Errorf("Shade estimates %v, EvalBSDF integrates to %v", shaded, evaluated)
+	}
+}
+
+func TestMelaninAbsorption(t *testing.T) {
+	// Eumelanin makes hair brown: it absorbs blue more than red.
+	brown := MelaninAbsorption(1.3, 0)
+	blue, red := brown(MaterialCoords{Freq: 450}), brown(MaterialCoords{Freq: 650})
+	if blue <= red {
+		t.Errorf("eumelanin absorbs %v at 450nm and %v at 650nm", blue, red)
+	}
+	if got := MelaninAbsorption(0, 0)(MaterialCoords{Freq: 550}); got != 0 {
+		t.Errorf("hair without melanin absorbs %v", got)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"row-major/harpoon/contact"
 	"row-major/harpoon/densesignal"
+	"row-major/harpoon/polarization"
 	"row-major/harpoon/ray"
 	"row-major/harpoon/vmath/vec2"
 	"row-major/harpoon/vmath/vec3"
@@ -31,6 +32,28 @@ func ConstantSpectrum(spectrum *densesignal.DenseSignal) MaterialMap {
 	}
 }
 
+// Blackbody is the emission spectrum of a black body, whose temperature (in
+// kelvin) is given by the temperature map.
+//
+// Like densesignal.BlackbodyEmission, the spectrum is normalized to an
+// integrated power of x over the visible spectrum, so the temperature sets the
+// color but not the brightness.
+func Blackbody(temperature MaterialMap, x float64) MaterialMap {
+	visible := densesignal.VisibleSpectrumSignal()
+	step := float64(visible.StepX())
+
+	return func(coords MaterialCoords) float64 {
+		t := temperature(coords)
+
+		total := 0.0
+		for i := range visible.Samples {
+			total += densesignal.Planck(t, float64(visible.SrcX)+(float64(i)+0.5)*step) * step
+		}
+
+		return densesignal.Planck(t, float64(coords.Freq)) / total * x
+	}
+}
+
 func LerpBetween(t, a, b MaterialMap) MaterialMap {
 	return func(coords MaterialCoords) float64 {
 		tVal := t(coords)
@@ -143,150 +166,88 @@ func BullseyeVolume(period float64) MaterialMap {
 	}
 }
 
-// A multiplicative hash (in Knuth's style), that makes use of the fact that we
-// only use 24 input bits.
+type ShadeInfo struct {
+	PropagationK float32
+	EmittedPower float32
+	IncidentRay  ray.Ray
+
+	// IncidentFreq is the wavelength of the light arriving along IncidentRay,
+	// for materials that shift wavelengths (see Reradiator).  Zero means it's
+	// the wavelength that was shaded.
+	IncidentFreq float32
+
+	// Polarization describes how the material changes the polarization of the
+	// light arriving along IncidentRay.  It is only filled in by
+	// PolarizedShader.ShadePolarized.
+	Polarization *Polarization
+}
+
+// Polarization is the Mueller matrix that takes light arriving along a
+// ShadeInfo's IncidentRay to light leaving back along the contact's ray.
 //
-// The multiplicative constant is floor(2^24 / (golden ratio)), tweaked a bit to
-// avoid attractors above 0xc in the last digit.
+// InRef is the reference vector of the arriving light's Stokes frame (so it is
+// perpendicular to IncidentRay), and OutRef is the reference vector of the
+// leaving light's Stokes frame (perpendicular to the contact's ray).  See
+// package polarization for the conventions.
 //
-// Copied from the C++ version, I don't remember any of this shit.
-func hashmul(x uint32) uint32 {
-	x = ((x >> 16) ^ x) * 0x45d9f3b
-	x = ((x >> 16) ^ x) * 0x45d9f3b
-	x = ((x >> 16) ^ x)
-	return x
-}
-
-func perlinDotGrad(c0, c1, c2 uint32, d0, d1, d2 float64) float64 {
-	// I have totally forgotten how this works.  The comment is copied from my
-	// C++ version.
-	hash := hashmul(((c0 & 0xff) << 16) | ((c1 & 0xff) << 8) | (c2&0xff)<<0)
-
-	switch hash & 0x0f {
-	case 0x0:
-		return d0 + d1
-	case 0x1:
-		return d0 - d1
-	case 0x2:
-		return -d0 + d1
-	case 0x3:
-		return -d0 - d1
-
-	case 0x4:
-		return d1 + d2
-	case 0x5:
-		return d1 - d2
-	case 0x6:
-		return -d1 + d2
-	case 0x7:
-		return -d1 - d2
-
-	case 0x8:
-		return d2 + d0
-	case 0x9:
-		return d2 - d0
-	case 0xa:
-		return -d2 + d0
-	case 0xb:
-		return -d2 - d0
-
-	case 0xc:
-		return d0 + d1
-	case 0xd:
-		return -d0 + d1
-	case 0xe:
-		return -d1 + d2
-	case 0xf:
-		return -d1 - d2
-	}
-
-	// Dead code
-	return 0
-}
-
-func fade(x float64) float64 {
-	return x * x * x * (x*(x*6.0-15.0) + 10.0)
-}
-
-func lerp(t, a, b float64) float64 {
-	return (1-t)*a + t*b
-}
-
-func PerlinSurface(period float64) MaterialMap {
-	return func(coords MaterialCoords) float64 {
-		x := coords.Mtl2[0] * 256.0 / period
-		y := coords.Mtl2[1] * 256.0 / period
-		z := 0.0
-
-		cellX := uint32(int32(math.Floor(x)) & 0xff)
-		cellY := uint32(int32(math.Floor(y)) & 0xff)
-		cellZ := uint32(int32(math.Floor(z)) & 0xff)
+// Like PropagationK, Mueller is already divided by the probability of choosing
+// IncidentRay.
+type Polarization struct {
+	Mueller       polarization.Mueller
+	InRef, OutRef vec3.T
+}
 
-		xRel := x - math.Floor(x)
-		yRel := y - math.Floor(x)
-		zRel := z - math.Floor(z)
+type Material interface {
+	Crush(time float64)
+	Shade(globalContact contact.Contact, freq float32, rng *rand.Rand) ShadeInfo
+}
 
-		return lerp(fade(yRel),
-			lerp(fade(xRel),
-				perlinDotGrad(cellX+0, cellY+0, cellZ+0, xRel-0, yRel-0, zRel-0),
-				perlinDotGrad(cellX+1, cellY+0, cellZ+0, xRel-1, yRel-0, zRel-0),
-			),
-			lerp(fade(xRel),
-				perlinDotGrad(cellX+0, cellY+1, cellZ+0, xRel-0, yRel-1, zRel-0),
-				perlinDotGrad(cellX+1, cellY+1, cellZ+0, xRel-1, yRel-1, zRel-0),
-			),
-		)
-	}
+// SurfaceEmitter is implemented by materials that emit light from the surface
+// they are applied to, for integrators that start paths on light sources.
+type SurfaceEmitter interface {
+	// SampleEmission picks a direction for light to leave the surface at the
+	// given contact (only its position, normal, and material coordinates are
+	// meaningful).  It returns the direction, and the emitted power density in
+	// that direction divided by the projected-solid-angle pdf of the choice.
+	SampleEmission(globalContact contact.Contact, freq float32, rng *rand.Rand) (vec3.T, float32)
 }
 
-func PerlinVolume(period float64) MaterialMap {
-	return func(coords MaterialCoords) float64 {
-		x := coords.Mtl3[1] * 256.0 / period
-		y := coords.Mtl3[1] * 256.0 / period
-		z := coords.Mtl3[1] * 256.0 / period
-
-		cellX := uint32(int32(math.Floor(x)) & 0xff)
-		cellY := uint32(int32(math.Floor(y)) & 0xff)
-		cellZ := uint32(int32(math.Floor(z)) & 0xff)
-
-		xRel := x - math.Floor(x)
-		yRel := y - math.Floor(x)
-		zRel := z - math.Floor(z)
-
-		return lerp(fade(zRel),
-			lerp(fade(yRel),
-				lerp(fade(xRel),
-					perlinDotGrad(cellX+0, cellY+0, cellZ+0, xRel-0, yRel-0, zRel-0),
-					perlinDotGrad(cellX+1, cellY+0, cellZ+0, xRel-1, yRel-0, zRel-0),
-				),
-				lerp(fade(xRel),
-					perlinDotGrad(cellX+0, cellY+1, cellX+0, xRel-0, yRel-1, zRel-0),
-					perlinDotGrad(cellX+1, cellX+0, cellX+0, xRel-1, yRel-0, zRel-0),
-				),
-			),
-			lerp(fade(yRel),
-				lerp(fade(xRel),
-					perlinDotGrad(cellX+0, cellY+0, cellZ+1, xRel-0, yRel-0, zRel-1),
-					perlinDotGrad(cellX+1, cellY+0, cellZ+1, xRel-1, yRel-0, zRel-1),
-				),
-				lerp(fade(xRel),
-					perlinDotGrad(cellX+0, cellY+1, cellZ+1, xRel-0, yRel-1, zRel-1),
-					perlinDotGrad(cellX+1, cellY+1, cellZ+1, xRel-1, yRel-1, zRel-1),
-				),
-			),
-		)
-	}
+// BSDFEvaluator is implemented by materials whose scattering isn't
+// concentrated on a few directions, so that integrators can connect them to
+// light arriving from an arbitrary direction.
+type BSDFEvaluator interface {
+	// EvalBSDF returns the scattering function for light arriving at the
+	// contact from direction incident (pointing away from the surface) and
+	// leaving back along the contact ray.
+	//
+	// It is consistent with Shade: if Shade picks an incident ray with pdf p,
+	// its PropagationK is EvalBSDF * |cos| / p.
+	EvalBSDF(globalContact contact.Contact, incident vec3.T, freq float32) float32
 }
 
-type ShadeInfo struct {
-	PropagationK float32
-	EmittedPower float32
-	IncidentRay  ray.Ray
+// SecondaryShader is implemented by materials that can reuse a shading
+// decision made at one wavelength for another wavelength.
+//
+// This is what makes hero-wavelength sampling possible: a path is shaded at its
+// hero wavelength, and the secondary wavelengths ride along the same incident
+// rays.  ShadeSecondary returns false if the incident ray chosen at heroFreq
+// isn't one that freq could have taken (a dispersive event), in which case the
+// path has to collapse down to just the hero wavelength.
+//
+// Materials that don't implement SecondaryShader are treated as dispersive.
+type SecondaryShader interface {
+	ShadeSecondary(globalContact contact.Contact, heroFreq float32, hero ShadeInfo, freq float32) (ShadeInfo, bool)
 }
 
-type Material interface {
-	Crush(time float64)
-	Shade(globalContact contact.Contact, freq float32, rng *rand.Rand) ShadeInfo
+// PolarizedShader is implemented by materials that change the polarization of
+// light, for integrators that track it.  ShadePolarized is Shade, with
+// ShadeInfo.Polarization filled in.  Its PropagationK is the effect on
+// unpolarized light.
+//
+// Materials that don't implement PolarizedShader are treated as depolarizing:
+// the light they scatter is unpolarized, scaled by PropagationK.
+type PolarizedShader interface {
+	ShadePolarized(globalContact contact.Contact, freq float32, rng *rand.Rand) ShadeInfo
 }
 
 // DirectionalEmitter is an emitter that queries an emissivity material map
@@ -314,6 +275,10 @@ func (d *DirectionalEmitter) Shade(contact contact.Contact, freq float32, rng *r
 	}
 }
 
+func (d *DirectionalEmitter) ShadeSecondary(contact contact.Contact, heroFreq float32, hero ShadeInfo, freq float32) (ShadeInfo, bool) {
+	return d.Shade(contact, freq, nil), true
+}
+
 type Emitter struct {
 	Emissivity MaterialMap
 }
@@ -332,6 +297,23 @@ func (e *Emitter) Shade(contact contact.Contact, freq float32, rng *rand.Rand) S
 	}
 }
 
+// SampleEmission emits diffusely (with a cosine distribution about the surface
+// normal).
+func (e *Emitter) SampleEmission(contact contact.Contact, freq float32, rng *rand.Rand) (vec3.T, float32) {
+	materialCoords := MaterialCoords{
+		Mtl3: contact.Mtl3,
+		Mtl2: contact.Mtl2,
+		Freq: freq,
+	}
+
+	dir := vec3.CosineUnitVec3Distribution(contact.N, rng)
+	return dir, float32(e.Emissivity(materialCoords) * math.Pi)
+}
+
+func (e *Emitter) ShadeSecondary(contact contact.Contact, heroFreq float32, hero ShadeInfo, freq float32) (ShadeInfo, bool) {
+	return e.Shade(contact, freq, nil), true
+}
+
 type MonteCarloLambert struct {
 	Reflectance MaterialMap
 }
@@ -339,20 +321,39 @@ type MonteCarloLambert struct {
 func (l *MonteCarloLambert) Crush(time float64) {}
 
 func (l *MonteCarloLambert) Shade(contact contact.Contact, freq float32, rng *rand.Rand) ShadeInfo {
-	dir := vec3.HemisphereUnitVec3Distribution(contact.N, rng)
+	// Directions are cosine-distributed, which cancels the cosine term and the
+	// 1/pi of the BSDF against the pdf, leaving just the reflectance.
+	dir := vec3.CosineUnitVec3Distribution(contact.N, rng)
 	reflectance := l.Reflectance(MaterialCoords{contact.Mtl2, contact.Mtl3, freq})
-	propagation := float32(vec3.IProd(contact.N, dir) * reflectance)
 
 	return ShadeInfo{
 		IncidentRay: ray.Ray{
 			Point: contact.P,
 			Slope: dir,
 		},
-		PropagationK: propagation,
+		PropagationK: float32(reflectance),
 		EmittedPower: 0.0,
 	}
 }
 
+// EvalBSDF is constant over the hemisphere: reflectance / pi.
+func (l *MonteCarloLambert) EvalBSDF(contact contact.Contact, incident vec3.T, freq float32) float32 {
+	if vec3.IProd(contact.N, incident) <= 0.0 {
+		return 0.0
+	}
+	reflectance := l.Reflectance(MaterialCoords{contact.Mtl2, contact.Mtl3, freq})
+	return float32(reflectance / math.Pi)
+}
+
+func (l *MonteCarloLambert) ShadeSecondary(contact contact.Contact, heroFreq float32, hero ShadeInfo, freq float32) (ShadeInfo, bool) {
+	reflectance := l.Reflectance(MaterialCoords{contact.Mtl2, contact.Mtl3, freq})
+	return ShadeInfo{
+		IncidentRay:  hero.IncidentRay,
+		PropagationK: float32(reflectance),
+		EmittedPower: 0.0,
+	}, true
+}
+
 type NonConductiveSmooth struct {
 	InteriorIndexOfRefraction MaterialMap
 	ExteriorIndexOfRefraction MaterialMap
@@ -360,6 +361,31 @@ type NonConductiveSmooth struct {
 
 func (n *NonConductiveSmooth) Crush(time float64) {}
 
+// ShadeSecondary only succeeds if the indices of refraction are the same at
+// both wavelengths.  With a spectral index of refraction, the refracted ray
+// bends differently for each wavelength, and the path has to collapse.
+func (n *NonConductiveSmooth) ShadeSecondary(contact contact.Contact, heroFreq float32, hero ShadeInfo, freq float32) (ShadeInfo, bool) {
+	heroCoord := MaterialCoords{
+		Mtl2: contact.Mtl2,
+		Mtl3: contact.Mtl3,
+		Freq: heroFreq,
+	}
+	coord := MaterialCoords{
+		Mtl2: contact.Mtl2,
+		Mtl3: contact.Mtl3,
+		Freq: freq,
+	}
+
+	if n.ExteriorIndexOfRefraction(heroCoord) != n.ExteriorIndexOfRefraction(coord) {
+		return ShadeInfo{}, false
+	}
+	if n.InteriorIndexOfRefraction(heroCoord) != n.InteriorIndexOfRefraction(coord) {
+		return ShadeInfo{}, false
+	}
+
+	return hero, true
+}
+
 func (n *NonConductiveSmooth) Shade(contact contact.Contact, freq float32, rng *rand.Rand) ShadeInfo {
 	coord := MaterialCoords{
 		Mtl2: contact.Mtl2,
@@ -439,6 +465,101 @@ func (n *NonConductiveSmooth) Shade(contact contact.Contact, freq float32, rng *
 	}
 }
 
+// ShadePolarized computes the Fresnel coefficients for the s and p
+// polarizations separately, and chooses between reflection and refraction by
+// their unpolarized average.  (Shade only uses the p coefficients.)
+//
+// The reference vectors are the s direction, perpendicular to the plane of
+// incidence.
+func (n *NonConductiveSmooth) ShadePolarized(contact contact.Contact, freq float32, rng *rand.Rand) ShadeInfo {
+	coord := MaterialCoords{
+		Mtl2: contact.Mtl2,
+		Mtl3: contact.Mtl3,
+		Freq: freq,
+	}
+	nA := n.ExteriorIndexOfRefraction(coord)
+	nB := n.InteriorIndexOfRefraction(coord)
+
+	// Region A is the one the contact ray arrived from, which the scattered
+	// light leaves into.
+	aCos := vec3.IProd(contact.R.Slope, contact.N)
+	if aCos > 0.0 {
+		nA, nB = nB, nA
+	}
+	cA := math.Abs(aCos)
+	nR := nA / nB
+
+	sRef := vec3.CProd(contact.N, contact.R.Slope)
+	if sRef.Norm() < 1e-9 {
+		sRef = polarization.PerpendicularTo(contact.R.Slope)
+	}
+	sRef = vec3.Normalize(sRef)
+
+	reflected := ray.Ray{
+		Point: contact.P,
+		Slope: vec3.Reflect(contact.R.Slope, contact.N),
+	}
+
+	snell := 1.0 - (nR*nR)*(1.0-(aCos*aCos))
+	if snell < 0.0 {
+		// Total internal reflection.  All of the power is reflected, but the s
+		// and p polarizations pick up different phase shifts.
+		sin2 := 1 - cA*cA
+		k := nB / nA
+		delta := 2 * math.Atan(cA*math.Sqrt(sin2-k*k)/sin2)
+		return ShadeInfo{
+			PropagationK: 1.0,
+			IncidentRay:  reflected,
+			Polarization: &Polarization{
+				Mueller: polarization.Retarder(delta),
+				InRef:   sRef,
+				OutRef:  sRef,
+			},
+		}
+	}
+	cB := math.Sqrt(snell)
+
+	// Amplitude coefficients for reflection within region A.  Reflection
+	// within region B has the same power coefficients.
+	rs := (nA*cA - nB*cB) / (nA*cA + nB*cB)
+	rp := (nB*cA - nA*cB) / (nB*cA + nA*cB)
+	reflectance := (rs*rs + rp*rp) / 2
+
+	if rng.Float64() < reflectance {
+		return ShadeInfo{
+			PropagationK: 1.0,
+			IncidentRay:  reflected,
+			Polarization: &Polarization{
+				Mueller: polarization.Diattenuator(rs, rp, 1/reflectance),
+				InRef:   sRef,
+				OutRef:  sRef,
+			},
+		}
+	}
+
+	// Amplitude coefficients for transmission from region B into region A.
+	// The beam changes cross-section as it bends, which scales its power by
+	// (nA cA) / (nB cB).
+	ts := 2 * nB * cB / (nB*cB + nA*cA)
+	tp := 2 * nB * cB / (nA*cB + nB*cA)
+	bCos := cB
+	if aCos < 0.0 {
+		bCos = -bCos
+	}
+	return ShadeInfo{
+		PropagationK: 1.0,
+		IncidentRay: ray.Ray{
+			Point: contact.P,
+			Slope: vec3.AddVV(vec3.MulVS(contact.N, bCos-nR*aCos), vec3.MulVS(contact.R.Slope, nR)),
+		},
+		Polarization: &Polarization{
+			Mueller: polarization.Diattenuator(ts, tp, (nA*cA)/(nB*cB)/(1-reflectance)),
+			InRef:   sRef,
+			OutRef:  sRef,
+		},
+	}
+}
+
 type PerfectlyConductiveSmooth struct {
 	Reflectance MaterialMap
 }
@@ -462,6 +583,40 @@ func (p *PerfectlyConductiveSmooth) Shade(contact contact.Contact, freq float32,
 	}
 }
 
+func (p *PerfectlyConductiveSmooth) ShadeSecondary(contact contact.Contact, heroFreq float32, hero ShadeInfo, freq float32) (ShadeInfo, bool) {
+	propagation := p.Reflectance(MaterialCoords{
+		Mtl2: contact.Mtl2,
+		Mtl3: contact.Mtl3,
+		Freq: freq,
+	})
+
+	return ShadeInfo{
+		EmittedPower: 0.0,
+		PropagationK: float32(propagation),
+		IncidentRay:  hero.IncidentRay,
+	}, true
+}
+
+// ShadePolarized treats the conductor as ideal: both polarizations are
+// reflected, with the p polarization's phase flipped relative to the s
+// polarization's.
+func (p *PerfectlyConductiveSmooth) ShadePolarized(contact contact.Contact, freq float32, rng *rand.Rand) ShadeInfo {
+	result := p.Shade(contact, freq, rng)
+
+	sRef := vec3.CProd(contact.N, contact.R.Slope)
+	if sRef.Norm() < 1e-9 {
+		sRef = polarization.PerpendicularTo(contact.R.Slope)
+	}
+	sRef = vec3.Normalize(sRef)
+
+	result.Polarization = &Polarization{
+		Mueller: polarization.Diattenuator(-1, 1, float64(result.PropagationK)),
+		InRef:   sRef,
+		OutRef:  sRef,
+	}
+	return result
+}
+
 type GaussianRoughNonConductive struct {
 	Variance MaterialMap
 }
@@ -486,3 +641,74 @@ func (g *GaussianRoughNonConductive) Shade(contact contact.Contact, freq float32
 		},
 	}
 }
+
+// facetDensity is the pdf (over the hemisphere) of the facet normals picked by
+// vec3.GaussianUnitVec3Distribution, as a function of the cosine between the
+// facet normal and the surface normal.
+func facetDensity(cosine, mid float64) float64 {
+	// The distribution accepts a uniform hemisphere candidate with probability
+	// one minus a triangle function of the cosine.  The triangle integrates to
+	// 1/2 over [0, 1], so the normalizing constant over the hemisphere is pi.
+	triangle := 0.0
+	if cosine < mid {
+		triangle = cosine / mid
+	} else {
+		triangle = -(cosine-mid)/(1-mid) + 1
+	}
+	return (1 - triangle) / math.Pi
+}
+
+// EvalBSDF inverts the facet sampling performed by Shade.  A given incident
+// direction could have been produced by two different facets, depending on
+// whether Shade flipped the facet it picked.
+func (g *GaussianRoughNonConductive) EvalBSDF(contact contact.Contact, incident vec3.T, freq float32) float32 {
+	variance := g.Variance(MaterialCoords{contact.Mtl2, contact.Mtl3, freq})
+
+	half := vec3.SubVV(incident, contact.R.Slope)
+	if half.Norm() == 0.0 {
+		return 0.0
+	}
+	half = vec3.Normalize(half)
+
+	// The facet that reflects the contact ray into incident without being
+	// flipped.
+	facetA := half
+	if vec3.IProd(facetA, contact.N) < 0.0 {
+		facetA = vec3.MulVS(facetA, -1.0)
+	}
+
+	// The facet that, once flipped, reflects the contact ray into incident.
+	facetB := vec3.Reflect(half, contact.N)
+	if vec3.IProd(facetB, contact.N) < 0.0 {
+		facetB = vec3.MulVS(facetB, -1.0)
+	}
+
+	facetPDF := 0.0
+	if vec3.IProd(facetA, contact.R.Slope) >= 0.0 {
+		facetPDF += facetDensity(vec3.IProd(facetA, contact.N), variance)
+	}
+	if vec3.IProd(facetB, contact.R.Slope) < 0.0 {
+		facetPDF += facetDensity(vec3.IProd(facetB, contact.N), variance)
+	}
+
+	// Change of variables from facet normal to reflected direction.
+	incidentPDF := facetPDF / (4 * math.Abs(vec3.IProd(incident, half)))
+
+	cosine := math.Abs(vec3.IProd(incident, contact.N))
+	if cosine == 0.0 || math.IsInf(incidentPDF, 0) || math.IsNaN(incidentPDF) {
+		return 0.0
+	}
+
+	return float32(0.8 * incidentPDF / cosine)
+}
+
+// ShadeSecondary only succeeds if the facet variance is the same at both
+// wavelengths.  The propagation coefficient doesn't depend on wavelength.
+func (g *GaussianRoughNonConductive) ShadeSecondary(contact contact.Contact, heroFreq float32, hero ShadeInfo, freq float32) (ShadeInfo, bool) {
+	heroVariance := g.Variance(MaterialCoords{contact.Mtl2, contact.Mtl3, heroFreq})
+	variance := g.Variance(MaterialCoords{contact.Mtl2, contact.Mtl3, freq})
+	if heroVariance != variance {
+		return ShadeInfo{}, false
+	}
+	return hero, true
+}
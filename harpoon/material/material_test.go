@@ -0,0 +1,68 @@
+package material
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"row-major/harpoon/contact"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// TestEvalBSDFMatchesShade checks the BSDFEvaluator contract: integrating
+// EvalBSDF against the cosine over the hemisphere gives the same answer as
+// averaging the PropagationK of Shade's samples.  Both are weighted by an
+// arbitrary function of direction, so that the test sees the distribution of
+// directions and not just the albedo.
+//
+// EvalBSDF only covers light arriving from above the surface, so directions
+// below it get no weight.  (GaussianRoughNonConductive's facets can reflect
+// rays below the surface.)
+func TestEvalBSDFMatchesShade(t *testing.T) {
+	cases := []struct {
+		name string
+		m    Material
+	}{
+		{"lambert", &MonteCarloLambert{Reflectance: ConstantScalar(0.7)}},
+		{"gaussian_rough", &GaussianRoughNonConductive{Variance: ConstantScalar(0.5)}},
+	}
+
+	n := vec3.T{0, 0, 1}
+	view := vec3.Normalize(vec3.T{0.3, 0, -1})
+	c := contact.Contact{
+		R: ray.Ray{Point: vec3.T{0, 0, 0}, Slope: view},
+		N: n,
+	}
+	weight := func(dir vec3.T) float64 {
+		if vec3.IProd(n, dir) <= 0 {
+			return 0
+		}
+		return 1 + dir[0] + dir[2]*dir[2]
+	}
+
+	const samples = 200000
+	for _, tc := range cases {
+		rng := rand.New(rand.NewSource(1))
+
+		shaded := 0.0
+		for i := 0; i < samples; i++ {
+			info := tc.m.Shade(c, 550, rng)
+			shaded += float64(info.PropagationK) * weight(info.IncidentRay.Slope)
+		}
+		shaded /= samples
+
+		evaluator := tc.m.(BSDFEvaluator)
+		evaluated := 0.0
+		for i := 0; i < samples; i++ {
+			dir := vec3.HemisphereUnitVec3Distribution(n, rng)
+			f := float64(evaluator.EvalBSDF(c, dir, 550))
+			evaluated += f * vec3.IProd(n, dir) * weight(dir) * 2 * math.Pi
+		}
+		evaluated /= samples
+
+		if math.Abs(shaded-evaluated) > 0.02*evaluated {
+			t.Errorf("%s: Shade estimates %v, EvalBSDF integrates to %v", tc.name, shaded, evaluated)
+		}
+	}
+}
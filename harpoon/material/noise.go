@@ -0,0 +1,429 @@
+package material
+
+import (
+	"math"
+	"row-major/harpoon/vmath/vec2"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// Procedural noise.
+//
+// The lattice noises (Perlin, simplex, and Worley) all share a convention: the
+// period argument is the distance over which 256 lattice cells are laid out.
+// Perlin and Worley noise repeat with that period.
+
+// A multiplicative hash (in Knuth's style), that makes use of the fact that we
+// only use 24 input bits.
+//
+// The multiplicative constant is floor(2^24 / (golden ratio)), tweaked a bit to
+// avoid attractors above 0xc in the last digit.
+//
+// Copied from the C++ version, I don't remember any of this shit.
+func hashmul(x uint32) uint32 {
+	x = ((x >> 16) ^ x) * 0x45d9f3b
+	x = ((x >> 16) ^ x) * 0x45d9f3b
+	x = ((x >> 16) ^ x)
+	return x
+}
+
+// latticeKey packs the low 8 bits of each lattice coordinate into the 24 bits
+// that hashmul looks at.  Taking the low 8 bits is what makes the lattice
+// noises repeat every 256 cells.
+func latticeKey(c0, c1, c2 uint32) uint32 {
+	return ((c0 & 0xff) << 16) | ((c1 & 0xff) << 8) | (c2&0xff)<<0
+}
+
+// latticeCell returns the integer lattice coordinate below x, in the form
+// latticeKey wants.
+func latticeCell(x float64) uint32 {
+	return uint32(int32(math.Floor(x)))
+}
+
+func perlinDotGrad(c0, c1, c2 uint32, d0, d1, d2 float64) float64 {
+	// I have totally forgotten how this works.  The comment is copied from my
+	// C++ version.
+	hash := hashmul(latticeKey(c0, c1, c2))
+
+	switch hash & 0x0f {
+	case 0x0:
+		return d0 + d1
+	case 0x1:
+		return d0 - d1
+	case 0x2:
+		return -d0 + d1
+	case 0x3:
+		return -d0 - d1
+
+	case 0x4:
+		return d1 + d2
+	case 0x5:
+		return d1 - d2
+	case 0x6:
+		return -d1 + d2
+	case 0x7:
+		return -d1 - d2
+
+	case 0x8:
+		return d2 + d0
+	case 0x9:
+		return d2 - d0
+	case 0xa:
+		return -d2 + d0
+	case 0xb:
+		return -d2 - d0
+
+	case 0xc:
+		return d0 + d1
+	case 0xd:
+		return -d0 + d1
+	case 0xe:
+		return -d1 + d2
+	case 0xf:
+		return -d1 - d2
+	}
+
+	// Dead code
+	return 0
+}
+
+func fade(x float64) float64 {
+	return x * x * x * (x*(x*6.0-15.0) + 10.0)
+}
+
+func lerp(t, a, b float64) float64 {
+	return (1-t)*a + t*b
+}
+
+// perlin3 is Perlin's improved noise, in lattice units.  It is zero at every
+// lattice point, and stays roughly within [-1, 1].
+func perlin3(x, y, z float64) float64 {
+	cellX := latticeCell(x)
+	cellY := latticeCell(y)
+	cellZ := latticeCell(z)
+
+	xRel := x - math.Floor(x)
+	yRel := y - math.Floor(y)
+	zRel := z - math.Floor(z)
+
+	return lerp(fade(zRel),
+		lerp(fade(yRel),
+			lerp(fade(xRel),
+				perlinDotGrad(cellX+0, cellY+0, cellZ+0, xRel-0, yRel-0, zRel-0),
+				perlinDotGrad(cellX+1, cellY+0, cellZ+0, xRel-1, yRel-0, zRel-0),
+			),
+			lerp(fade(xRel),
+				perlinDotGrad(cellX+0, cellY+1, cellZ+0, xRel-0, yRel-1, zRel-0),
+				perlinDotGrad(cellX+1, cellY+1, cellZ+0, xRel-1, yRel-1, zRel-0),
+			),
+		),
+		lerp(fade(yRel),
+			lerp(fade(xRel),
+				perlinDotGrad(cellX+0, cellY+0, cellZ+1, xRel-0, yRel-0, zRel-1),
+				perlinDotGrad(cellX+1, cellY+0, cellZ+1, xRel-1, yRel-0, zRel-1),
+			),
+			lerp(fade(xRel),
+				perlinDotGrad(cellX+0, cellY+1, cellZ+1, xRel-0, yRel-1, zRel-1),
+				perlinDotGrad(cellX+1, cellY+1, cellZ+1, xRel-1, yRel-1, zRel-1),
+			),
+		),
+	)
+}
+
+// PerlinSurface is Perlin noise over the surface coordinates.
+func PerlinSurface(period float64) MaterialMap {
+	return func(coords MaterialCoords) float64 {
+		x := coords.Mtl2[0] * 256.0 / period
+		y := coords.Mtl2[1] * 256.0 / period
+		return perlin3(x, y, 0.0)
+	}
+}
+
+// PerlinVolume is Perlin noise over the volume coordinates.
+func PerlinVolume(period float64) MaterialMap {
+	return func(coords MaterialCoords) float64 {
+		x := coords.Mtl3[0] * 256.0 / period
+		y := coords.Mtl3[1] * 256.0 / period
+		z := coords.Mtl3[2] * 256.0 / period
+		return perlin3(x, y, z)
+	}
+}
+
+// Skew and unskew factors for simplex noise, which map between the simplex
+// grid and the hypercube grid.
+var (
+	simplexSkew2   = (math.Sqrt(3.0) - 1.0) / 2.0
+	simplexUnskew2 = (3.0 - math.Sqrt(3.0)) / 6.0
+	simplexSkew3   = 1.0 / 3.0
+	simplexUnskew3 = 1.0 / 6.0
+)
+
+// simplexCorner is the contribution of one simplex corner, which falls off to
+// zero at distance sqrt(1/2) from the corner.
+func simplexCorner(c0, c1, c2 uint32, d0, d1, d2 float64) float64 {
+	t := 0.5 - d0*d0 - d1*d1 - d2*d2
+	if t < 0.0 {
+		return 0.0
+	}
+	t *= t
+	return t * t * perlinDotGrad(c0, c1, c2, d0, d1, d2)
+}
+
+// simplex2 is simplex noise in two dimensions, in lattice units (of the skewed
+// lattice).  It stays roughly within [-1, 1].
+func simplex2(x, y float64) float64 {
+	s := (x + y) * simplexSkew2
+	i := math.Floor(x + s)
+	j := math.Floor(y + s)
+
+	t := (i + j) * simplexUnskew2
+	x0 := x - (i - t)
+	y0 := y - (j - t)
+
+	// Which of the two triangles in the cell are we in?
+	var i1, j1 uint32
+	if x0 > y0 {
+		i1, j1 = 1, 0
+	} else {
+		i1, j1 = 0, 1
+	}
+
+	x1 := x0 - float64(i1) + simplexUnskew2
+	y1 := y0 - float64(j1) + simplexUnskew2
+	x2 := x0 - 1.0 + 2.0*simplexUnskew2
+	y2 := y0 - 1.0 + 2.0*simplexUnskew2
+
+	ci := latticeCell(i)
+	cj := latticeCell(j)
+
+	n := simplexCorner(ci, cj, 0, x0, y0, 0.0) +
+		simplexCorner(ci+i1, cj+j1, 0, x1, y1, 0.0) +
+		simplexCorner(ci+1, cj+1, 0, x2, y2, 0.0)
+	return 70.0 * n
+}
+
+// simplex3 is simplex noise in three dimensions, in lattice units (of the
+// skewed lattice).  It stays roughly within [-1, 1].
+func simplex3(x, y, z float64) float64 {
+	s := (x + y + z) * simplexSkew3
+	i := math.Floor(x + s)
+	j := math.Floor(y + s)
+	k := math.Floor(z + s)
+
+	t := (i + j + k) * simplexUnskew3
+	x0 := x - (i - t)
+	y0 := y - (j - t)
+	z0 := z - (k - t)
+
+	// Which of the six tetrahedra in the cell are we in?  The offsets of the
+	// second and third corners follow from the order of the coordinates.
+	var i1, j1, k1, i2, j2, k2 uint32
+	if x0 >= y0 {
+		if y0 >= z0 {
+			i1, j1, k1, i2, j2, k2 = 1, 0, 0, 1, 1, 0
+		} else if x0 >= z0 {
+			i1, j1, k1, i2, j2, k2 = 1, 0, 0, 1, 0, 1
+		} else {
+			i1, j1, k1, i2, j2, k2 = 0, 0, 1, 1, 0, 1
+		}
+	} else {
+		if y0 < z0 {
+			i1, j1, k1, i2, j2, k2 = 0, 0, 1, 0, 1, 1
+		} else if x0 < z0 {
+			i1, j1, k1, i2, j2, k2 = 0, 1, 0, 0, 1, 1
+		} else {
+			i1, j1, k1, i2, j2, k2 = 0, 1, 0, 1, 1, 0
+		}
+	}
+
+	x1 := x0 - float64(i1) + simplexUnskew3
+	y1 := y0 - float64(j1) + simplexUnskew3
+	z1 := z0 - float64(k1) + simplexUnskew3
+	x2 := x0 - float64(i2) + 2.0*simplexUnskew3
+	y2 := y0 - float64(j2) + 2.0*simplexUnskew3
+	z2 := z0 - float64(k2) + 2.0*simplexUnskew3
+	x3 := x0 - 1.0 + 3.0*simplexUnskew3
+	y3 := y0 - 1.0 + 3.0*simplexUnskew3
+	z3 := z0 - 1.0 + 3.0*simplexUnskew3
+
+	ci := latticeCell(i)
+	cj := latticeCell(j)
+	ck := latticeCell(k)
+
+	n := simplexCorner(ci, cj, ck, x0, y0, z0) +
+		simplexCorner(ci+i1, cj+j1, ck+k1, x1, y1, z1) +
+		simplexCorner(ci+i2, cj+j2, ck+k2, x2, y2, z2) +
+		simplexCorner(ci+1, cj+1, ck+1, x3, y3, z3)
+	return 76.0 * n
+}
+
+// SimplexSurface is simplex noise over the surface coordinates.
+//
+// Simplex noise is cheaper than Perlin noise and has fewer axis-aligned
+// artifacts.  It doesn't repeat along the axes.
+func SimplexSurface(period float64) MaterialMap {
+	return func(coords MaterialCoords) float64 {
+		x := coords.Mtl2[0] * 256.0 / period
+		y := coords.Mtl2[1] * 256.0 / period
+		return simplex2(x, y)
+	}
+}
+
+// SimplexVolume is simplex noise over the volume coordinates.
+func SimplexVolume(period float64) MaterialMap {
+	return func(coords MaterialCoords) float64 {
+		x := coords.Mtl3[0] * 256.0 / period
+		y := coords.Mtl3[1] * 256.0 / period
+		z := coords.Mtl3[2] * 256.0 / period
+		return simplex3(x, y, z)
+	}
+}
+
+// worleyFeature returns the position of the feature point within a lattice
+// cell, as offsets in [0, 1).
+func worleyFeature(c0, c1, c2 uint32) (float64, float64, float64) {
+	// Set a bit above the 24 used by latticeKey, so that the feature points
+	// aren't correlated with the Perlin gradients.
+	hash := hashmul(latticeKey(c0, c1, c2) | 1<<24)
+	return float64(hash&0x3ff) / 1024.0,
+		float64((hash>>10)&0x3ff) / 1024.0,
+		float64((hash>>20)&0x3ff) / 1024.0
+}
+
+// worley2 is Worley (cellular) noise in two dimensions: the distance from (x,
+// y) to the nearest feature point, in lattice units.
+func worley2(x, y float64) float64 {
+	cellX := latticeCell(x)
+	cellY := latticeCell(y)
+	xRel := x - math.Floor(x)
+	yRel := y - math.Floor(y)
+
+	minDist2 := math.Inf(1)
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			fx, fy, _ := worleyFeature(cellX+uint32(dx), cellY+uint32(dy), 0)
+			ex := float64(dx) + fx - xRel
+			ey := float64(dy) + fy - yRel
+			minDist2 = math.Min(minDist2, ex*ex+ey*ey)
+		}
+	}
+	return math.Sqrt(minDist2)
+}
+
+// worley3 is Worley (cellular) noise in three dimensions: the distance from (x,
+// y, z) to the nearest feature point, in lattice units.
+func worley3(x, y, z float64) float64 {
+	cellX := latticeCell(x)
+	cellY := latticeCell(y)
+	cellZ := latticeCell(z)
+	xRel := x - math.Floor(x)
+	yRel := y - math.Floor(y)
+	zRel := z - math.Floor(z)
+
+	minDist2 := math.Inf(1)
+	for dz := -1; dz <= 1; dz++ {
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				fx, fy, fz := worleyFeature(cellX+uint32(dx), cellY+uint32(dy), cellZ+uint32(dz))
+				ex := float64(dx) + fx - xRel
+				ey := float64(dy) + fy - yRel
+				ez := float64(dz) + fz - zRel
+				minDist2 = math.Min(minDist2, ex*ex+ey*ey+ez*ez)
+			}
+		}
+	}
+	return math.Sqrt(minDist2)
+}
+
+// WorleySurface is Worley (cellular) noise over the surface coordinates.  It
+// is the distance to the nearest of a set of randomly-scattered feature
+// points, in lattice cells, and so starts from zero and rarely exceeds one.
+func WorleySurface(period float64) MaterialMap {
+	return func(coords MaterialCoords) float64 {
+		x := coords.Mtl2[0] * 256.0 / period
+		y := coords.Mtl2[1] * 256.0 / period
+		return worley2(x, y)
+	}
+}
+
+// WorleyVolume is Worley (cellular) noise over the volume coordinates.
+func WorleyVolume(period float64) MaterialMap {
+	return func(coords MaterialCoords) float64 {
+		x := coords.Mtl3[0] * 256.0 / period
+		y := coords.Mtl3[1] * 256.0 / period
+		z := coords.Mtl3[2] * 256.0 / period
+		return worley3(x, y, z)
+	}
+}
+
+// scaleCoords scales the spatial parts of coords.
+func scaleCoords(coords MaterialCoords, scale float64) MaterialCoords {
+	return MaterialCoords{
+		Mtl2: vec2.T{coords.Mtl2[0] * scale, coords.Mtl2[1] * scale},
+		Mtl3: vec3.MulVS(coords.Mtl3, scale),
+		Freq: coords.Freq,
+	}
+}
+
+// FBM sums octaves of a noise map (fractional Brownian motion).  Each octave
+// is evaluated at coordinates scaled up by lacunarity, and weighted by gain
+// relative to the octave before it.
+//
+// The sum is normalized by the total weight, so the result has the same range
+// as the underlying map.
+func FBM(octaves int, lacunarity, gain float64, a MaterialMap) MaterialMap {
+	return func(coords MaterialCoords) float64 {
+		sum := 0.0
+		totalWeight := 0.0
+		weight := 1.0
+		scale := 1.0
+		for i := 0; i < octaves; i++ {
+			sum += weight * a(scaleCoords(coords, scale))
+			totalWeight += weight
+			weight *= gain
+			scale *= lacunarity
+		}
+		return sum / totalWeight
+	}
+}
+
+// Turbulence is like FBM, but sums the absolute value of each octave.  With
+// Perlin or simplex noise, this gives sharp creases where the noise crosses
+// zero.
+func Turbulence(octaves int, lacunarity, gain float64, a MaterialMap) MaterialMap {
+	return func(coords MaterialCoords) float64 {
+		sum := 0.0
+		totalWeight := 0.0
+		weight := 1.0
+		scale := 1.0
+		for i := 0; i < octaves; i++ {
+			sum += weight * math.Abs(a(scaleCoords(coords, scale)))
+			totalWeight += weight
+			weight *= gain
+			scale *= lacunarity
+		}
+		return sum / totalWeight
+	}
+}
+
+// WarpSurface evaluates a at surface coordinates displaced by amount times
+// (warpX, warpY).
+func WarpSurface(amount float64, warpX, warpY, a MaterialMap) MaterialMap {
+	return func(coords MaterialCoords) float64 {
+		warped := coords
+		warped.Mtl2[0] += amount * warpX(coords)
+		warped.Mtl2[1] += amount * warpY(coords)
+		return a(warped)
+	}
+}
+
+// WarpVolume evaluates a at volume coordinates displaced by amount times
+// (warpX, warpY, warpZ).
+func WarpVolume(amount float64, warpX, warpY, warpZ, a MaterialMap) MaterialMap {
+	return func(coords MaterialCoords) float64 {
+		warped := coords
+		warped.Mtl3[0] += amount * warpX(coords)
+		warped.Mtl3[1] += amount * warpY(coords)
+		warped.Mtl3[2] += amount * warpZ(coords)
+		return a(warped)
+	}
+}
@@ -0,0 +1,222 @@
+package material
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"row-major/harpoon/vmath/vec2"
+	"row-major/harpoon/vmath/vec3"
+)
+
+var updateGoldens = flag.Bool("update-goldens", false, "Rewrite the golden images in testdata/ instead of checking against them")
+
+const goldenSize = 64
+
+// goldenCase is a material map rendered to a grayscale image.
+type goldenCase struct {
+	name string
+	m    MaterialMap
+
+	// The range of values that map to black and white.
+	lo, hi float64
+}
+
+// goldenCoords gives the material coordinates for a pixel.  The surface
+// coordinates cover [0, 1) in each direction.  The volume coordinates lie on
+// a tilted plane, so that all three axes vary.
+func goldenCoords(r, c int) MaterialCoords {
+	u := float64(c) / goldenSize
+	v := float64(r) / goldenSize
+	return MaterialCoords{
+		Mtl2: vec2.T{u, v},
+		Mtl3: vec3.T{u, v, 0.4*u + 0.7*v},
+		Freq: 550,
+	}
+}
+
+func renderGolden(gc goldenCase) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, goldenSize, goldenSize))
+	for r := 0; r < goldenSize; r++ {
+		for c := 0; c < goldenSize; c++ {
+			val := (gc.m(goldenCoords(r, c)) - gc.lo) / (gc.hi - gc.lo)
+			val = math.Max(0.0, math.Min(1.0, val))
+			img.SetGray(c, r, color.Gray{uint8(math.Round(255 * val))})
+		}
+	}
+	return img
+}
+
+func TestNoiseGoldens(t *testing.T) {
+	// 256 lattice cells per period, so a period of 32 puts 8 cells across each
+	// image.
+	cases := []goldenCase{
+		{name: "perlin_surface", m: PerlinSurface(32), lo: -1, hi: 1},
+		{name: "perlin_volume", m: PerlinVolume(32), lo: -1, hi: 1},
+		{name: "simplex_surface", m: SimplexSurface(32), lo: -1, hi: 1},
+		{name: "simplex_volume", m: SimplexVolume(32), lo: -1, hi: 1},
+		{name: "worley_surface", m: WorleySurface(32), lo: 0, hi: 1},
+		{name: "worley_volume", m: WorleyVolume(32), lo: 0, hi: 1},
+		{name: "fbm_perlin", m: FBM(5, 2, 0.5, PerlinVolume(64)), lo: -1, hi: 1},
+		{name: "turbulence_simplex", m: Turbulence(5, 2, 0.5, SimplexVolume(64)), lo: 0, hi: 1},
+		{
+			name: "warp_perlin",
+			m:    WarpSurface(0.05, PerlinSurface(64), SimplexSurface(64), PerlinSurface(32)),
+			lo:   -1,
+			hi:   1,
+		},
+	}
+
+	for _, gc := range cases {
+		t.Run(gc.name, func(t *testing.T) {
+			got := renderGolden(gc)
+			path := filepath.Join("testdata", gc.name+".png")
+
+			if *updateGoldens {
+				f, err := os.Create(path)
+				if err != nil {
+					t.Fatalf("while creating golden: %v", err)
+				}
+				defer f.Close()
+				if err := png.Encode(f, got); err != nil {
+					t.Fatalf("while encoding golden: %v", err)
+				}
+				return
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("while opening golden (run with -update-goldens to create it): %v", err)
+			}
+			defer f.Close()
+			want, err := png.Decode(f)
+			if err != nil {
+				t.Fatalf("while decoding golden: %v", err)
+			}
+
+			if want.Bounds() != got.Bounds() {
+				t.Fatalf("Got bounds %v, want %v", got.Bounds(), want.Bounds())
+			}
+
+			// Allow for rounding differences across platforms.
+			mismatches := 0
+			for r := 0; r < goldenSize; r++ {
+				for c := 0; c < goldenSize; c++ {
+					wantY := int(color.GrayModel.Convert(want.At(c, r)).(color.Gray).Y)
+					gotY := int(got.GrayAt(c, r).Y)
+					if wantY-gotY > 1 || gotY-wantY > 1 {
+						mismatches++
+					}
+				}
+			}
+			if mismatches != 0 {
+				t.Errorf("%d pixels differ from %s", mismatches, path)
+			}
+		})
+	}
+}
+
+func TestPerlinZeroOnLattice(t *testing.T) {
+	for _, m := range []MaterialMap{PerlinSurface(256), PerlinVolume(256)} {
+		for i := -3; i <= 3; i++ {
+			for j := -3; j <= 3; j++ {
+				coords := MaterialCoords{
+					Mtl2: vec2.T{float64(i), float64(j)},
+					Mtl3: vec3.T{float64(i), float64(j), float64(i + j)},
+				}
+				if got := m(coords); got != 0.0 {
+					t.Errorf("Got %v at lattice point %v, want 0", got, coords)
+				}
+			}
+		}
+	}
+}
+
+func TestLatticeNoisesRepeat(t *testing.T) {
+	const period = 3.0
+	cases := map[string]MaterialMap{
+		"PerlinSurface": PerlinSurface(period),
+		"PerlinVolume":  PerlinVolume(period),
+		"WorleySurface": WorleySurface(period),
+		"WorleyVolume":  WorleyVolume(period),
+	}
+
+	for name, m := range cases {
+		for _, p := range []vec3.T{{0.1, 0.2, 0.3}, {-1.7, 2.9, 0.05}, {1.23, -0.4, -2.2}} {
+			base := m(MaterialCoords{Mtl2: vec2.T{p[0], p[1]}, Mtl3: p})
+			for axis := 0; axis < 3; axis++ {
+				q := p
+				q[axis] += period
+				shifted := m(MaterialCoords{Mtl2: vec2.T{q[0], q[1]}, Mtl3: q})
+				if math.Abs(shifted-base) > 1e-9 {
+					t.Errorf("%s: got %v at %v, but %v at %v", name, base, p, shifted, q)
+				}
+			}
+		}
+	}
+}
+
+// Each volume noise should depend on all three coordinates.  (PerlinVolume
+// once read Mtl3[1] for every axis.)
+func TestVolumeNoisesUseEveryAxis(t *testing.T) {
+	cases := map[string]MaterialMap{
+		"PerlinVolume":  PerlinVolume(256),
+		"SimplexVolume": SimplexVolume(256),
+		"WorleyVolume":  WorleyVolume(256),
+	}
+
+	for name, m := range cases {
+		p := vec3.T{0.3, 0.6, 0.2}
+		base := m(MaterialCoords{Mtl3: p})
+		for axis := 0; axis < 3; axis++ {
+			q := p
+			q[axis] += 0.25
+			if m(MaterialCoords{Mtl3: q}) == base {
+				t.Errorf("%s doesn't change along axis %d", name, axis)
+			}
+		}
+	}
+}
+
+// The noises should be continuous, including across lattice cell boundaries.
+func TestNoisesAreContinuous(t *testing.T) {
+	cases := map[string]MaterialMap{
+		"PerlinSurface":  PerlinSurface(256),
+		"PerlinVolume":   PerlinVolume(256),
+		"SimplexSurface": SimplexSurface(256),
+		"SimplexVolume":  SimplexVolume(256),
+		"WorleySurface":  WorleySurface(256),
+		"WorleyVolume":   WorleyVolume(256),
+	}
+
+	const step = 1e-4
+	for name, m := range cases {
+		for i := 0; i < 5000; i++ {
+			// Walk a line that crosses many cell boundaries at odd angles.
+			s := float64(i) * 0.0037
+			p := vec3.T{-4 + 1.1*s, -3 + 0.7*s, -2 + 0.3*s}
+			q := vec3.T{p[0] + step, p[1] + step, p[2] + step}
+
+			a := m(MaterialCoords{Mtl2: vec2.T{p[0], p[1]}, Mtl3: p})
+			b := m(MaterialCoords{Mtl2: vec2.T{q[0], q[1]}, Mtl3: q})
+			if math.Abs(a-b) > 100*step {
+				t.Errorf("%s jumps from %v at %v to %v at %v", name, a, p, b, q)
+				break
+			}
+		}
+	}
+}
+
+func TestFBMSingleOctaveIsIdentity(t *testing.T) {
+	m := PerlinVolume(10)
+	fbm := FBM(1, 2.0, 0.5, m)
+	coords := MaterialCoords{Mtl3: vec3.T{1.3, 2.1, -0.7}}
+	if got, want := fbm(coords), m(coords); got != want {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
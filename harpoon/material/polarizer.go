@@ -0,0 +1,136 @@
+package material
+
+import (
+	"math/rand"
+	"row-major/harpoon/contact"
+	"row-major/harpoon/polarization"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// passThrough is the ray that light passing straight through a thin sheet at
+// the contact arrives along.
+func passThrough(contact contact.Contact) ray.Ray {
+	return ray.Ray{
+		Point: contact.P,
+		Slope: contact.R.Slope,
+	}
+}
+
+// axisReference projects a filter's axis onto the plane perpendicular to the
+// contact's ray, for use as a Stokes reference vector.  It returns false if
+// the axis is parallel to the ray.
+func axisReference(contact contact.Contact, axis vec3.T) (vec3.T, bool) {
+	ref := vec3.Reject(contact.R.Slope, axis)
+	if ref.Norm() < 1e-9 {
+		return vec3.T{}, false
+	}
+	return vec3.Normalize(ref), true
+}
+
+// LinearPolarizer is a thin sheet, like a polarizing filter, that transmits
+// light polarized along its axis and absorbs the rest.  Light passes through
+// it without bending.
+//
+// Without polarized transport, it just passes half of the light.
+type LinearPolarizer struct {
+	// Axis is the transmission axis, in world space.  It should lie in the
+	// plane of the sheet.
+	Axis vec3.T
+
+	// Transmittance is the fraction of light polarized along the axis that
+	// gets through.
+	Transmittance MaterialMap
+}
+
+func (l *LinearPolarizer) Crush(time float64) {}
+
+func (l *LinearPolarizer) Shade(contact contact.Contact, freq float32, rng *rand.Rand) ShadeInfo {
+	transmittance := l.Transmittance(MaterialCoords{contact.Mtl2, contact.Mtl3, freq})
+	return ShadeInfo{
+		PropagationK: float32(transmittance / 2),
+		IncidentRay:  passThrough(contact),
+	}
+}
+
+func (l *LinearPolarizer) ShadeSecondary(contact contact.Contact, heroFreq float32, hero ShadeInfo, freq float32) (ShadeInfo, bool) {
+	return l.Shade(contact, freq, nil), true
+}
+
+func (l *LinearPolarizer) ShadePolarized(contact contact.Contact, freq float32, rng *rand.Rand) ShadeInfo {
+	result := l.Shade(contact, freq, rng)
+
+	ref, ok := axisReference(contact, l.Axis)
+	if !ok {
+		// Seen edge-on, so nothing gets through.
+		result.PropagationK = 0.0
+		result.Polarization = &Polarization{
+			Mueller: polarization.Depolarizer(0),
+			InRef:   polarization.PerpendicularTo(contact.R.Slope),
+			OutRef:  polarization.PerpendicularTo(contact.R.Slope),
+		}
+		return result
+	}
+
+	transmittance := l.Transmittance(MaterialCoords{contact.Mtl2, contact.Mtl3, freq})
+	result.Polarization = &Polarization{
+		Mueller: polarization.MulMK(polarization.LinearPolarizer(0), transmittance),
+		InRef:   ref,
+		OutRef:  ref,
+	}
+	return result
+}
+
+// Retarder is a thin sheet, like a wave plate, that delays light polarized
+// perpendicular to its fast axis relative to light polarized along it.  Light
+// passes through it without bending or losing power.
+//
+// A quarter-wave plate behind a linear polarizer, with its fast axis at 45
+// degrees to the polarizer's axis, makes a circular polarizer.
+//
+// Without polarized transport, it has no effect.
+type Retarder struct {
+	// FastAxis is in world space.  It should lie in the plane of the sheet.
+	FastAxis vec3.T
+
+	// Retardance is the delay, in radians of phase.  A quarter-wave plate has
+	// a retardance of pi/2 at its design wavelength.
+	Retardance MaterialMap
+}
+
+func (r *Retarder) Crush(time float64) {}
+
+func (r *Retarder) Shade(contact contact.Contact, freq float32, rng *rand.Rand) ShadeInfo {
+	return ShadeInfo{
+		PropagationK: 1.0,
+		IncidentRay:  passThrough(contact),
+	}
+}
+
+func (r *Retarder) ShadeSecondary(contact contact.Contact, heroFreq float32, hero ShadeInfo, freq float32) (ShadeInfo, bool) {
+	return r.Shade(contact, freq, nil), true
+}
+
+func (r *Retarder) ShadePolarized(contact contact.Contact, freq float32, rng *rand.Rand) ShadeInfo {
+	result := r.Shade(contact, freq, rng)
+
+	ref, ok := axisReference(contact, r.FastAxis)
+	if !ok {
+		// Seen edge-on; both polarizations see the same (slow) index.
+		ref = polarization.PerpendicularTo(contact.R.Slope)
+		result.Polarization = &Polarization{
+			Mueller: polarization.Identity(),
+			InRef:   ref,
+			OutRef:  ref,
+		}
+		return result
+	}
+
+	retardance := r.Retardance(MaterialCoords{contact.Mtl2, contact.Mtl3, freq})
+	result.Polarization = &Polarization{
+		Mueller: polarization.Retarder(retardance),
+		InRef:   ref,
+		OutRef:  ref,
+	}
+	return result
+}
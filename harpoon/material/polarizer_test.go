@@ -0,0 +1,104 @@
+package material
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"row-major/harpoon/contact"
+	"row-major/harpoon/polarization"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// glassContact is a contact with a horizontal surface, seen from above at the
+// given angle from the normal.
+func glassContact(theta float64) contact.Contact {
+	slope := vec3.T{math.Sin(theta), 0, -math.Cos(theta)}
+	return contact.Contact{
+		R: ray.Ray{Point: vec3.MulVS(slope, -1), Slope: slope},
+		N: vec3.T{0, 0, 1},
+	}
+}
+
+func TestNonConductiveSmoothPolarized(t *testing.T) {
+	glass := &NonConductiveSmooth{
+		InteriorIndexOfRefraction: ConstantScalar(1.5),
+		ExteriorIndexOfRefraction: ConstantScalar(1.0),
+	}
+	rng := rand.New(rand.NewSource(1))
+
+	for _, theta := range []float64{0, 0.3, math.Atan(1.5), 1.2, 1.5} {
+		c := glassContact(theta)
+		for i := 0; i < 100; i++ {
+			info := glass.ShadePolarized(c, 550, rng)
+			p := info.Polarization
+			if p == nil {
+				t.Fatalf("theta %v: no polarization", theta)
+			}
+
+			// Importance sampling by the unpolarized coefficients means
+			// unpolarized light always comes through at full strength.
+			if math.Abs(p.Mueller[0]-1) > 1e-9 {
+				t.Errorf("theta %v: M00 is %v, want 1", theta, p.Mueller[0])
+			}
+
+			if math.Abs(vec3.IProd(p.OutRef, c.R.Slope)) > 1e-9 || math.Abs(vec3.IProd(p.InRef, info.IncidentRay.Slope)) > 1e-9 {
+				t.Errorf("theta %v: reference vectors aren't perpendicular to their rays", theta)
+			}
+
+			// At Brewster's angle, reflected light is completely
+			// s-polarized.
+			reflected := info.IncidentRay.Slope[2] > 0
+			if theta == math.Atan(1.5) && reflected {
+				s := polarization.MulMS(p.Mueller, polarization.Unpolarized(1))
+				if math.Abs(s.DegreeOfPolarization()-1) > 1e-9 || s[1] <= 0 {
+					t.Errorf("Brewster reflection gave %v, want s-polarized light", s)
+				}
+			}
+		}
+	}
+
+	// Past the critical angle from inside, everything is reflected, and
+	// polarized light stays polarized.
+	inside := glassContact(1.2)
+	inside.N = vec3.MulVS(inside.N, -1)
+	info := glass.ShadePolarized(inside, 550, rng)
+	s := polarization.MulMS(info.Polarization.Mueller, polarization.Stokes{1, 0, 1, 0})
+	if math.Abs(s[0]-1) > 1e-9 || math.Abs(s.DegreeOfPolarization()-1) > 1e-9 {
+		t.Errorf("total internal reflection gave %v", s)
+	}
+	if math.Abs(s[3]) < 0.1 {
+		t.Errorf("total internal reflection gave %v, want some circular polarization", s)
+	}
+}
+
+func TestLinearPolarizerPolarized(t *testing.T) {
+	sheet := &LinearPolarizer{
+		Axis:          vec3.T{0, 1, 1},
+		Transmittance: ConstantScalar(0.9),
+	}
+	c := glassContact(0)
+
+	info := sheet.ShadePolarized(c, 550, nil)
+	if info.PropagationK != 0.45 {
+		t.Errorf("got PropagationK %v, want 0.45", info.PropagationK)
+	}
+	if info.IncidentRay.Slope != c.R.Slope {
+		t.Errorf("light bends through the sheet: %v", info.IncidentRay.Slope)
+	}
+
+	// Seen from directly above, the axis projects to +Y.
+	if ref := info.Polarization.OutRef; math.Abs(ref[1]-1) > 1e-9 {
+		t.Errorf("got reference %v, want +Y", ref)
+	}
+	s := polarization.MulMS(info.Polarization.Mueller, polarization.Unpolarized(1))
+	if math.Abs(s[0]-0.45) > 1e-9 || math.Abs(s[1]-0.45) > 1e-9 {
+		t.Errorf("got %v, want light polarized along the axis", s)
+	}
+
+	edgeOn := &LinearPolarizer{Axis: vec3.T{0, 0, 1}, Transmittance: ConstantScalar(1)}
+	if info := edgeOn.ShadePolarized(c, 550, nil); info.Polarization.Mueller[0] != 0 {
+		t.Errorf("light got through a polarizer seen edge-on")
+	}
+}
@@ -0,0 +1,174 @@
+package material
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"row-major/harpoon/contact"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// ThinFilmSmooth is a smooth boundary between two non-conductive media, coated
+// with a thin transparent film.  Light reflected from the top and the bottom of
+// the film interferes, so the reflectance depends strongly on wavelength:
+// soap bubbles, oil slicks, and anti-reflective lens coatings.
+//
+// For a free-standing film, like a soap bubble, make the interior and exterior
+// indices of refraction the same.  Light then passes through the film without
+// bending.
+//
+// FilmThickness is in nanometers, the same units as wavelength.
+type ThinFilmSmooth struct {
+	InteriorIndexOfRefraction MaterialMap
+	ExteriorIndexOfRefraction MaterialMap
+	FilmIndexOfRefraction     MaterialMap
+	FilmThickness             MaterialMap
+}
+
+func (t *ThinFilmSmooth) Crush(time float64) {}
+
+// fresnelAmplitudes returns the s- and p-polarized reflection amplitudes at a
+// boundary from index n1 to index n2, given the cosines of the angles from
+// the normal on each side.  The cosines are complex to carry evanescent waves
+// past the critical angle.
+func fresnelAmplitudes(n1, n2 float64, cos1, cos2 complex128) (complex128, complex128) {
+	c1, c2 := complex(n1, 0), complex(n2, 0)
+	rs := (c1*cos1 - c2*cos2) / (c1*cos1 + c2*cos2)
+	rp := (c2*cos1 - c1*cos2) / (c2*cos1 + c1*cos2)
+	return rs, rp
+}
+
+// snellCosine is the cosine of the refracted angle when light crosses from
+// index n1 to index n2 with the given incident cosine.  Past the critical
+// angle it's imaginary.
+func snellCosine(n1, n2, cos1 float64) complex128 {
+	sin2 := (n1 / n2) * (n1 / n2) * (1 - cos1*cos1)
+	return cmplx.Sqrt(complex(1-sin2, 0))
+}
+
+// ThinFilmReflectance is the fraction of unpolarized light reflected by a film
+// of index n2 and the given thickness, lying between media of index n1 (where
+// the light arrives from, at incident cosine cos1) and n3.  Thickness and
+// wavelength are in the same units.
+//
+// The reflectance sums every bounce inside the film (the Airy formula),
+// averaged over the two polarizations.
+func ThinFilmReflectance(n1, n2, n3, thickness, wavelength, cos1 float64) float64 {
+	cos2 := snellCosine(n1, n2, cos1)
+	cos3 := snellCosine(n1, n3, cos1)
+
+	rs12, rp12 := fresnelAmplitudes(n1, n2, complex(cos1, 0), cos2)
+	rs23, rp23 := fresnelAmplitudes(n2, n3, cos2, cos3)
+
+	// The phase picked up by a round trip through the film.
+	phase := cmplx.Exp(complex(0, 4*math.Pi*n2*thickness/wavelength) * cos2)
+
+	rs := (rs12 + rs23*phase) / (1 + rs12*rs23*phase)
+	rp := (rp12 + rp23*phase) / (1 + rp12*rp23*phase)
+
+	r := (real(rs*cmplx.Conj(rs)) + real(rp*cmplx.Conj(rp))) / 2
+	return math.Min(r, 1.0)
+}
+
+// boundary works out which side of the boundary a ray is on.  It returns the
+// indices of refraction on the near and far sides, and the cosine between the
+// ray and the normal (negative if the ray is travelling against the normal).
+func (t *ThinFilmSmooth) boundary(c contact.Contact, freq float32) (float64, float64, float64) {
+	coord := MaterialCoords{
+		Mtl2: c.Mtl2,
+		Mtl3: c.Mtl3,
+		Freq: freq,
+	}
+	nA := t.ExteriorIndexOfRefraction(coord)
+	nB := t.InteriorIndexOfRefraction(coord)
+
+	aCos := vec3.IProd(c.R.Slope, c.N)
+	if aCos > 0.0 {
+		nA, nB = nB, nA
+	}
+	return nA, nB, aCos
+}
+
+// reflectance is the film's reflectance for the contact's ray at freq.
+func (t *ThinFilmSmooth) reflectance(c contact.Contact, freq float32) float64 {
+	coord := MaterialCoords{
+		Mtl2: c.Mtl2,
+		Mtl3: c.Mtl3,
+		Freq: freq,
+	}
+	nA, nB, aCos := t.boundary(c, freq)
+	return ThinFilmReflectance(nA, t.FilmIndexOfRefraction(coord), nB, t.FilmThickness(coord), float64(freq), math.Abs(aCos))
+}
+
+func (t *ThinFilmSmooth) Shade(c contact.Contact, freq float32, rng *rand.Rand) ShadeInfo {
+	nA, nB, aCos := t.boundary(c, freq)
+	nR := nA / nB
+
+	reflected := ShadeInfo{
+		PropagationK: 1.0,
+		IncidentRay: ray.Ray{
+			Point: c.P,
+			Slope: vec3.Reflect(c.R.Slope, c.N),
+		},
+	}
+
+	// The film is parallel to the boundary, so it doesn't change the
+	// direction of the transmitted ray; that's decided by the media on either
+	// side.  Total internal reflection also happens as if the film weren't
+	// there.
+	snell := 1.0 - (nR*nR)*(1.0-(aCos*aCos))
+	if snell < 0.0 {
+		return reflected
+	}
+
+	if rng.Float64() < t.reflectance(c, freq) {
+		return reflected
+	}
+
+	bCos := math.Sqrt(snell)
+	if aCos < 0.0 {
+		bCos = -bCos
+	}
+	return ShadeInfo{
+		PropagationK: 1.0,
+		IncidentRay: ray.Ray{
+			Point: c.P,
+			Slope: vec3.AddVV(vec3.MulVS(c.N, bCos-nR*aCos), vec3.MulVS(c.R.Slope, nR)),
+		},
+	}
+}
+
+// ShadeSecondary reuses the hero's choice of reflection or transmission,
+// reweighted by the film's reflectance at each wavelength.  This keeps
+// iridescence cheap to render: the film's color comes from interference, not
+// from dispersion, so the paths don't need to collapse.
+//
+// Like NonConductiveSmooth, it fails if the indices of refraction of the media
+// on either side differ between the wavelengths.
+func (t *ThinFilmSmooth) ShadeSecondary(c contact.Contact, heroFreq float32, hero ShadeInfo, freq float32) (ShadeInfo, bool) {
+	heroA, heroB, aCos := t.boundary(c, heroFreq)
+	nA, nB, _ := t.boundary(c, freq)
+	if heroA != nA || heroB != nB {
+		return ShadeInfo{}, false
+	}
+
+	nR := nA / nB
+	if 1.0-(nR*nR)*(1.0-(aCos*aCos)) < 0.0 {
+		return hero, true
+	}
+
+	heroR := t.reflectance(c, heroFreq)
+	r := t.reflectance(c, freq)
+
+	// A reflected ray heads back to the side the contact ray came from.
+	k := r / heroR
+	if vec3.IProd(hero.IncidentRay.Slope, c.N)*aCos > 0.0 {
+		k = (1 - r) / (1 - heroR)
+	}
+
+	return ShadeInfo{
+		PropagationK: float32(k),
+		IncidentRay:  hero.IncidentRay,
+	}, true
+}
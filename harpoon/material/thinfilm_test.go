@@ -0,0 +1,51 @@
+package material
+
+import (
+	"math"
+	"testing"
+)
+
+func TestThinFilmReflectance(t *testing.T) {
+	glass := 1.5
+	plain := (1 - glass) / (1 + glass)
+	plain *= plain
+
+	// A film of no thickness, or one matching the substrate, doesn't change
+	// anything.
+	if got := ThinFilmReflectance(1, 1.38, glass, 0, 550, 1); math.Abs(got-plain) > 1e-9 {
+		t.Errorf("zero-thickness film reflects %v, want %v", got, plain)
+	}
+	if got := ThinFilmReflectance(1, glass, glass, 200, 550, 1); math.Abs(got-plain) > 1e-9 {
+		t.Errorf("film matching the substrate reflects %v, want %v", got, plain)
+	}
+
+	// An ideal quarter-wave anti-reflective coating cancels reflection at its
+	// design wavelength, but not at others.
+	coating := math.Sqrt(glass)
+	thickness := 550 / (4 * coating)
+	if got := ThinFilmReflectance(1, coating, glass, thickness, 550, 1); got > 1e-9 {
+		t.Errorf("quarter-wave coating reflects %v at its design wavelength, want 0", got)
+	}
+	if got := ThinFilmReflectance(1, coating, glass, thickness, 400, 1); got < 1e-3 {
+		t.Errorf("quarter-wave coating reflects %v at 400nm, want more", got)
+	}
+
+	// A soap film's reflectance swings with wavelength, and it conserves
+	// energy.
+	lo, hi := 1.0, 0.0
+	for wavelength := 390.0; wavelength < 835; wavelength += 5 {
+		r := ThinFilmReflectance(1, 1.33, 1, 500, wavelength, 0.8)
+		if r < 0 || r > 1 {
+			t.Fatalf("soap film reflects %v at %vnm", r, wavelength)
+		}
+		lo, hi = math.Min(lo, r), math.Max(hi, r)
+	}
+	if hi-lo < 0.05 {
+		t.Errorf("soap film reflectance only ranges over [%v, %v]", lo, hi)
+	}
+
+	// Past the critical angle, everything is reflected.
+	if got := ThinFilmReflectance(1.5, 1.38, 1, 100, 550, 0.1); math.Abs(got-1) > 1e-9 {
+		t.Errorf("reflectance past the critical angle is %v, want 1", got)
+	}
+}
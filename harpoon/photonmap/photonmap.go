@@ -0,0 +1,127 @@
+// Package photonmap stores photons traced from light sources, and answers
+// radius queries against them.
+package photonmap
+
+import (
+	"sort"
+
+	"row-major/harpoon/vmath/vec3"
+)
+
+// Photon is a packet of power that landed on a surface.
+type Photon struct {
+	// Where the photon landed.
+	P vec3.T
+
+	// The normal of the surface the photon landed on.
+	N vec3.T
+
+	// The direction the photon arrived from (pointing away from the surface).
+	Incident vec3.T
+
+	// The wavelength of the photon.
+	Freq float32
+
+	// The power carried by the photon.
+	Power float32
+}
+
+// PhotonMap is a balanced kd-tree of photons.
+//
+// The tree is implicit: the photons in the range [lo, hi) are split at the
+// median element mid, with the lower half in [lo, mid) and the upper half in
+// [mid+1, hi).
+type PhotonMap struct {
+	photons []Photon
+	axes    []uint8
+}
+
+// New builds a photon map.  It takes ownership of photons.
+func New(photons []Photon) *PhotonMap {
+	m := &PhotonMap{
+		photons: photons,
+		axes:    make([]uint8, len(photons)),
+	}
+	m.balance(0, len(photons))
+	return m
+}
+
+// Len returns the number of photons in the map.
+func (m *PhotonMap) Len() int {
+	return len(m.photons)
+}
+
+func (m *PhotonMap) balance(lo, hi int) {
+	if hi-lo <= 1 {
+		return
+	}
+
+	// Split along the axis with the largest extent.
+	minP := m.photons[lo].P
+	maxP := m.photons[lo].P
+	for i := lo + 1; i < hi; i++ {
+		for a := 0; a < 3; a++ {
+			if m.photons[i].P[a] < minP[a] {
+				minP[a] = m.photons[i].P[a]
+			}
+			if m.photons[i].P[a] > maxP[a] {
+				maxP[a] = m.photons[i].P[a]
+			}
+		}
+	}
+
+	axis := 0
+	for a := 1; a < 3; a++ {
+		if maxP[a]-minP[a] > maxP[axis]-minP[axis] {
+			axis = a
+		}
+	}
+
+	span := m.photons[lo:hi]
+	sort.Slice(span, func(i, j int) bool {
+		return span[i].P[axis] < span[j].P[axis]
+	})
+
+	mid := lo + (hi-lo)/2
+	m.axes[mid] = uint8(axis)
+
+	m.balance(lo, mid)
+	m.balance(mid+1, hi)
+}
+
+// Query calls visitor for every photon within radius of p.
+func (m *PhotonMap) Query(p vec3.T, radius float64, visitor func(*Photon)) {
+	m.query(0, len(m.photons), p, radius*radius, visitor)
+}
+
+func (m *PhotonMap) query(lo, hi int, p vec3.T, radiusSquared float64, visitor func(*Photon)) {
+	for hi-lo > 0 {
+		mid := lo + (hi-lo)/2
+		cur := &m.photons[mid]
+
+		d := vec3.SubVV(cur.P, p)
+		if vec3.IProd(d, d) <= radiusSquared {
+			visitor(cur)
+		}
+
+		if hi-lo == 1 {
+			return
+		}
+
+		// Recurse into the near side, then loop on the far side if the query
+		// sphere crosses the splitting plane.
+		axis := m.axes[mid]
+		delta := p[axis] - cur.P[axis]
+		nearLo, nearHi, farLo, farHi := lo, mid, mid+1, hi
+		if delta > 0 {
+			nearLo, nearHi, farLo, farHi = mid+1, hi, lo, mid
+		}
+
+		m.query(nearLo, nearHi, p, radiusSquared, visitor)
+
+		if delta*delta > radiusSquared {
+			return
+		}
+		lo, hi = farLo, farHi
+	}
+}
@@ -0,0 +1,57 @@
+package photonmap
+
+import (
+	"math/rand"
+	"testing"
+
+	"row-major/harpoon/vmath/vec3"
+)
+
+func TestQueryMatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(12345))
+
+	photons := make([]Photon, 2000)
+	for i := range photons {
+		photons[i] = Photon{
+			P:     vec3.T{rng.Float64() * 10, rng.Float64() * 5, rng.Float64()},
+			Power: float32(i),
+		}
+	}
+
+	// New takes ownership, so keep a copy to check against.
+	want := make([]Photon, len(photons))
+	copy(want, photons)
+
+	m := New(photons)
+	if m.Len() != len(want) {
+		t.Fatalf("Got Len() = %d, want %d", m.Len(), len(want))
+	}
+
+	for q := 0; q < 100; q++ {
+		p := vec3.T{rng.Float64() * 10, rng.Float64() * 5, rng.Float64()}
+		radius := rng.Float64()
+
+		got := map[float32]bool{}
+		m.Query(p, radius, func(ph *Photon) {
+			if got[ph.Power] {
+				t.Errorf("Query(%v, %v) visited photon %v twice", p, radius, ph.Power)
+			}
+			got[ph.Power] = true
+		})
+
+		wantCount := 0
+		for i := range want {
+			if vec3.SubVV(want[i].P, p).Norm() > radius {
+				continue
+			}
+			wantCount++
+			if !got[want[i].Power] {
+				t.Errorf("Query(%v, %v) missed photon %v at %v", p, radius, want[i].Power, want[i].P)
+			}
+		}
+
+		if len(got) != wantCount {
+			t.Errorf("Query(%v, %v) visited %d photons, want %d", p, radius, len(got), wantCount)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Package polarization describes the polarization state of light with Stokes
+// vectors, and the way optical elements change it with Mueller matrices.
+//
+// A Stokes vector is only meaningful relative to a reference frame: light
+// traveling along a direction d, with a reference vector x perpendicular to d.
+// The frame's second axis is y = d × x.  Q is the excess of light polarized
+// along x over light polarized along y, U is the same for the diagonals
+// (x + y) and (x - y), and V is the excess of right-handed over left-handed
+// circular polarization.
+package polarization
+
+import (
+	"math"
+
+	"row-major/harpoon/vmath/vec3"
+)
+
+// Stokes is a Stokes vector: I, Q, U, V.
+type Stokes [4]float64
+
+// Unpolarized is unpolarized light with intensity i.
+func Unpolarized(i float64) Stokes {
+	return Stokes{i, 0, 0, 0}
+}
+
+// AddSS returns a + b.
+func AddSS(a, b Stokes) Stokes {
+	return Stokes{a[0] + b[0], a[1] + b[1], a[2] + b[2], a[3] + b[3]}
+}
+
+// MulSS returns s scaled by k.
+func MulSS(s Stokes, k float64) Stokes {
+	return Stokes{s[0] * k, s[1] * k, s[2] * k, s[3] * k}
+}
+
+// DegreeOfPolarization is the fraction of the light that is polarized.
+func (s Stokes) DegreeOfPolarization() float64 {
+	if s[0] == 0 {
+		return 0
+	}
+	return math.Sqrt(s[1]*s[1]+s[2]*s[2]+s[3]*s[3]) / s[0]
+}
+
+// AngleOfPolarization is the angle of the major axis of the polarization
+// ellipse, measured from the reference vector towards the frame's second axis,
+// in (-pi/2, pi/2].
+func (s Stokes) AngleOfPolarization() float64 {
+	return math.Atan2(s[2], s[1]) / 2
+}
+
+// Mueller is a Mueller matrix, in row-major order.  It maps a Stokes vector in
+// one frame (for light arriving at an optical element) to a Stokes vector in
+// another (for light leaving it).
+type Mueller [16]float64
+
+// Identity is the Mueller matrix that leaves light unchanged.
+func Identity() Mueller {
+	return Mueller{
+		1, 0, 0, 0,
+		0, 1, 0, 0,
+		0, 0, 1, 0,
+		0, 0, 0, 1,
+	}
+}
+
+// Depolarizer scales intensity by k, and leaves the light unpolarized.
+func Depolarizer(k float64) Mueller {
+	return Mueller{0: k}
+}
+
+// MulMM returns the matrix product a * b: the effect of b, followed by a.
+func MulMM(a, b Mueller) Mueller {
+	result := Mueller{}
+	for r := 0; r < 4; r++ {
+		for c := 0; c < 4; c++ {
+			sum := 0.0
+			for k := 0; k < 4; k++ {
+				sum += a[4*r+k] * b[4*k+c]
+			}
+			result[4*r+c] = sum
+		}
+	}
+	return result
+}
+
+// MulMK returns m scaled by k.
+func MulMK(m Mueller, k float64) Mueller {
+	for i := range m {
+		m[i] *= k
+	}
+	return m
+}
+
+// MulMS applies m to s.
+func MulMS(m Mueller, s Stokes) Stokes {
+	result := Stokes{}
+	for r := 0; r < 4; r++ {
+		result[r] = m[4*r]*s[0] + m[4*r+1]*s[1] + m[4*r+2]*s[2] + m[4*r+3]*s[3]
+	}
+	return result
+}
+
+// Rotator converts Stokes vectors to a frame whose reference vector is rotated
+// by theta (towards the frame's second axis).
+func Rotator(theta float64) Mueller {
+	s, c := math.Sincos(2 * theta)
+	return Mueller{
+		1, 0, 0, 0,
+		0, c, s, 0,
+		0, -s, c, 0,
+		0, 0, 0, 1,
+	}
+}
+
+// Reframe converts Stokes vectors for light traveling along dir from the frame
+// with reference vector from, to the frame with reference vector to.  Both
+// reference vectors must be perpendicular to dir.
+func Reframe(from, to, dir vec3.T) Mueller {
+	y := vec3.CProd(dir, from)
+	theta := math.Atan2(vec3.IProd(to, y), vec3.IProd(to, from))
+	return Rotator(theta)
+}
+
+// LinearPolarizer is an ideal linear polarizer, with its transmission axis at
+// angle theta from the reference vector.
+func LinearPolarizer(theta float64) Mueller {
+	s, c := math.Sincos(2 * theta)
+	return Mueller{
+		0.5, 0.5 * c, 0.5 * s, 0,
+		0.5 * c, 0.5 * c * c, 0.5 * c * s, 0,
+		0.5 * s, 0.5 * c * s, 0.5 * s * s, 0,
+		0, 0, 0, 0,
+	}
+}
+
+// Retarder is a linear retarder, with its fast axis along the reference
+// vector, that delays the slow axis by delta radians.  A quarter-wave plate
+// has a delta of pi/2.
+func Retarder(delta float64) Mueller {
+	s, c := math.Sincos(delta)
+	return Mueller{
+		1, 0, 0, 0,
+		0, 1, 0, 0,
+		0, 0, c, s,
+		0, 0, -s, c,
+	}
+}
+
+// Diattenuator scales the amplitude of light polarized along the reference
+// vector by as, and of light polarized along the frame's second axis by ap.
+// With the reference vector perpendicular to the plane of incidence, this is
+// Fresnel reflection or transmission, with as and ap the s and p amplitude
+// coefficients.
+//
+// The result is scaled by k, for example to account for a change in beam
+// cross-section on refraction.
+func Diattenuator(as, ap, k float64) Mueller {
+	sum := 0.5 * k * (as*as + ap*ap)
+	diff := 0.5 * k * (as*as - ap*ap)
+	cross := k * as * ap
+	return Mueller{
+		sum, diff, 0, 0,
+		diff, sum, 0, 0,
+		0, 0, cross, 0,
+		0, 0, 0, cross,
+	}
+}
+
+// PerpendicularTo returns a unit vector perpendicular to dir, for use as a
+// reference vector when nothing better is available.
+func PerpendicularTo(dir vec3.T) vec3.T {
+	u, _ := vec3.OrthonormalBasis(vec3.Normalize(dir))
+	return u
+}
@@ -0,0 +1,102 @@
+package polarization
+
+import (
+	"math"
+	"testing"
+
+	"row-major/harpoon/vmath/vec3"
+)
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func nearStokes(a, b Stokes) bool {
+	for i := range a {
+		if !near(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMalusLaw(t *testing.T) {
+	polarized := MulMS(LinearPolarizer(0), Unpolarized(1))
+	if !nearStokes(polarized, Stokes{0.5, 0.5, 0, 0}) {
+		t.Fatalf("polarizer passed %v, want half the light, horizontally polarized", polarized)
+	}
+
+	for _, theta := range []float64{0, 0.3, math.Pi / 4, 1.2, math.Pi / 2} {
+		got := MulMS(LinearPolarizer(theta), polarized)[0]
+		want := 0.5 * math.Cos(theta) * math.Cos(theta)
+		if !near(got, want) {
+			t.Errorf("analyzer at %v passed %v, want %v", theta, got, want)
+		}
+	}
+}
+
+func TestStokesAngles(t *testing.T) {
+	s := MulMS(LinearPolarizer(0.4), Unpolarized(2))
+	if got := s.DegreeOfPolarization(); !near(got, 1) {
+		t.Errorf("got degree of polarization %v, want 1", got)
+	}
+	if got := s.AngleOfPolarization(); !near(got, 0.4) {
+		t.Errorf("got angle of polarization %v, want 0.4", got)
+	}
+	if got := Unpolarized(1).DegreeOfPolarization(); got != 0 {
+		t.Errorf("got degree of polarization %v for unpolarized light, want 0", got)
+	}
+}
+
+func TestReframe(t *testing.T) {
+	dir := vec3.T{0, 0, 1}
+	x := vec3.T{1, 0, 0}
+	diagonal := vec3.Normalize(vec3.T{1, 1, 0})
+
+	// Light polarized along the diagonal, measured against the diagonal, is
+	// polarized at 45 degrees when measured against x.
+	s := Stokes{1, 1, 0, 0}
+	got := MulMS(Reframe(diagonal, x, dir), s)
+	if !nearStokes(got, Stokes{1, 0, 1, 0}) {
+		t.Errorf("got %v, want light polarized at 45 degrees", got)
+	}
+
+	// Going there and back is the identity.
+	round := MulMM(Reframe(diagonal, x, dir), Reframe(x, diagonal, dir))
+	for i := range round {
+		if !near(round[i], Identity()[i]) {
+			t.Fatalf("reframing there and back gave %v", round)
+		}
+	}
+
+	// Reversing the reference vector changes nothing.
+	got = MulMS(Reframe(x, vec3.T{-1, 0, 0}, dir), Stokes{1, 0.3, 0.4, 0.5})
+	if !nearStokes(got, Stokes{1, 0.3, 0.4, 0.5}) {
+		t.Errorf("reversing the reference vector gave %v", got)
+	}
+}
+
+func TestDiattenuator(t *testing.T) {
+	// A perfect mirror reverses handedness.
+	mirror := Diattenuator(-1, 1, 1)
+	got := MulMS(mirror, Stokes{1, 0.2, 0.3, 0.4})
+	if !nearStokes(got, Stokes{1, 0.2, -0.3, -0.4}) {
+		t.Errorf("mirror gave %v", got)
+	}
+
+	// At Brewster's angle, rp is zero, and reflected light is completely
+	// s-polarized.
+	brewster := MulMS(Diattenuator(0.4, 0, 1), Unpolarized(1))
+	if !nearStokes(brewster, Stokes{0.08, 0.08, 0, 0}) {
+		t.Errorf("Brewster reflection gave %v", brewster)
+	}
+}
+
+func TestRetarderMakesCircularPolarization(t *testing.T) {
+	// Light polarized at 45 degrees to a quarter-wave plate's fast axis comes
+	// out circularly polarized.
+	s := MulMS(Retarder(math.Pi/2), Stokes{1, 0, 1, 0})
+	if !near(math.Abs(s[3]), 1) {
+		t.Errorf("got %v, want circular polarization", s)
+	}
+}
@@ -0,0 +1,94 @@
+package ray
+
+import (
+	"math"
+	"row-major/harpoon/vmath/vec3"
+	"row-major/harpoon/vmath/vec3soa"
+)
+
+// PacketWidth is the most ray segments a Packet can hold.
+const PacketWidth = vec3soa.Width
+
+// Packet is a group of ray segments, traced together through an acceleration
+// structure.  Packets work best for coherent rays, like camera rays through
+// neighboring pixels, which mostly visit the same nodes.
+//
+// Packets are stored in float32, so they are only suitable for conservative
+// culling; intersections should still be computed with the RaySegments the
+// packet was built from.  To keep float32 precise enough, the rays' points
+// are stored relative to Origin, the point of the first ray.
+//
+// Sets of rays in a packet are represented as bit masks, with bit i standing
+// for ray i.
+type Packet struct {
+	Origin vec3.T
+
+	// Point is each ray's point, relative to Origin.
+	Point    vec3soa.T
+	InvSlope vec3soa.T
+
+	// The segment of each ray, rounded outwards to float32.
+	Lo, Hi [PacketWidth]float32
+
+	// Slack is how far the packet's box tests should widen boxes, to cover
+	// the rounding of the rays' points to float32.
+	Slack float32
+
+	// Active is the mask of rays present in the packet.
+	Active uint32
+}
+
+// NewPacket builds a packet from up to PacketWidth ray segments.
+func NewPacket(segs []RaySegment) Packet {
+	p := Packet{}
+	if len(segs) == 0 {
+		return p
+	}
+
+	p.Origin = segs[0].TheRay.Point
+
+	maxOffset := 0.0
+	slope := vec3soa.T{}
+	for i := range segs {
+		offset := vec3.SubVV(segs[i].TheRay.Point, p.Origin)
+		p.Point.Set(i, offset)
+		slope.Set(i, segs[i].TheRay.Slope)
+		p.Lo[i] = roundDown32(segs[i].TheSegment.Lo)
+		p.Hi[i] = roundUp32(segs[i].TheSegment.Hi)
+		p.Active |= 1 << i
+
+		for j := 0; j < 3; j++ {
+			maxOffset = math.Max(maxOffset, math.Abs(offset[j]))
+		}
+	}
+
+	// Unused lanes get a unit slope, so that they never produce NaNs.
+	for i := len(segs); i < PacketWidth; i++ {
+		slope.Set(i, vec3.T{1, 1, 1})
+	}
+	p.InvSlope = vec3soa.Reciprocal(&slope)
+
+	p.Slack = float32(2e-6 * maxOffset)
+	return p
+}
+
+// SetHi shrinks the segment of ray i, for example after finding a hit.
+func (p *Packet) SetHi(i int, hi float64) {
+	p.Hi[i] = roundUp32(hi)
+}
+
+func roundUp32(x float64) float32 {
+	f := float32(x)
+	if float64(f) < x {
+		f = math.Nextafter32(f, float32(math.Inf(1)))
+	}
+	return f
+}
+
+func roundDown32(x float64) float32 {
+	f := float32(x)
+	if float64(f) > x {
+		f = math.Nextafter32(f, float32(math.Inf(-1)))
+	}
+	return f
+}
@@ -0,0 +1,213 @@
+package renderqueue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// maxUploadBytes bounds the size of an uploaded scene.
+const maxUploadBytes = 1 << 30
+
+// Handler serves the queue's HTTP API:
+//
+//	POST /jobs                submit a job (multipart form, see below)
+//	GET  /jobs                list jobs
+//	GET  /jobs/{id}           get a job's status and progress
+//	POST /jobs/{id}/cancel    cancel a job
+//	GET  /jobs/{id}/output    download the job's spectral image
+//	GET  /jobs/{id}/stokes/{component}
+//	                          download a polarized job's Q, U, or V image
+//
+// A submission is a multipart form with the scene file in the "scene" field,
+// and optionally the render options as JSON in the "options" field.  Options
+// that aren't given take the renderer's defaults.
+func (q *Queue) Handler() http.Handler {
+	m := http.NewServeMux()
+	m.HandleFunc("/jobs", q.jobsHandler)
+	m.HandleFunc("/jobs/", q.jobHandler)
+	return m
+}
+
+// allowMethod checks that r uses method, and responds with an error if it
+// doesn't.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// jobsHandler serves /jobs.
+func (q *Queue) jobsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		q.submitHandler(w, r)
+	case http.MethodGet:
+		q.listHandler(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// jobHandler serves the paths under /jobs/, which all start with a job ID.
+func (q *Queue) jobHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	id := parts[0]
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		if allowMethod(w, r, http.MethodGet) {
+			q.getHandler(w, r, id)
+		}
+	case len(parts) == 2 && parts[1] == "cancel":
+		if allowMethod(w, r, http.MethodPost) {
+			q.cancelHandler(w, r, id)
+		}
+	case len(parts) == 2 && parts[1] == "output":
+		if allowMethod(w, r, http.MethodGet) {
+			q.outputHandler(w, r, id)
+		}
+	case len(parts) == 3 && parts[1] == "stokes" && parts[2] != "":
+		if allowMethod(w, r, http.MethodGet) {
+			q.stokesHandler(w, r, id, parts[2])
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, ErrNotFound) {
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func (q *Queue) submitHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+
+	options := DefaultOptions()
+	if optionsJSON := r.FormValue("options"); optionsJSON != "" {
+		dec := json.NewDecoder(strings.NewReader(optionsJSON))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&options); err != nil {
+			http.Error(w, fmt.Sprintf("while parsing options: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sceneFile, sceneHeader, err := r.FormFile("scene")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("while reading scene upload: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer sceneFile.Close()
+
+	job, err := q.Submit(sceneHeader.Filename, sceneFile, options)
+	if err != nil {
+		// Almost every submission failure is a bad scene or bad options.
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSON(w, http.StatusCreated, job)
+}
+
+func (q *Queue) listHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, q.List())
+}
+
+func (q *Queue) getHandler(w http.ResponseWriter, r *http.Request, id string) {
+	job, err := q.Get(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (q *Queue) cancelHandler(w http.ResponseWriter, r *http.Request, id string) {
+	job, err := q.Cancel(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (q *Queue) outputHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if _, err := q.Get(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	serveSpectralFile(w, r, q.OutputPath(id), id+".spectral")
+}
+
+func (q *Queue) stokesHandler(w http.ResponseWriter, r *http.Request, id, component string) {
+	job, err := q.Get(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !job.Options.Polarized {
+		http.Error(w, "job is not polarized", http.StatusNotFound)
+		return
+	}
+
+	known := false
+	for _, c := range StokesComponents {
+		known = known || c == component
+	}
+	if !known {
+		http.Error(w, fmt.Sprintf("unknown Stokes component %q", component), http.StatusNotFound)
+		return
+	}
+	serveSpectralFile(w, r, q.StokesPath(id, component), id+"-"+component+".spectral")
+}
+
+// serveSpectralFile serves a job's spectral image for download as name.
+func serveSpectralFile(w http.ResponseWriter, r *http.Request, fileName, name string) {
+	f, err := os.Open(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "job has no output yet", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(w, r, "", stat.ModTime(), f)
+}
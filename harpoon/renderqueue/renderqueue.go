@@ -0,0 +1,779 @@
+// Package renderqueue runs queued render jobs in the background.
+//
+// Each job lives in its own directory, holding the uploaded scene, a JSON
+// record of the job, and the spectral image being rendered.  Renders are
+// checkpointed to disk every few subsamples, so a job interrupted by a restart
+// picks up where it left off, in the same way as the renderer's --resume flag.
+package renderqueue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"row-major/harpoon/scene"
+	"row-major/harpoon/sceneload"
+	"row-major/harpoon/spectralimage"
+)
+
+// State is the lifecycle stage of a job.
+type State string
+
+const (
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateDone      State = "done"
+	StateCancelled State = "cancelled"
+	StateFailed    State = "failed"
+)
+
+// Finished reports whether a job in state s will never run again.
+func (s State) Finished() bool {
+	return s == StateDone || s == StateCancelled || s == StateFailed
+}
+
+// Options are the render settings for a job.  They mirror the renderer's
+// flags.
+type Options struct {
+	OutputRows     int     `json:"output_rows"`
+	OutputCols     int     `json:"output_cols"`
+	WavelengthBins int     `json:"wavelength_bins"`
+	WavelengthMin  float64 `json:"wavelength_min"`
+	WavelengthMax  float64 `json:"wavelength_max"`
+
+	TargetSubsamples int    `json:"target_subsamples"`
+	MaxDepth         int    `json:"max_depth"`
+	HeroWavelength   bool   `json:"hero_wavelength"`
+	PacketTraversal  bool   `json:"packet_traversal"`
+	Polarized        bool   `json:"polarized"`
+	Integrator       string `json:"integrator"`
+
+	PhotonsPerPass      int     `json:"photons_per_pass"`
+	PhotonInitialRadius float64 `json:"photon_initial_radius"`
+	PhotonRadiusAlpha   float64 `json:"photon_radius_alpha"`
+}
+
+// DefaultOptions returns the renderer's default settings.
+func DefaultOptions() Options {
+	return Options{
+		OutputRows:          512,
+		OutputCols:          768,
+		WavelengthBins:      25,
+		WavelengthMin:       390.0,
+		WavelengthMax:       935.0,
+		TargetSubsamples:    4,
+		MaxDepth:            8,
+		HeroWavelength:      false,
+		PacketTraversal:     false,
+		Integrator:          "path",
+		PhotonsPerPass:      100000,
+		PhotonInitialRadius: 0.1,
+		PhotonRadiusAlpha:   0.7,
+	}
+}
+
+// Validate checks that the options describe a render that can be run.
+func (o *Options) Validate() error {
+	if o.OutputRows <= 0 || o.OutputCols <= 0 {
+		return fmt.Errorf("output size must be positive (got %dx%d)", o.OutputRows, o.OutputCols)
+	}
+	if o.WavelengthBins <= 0 {
+		return fmt.Errorf("wavelength_bins must be positive (got %d)", o.WavelengthBins)
+	}
+	if !(o.WavelengthMin < o.WavelengthMax) {
+		return fmt.Errorf("wavelength_min must be less than wavelength_max (got %v, %v)", o.WavelengthMin, o.WavelengthMax)
+	}
+	if o.TargetSubsamples <= 0 {
+		return fmt.Errorf("target_subsamples must be positive (got %d)", o.TargetSubsamples)
+	}
+	if o.MaxDepth <= 0 {
+		return fmt.Errorf("max_depth must be positive (got %d)", o.MaxDepth)
+	}
+	if o.PhotonsPerPass <= 0 {
+		return fmt.Errorf("photons_per_pass must be positive (got %d)", o.PhotonsPerPass)
+	}
+	if o.PhotonInitialRadius <= 0 {
+		return fmt.Errorf("photon_initial_radius must be positive (got %v)", o.PhotonInitialRadius)
+	}
+	if !(0 < o.PhotonRadiusAlpha && o.PhotonRadiusAlpha < 1) {
+		return fmt.Errorf("photon_radius_alpha must be between 0 and 1 (got %v)", o.PhotonRadiusAlpha)
+	}
+	integrator, err := o.integrator()
+	if err != nil {
+		return err
+	}
+	if o.Polarized && integrator != scene.IntegratorPathTracing {
+		return fmt.Errorf("polarized rendering requires the path integrator")
+	}
+	return nil
+}
+
+func (o *Options) integrator() (scene.Integrator, error) {
+	switch o.Integrator {
+	case "path":
+		return scene.IntegratorPathTracing, nil
+	case "photon":
+		return scene.IntegratorPhotonMapping, nil
+	default:
+		return 0, fmt.Errorf("unknown integrator %q", o.Integrator)
+	}
+}
+
+// Limits bound the resources a single job may ask for.  The sample DB holds
+// OutputRows*OutputCols*WavelengthBins bins, so these bound its size.
+type Limits struct {
+	MaxOutputRows     int
+	MaxOutputCols     int
+	MaxWavelengthBins int
+	MaxPhotonsPerPass int
+}
+
+// DefaultLimits returns the limits a new queue starts with.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxOutputRows:     4096,
+		MaxOutputCols:     4096,
+		MaxWavelengthBins: 64,
+		MaxPhotonsPerPass: 10000000,
+	}
+}
+
+// Check returns an error if o asks for more than l allows.
+func (l *Limits) Check(o *Options) error {
+	if o.OutputRows > l.MaxOutputRows || o.OutputCols > l.MaxOutputCols {
+		return fmt.Errorf("output size %dx%d exceeds the limit of %dx%d", o.OutputRows, o.OutputCols, l.MaxOutputRows, l.MaxOutputCols)
+	}
+	if o.WavelengthBins > l.MaxWavelengthBins {
+		return fmt.Errorf("wavelength_bins %d exceeds the limit of %d", o.WavelengthBins, l.MaxWavelengthBins)
+	}
+	if o.PhotonsPerPass > l.MaxPhotonsPerPass {
+		return fmt.Errorf("photons_per_pass %d exceeds the limit of %d", o.PhotonsPerPass, l.MaxPhotonsPerPass)
+	}
+	return nil
+}
+
+// Job is the externally-visible record of a render job.  It is what the HTTP
+// API returns, and what is stored in the job's directory.
+type Job struct {
+	ID        string  `json:"id"`
+	SceneFile string  `json:"scene_file"`
+	Options   Options `json:"options"`
+
+	State State  `json:"state"`
+	Error string `json:"error,omitempty"`
+
+	// CompletedSubsamples is the number of subsamples every pixel has reached
+	// as of the last checkpoint.
+	CompletedSubsamples int `json:"completed_subsamples"`
+
+	// Progress is the fraction of the render that is complete, in [0, 1].
+	Progress float64 `json:"progress"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+const (
+	jobFileName    = "job.json"
+	outputFileName = "output.spectral"
+)
+
+// StokesComponents name the Stokes parameters recorded by polarized jobs, in
+// the order of scene.RenderOptions.StokesDBs.
+var StokesComponents = [3]string{"q", "u", "v"}
+
+// ErrNotFound is returned for operations on a job that doesn't exist.
+var ErrNotFound = errors.New("job not found")
+
+// SceneLoader loads the scene stored in a file.
+type SceneLoader func(fileName string) (*scene.Scene, error)
+
+// LoadSceneFile loads a scene in any format understood by sceneload, logging
+// any warnings.
+func LoadSceneFile(fileName string) (*scene.Scene, error) {
+	s, warnings, err := sceneload.LoadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range warnings {
+		log.Printf("Loading %s: %s", filepath.Base(fileName), w)
+	}
+	return s, nil
+}
+
+// loadScene loads a scene with LoadScene, and validates it.  LoadSceneFile
+// already validates, but other loaders might not.
+func (q *Queue) loadScene(fileName string) (*scene.Scene, error) {
+	s, err := q.LoadScene(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Validate().Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type jobEntry struct {
+	job Job
+
+	// cancel is closed to ask the job to stop.
+	cancel     chan struct{}
+	cancelOnce sync.Once
+}
+
+func (e *jobEntry) requestCancel() {
+	e.cancelOnce.Do(func() { close(e.cancel) })
+}
+
+// Queue holds render jobs, and runs them with bounded concurrency.
+type Queue struct {
+	dir         string
+	concurrency int
+
+	// LoadScene loads uploaded scenes.  Defaults to LoadSceneFile.
+	LoadScene SceneLoader
+
+	// CheckpointSubsamples is how many subsamples are collected between writes
+	// of a job's output to disk.
+	CheckpointSubsamples int
+
+	// Limits bound the options of submitted jobs.  Jobs already on disk are
+	// not checked against them.
+	Limits Limits
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	jobs    map[string]*jobEntry
+	pending []string
+}
+
+// New creates a queue that keeps its jobs under dir, running up to concurrency
+// jobs at once.  Jobs already in dir are loaded; any that were queued or
+// running when the previous queue stopped are queued again.
+func New(dir string, concurrency int) (*Queue, error) {
+	if concurrency <= 0 {
+		return nil, fmt.Errorf("concurrency must be positive (got %d)", concurrency)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("while creating job directory: %w", err)
+	}
+
+	q := &Queue{
+		dir:                  dir,
+		concurrency:          concurrency,
+		LoadScene:            LoadSceneFile,
+		CheckpointSubsamples: 1,
+		Limits:               DefaultLimits(),
+		jobs:                 map[string]*jobEntry{},
+	}
+	q.cond = sync.NewCond(&q.lock)
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("while listing job directory: %w", err)
+	}
+
+	resumed := []*jobEntry{}
+	for _, de := range dirEntries {
+		if !de.IsDir() {
+			continue
+		}
+
+		job, err := readJob(filepath.Join(dir, de.Name(), jobFileName))
+		if err != nil {
+			log.Printf("Skipping job directory %q: %v", de.Name(), err)
+			continue
+		}
+
+		entry := &jobEntry{job: *job, cancel: make(chan struct{})}
+		q.jobs[job.ID] = entry
+
+		if !job.State.Finished() {
+			entry.job.State = StateQueued
+			resumed = append(resumed, entry)
+		}
+	}
+
+	// Resume jobs in the order they were submitted.
+	sort.Slice(resumed, func(i, j int) bool {
+		return resumed[i].job.Created.Before(resumed[j].job.Created)
+	})
+	for _, entry := range resumed {
+		q.pending = append(q.pending, entry.job.ID)
+	}
+
+	return q, nil
+}
+
+func readJob(fileName string) (*Job, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("while reading job file: %w", err)
+	}
+
+	job := &Job{}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, fmt.Errorf("while parsing job file: %w", err)
+	}
+
+	return job, nil
+}
+
+// writeFileAtomic writes a file via a temporary file and a rename, so that a
+// crash never leaves a half-written file behind.
+func writeFileAtomic(fileName string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fileName)
+}
+
+func (q *Queue) jobDir(id string) string {
+	return filepath.Join(q.dir, id)
+}
+
+// OutputPath is the path of the spectral image rendered by a job.  It doesn't
+// exist until the job's first checkpoint.
+func (q *Queue) OutputPath(id string) string {
+	return filepath.Join(q.jobDir(id), outputFileName)
+}
+
+// StokesPath is the path of the spectral image of one of a polarized job's
+// Stokes parameters, named by an entry of StokesComponents.  Like the output,
+// it doesn't exist until the job's first checkpoint.
+func (q *Queue) StokesPath(id, component string) string {
+	return filepath.Join(q.jobDir(id), "stokes-"+component+".spectral")
+}
+
+// saveLocked writes the job record to disk.  q.lock must be held.
+func (q *Queue) saveLocked(entry *jobEntry) error {
+	entry.job.Updated = time.Now()
+	return writeFileAtomic(filepath.Join(q.jobDir(entry.job.ID), jobFileName), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(&entry.job)
+	})
+}
+
+// update applies fn to a job's record, and saves it.
+func (q *Queue) update(entry *jobEntry, fn func(job *Job)) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	fn(&entry.job)
+	if err := q.saveLocked(entry); err != nil {
+		log.Printf("Error saving job %s: %v", entry.job.ID, err)
+	}
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Submit adds a job that renders the scene read from sceneData.  sceneName is
+// the scene's original file name; its extension picks the scene format.
+func (q *Queue) Submit(sceneName string, sceneData io.Reader, options Options) (*Job, error) {
+	if err := options.Validate(); err != nil {
+		return nil, fmt.Errorf("while validating options: %w", err)
+	}
+	if err := q.Limits.Check(&options); err != nil {
+		return nil, fmt.Errorf("while validating options: %w", err)
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		return nil, fmt.Errorf("while generating job ID: %w", err)
+	}
+
+	dir := q.jobDir(id)
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("while creating job directory: %w", err)
+	}
+
+	// Only keep the extension of the uploaded name, so the upload can't
+	// escape the job directory.
+	sceneFile := "scene" + strings.ToLower(filepath.Ext(sceneName))
+	err = writeFileAtomic(filepath.Join(dir, sceneFile), func(w io.Writer) error {
+		_, err := io.Copy(w, sceneData)
+		return err
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("while storing scene: %w", err)
+	}
+
+	// Make sure the scene loads now, rather than failing once the job reaches
+	// the front of the queue.
+	if _, err := q.loadScene(filepath.Join(dir, sceneFile)); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("while loading scene: %w", err)
+	}
+
+	now := time.Now()
+	entry := &jobEntry{
+		job: Job{
+			ID:        id,
+			SceneFile: sceneFile,
+			Options:   options,
+			State:     StateQueued,
+			Created:   now,
+		},
+		cancel: make(chan struct{}),
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err := q.saveLocked(entry); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("while saving job: %w", err)
+	}
+
+	q.jobs[id] = entry
+	q.pending = append(q.pending, id)
+	q.cond.Signal()
+
+	job := entry.job
+	return &job, nil
+}
+
+// Get returns a snapshot of a job.
+func (q *Queue) Get(id string) (*Job, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	entry, ok := q.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	job := entry.job
+	return &job, nil
+}
+
+// List returns snapshots of all jobs, oldest first.
+func (q *Queue) List() []*Job {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	jobs := []*Job{}
+	for _, entry := range q.jobs {
+		job := entry.job
+		jobs = append(jobs, &job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Created.Before(jobs[j].Created)
+	})
+	return jobs
+}
+
+// Cancel stops a job.  A queued job is cancelled immediately; a running job
+// stops at its next opportunity, keeping the samples it has collected.
+// Cancelling a finished job does nothing.
+func (q *Queue) Cancel(id string) (*Job, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	entry, ok := q.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	switch entry.job.State {
+	case StateQueued:
+		for i, pendingID := range q.pending {
+			if pendingID == id {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				break
+			}
+		}
+		entry.job.State = StateCancelled
+		if err := q.saveLocked(entry); err != nil {
+			return nil, fmt.Errorf("while saving job: %w", err)
+		}
+	case StateRunning:
+		entry.requestCancel()
+	}
+
+	job := entry.job
+	return &job, nil
+}
+
+// Run runs queued jobs until ctx is cancelled.  Running jobs are then
+// interrupted, and checkpointed so that they resume the next time the queue is
+// started.
+func (q *Queue) Run(ctx context.Context) {
+	// Wake up the workers when ctx is cancelled.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.lock.Lock()
+			defer q.lock.Unlock()
+			q.cond.Broadcast()
+		case <-stop:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < q.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				entry := q.next(ctx)
+				if entry == nil {
+					return
+				}
+				q.runJob(ctx, entry)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// next waits for a pending job and marks it as running.  It returns nil once
+// ctx is cancelled.
+func (q *Queue) next(ctx context.Context) *jobEntry {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for len(q.pending) == 0 && ctx.Err() == nil {
+		q.cond.Wait()
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	id := q.pending[0]
+	q.pending = q.pending[1:]
+
+	entry := q.jobs[id]
+	entry.job.State = StateRunning
+	if err := q.saveLocked(entry); err != nil {
+		log.Printf("Error saving job %s: %v", id, err)
+	}
+	return entry
+}
+
+func (q *Queue) runJob(ctx context.Context, entry *jobEntry) {
+	id := entry.job.ID
+	log.Printf("Starting job %s", id)
+
+	err := q.render(ctx, entry)
+
+	q.update(entry, func(job *Job) {
+		switch {
+		case err != nil:
+			log.Printf("Job %s failed: %v", id, err)
+			job.State = StateFailed
+			job.Error = err.Error()
+		case job.CompletedSubsamples >= job.Options.TargetSubsamples:
+			log.Printf("Finished job %s", id)
+			job.State = StateDone
+			job.Progress = 1
+		case ctx.Err() != nil:
+			// Shutting down.  Leave the job marked as running, so that it
+			// resumes on restart.
+			log.Printf("Interrupted job %s", id)
+		default:
+			log.Printf("Cancelled job %s", id)
+			job.State = StateCancelled
+		}
+	})
+}
+
+// openSampleDB loads a checkpointed sample DB of the job, if there is one, or
+// creates a fresh one.
+func openSampleDB(fileName string, options *Options) (*spectralimage.SpectralImage, error) {
+	if _, err := os.Stat(fileName); errors.Is(err, os.ErrNotExist) {
+		sampleDB := &spectralimage.SpectralImage{
+			WavelengthMin: float32(options.WavelengthMin),
+			WavelengthMax: float32(options.WavelengthMax),
+		}
+		sampleDB.Resize(options.OutputRows, options.OutputCols, options.WavelengthBins)
+		return sampleDB, nil
+	}
+
+	sampleDB, err := spectralimage.ReadSpectralImageFromFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("while reading checkpoint: %w", err)
+	}
+
+	if sampleDB.RowSize != options.OutputRows ||
+		sampleDB.ColSize != options.OutputCols ||
+		sampleDB.WavelengthSize != options.WavelengthBins ||
+		sampleDB.WavelengthMin != float32(options.WavelengthMin) ||
+		sampleDB.WavelengthMax != float32(options.WavelengthMax) {
+		return nil, fmt.Errorf("checkpoint doesn't match the job's options")
+	}
+
+	return sampleDB, nil
+}
+
+// completedSubsamples is the number of subsamples reached by every entry of
+// the sample DB.
+func completedSubsamples(sampleDB *spectralimage.SpectralImage) int {
+	least := -1
+	for _, count := range sampleDB.PowerDensityCounts {
+		if least == -1 || int(count) < least {
+			least = int(count)
+		}
+	}
+	if least == -1 {
+		return 0
+	}
+	return least
+}
+
+// render runs the job until it completes, is cancelled, or ctx is cancelled.
+//
+// The render proceeds in rounds of CheckpointSubsamples subsamples.  After each
+// round, the sample DB is written to disk; the next round resumes from it.
+// Polarized jobs also checkpoint their Stokes DBs, before the sample DB, which
+// is what progress is measured from.
+func (q *Queue) render(ctx context.Context, entry *jobEntry) error {
+	options := entry.job.Options
+	dir := q.jobDir(entry.job.ID)
+
+	integrator, err := options.integrator()
+	if err != nil {
+		return err
+	}
+
+	theScene, err := q.loadScene(filepath.Join(dir, entry.job.SceneFile))
+	if err != nil {
+		return fmt.Errorf("while loading scene: %w", err)
+	}
+	theScene.Crush(0.0)
+
+	outputPath := q.OutputPath(entry.job.ID)
+	sampleDB, err := openSampleDB(outputPath, &options)
+	if err != nil {
+		return err
+	}
+
+	var stokesDBs [3]*spectralimage.SpectralImage
+	if options.Polarized {
+		for i, component := range StokesComponents {
+			stokesDBs[i], err = openSampleDB(q.StokesPath(entry.job.ID, component), &options)
+			if err != nil {
+				return fmt.Errorf("while opening Stokes %s: %w", strings.ToUpper(component), err)
+			}
+		}
+	}
+
+	// Stop rendering when either the job or the whole queue is cancelled.
+	cancel := make(chan struct{})
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-entry.cancel:
+		case <-ctx.Done():
+		case <-finished:
+		}
+		close(cancel)
+	}()
+
+	step := q.CheckpointSubsamples
+	if step <= 0 {
+		step = 1
+	}
+
+	for {
+		done := completedSubsamples(sampleDB)
+		q.update(entry, func(job *Job) {
+			job.CompletedSubsamples = done
+			job.Progress = float64(done) / float64(options.TargetSubsamples)
+		})
+
+		if done >= options.TargetSubsamples {
+			return nil
+		}
+		select {
+		case <-cancel:
+			return nil
+		default:
+		}
+
+		roundTarget := done + step
+		if roundTarget > options.TargetSubsamples {
+			roundTarget = options.TargetSubsamples
+		}
+
+		renderOptions := &scene.RenderOptions{
+			MaxDepth:            options.MaxDepth,
+			TargetSubsamples:    roundTarget,
+			HeroWavelength:      options.HeroWavelength,
+			PacketTraversal:     options.PacketTraversal,
+			Polarized:           options.Polarized,
+			StokesDBs:           stokesDBs,
+			Integrator:          integrator,
+			PhotonsPerPass:      options.PhotonsPerPass,
+			PhotonInitialRadius: options.PhotonInitialRadius,
+			PhotonRadiusAlpha:   options.PhotonRadiusAlpha,
+			Cancel:              cancel,
+		}
+
+		progress := func(cur, tot int) {
+			if tot == 0 {
+				return
+			}
+			roundFraction := float64(cur) / float64(tot)
+			q.lock.Lock()
+			defer q.lock.Unlock()
+			entry.job.Progress = (float64(done) + roundFraction*float64(roundTarget-done)) / float64(options.TargetSubsamples)
+		}
+
+		scene.RenderScene(theScene, renderOptions, sampleDB, progress)
+
+		for i, db := range stokesDBs {
+			if db == nil {
+				continue
+			}
+			err := writeFileAtomic(q.StokesPath(entry.job.ID, StokesComponents[i]), func(w io.Writer) error {
+				return spectralimage.WriteSpectralImage(db, w)
+			})
+			if err != nil {
+				return fmt.Errorf("while writing Stokes checkpoint: %w", err)
+			}
+		}
+
+		err := writeFileAtomic(outputPath, func(w io.Writer) error {
+			return spectralimage.WriteSpectralImage(sampleDB, w)
+		})
+		if err != nil {
+			return fmt.Errorf("while writing checkpoint: %w", err)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package renderqueue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"row-major/harpoon/camera"
+	"row-major/harpoon/material"
+	"row-major/harpoon/scene"
+	"row-major/harpoon/spectralimage"
+	"row-major/harpoon/vmath/mat33"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// loadTestScene ignores the uploaded file, and returns an empty scene lit by a
+// uniform sky.
+func loadTestScene(fileName string) (*scene.Scene, error) {
+	s := &scene.Scene{}
+	s.InfinityMaterialIndex = s.AddMaterial(&material.Emitter{
+		Emissivity: material.ConstantScalar(1),
+	})
+
+	cam := &camera.PinholeCamera{
+		ApertureToWorld: mat33.T{1, 0, 0, 0, 1, 0, 0, 0, 1},
+		Aperture:        vec3.T{0.02, 0.01, 0.01},
+	}
+	cam.SetEye(vec3.T{1, 0, 0})
+	s.AddCamera(cam)
+	return s, nil
+}
+
+func testOptions(target int) Options {
+	options := DefaultOptions()
+	options.OutputRows = 4
+	options.OutputCols = 4
+	options.WavelengthBins = 3
+	options.TargetSubsamples = target
+	options.MaxDepth = 2
+	return options
+}
+
+func newTestQueue(t *testing.T, dir string) *Queue {
+	t.Helper()
+	q, err := New(dir, 2)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	q.LoadScene = loadTestScene
+	return q
+}
+
+// runQueue runs q until the test ends.
+func runQueue(t *testing.T, q *Queue) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func waitFinished(t *testing.T, q *Queue, id string) *Job {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := q.Get(id)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", id, err)
+		}
+		if job.State.Finished() {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s didn't finish", id)
+	return nil
+}
+
+func checkOutputCounts(t *testing.T, q *Queue, id string, want int) {
+	t.Helper()
+	img, err := spectralimage.ReadSpectralImageFromFile(q.OutputPath(id))
+	if err != nil {
+		t.Fatalf("reading output: %v", err)
+	}
+	for i, count := range img.PowerDensityCounts {
+		if int(count) != want {
+			t.Fatalf("output entry %d has %v samples, want %d", i, count, want)
+		}
+	}
+}
+
+// postJob submits a job over HTTP, with an upload named fileName.
+func postJob(t *testing.T, url, fileName string, options Options) *http.Response {
+	t.Helper()
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	optionsJSON, err := json.Marshal(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.WriteField("options", string(optionsJSON)); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := mw.CreateFormFile("scene", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("scene data"))
+	mw.Close()
+
+	resp, err := http.Post(url+"/jobs", mw.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("POST /jobs: %v", err)
+	}
+	return resp
+}
+
+func TestSubmitAndRunOverHTTP(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	q.CheckpointSubsamples = 2
+	runQueue(t, q)
+
+	server := httptest.NewServer(q.Handler())
+	defer server.Close()
+
+	resp := postJob(t, server.URL, "../../sky.scenepack", testOptions(5))
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /jobs: got status %d", resp.StatusCode)
+	}
+
+	submitted := &Job{}
+	if err := json.NewDecoder(resp.Body).Decode(submitted); err != nil {
+		t.Fatalf("decoding job: %v", err)
+	}
+	if submitted.SceneFile != "scene.scenepack" {
+		t.Errorf("got scene file %q, want scene.scenepack", submitted.SceneFile)
+	}
+
+	job := waitFinished(t, q, submitted.ID)
+	if job.State != StateDone {
+		t.Fatalf("got state %q (error %q), want done", job.State, job.Error)
+	}
+	if job.CompletedSubsamples != 5 || job.Progress != 1 {
+		t.Errorf("got %d subsamples and progress %v, want 5 and 1", job.CompletedSubsamples, job.Progress)
+	}
+	checkOutputCounts(t, q, job.ID, 5)
+
+	statusResp, err := http.Get(server.URL + "/jobs/" + job.ID)
+	if err != nil {
+		t.Fatalf("GET job: %v", err)
+	}
+	statusResp.Body.Close()
+	if statusResp.StatusCode != http.StatusOK {
+		t.Errorf("GET job: got status %d", statusResp.StatusCode)
+	}
+
+	outputResp, err := http.Get(server.URL + "/jobs/" + job.ID + "/output")
+	if err != nil {
+		t.Fatalf("GET output: %v", err)
+	}
+	outputResp.Body.Close()
+	if outputResp.StatusCode != http.StatusOK {
+		t.Errorf("GET output: got status %d", outputResp.StatusCode)
+	}
+
+	missingResp, err := http.Get(server.URL + "/jobs/nonexistent")
+	if err != nil {
+		t.Fatalf("GET missing job: %v", err)
+	}
+	missingResp.Body.Close()
+	if missingResp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET missing job: got status %d, want 404", missingResp.StatusCode)
+	}
+}
+
+func TestHandlerRejectsBadRequests(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	job, err := q.Submit("a.scenepack", strings.NewReader(""), testOptions(1))
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+
+	testCases := []struct {
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{http.MethodDelete, "/jobs", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/jobs/" + job.ID, http.StatusMethodNotAllowed},
+		{http.MethodGet, "/jobs/" + job.ID + "/cancel", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/jobs/" + job.ID + "/output", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/jobs/", http.StatusNotFound},
+		{http.MethodGet, "/jobs/" + job.ID + "/", http.StatusNotFound},
+		{http.MethodGet, "/jobs/" + job.ID + "/unknown", http.StatusNotFound},
+		{http.MethodGet, "/jobs/" + job.ID + "/stokes/", http.StatusNotFound},
+		{http.MethodGet, "/other", http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		q.Handler().ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.path, w.Code, tc.wantStatus)
+		}
+	}
+}
+
+func TestPolarizedJobRecordsStokes(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	q.CheckpointSubsamples = 2
+	runQueue(t, q)
+
+	server := httptest.NewServer(q.Handler())
+	defer server.Close()
+
+	options := testOptions(3)
+	options.Polarized = true
+	polarized, err := q.Submit("a.scenepack", strings.NewReader(""), options)
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	plain, err := q.Submit("b.scenepack", strings.NewReader(""), testOptions(1))
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	for _, id := range []string{polarized.ID, plain.ID} {
+		if job := waitFinished(t, q, id); job.State != StateDone {
+			t.Fatalf("got state %q (error %q), want done", job.State, job.Error)
+		}
+	}
+
+	for _, component := range StokesComponents {
+		img, err := spectralimage.ReadSpectralImageFromFile(q.StokesPath(polarized.ID, component))
+		if err != nil {
+			t.Fatalf("reading Stokes %s: %v", component, err)
+		}
+		if img.RowSize != options.OutputRows || img.ColSize != options.OutputCols || img.WavelengthSize != options.WavelengthBins {
+			t.Errorf("Stokes %s has shape %dx%dx%d, want the output's", component, img.RowSize, img.ColSize, img.WavelengthSize)
+		}
+		for i, count := range img.PowerDensityCounts {
+			if count != 3 {
+				t.Fatalf("Stokes %s entry %d has %v samples, want 3", component, i, count)
+			}
+		}
+	}
+
+	testCases := []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/jobs/" + polarized.ID + "/stokes/q", http.StatusOK},
+		{"/jobs/" + polarized.ID + "/stokes/v", http.StatusOK},
+		{"/jobs/" + polarized.ID + "/stokes/i", http.StatusNotFound},
+		{"/jobs/" + plain.ID + "/stokes/q", http.StatusNotFound},
+		{"/jobs/nonexistent/stokes/q", http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		resp, err := http.Get(server.URL + tc.path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tc.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("GET %s: got status %d, want %d", tc.path, resp.StatusCode, tc.wantStatus)
+		}
+	}
+}
+
+func TestSubmitRejectsBadOptions(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	server := httptest.NewServer(q.Handler())
+	defer server.Close()
+
+	testCases := []struct {
+		name   string
+		modify func(o *Options)
+	}{
+		{"unknown integrator", func(o *Options) { o.Integrator = "bidirectional" }},
+		{"zero photons per pass", func(o *Options) { o.PhotonsPerPass = 0 }},
+		{"negative photons per pass", func(o *Options) { o.PhotonsPerPass = -1 }},
+		{"zero photon radius", func(o *Options) { o.PhotonInitialRadius = 0 }},
+		{"negative photon radius", func(o *Options) { o.PhotonInitialRadius = -0.1 }},
+		{"zero photon radius alpha", func(o *Options) { o.PhotonRadiusAlpha = 0 }},
+		{"photon radius alpha of one", func(o *Options) { o.PhotonRadiusAlpha = 1 }},
+		{"photon radius alpha above one", func(o *Options) { o.PhotonRadiusAlpha = 1.5 }},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			options := testOptions(1)
+			tc.modify(&options)
+			resp := postJob(t, server.URL, "a.scenepack", options)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("POST /jobs: got status %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+	if got := len(q.List()); got != 0 {
+		t.Errorf("got %d jobs after rejected submissions, want 0", got)
+	}
+}
+
+func TestSubmitEnforcesLimits(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	q.Limits = Limits{
+		MaxOutputRows:     8,
+		MaxOutputCols:     8,
+		MaxWavelengthBins: 4,
+		MaxPhotonsPerPass: 1000,
+	}
+
+	testCases := []struct {
+		name   string
+		modify func(o *Options)
+	}{
+		{"rows", func(o *Options) { o.OutputRows = 9 }},
+		{"cols", func(o *Options) { o.OutputCols = 1 << 30 }},
+		{"wavelength bins", func(o *Options) { o.WavelengthBins = 5 }},
+		{"photons per pass", func(o *Options) { o.PhotonsPerPass = 1001 }},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			options := testOptions(1)
+			options.PhotonsPerPass = 1000
+			tc.modify(&options)
+			if _, err := q.Submit("a.scenepack", strings.NewReader(""), options); err == nil {
+				t.Errorf("Submit accepted options over the limit")
+			}
+		})
+	}
+	if got := len(q.List()); got != 0 {
+		t.Errorf("got %d jobs after rejected submissions, want 0", got)
+	}
+
+	options := testOptions(1)
+	options.OutputRows = 8
+	options.OutputCols = 8
+	options.WavelengthBins = 4
+	options.PhotonsPerPass = 1000
+	if _, err := q.Submit("a.scenepack", strings.NewReader(""), options); err != nil {
+		t.Errorf("Submit rejected options at the limit: %v", err)
+	}
+}
+
+func TestCancelQueuedJob(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+
+	job, err := q.Submit("a.scenepack", strings.NewReader(""), testOptions(1))
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+
+	cancelled, err := q.Cancel(job.ID)
+	if err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	if cancelled.State != StateCancelled {
+		t.Errorf("got state %q, want cancelled", cancelled.State)
+	}
+
+	// The job shouldn't run once the queue starts.
+	runQueue(t, q)
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(q.OutputPath(job.ID)); err == nil {
+		t.Errorf("cancelled job produced output")
+	}
+}
+
+func TestResumeAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	// Submit a job, and checkpoint some of its samples by hand, as if the
+	// server had been stopped partway through the render.
+	first := newTestQueue(t, dir)
+	options := testOptions(3)
+	job, err := first.Submit("a.scenepack", strings.NewReader(""), options)
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+
+	partial := &scene.RenderOptions{
+		MaxDepth:         options.MaxDepth,
+		TargetSubsamples: 2,
+		HeroWavelength:   options.HeroWavelength,
+	}
+	sampleDB, err := openSampleDB(first.OutputPath(job.ID), &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := loadTestScene("")
+	s.Crush(0)
+	scene.RenderScene(s, partial, sampleDB, func(int, int) {})
+	out, err := os.Create(first.OutputPath(job.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spectralimage.WriteSpectralImage(sampleDB, out); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	// A new queue picks the job up, and renders only the missing subsample.
+	second := newTestQueue(t, dir)
+	runQueue(t, second)
+
+	resumed := waitFinished(t, second, job.ID)
+	if resumed.State != StateDone {
+		t.Fatalf("got state %q (error %q), want done", resumed.State, resumed.Error)
+	}
+	checkOutputCounts(t, second, job.ID, 3)
+}
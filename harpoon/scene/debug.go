@@ -0,0 +1,265 @@
+package scene
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+
+	"row-major/harpoon/ray"
+)
+
+// RayStats counts the work done to answer a scene query.
+type RayStats struct {
+	// NodeVisits is the number of query accelerator nodes whose bounds were
+	// tested.
+	NodeVisits int
+
+	// IntersectionTests is the number of elements whose geometry was tested.
+	IntersectionTests int
+}
+
+// DebugMode selects what RenderDebug draws.
+type DebugMode int
+
+const (
+	// DebugNodeVisits is a heatmap of the number of query accelerator nodes
+	// visited by each pixel's camera rays.
+	DebugNodeVisits DebugMode = iota
+
+	// DebugIntersectionTests is a heatmap of the number of elements tested
+	// against each pixel's camera rays.
+	DebugIntersectionTests
+
+	// DebugPathDepth is a heatmap of the number of surfaces each pixel's
+	// paths bounce off before they escape, are absorbed, or hit the depth
+	// limit.
+	DebugPathDepth
+
+	// DebugNormals shows the surface normal seen by each pixel's camera rays,
+	// with X, Y, and Z mapped from [-1, 1] to red, green, and blue.
+	DebugNormals
+)
+
+// DebugImage is the output of RenderDebug.
+type DebugImage struct {
+	Mode       DebugMode
+	Rows, Cols int
+
+	// Values holds the per-pixel averages, in row-major order.  Normals have
+	// three values per pixel; everything else has one.
+	Values []float64
+
+	// DepthHistogram[d] is the number of paths that bounced off d surfaces.
+	// Only filled in for DebugPathDepth.
+	DepthHistogram []int
+}
+
+func (d *DebugImage) channels() int {
+	if d.Mode == DebugNormals {
+		return 3
+	}
+	return 1
+}
+
+// Max is the largest value in the image.
+func (d *DebugImage) Max() float64 {
+	max := 0.0
+	for _, v := range d.Values {
+		max = math.Max(max, v)
+	}
+	return max
+}
+
+// Mean is the mean value over the image.
+func (d *DebugImage) Mean() float64 {
+	if len(d.Values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range d.Values {
+		sum += v
+	}
+	return sum / float64(len(d.Values))
+}
+
+// heatmapStops is the color ramp for heatmaps, from zero up to the image's
+// maximum.
+var heatmapStops = []color.RGBA{
+	{0, 0, 0, 255},
+	{40, 0, 160, 255},
+	{200, 0, 60, 255},
+	{255, 160, 0, 255},
+	{255, 255, 255, 255},
+}
+
+func heatmapColor(t float64) color.RGBA {
+	if math.IsNaN(t) || t <= 0 {
+		return heatmapStops[0]
+	}
+	if t >= 1 {
+		return heatmapStops[len(heatmapStops)-1]
+	}
+
+	x := t * float64(len(heatmapStops)-1)
+	i := int(x)
+	f := x - float64(i)
+	a, b := heatmapStops[i], heatmapStops[i+1]
+	lerp := func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a) + f*(float64(b)-float64(a))))
+	}
+	return color.RGBA{lerp(a.R, b.R), lerp(a.G, b.G), lerp(a.B, b.B), 255}
+}
+
+// Image converts the debug image for viewing.  Heatmaps are scaled so that the
+// image's maximum is white.
+func (d *DebugImage) Image() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, d.Cols, d.Rows))
+
+	if d.Mode == DebugNormals {
+		to8 := func(v float64) uint8 {
+			return uint8(math.Round(255 * math.Max(0, math.Min(1, (v+1)/2))))
+		}
+		for r := 0; r < d.Rows; r++ {
+			for c := 0; c < d.Cols; c++ {
+				v := d.Values[3*(r*d.Cols+c):]
+				img.SetRGBA(c, r, color.RGBA{to8(v[0]), to8(v[1]), to8(v[2]), 255})
+			}
+		}
+		return img
+	}
+
+	max := d.Max()
+	for r := 0; r < d.Rows; r++ {
+		for c := 0; c < d.Cols; c++ {
+			img.SetRGBA(c, r, heatmapColor(d.Values[r*d.Cols+c]/max))
+		}
+	}
+	return img
+}
+
+// debugFreq is the wavelength used to shade paths for DebugPathDepth.
+const debugFreq = 550.0
+
+// pathDepth follows a path from r, and returns the number of surfaces it
+// bounced off.
+func (s *Scene) pathDepth(r ray.Ray, rng *rand.Rand, depthLim int) int {
+	for depth := 0; depth < depthLim; depth++ {
+		c, m, hit := s.rayContact(r)
+		if !hit {
+			return depth
+		}
+
+		info := m.Shade(c, debugFreq, rng)
+		if info.PropagationK == 0.0 {
+			return depth + 1
+		}
+		r = info.IncidentRay
+	}
+	return depthLim
+}
+
+// RenderDebug draws a debug visualization of the scene, averaging samples
+// camera rays per pixel.  Paths for DebugPathDepth are limited to depthLim
+// surfaces.  The scene must already be crushed.
+func RenderDebug(s *Scene, mode DebugMode, rows, cols, samples, depthLim int) *DebugImage {
+	d := &DebugImage{
+		Mode: mode,
+		Rows: rows,
+		Cols: cols,
+	}
+	channels := d.channels()
+	d.Values = make([]float64, rows*cols*channels)
+	if mode == DebugPathDepth {
+		d.DepthHistogram = make([]int, depthLim+1)
+	}
+
+	processorCount := runtime.NumCPU()
+	histogramMutex := sync.Mutex{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < processorCount; i++ {
+		rowSrc, rowLim := rowChunk(i, processorCount, rows)
+		rng := rand.New(rand.NewSource(int64(i)))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			histogram := make([]int, len(d.DepthHistogram))
+			for r := rowSrc; r < rowLim; r++ {
+				for c := 0; c < cols; c++ {
+					v := d.Values[channels*(r*cols+c):][:channels]
+					for i := 0; i < samples; i++ {
+						cameraRay := s.Cameras[0].ImageToRay(r, rows, c, cols, rng)
+						query := ray.RaySegment{
+							TheRay:     cameraRay,
+							TheSegment: ray.Span{Lo: 0.0001, Hi: math.Inf(1)},
+						}
+
+						switch mode {
+						case DebugNodeVisits, DebugIntersectionTests:
+							stats := RayStats{}
+							s.sceneRayIntersect(query, &stats)
+							if mode == DebugNodeVisits {
+								v[0] += float64(stats.NodeVisits)
+							} else {
+								v[0] += float64(stats.IntersectionTests)
+							}
+						case DebugPathDepth:
+							depth := s.pathDepth(cameraRay, rng, depthLim)
+							v[0] += float64(depth)
+							histogram[depth]++
+						case DebugNormals:
+							if hit, index := s.SceneRayIntersect(query); index != -1 {
+								v[0] += hit.N[0]
+								v[1] += hit.N[1]
+								v[2] += hit.N[2]
+							}
+						}
+					}
+					for j := range v {
+						v[j] /= float64(samples)
+					}
+				}
+			}
+
+			histogramMutex.Lock()
+			defer histogramMutex.Unlock()
+			for depth, count := range histogram {
+				d.DepthHistogram[depth] += count
+			}
+		}()
+	}
+	wg.Wait()
+
+	return d
+}
+
+// WriteStats writes a report on the size of the scene, and the shape of its
+// query accelerator.  The scene must already be crushed.
+func (s *Scene) WriteStats(w io.Writer) {
+	kd := s.QueryAccelerator.Stats(kdSplitCost)
+
+	fmt.Fprintf(w, "Geometries:   %d\n", len(s.Geometries))
+	fmt.Fprintf(w, "Materials:    %d\n", len(s.Materials))
+	fmt.Fprintf(w, "Elements:     %d\n", len(s.CrushedElements))
+	fmt.Fprintf(w, "Lights:       %d\n", len(s.Lights))
+	fmt.Fprintf(w, "Cameras:      %d\n", len(s.Cameras))
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "Query accelerator (kd-tree):\n")
+	fmt.Fprintf(w, "  Nodes:      %d\n", kd.Nodes)
+	fmt.Fprintf(w, "  Leaves:     %d\n", kd.Leaves)
+	fmt.Fprintf(w, "  Max depth:  %d\n", kd.MaxDepth)
+	fmt.Fprintf(w, "  SAH cost:   %.3f element tests per ray (%d without the tree)\n", kd.SAHCost, kd.Elements)
+	fmt.Fprintf(w, "  Leaf sizes:\n")
+	for n, count := range kd.LeafSizes {
+		if count != 0 {
+			fmt.Fprintf(w, "    %4d elements: %d leaves\n", n, count)
+		}
+	}
+}
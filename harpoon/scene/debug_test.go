@@ -0,0 +1,48 @@
+package scene
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRenderDebug(t *testing.T) {
+	s := DemoScene()
+	s.Crush(0)
+
+	const rows, cols, samples, depthLim = 12, 18, 2, 5
+
+	visits := RenderDebug(s, DebugNodeVisits, rows, cols, samples, depthLim)
+	tests := RenderDebug(s, DebugIntersectionTests, rows, cols, samples, depthLim)
+	for i := range visits.Values {
+		// Every camera ray visits at least the root.
+		if visits.Values[i] < 1 {
+			t.Fatalf("pixel %d: %v node visits, want at least 1", i, visits.Values[i])
+		}
+		if tests.Values[i] > float64(len(s.CrushedElements)) {
+			t.Fatalf("pixel %d: %v intersection tests, but there are only %d elements", i, tests.Values[i], len(s.CrushedElements))
+		}
+	}
+
+	depth := RenderDebug(s, DebugPathDepth, rows, cols, samples, depthLim)
+	total := 0
+	for _, count := range depth.DepthHistogram {
+		total += count
+	}
+	if total != rows*cols*samples {
+		t.Errorf("depth histogram counts %d paths, want %d", total, rows*cols*samples)
+	}
+	if depth.Max() > depthLim {
+		t.Errorf("mean path depth reaches %v, beyond the limit of %d", depth.Max(), depthLim)
+	}
+
+	// The demo scene is a closed room, so every camera ray hits something,
+	// and the averaged normals can't be longer than 1.
+	normals := RenderDebug(s, DebugNormals, rows, cols, samples, depthLim)
+	for i := 0; i < rows*cols; i++ {
+		n := normals.Values[3*i : 3*i+3]
+		length := math.Sqrt(n[0]*n[0] + n[1]*n[1] + n[2]*n[2])
+		if length > 1+1e-9 {
+			t.Fatalf("pixel %d: normal %v has length %v", i, n, length)
+		}
+	}
+}
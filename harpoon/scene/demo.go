@@ -0,0 +1,97 @@
+package scene
+
+import (
+	"row-major/harpoon/affinetransform"
+	"row-major/harpoon/camera"
+	"row-major/harpoon/densesignal"
+	"row-major/harpoon/geometry"
+	"row-major/harpoon/material"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/mat33"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// DemoScene is the scene the renderer draws when it isn't given one: a room
+// holding a glowing sphere, a matte sphere, and a glass block.
+func DemoScene() *Scene {
+	theScene := &Scene{}
+
+	cieD65Emitter := theScene.AddMaterial(&material.Emitter{
+		Emissivity: material.ConstantSpectrum(densesignal.CIED65Emission(300)),
+	})
+	cieAEmitter := theScene.AddMaterial(&material.Emitter{
+		Emissivity: material.ConstantSpectrum(densesignal.CIEAEmission(100)),
+	})
+	matte := theScene.AddMaterial(&material.GaussianRoughNonConductive{
+		Variance: material.ConstantScalar(0.5),
+	})
+	matte2 := theScene.AddMaterial(&material.GaussianRoughNonConductive{
+		Variance: material.ConstantScalar(0.05),
+	})
+	glass := theScene.AddMaterial(&material.NonConductiveSmooth{
+		InteriorIndexOfRefraction: material.ConstantSpectrum(densesignal.VisibleSpectrumRamp(1.7, 1.5)),
+		ExteriorIndexOfRefraction: material.ConstantScalar(1.0),
+	})
+
+	sphere := theScene.AddGeometry(&geometry.Sphere{})
+	centerBox := theScene.AddGeometry(&geometry.Box{[3]ray.Span{ray.Span{0, 0.5}, ray.Span{0, 0.5}, ray.Span{0, 0.5}}})
+	ground := theScene.AddGeometry(&geometry.Box{[3]ray.Span{ray.Span{0, 10.1}, ray.Span{0, 10.1}, ray.Span{-0.5, 0}}})
+	roof := theScene.AddGeometry(&geometry.Box{[3]ray.Span{ray.Span{0, 10.1}, ray.Span{0, 10.1}, ray.Span{10, 10.1}}})
+	wallN := theScene.AddGeometry(&geometry.Box{[3]ray.Span{ray.Span{0, 10}, ray.Span{10, 10.1}, ray.Span{0, 10}}})
+	wallW := theScene.AddGeometry(&geometry.Box{[3]ray.Span{ray.Span{-0.1, 0}, ray.Span{0, 10}, ray.Span{0, 10}}})
+	wallS := theScene.AddGeometry(&geometry.Box{[3]ray.Span{ray.Span{0, 10}, ray.Span{-0.1, 0}, ray.Span{0, 10}}})
+
+	theScene.InfinityMaterialIndex = cieD65Emitter
+	theScene.Elements = []*SceneElement{
+		{
+			GeometryIndex: sphere,
+			MaterialIndex: cieAEmitter,
+			ModelToWorld:  affinetransform.Compose(affinetransform.Translate(vec3.T{5, 4, 0}), affinetransform.Scale(1)),
+		},
+		{
+			GeometryIndex: sphere,
+			MaterialIndex: matte,
+			ModelToWorld:  affinetransform.Compose(affinetransform.Translate(vec3.T{5, 6, 0}), affinetransform.Scale(1)),
+		},
+		{
+			GeometryIndex: ground,
+			MaterialIndex: matte2,
+			ModelToWorld:  affinetransform.Identity(),
+		},
+		{
+			GeometryIndex: roof,
+			MaterialIndex: matte2,
+			ModelToWorld:  affinetransform.Identity(),
+		},
+		{
+			GeometryIndex: wallN,
+			MaterialIndex: matte2,
+			ModelToWorld:  affinetransform.Identity(),
+		},
+		{
+			GeometryIndex: wallW,
+			MaterialIndex: matte2,
+			ModelToWorld:  affinetransform.Identity(),
+		},
+		{
+			GeometryIndex: wallS,
+			MaterialIndex: matte2,
+			ModelToWorld:  affinetransform.Identity(),
+		},
+		{
+			GeometryIndex: centerBox,
+			MaterialIndex: glass,
+			ModelToWorld:  affinetransform.Translate(vec3.T{3, 3, 0}),
+		},
+	}
+
+	cam := &camera.PinholeCamera{
+		Center:          vec3.T{1, 1, 2},
+		ApertureToWorld: mat33.T{1, 0, 0, 0, 1, 0, 0, 0, 1},
+		Aperture:        vec3.T{0.02, 0.018, 0.012},
+	}
+	cam.SetEye(vec3.SubVV(vec3.T{5, 5, 1}, cam.Center))
+	theScene.AddCamera(cam)
+
+	return theScene
+}
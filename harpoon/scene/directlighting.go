@@ -0,0 +1,92 @@
+package scene
+
+import (
+	"math"
+	"math/rand"
+
+	"row-major/harpoon/contact"
+	"row-major/harpoon/light"
+	"row-major/harpoon/material"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// lightSample is an unoccluded sample of one of the scene's lights, as seen
+// from a contact.
+type lightSample struct {
+	light  light.Light
+	dir    vec3.T
+	weight float64
+}
+
+// sampleLights takes one sample from each of the scene's lights, as seen from
+// c, and appends the ones that aren't occluded to samples.
+func (s *Scene) sampleLights(c contact.Contact, rng *rand.Rand, samples []lightSample) []lightSample {
+	for _, l := range s.Lights {
+		dir, dist, weight := l.SampleIllumination(c.P, rng)
+		if weight == 0.0 {
+			continue
+		}
+
+		shadowQuery := ray.RaySegment{
+			TheRay: ray.Ray{
+				Point: c.P,
+				Slope: dir,
+			},
+			TheSegment: ray.Span{0.0001, dist - 0.0001},
+		}
+		if _, hitIndex := s.SceneRayIntersect(shadowQuery); hitIndex != -1 {
+			continue
+		}
+
+		samples = append(samples, lightSample{
+			light:  l,
+			dir:    dir,
+			weight: weight,
+		})
+	}
+	return samples
+}
+
+// directlyLit reports whether the scene's lights should be sampled directly at
+// a contact shaded by m.
+func directlyLit(m material.Material) bool {
+	if _, ok := m.(material.BSDFEvaluator); ok {
+		return true
+	}
+	_, ok := m.(material.Reradiator)
+	return ok
+}
+
+// directPower is the power that m scatters back along c's ray at freq, from
+// the given light samples.
+//
+// If m is a material.Reradiator, this includes light absorbed at other
+// wavelengths and re-emitted at freq.  Each light sample is paired with one
+// excitation wavelength.
+func directPower(m material.Material, c contact.Contact, samples []lightSample, freq float32, rng *rand.Rand) float32 {
+	evaluator, _ := m.(material.BSDFEvaluator)
+	reradiator, _ := m.(material.Reradiator)
+
+	var power float32
+	for _, ls := range samples {
+		cosine := float32(math.Abs(vec3.IProd(c.N, ls.dir)) * ls.weight)
+
+		if evaluator != nil {
+			if f := evaluator.EvalBSDF(c, ls.dir, freq); f != 0.0 {
+				power += f * cosine * ls.light.Spectrum(freq)
+			}
+		}
+
+		if reradiator != nil {
+			excitation, pdf := reradiator.SampleExcitation(c, freq, rng)
+			if pdf == 0.0 {
+				continue
+			}
+			if f := reradiator.EvalReradiation(c, ls.dir, excitation, freq); f != 0.0 {
+				power += f / pdf * cosine * ls.light.Spectrum(excitation)
+			}
+		}
+	}
+	return power
+}
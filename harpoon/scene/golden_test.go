@@ -0,0 +1,318 @@
+package scene
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"row-major/harpoon/affinetransform"
+	"row-major/harpoon/camera"
+	"row-major/harpoon/densesignal"
+	"row-major/harpoon/geometry"
+	"row-major/harpoon/material"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/spectralimage"
+	"row-major/harpoon/vmath/mat33"
+	"row-major/harpoon/vmath/vec3"
+)
+
+var updateGoldens = flag.Bool("update-goldens", false, "Rewrite the golden renders in testdata/ instead of checking against them")
+
+const (
+	goldenRows       = 16
+	goldenCols       = 16
+	goldenBins       = 4
+	goldenSubsamples = 64
+	goldenMaxDepth   = 6
+
+	// Renders are compared in blocks of goldenBlock x goldenBlock pixels.
+	goldenBlock = 4
+)
+
+// lookAt adds a pinhole camera at center, looking at target with +Z up.
+// halfWidth is the tangent of half the horizontal field of view.
+func lookAt(s *Scene, center, target vec3.T, halfWidth float64) {
+	cam := &camera.PinholeCamera{
+		Center:          center,
+		ApertureToWorld: mat33.T{1, 0, 0, 0, 1, 0, 0, 0, 1},
+		Aperture:        vec3.T{1, halfWidth, halfWidth * goldenRows / goldenCols},
+	}
+	cam.SetEye(vec3.SubVV(target, center))
+	s.AddCamera(cam)
+}
+
+// furnaceScene is a diffuse sphere under a uniform white sky, filling the
+// view.  Every ray off the sphere escapes to the sky, so the sphere has the
+// same radiance everywhere: its albedo.
+func furnaceScene(reflectance float64) *Scene {
+	s := &Scene{}
+	s.InfinityMaterialIndex = s.AddMaterial(&material.Emitter{Emissivity: material.ConstantScalar(1)})
+	s.AddElement(&SceneElement{
+		GeometryIndex: s.AddGeometry(&geometry.Sphere{}),
+		MaterialIndex: s.AddMaterial(&material.MonteCarloLambert{Reflectance: material.ConstantScalar(reflectance)}),
+		ModelToWorld:  affinetransform.Identity(),
+	})
+	lookAt(s, vec3.T{0, -3, 0}, vec3.T{0, 0, 0}, 0.2)
+	return s
+}
+
+// cornellBoxScene is a unit box, open towards the camera, with red and green
+// side walls, two white blocks, and a light set into the ceiling.
+func cornellBoxScene() *Scene {
+	s := &Scene{}
+	s.InfinityMaterialIndex = s.AddMaterial(&material.Emitter{Emissivity: material.ConstantScalar(0)})
+
+	white := s.AddMaterial(&material.MonteCarloLambert{Reflectance: material.ConstantSpectrum(densesignal.SRGBReflectance(0.8, 0.8, 0.8))})
+	red := s.AddMaterial(&material.MonteCarloLambert{Reflectance: material.ConstantSpectrum(densesignal.SRGBReflectance(0.8, 0.1, 0.1))})
+	green := s.AddMaterial(&material.MonteCarloLambert{Reflectance: material.ConstantSpectrum(densesignal.SRGBReflectance(0.1, 0.8, 0.1))})
+	light := s.AddMaterial(&material.Emitter{Emissivity: material.ConstantSpectrum(densesignal.CIED65Emission(3000))})
+
+	slab := func(x, y, z ray.Span, m int) {
+		s.AddElement(&SceneElement{
+			GeometryIndex: s.AddGeometry(&geometry.Box{Spans: [3]ray.Span{x, y, z}}),
+			MaterialIndex: m,
+			ModelToWorld:  affinetransform.Identity(),
+		})
+	}
+	slab(ray.Span{Lo: 0, Hi: 1}, ray.Span{Lo: 0, Hi: 1}, ray.Span{Lo: -0.05, Hi: 0}, white)
+	slab(ray.Span{Lo: 0, Hi: 1}, ray.Span{Lo: 0, Hi: 1}, ray.Span{Lo: 1, Hi: 1.05}, white)
+	slab(ray.Span{Lo: 0, Hi: 1}, ray.Span{Lo: 1, Hi: 1.05}, ray.Span{Lo: 0, Hi: 1}, white)
+	slab(ray.Span{Lo: -0.05, Hi: 0}, ray.Span{Lo: 0, Hi: 1}, ray.Span{Lo: 0, Hi: 1}, red)
+	slab(ray.Span{Lo: 1, Hi: 1.05}, ray.Span{Lo: 0, Hi: 1}, ray.Span{Lo: 0, Hi: 1}, green)
+	slab(ray.Span{Lo: 0.35, Hi: 0.65}, ray.Span{Lo: 0.35, Hi: 0.65}, ray.Span{Lo: 0.99, Hi: 1}, light)
+	slab(ray.Span{Lo: 0.15, Hi: 0.45}, ray.Span{Lo: 0.5, Hi: 0.8}, ray.Span{Lo: 0, Hi: 0.6}, white)
+	slab(ray.Span{Lo: 0.55, Hi: 0.85}, ray.Span{Lo: 0.2, Hi: 0.5}, ray.Span{Lo: 0, Hi: 0.3}, white)
+
+	lookAt(s, vec3.T{0.5, -1.4, 0.5}, vec3.T{0.5, 0.5, 0.5}, 0.3)
+	return s
+}
+
+// checkerboardGround adds a diffuse checkerboard ground plane, with squares
+// of side 1.
+func checkerboardGround(s *Scene) {
+	s.AddElement(&SceneElement{
+		GeometryIndex: s.AddGeometry(&geometry.Box{Spans: [3]ray.Span{{Lo: -10, Hi: 10}, {Lo: -10, Hi: 10}, {Lo: -1, Hi: 0}}}),
+		MaterialIndex: s.AddMaterial(&material.MonteCarloLambert{
+			Reflectance: material.LerpBetween(material.CheckerboardSurface(2), material.ConstantScalar(0.2), material.ConstantScalar(0.8)),
+		}),
+		ModelToWorld: affinetransform.Identity(),
+	})
+}
+
+// checkerboardScene is a checkerboard plane under a daylight sky.
+func checkerboardScene() *Scene {
+	s := &Scene{}
+	s.InfinityMaterialIndex = s.AddMaterial(&material.Emitter{Emissivity: material.ConstantSpectrum(densesignal.CIED65Emission(300))})
+	checkerboardGround(s)
+	lookAt(s, vec3.T{0, -4, 3}, vec3.T{0, 0, 0}, 0.6)
+	return s
+}
+
+// glassSphereScene is a dispersive glass sphere resting on a checkerboard
+// plane, under a daylight sky.
+func glassSphereScene() *Scene {
+	s := &Scene{}
+	s.InfinityMaterialIndex = s.AddMaterial(&material.Emitter{Emissivity: material.ConstantSpectrum(densesignal.CIED65Emission(300))})
+	checkerboardGround(s)
+	s.AddElement(&SceneElement{
+		GeometryIndex: s.AddGeometry(&geometry.Sphere{}),
+		MaterialIndex: s.AddMaterial(&material.NonConductiveSmooth{
+			InteriorIndexOfRefraction: material.ConstantSpectrum(densesignal.VisibleSpectrumRamp(1.7, 1.5)),
+			ExteriorIndexOfRefraction: material.ConstantScalar(1.0),
+		}),
+		ModelToWorld: affinetransform.Translate(vec3.T{0, 0, 1}),
+	})
+	lookAt(s, vec3.T{0, -4, 2}, vec3.T{0, 0, 1}, 0.4)
+	return s
+}
+
+// goldenMode is a way of sampling wavelengths that the goldens are rendered
+// with.  Packet traversal only applies to hero-wavelength sampling.
+type goldenMode struct {
+	// suffix is appended to the scene's name to make the golden's name.
+	suffix string
+	hero   bool
+}
+
+var goldenModes = []goldenMode{
+	{suffix: "", hero: false},
+	{suffix: "_hero", hero: true},
+}
+
+// renderGolden renders the scene on a single worker with a fixed seed, so the
+// result doesn't depend on the number of CPUs.
+func renderGolden(s *Scene, seed int64, hero, packets bool) *spectralimage.SpectralImage {
+	s.Crush(0)
+
+	db := &spectralimage.SpectralImage{WavelengthMin: 390, WavelengthMax: 830}
+	db.Resize(goldenRows, goldenCols, goldenBins)
+
+	w := &ChunkWorker{
+		sampleDB:         db,
+		rng:              rand.New(rand.NewSource(seed)),
+		progressFunction: func(int) {},
+		maxDepth:         goldenMaxDepth,
+		targetSamples:    goldenSubsamples,
+		heroWavelength:   hero,
+		packetTraversal:  packets,
+		imgRows:          goldenRows,
+		imgCols:          goldenCols,
+		rowSrc:           0,
+		rowLim:           goldenRows,
+		colSrc:           0,
+		colLim:           goldenCols,
+		scene:            s,
+	}
+	w.Render()
+	return db
+}
+
+// blockStats returns the mean of the per-pixel means of a block of one
+// wavelength bin, and the standard error of that mean estimated from the
+// spread of the pixels.  The spread includes real variation across the block,
+// so the error is an overestimate.
+func blockStats(im *spectralimage.SpectralImage, r0, c0, w int) (float64, float64) {
+	vals := []float64{}
+	for r := r0; r < r0+goldenBlock; r++ {
+		for c := c0; c < c0+goldenBlock; c++ {
+			samp := im.ReadSample(r, c, w)
+			vals = append(vals, float64(samp.PowerDensitySum/samp.PowerDensityCount))
+		}
+	}
+
+	mean := 0.0
+	for _, v := range vals {
+		mean += v
+	}
+	mean /= float64(len(vals))
+
+	variance := 0.0
+	for _, v := range vals {
+		variance += (v - mean) * (v - mean)
+	}
+	variance /= float64(len(vals) - 1)
+
+	return mean, math.Sqrt(variance / float64(len(vals)))
+}
+
+// compareRenders checks that two renders of the same scene agree, up to the
+// noise in each.  It returns a description of each block that doesn't.
+func compareRenders(got, want *spectralimage.SpectralImage) []string {
+	if got.RowSize != want.RowSize || got.ColSize != want.ColSize || got.WavelengthSize != want.WavelengthSize {
+		return []string{fmt.Sprintf("got a %dx%dx%d render, want %dx%dx%d", got.RowSize, got.ColSize, got.WavelengthSize, want.RowSize, want.ColSize, want.WavelengthSize)}
+	}
+
+	mismatches := []string{}
+	for w := 0; w < got.WavelengthSize; w++ {
+		for r := 0; r < got.RowSize; r += goldenBlock {
+			for c := 0; c < got.ColSize; c += goldenBlock {
+				gotMean, gotErr := blockStats(got, r, c, w)
+				wantMean, wantErr := blockStats(want, r, c, w)
+
+				// Five standard errors, plus a little slack for renders
+				// that are noise-free but differ by rounding.
+				tolerance := 5*math.Hypot(gotErr, wantErr) + 1e-3*math.Abs(wantMean) + 1e-6
+				if math.Abs(gotMean-wantMean) > tolerance {
+					mismatches = append(mismatches, fmt.Sprintf("block at (%d, %d), bin %d: got mean %v, want %v +/- %v", r, c, w, gotMean, wantMean, tolerance))
+				}
+			}
+		}
+	}
+	return mismatches
+}
+
+func TestGoldenRenders(t *testing.T) {
+	cases := []struct {
+		name  string
+		scene func() *Scene
+	}{
+		{"furnace", func() *Scene { return furnaceScene(0.6) }},
+		{"cornell_box", cornellBoxScene},
+		{"glass_sphere", glassSphereScene},
+		{"checkerboard", checkerboardScene},
+	}
+
+	for _, tc := range cases {
+		for _, mode := range goldenModes {
+			name := tc.name + mode.suffix
+			t.Run(name, func(t *testing.T) {
+				testGoldenRender(t, name, tc.scene, mode)
+			})
+		}
+	}
+}
+
+func testGoldenRender(t *testing.T, name string, scene func() *Scene, mode goldenMode) {
+	got := renderGolden(scene(), 1, mode.hero, false)
+	path := filepath.Join("testdata", name+".spectral")
+
+	if *updateGoldens {
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatalf("while creating golden: %v", err)
+		}
+		defer f.Close()
+		if err := spectralimage.WriteSpectralImage(got, f); err != nil {
+			t.Fatalf("while writing golden: %v", err)
+		}
+		return
+	}
+
+	want, err := spectralimage.ReadSpectralImageFromFile(path)
+	if err != nil {
+		t.Fatalf("while reading golden (run with -update-goldens to create it): %v", err)
+	}
+	for _, m := range compareRenders(got, want) {
+		t.Error(m)
+	}
+
+	if !mode.hero {
+		return
+	}
+
+	// Packet traversal changes the order of random choices, but should
+	// converge to the same image.
+	packets := renderGolden(scene(), 1, true, true)
+	for _, m := range compareRenders(packets, want) {
+		t.Errorf("with packet traversal: %s", m)
+	}
+}
+
+// TestGoldenTolerance checks that the comparison tolerates renders with a
+// different seed, but not renders of a different scene.
+func TestGoldenTolerance(t *testing.T) {
+	for _, m := range compareRenders(renderGolden(cornellBoxScene(), 1, false, false), renderGolden(cornellBoxScene(), 2, false, false)) {
+		t.Errorf("renders with different seeds: %s", m)
+	}
+
+	if len(compareRenders(renderGolden(furnaceScene(0.5), 1, false, false), renderGolden(furnaceScene(0.6), 1, false, false))) == 0 {
+		t.Errorf("renders of furnaces with different albedos compared equal")
+	}
+}
+
+// TestFurnace checks the furnace against its analytic radiance, which is
+// MonteCarloLambert's reflectance.
+func TestFurnace(t *testing.T) {
+	const reflectance = 0.6
+	for _, mode := range goldenModes {
+		im := renderGolden(furnaceScene(reflectance), 1, mode.hero, false)
+
+		for w := 0; w < im.WavelengthSize; w++ {
+			sum, count := 0.0, 0.0
+			for r := 0; r < im.RowSize; r++ {
+				for c := 0; c < im.ColSize; c++ {
+					samp := im.ReadSample(r, c, w)
+					sum += float64(samp.PowerDensitySum)
+					count += float64(samp.PowerDensityCount)
+				}
+			}
+			if got, want := sum/count, reflectance; math.Abs(got-want) > 0.01 {
+				t.Errorf("hero wavelength %v, bin %d: furnace radiance is %v, want %v", mode.hero, w, got, want)
+			}
+		}
+	}
+}
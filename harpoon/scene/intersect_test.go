@@ -0,0 +1,110 @@
+package scene
+
+import (
+	"math"
+	"testing"
+
+	"row-major/harpoon/aabox"
+	"row-major/harpoon/affinetransform"
+	"row-major/harpoon/contact"
+	"row-major/harpoon/geometry"
+	"row-major/harpoon/material"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec2"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// uPrism is a closed mesh of a U-shaped prism, 3 units wide in X and Y and 1
+// unit tall in Z, with a notch 1 unit wide cut into it from +Y.
+func uPrism() *geometry.TriangleMesh {
+	outline := []vec2.T{{0, 0}, {3, 0}, {3, 3}, {2, 3}, {2, 1}, {1, 1}, {1, 3}, {0, 3}}
+	caps := [][3]int{{0, 1, 4}, {0, 4, 5}, {0, 5, 7}, {5, 6, 7}, {1, 2, 3}, {1, 3, 4}}
+
+	m := &geometry.TriangleMesh{}
+	for _, z := range []float64{0, 1} {
+		for _, p := range outline {
+			m.Vertices = append(m.Vertices, vec3.T{p[0], p[1], z})
+		}
+	}
+	n := len(outline)
+	for _, c := range caps {
+		m.Triangles = append(m.Triangles, [3]int{c[0], c[2], c[1]}, [3]int{c[0] + n, c[1] + n, c[2] + n})
+	}
+	for i := 0; i < n; i++ {
+		j := (i + 1) % n
+		m.Triangles = append(m.Triangles, [3]int{i, j, j + n}, [3]int{i, j + n, i + n})
+	}
+	return m
+}
+
+// crossings is a geometry that reports fixed entry and exit distances along
+// any ray, in whichever order they're given, like a non-convex solid can.
+type crossings struct {
+	entryT, exitT float64
+}
+
+func (g *crossings) GetAABox() aabox.AABox {
+	return aabox.AABox{X: ray.Span{Lo: -10, Hi: 10}, Y: ray.Span{Lo: -10, Hi: 10}, Z: ray.Span{Lo: -10, Hi: 10}}
+}
+
+func (g *crossings) Crush(time float64) {}
+
+func (g *crossings) contact(query ray.RaySegment, t float64) contact.Contact {
+	if t < query.TheSegment.Lo || query.TheSegment.Hi < t {
+		return contact.ContactNaN()
+	}
+	return contact.Contact{T: t, R: query.TheRay, P: query.TheRay.Eval(t), N: vec3.T{0, 0, 1}}
+}
+
+func (g *crossings) RayInto(query ray.RaySegment) contact.Contact {
+	return g.contact(query, g.entryT)
+}
+
+func (g *crossings) RayExit(query ray.RaySegment) contact.Contact {
+	return g.contact(query, g.exitT)
+}
+
+func TestSceneRayIntersectFindsNearestCrossing(t *testing.T) {
+	// A ray along +X through the arms of the U.
+	across := func(x float64) ray.RaySegment {
+		return ray.RaySegment{
+			TheRay:     ray.Ray{Point: vec3.T{x, 2, 0.5}, Slope: vec3.T{1, 0, 0}},
+			TheSegment: ray.Span{Lo: 0.0001, Hi: math.Inf(1)},
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		geometry geometry.Geometry
+		query    ray.RaySegment
+		wantT    float64
+	}{
+		{"from outside the mesh", uPrism(), across(-1), 1},
+		{"from inside the mesh's near arm", uPrism(), across(0.5), 0.5},
+		{"from the mesh's notch", uPrism(), across(1.5), 0.5},
+		{"exit before entry", &crossings{entryT: 3, exitT: 1}, across(0), 1},
+		{"entry before exit", &crossings{entryT: 1, exitT: 3}, across(0), 1},
+		{"exit behind the ray", &crossings{entryT: 2, exitT: -1}, across(0), 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Scene{}
+			s.InfinityMaterialIndex = s.AddMaterial(&material.Emitter{Emissivity: material.ConstantScalar(0)})
+			s.AddElement(&SceneElement{
+				GeometryIndex: s.AddGeometry(tc.geometry),
+				MaterialIndex: s.AddMaterial(&material.MonteCarloLambert{Reflectance: material.ConstantScalar(0.5)}),
+				ModelToWorld:  affinetransform.Identity(),
+			})
+			s.Crush(0)
+
+			c, index := s.SceneRayIntersect(tc.query)
+			if index != 0 {
+				t.Fatalf("missed the element")
+			}
+			if math.Abs(c.T-tc.wantT) > 1e-9 {
+				t.Errorf("got contact at T=%v, want %v", c.T, tc.wantT)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package scene
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"row-major/harpoon/contact"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/spectralimage"
+)
+
+// cameraQueries returns a camera ray through each pixel of a rows x cols
+// image, in scanline order.
+func cameraQueries(s *Scene, rows, cols int, rng *rand.Rand) []ray.RaySegment {
+	queries := []ray.RaySegment{}
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			queries = append(queries, ray.RaySegment{
+				TheRay:     s.Cameras[0].ImageToRay(r, rows, c, cols, rng),
+				TheSegment: ray.Span{Lo: 0.0001, Hi: math.Inf(1)},
+			})
+		}
+	}
+	return queries
+}
+
+func TestSceneRayIntersectPacketMatchesScalar(t *testing.T) {
+	s := DemoScene()
+	s.Crush(0)
+	rng := rand.New(rand.NewSource(1))
+
+	queries := cameraQueries(s, 32, 48, rng)
+
+	// Incoherent rays, from all over the room.
+	for i := 0; i < 1000; i++ {
+		queries = append(queries, ray.RaySegment{
+			TheRay: ray.Ray{
+				Point: [3]float64{rng.Float64() * 10, rng.Float64() * 10, rng.Float64() * 10},
+				Slope: [3]float64{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()},
+			},
+			TheSegment: ray.Span{Lo: 0.0001, Hi: math.Inf(1)},
+		})
+	}
+
+	contacts := make([]contact.Contact, ray.PacketWidth)
+	indices := make([]int, ray.PacketWidth)
+	for start := 0; start < len(queries); start += ray.PacketWidth {
+		end := start + ray.PacketWidth
+		if end > len(queries) {
+			end = len(queries)
+		}
+		s.SceneRayIntersectPacket(queries[start:end], contacts, indices)
+
+		for k, query := range queries[start:end] {
+			wantContact, wantIndex := s.SceneRayIntersect(query)
+			if indices[k] != wantIndex || contacts[k].T != wantContact.T {
+				t.Fatalf("query %d: packet hit element %d at T=%v, scalar hit element %d at T=%v", start+k, indices[k], contacts[k].T, wantIndex, wantContact.T)
+			}
+		}
+	}
+}
+
+func BenchmarkSceneRayIntersect(b *testing.B) {
+	s := DemoScene()
+	s.Crush(0)
+	queries := cameraQueries(s, 64, 96, rand.New(rand.NewSource(1)))
+
+	b.ResetTimer()
+	began := time.Now()
+	for i := 0; i < b.N; i++ {
+		for _, query := range queries {
+			s.SceneRayIntersect(query)
+		}
+	}
+	b.ReportMetric(float64(b.N*len(queries))/time.Since(began).Seconds(), "rays/s")
+}
+
+func BenchmarkSceneRayIntersectPacket(b *testing.B) {
+	s := DemoScene()
+	s.Crush(0)
+	queries := cameraQueries(s, 64, 96, rand.New(rand.NewSource(1)))
+	contacts := make([]contact.Contact, ray.PacketWidth)
+	indices := make([]int, ray.PacketWidth)
+
+	b.ResetTimer()
+	began := time.Now()
+	for i := 0; i < b.N; i++ {
+		for start := 0; start < len(queries); start += ray.PacketWidth {
+			s.SceneRayIntersectPacket(queries[start:start+ray.PacketWidth], contacts, indices)
+		}
+	}
+	b.ReportMetric(float64(b.N*len(queries))/time.Since(began).Seconds(), "rays/s")
+}
+
+func benchmarkRender(b *testing.B, packets bool) {
+	s := DemoScene()
+	s.Crush(0)
+	options := &RenderOptions{
+		MaxDepth:         4,
+		TargetSubsamples: 4,
+		HeroWavelength:   true,
+		PacketTraversal:  packets,
+	}
+
+	for i := 0; i < b.N; i++ {
+		sampleDB := &spectralimage.SpectralImage{WavelengthMin: 390, WavelengthMax: 830}
+		sampleDB.Resize(32, 48, 8)
+		RenderScene(s, options, sampleDB, func(int, int) {})
+	}
+}
+
+func BenchmarkRenderHero(b *testing.B)        { benchmarkRender(b, false) }
+func BenchmarkRenderHeroPackets(b *testing.B) { benchmarkRender(b, true) }
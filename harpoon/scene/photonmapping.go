@@ -0,0 +1,417 @@
+package scene
+
+import (
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+
+	"row-major/harpoon/affinetransform"
+	"row-major/harpoon/geometry"
+	"row-major/harpoon/light"
+	"row-major/harpoon/material"
+	"row-major/harpoon/photonmap"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/spectralimage"
+	"row-major/harpoon/vmath/mat33"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// photonLight is a light source that photons can be emitted from.
+type photonLight struct {
+	// Index into CrushedElements, or -1 for the infinity material or a light.
+	elementIndex int
+
+	// Set if this is one of the scene's lights.
+	explicit light.Light
+
+	sampler geometry.SurfaceSampler
+	emitter material.SurfaceEmitter
+}
+
+// photonLights collects the light sources in the scene.  An element is a light
+// source if its geometry can be sampled and its material is a surface emitter.
+// The scene's lights and the infinity material are always light sources.
+func (s *Scene) photonLights() []photonLight {
+	lights := []photonLight{}
+	for i, elt := range s.CrushedElements {
+		sampler, ok := elt.TheGeometry.(geometry.SurfaceSampler)
+		if !ok {
+			continue
+		}
+		emitter, ok := elt.TheMaterial.(material.SurfaceEmitter)
+		if !ok {
+			continue
+		}
+		lights = append(lights, photonLight{
+			elementIndex: i,
+			sampler:      sampler,
+			emitter:      emitter,
+		})
+	}
+
+	for _, l := range s.Lights {
+		lights = append(lights, photonLight{
+			elementIndex: -1,
+			explicit:     l,
+		})
+	}
+
+	lights = append(lights, photonLight{elementIndex: -1})
+	return lights
+}
+
+// emitPhoton picks a ray for a photon leaving the given light, and returns it
+// along with the photon's power.
+func (s *Scene) emitPhoton(pl photonLight, freq float32, rng *rand.Rand) (ray.Ray, float32) {
+	if pl.explicit != nil {
+		photonRay, weight := pl.explicit.SampleEmission(rng)
+		return photonRay, float32(weight) * pl.explicit.Spectrum(freq)
+	}
+	if pl.elementIndex == -1 {
+		return s.emitInfinityPhoton(freq, rng)
+	}
+
+	elt := s.CrushedElements[pl.elementIndex]
+
+	mdlContact, mdlArea := pl.sampler.SampleSurface(rng)
+
+	wldContact := mdlContact
+	wldContact.P = affinetransform.TransformPoint(elt.ModelToWorld, mdlContact.P)
+	wldNormal := mat33.MulMV(elt.ModelToWorldNormals, mdlContact.N)
+	wldContact.N = vec3.Normalize(wldNormal)
+
+	// The surface was sampled uniformly by area in model space.  Scale by the
+	// change in area element from model space to world space at this point.
+	areaScale := math.Abs(mat33.Determinant(elt.ModelToWorld.Linear)) * wldNormal.Norm()
+
+	dir, power := pl.emitter.SampleEmission(wldContact, freq, rng)
+	photonRay := ray.Ray{
+		Point: wldContact.P,
+		Slope: dir,
+	}
+	return photonRay, power * float32(mdlArea*areaScale)
+}
+
+// emitInfinityPhoton emits a photon from the infinity material, towards the
+// scene.
+func (s *Scene) emitInfinityPhoton(freq float32, rng *rand.Rand) (ray.Ray, float32) {
+	bounds := s.QueryAccelerator.Root.Bounds
+	center := vec3.T{
+		(bounds.X.Lo + bounds.X.Hi) / 2,
+		(bounds.Y.Lo + bounds.Y.Hi) / 2,
+		(bounds.Z.Lo + bounds.Z.Hi) / 2,
+	}
+	radius := vec3.T{
+		bounds.X.Hi - bounds.X.Lo,
+		bounds.Y.Hi - bounds.Y.Lo,
+		bounds.Z.Hi - bounds.Z.Lo,
+	}.Norm() / 2
+
+	// Pick a direction of travel, and then a starting point on a disk that
+	// covers the scene when seen from that direction.
+	dir := vec3.UniformUnitDistribution(rng)
+
+	u, v := vec3.OrthonormalBasis(dir)
+	du, dv := 0.0, 0.0
+	for {
+		du = 2*rng.Float64() - 1
+		dv = 2*rng.Float64() - 1
+		if du*du+dv*dv <= 1 {
+			break
+		}
+	}
+
+	start := vec3.SubVV(center, vec3.MulVS(dir, radius))
+	start = vec3.AddVV(start, vec3.MulVS(u, du*radius))
+	start = vec3.AddVV(start, vec3.MulVS(v, dv*radius))
+
+	// The power arriving along dir is whatever a ray looking back along dir
+	// would see at infinity.
+	skyRay := ray.Ray{
+		Point: start,
+		Slope: vec3.MulVS(dir, -1.0),
+	}
+	sky := s.Materials[s.InfinityMaterialIndex].Shade(infinityContact(skyRay), freq, rng)
+
+	photonRay := ray.Ray{
+		Point: start,
+		Slope: dir,
+	}
+	return photonRay, sky.EmittedPower * float32(4*math.Pi*math.Pi*radius*radius)
+}
+
+// TracePhotons traces count photons from the scene's light sources, recording
+// them wherever they land on a surface whose material is a
+// material.BSDFEvaluator.
+//
+// The photons are spread evenly over the wavelength bins of sampleDB, and the
+// photons landing in each bin are returned separately.  Photon powers are
+// normalized so that summing over the photons of a bin estimates the power
+// for that bin.
+//
+// A photon re-emitted by a material.Reradiator at a different wavelength
+// moves to the bin of its new wavelength.
+func (s *Scene) TracePhotons(count int, sampleDB *spectralimage.SpectralImage, rng *rand.Rand, depthLim int) [][]photonmap.Photon {
+	lights := s.photonLights()
+
+	photons := make([][]photonmap.Photon, sampleDB.WavelengthSize)
+	wavelengthRange := sampleDB.WavelengthMax - sampleDB.WavelengthMin
+	for i := 0; i < count; i++ {
+		bin := i % sampleDB.WavelengthSize
+		binCount := count / sampleDB.WavelengthSize
+		if bin < count%sampleDB.WavelengthSize {
+			binCount++
+		}
+
+		binLo, binHi := sampleDB.WavelengthBin(bin)
+		freq := binLo + rng.Float32()*(binHi-binLo)
+
+		source := lights[rng.Intn(len(lights))]
+		curRay, power := s.emitPhoton(source, freq, rng)
+		power *= float32(len(lights)) / float32(binCount)
+
+		for depth := 0; depth < depthLim && power != 0.0; depth++ {
+			c, m, hit := s.rayContact(curRay)
+			if !hit {
+				break
+			}
+
+			if _, ok := m.(material.BSDFEvaluator); ok {
+				photons[bin] = append(photons[bin], photonmap.Photon{
+					P:        c.P,
+					N:        c.N,
+					Incident: vec3.MulVS(curRay.Slope, -1.0),
+					Freq:     freq,
+					Power:    power,
+				})
+			}
+
+			// Light transport through our materials is reciprocal, so the
+			// material can pick where the photon goes next as if it were a
+			// camera ray.  The exception is reradiation, which only goes
+			// from shorter wavelengths to longer ones.
+			var shading material.ShadeInfo
+			if reradiator, ok := m.(material.Reradiator); ok {
+				shading = reradiator.ShadePhoton(c, freq, rng)
+			} else {
+				shading = m.Shade(c, freq, rng)
+			}
+			power *= shading.PropagationK
+			curRay = shading.IncidentRay
+
+			if shading.IncidentFreq != 0.0 {
+				freq = shading.IncidentFreq
+				bin = int((freq - sampleDB.WavelengthMin) / wavelengthRange * float32(sampleDB.WavelengthSize))
+				if bin < 0 || bin >= sampleDB.WavelengthSize {
+					break
+				}
+			}
+		}
+	}
+
+	return photons
+}
+
+// GatherRay traces a camera path through specular bounces until it reaches a
+// surface whose material is a material.BSDFEvaluator, and estimates the power
+// arriving there from the photons within radius.
+//
+// photonMaps holds the photons of each wavelength bin, which are binWidth
+// wide.  Usually only the photons in the bin of freq are gathered, but a
+// material.Reradiator gathers from all of them.
+func (s *Scene) GatherRay(initialQuery ray.Ray, freq float32, photonMaps []*photonmap.PhotonMap, bin int, binWidth float32, radius float64, rng *rand.Rand, depthLim int) float32 {
+	var accumPower float32
+	var curK float32 = 1.0
+	curRay := initialQuery
+
+	for i := 0; i < depthLim; i++ {
+		c, m, _ := s.rayContact(curRay)
+
+		if evaluator, ok := m.(material.BSDFEvaluator); ok {
+			var density float32
+			photonMaps[bin].Query(c.P, radius, func(p *photonmap.Photon) {
+				// Don't gather photons from the other side of thin
+				// surfaces.
+				if vec3.IProd(p.N, c.N) <= 0.0 {
+					return
+				}
+				density += evaluator.EvalBSDF(c, p.Incident, p.Freq) * p.Power
+			})
+
+			// Photon powers are densities over wavelength, so integrating
+			// over excitation wavelengths takes a factor of the bin width.
+			if reradiator, ok := m.(material.Reradiator); ok {
+				for _, photons := range photonMaps {
+					photons.Query(c.P, radius, func(p *photonmap.Photon) {
+						if vec3.IProd(p.N, c.N) <= 0.0 {
+							return
+						}
+						density += reradiator.EvalReradiation(c, p.Incident, p.Freq, freq) * p.Power * binWidth
+					})
+				}
+			}
+
+			accumPower += curK * density / float32(math.Pi*radius*radius)
+			break
+		}
+
+		shading := m.Shade(c, freq, rng)
+		accumPower += curK * shading.EmittedPower
+
+		curK *= shading.PropagationK
+		if curK == 0.0 {
+			break
+		}
+		curRay = shading.IncidentRay
+	}
+
+	return accumPower
+}
+
+// renderPhotonMapping implements IntegratorPhotonMapping.
+//
+// Each pass traces a fresh set of photons, and adds one sample to every pixel
+// and wavelength bin.  Averaging the passes while shrinking the gather radius
+// converges to the correct image (Knaus and Zwicker, "Progressive Photon
+// Mapping: A Probabilistic Approach").
+func renderPhotonMapping(scene *Scene, options *RenderOptions, sampleDB *spectralimage.SpectralImage, progressFunction ProgressFunction) {
+	// When resuming, start from the pass implied by the least-sampled entry,
+	// so that the radius picks up where it left off.
+	firstPass := -1
+	for i := 0; i < len(sampleDB.PowerDensityCounts); i++ {
+		if firstPass == -1 || int(sampleDB.PowerDensityCounts[i]) < firstPass {
+			firstPass = int(sampleDB.PowerDensityCounts[i])
+		}
+	}
+	if firstPass == -1 {
+		return
+	}
+
+	totalSamples := 0
+	for i := 0; i < len(sampleDB.PowerDensityCounts); i++ {
+		if int(sampleDB.PowerDensityCounts[i]) < options.TargetSubsamples {
+			totalSamples += options.TargetSubsamples - int(sampleDB.PowerDensityCounts[i])
+		}
+	}
+	curProgress := 0
+
+	radiusSquared := options.PhotonInitialRadius * options.PhotonInitialRadius
+	for pass := 0; pass < firstPass; pass++ {
+		radiusSquared *= (float64(pass+1) + options.PhotonRadiusAlpha) / float64(pass+2)
+	}
+
+	processorCount := runtime.NumCPU()
+
+	for pass := firstPass; pass < options.TargetSubsamples; pass++ {
+		select {
+		case <-options.Cancel:
+			return
+		default:
+		}
+
+		// Trace photons in parallel.  Each worker traces an equal share, so
+		// each worker's photons are scaled down by the number of workers.
+		workerPhotons := make([][][]photonmap.Photon, processorCount)
+		var wg sync.WaitGroup
+		for i := 0; i < processorCount; i++ {
+			i := i
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rng := rand.New(rand.NewSource(int64(2 * (pass*processorCount + i))))
+				workerPhotons[i] = scene.TracePhotons(options.PhotonsPerPass/processorCount, sampleDB, rng, options.MaxDepth)
+			}()
+		}
+		wg.Wait()
+
+		photonMaps := make([]*photonmap.PhotonMap, sampleDB.WavelengthSize)
+		for bin := 0; bin < sampleDB.WavelengthSize; bin++ {
+			binPhotons := []photonmap.Photon{}
+			for i := 0; i < processorCount; i++ {
+				for _, p := range workerPhotons[i][bin] {
+					p.Power /= float32(processorCount)
+					binPhotons = append(binPhotons, p)
+				}
+			}
+			photonMaps[bin] = photonmap.New(binPhotons)
+		}
+
+		// Gather in parallel, chunked by rows.
+		radius := math.Sqrt(radiusSquared)
+		progressMutex := sync.Mutex{}
+		for i := 0; i < processorCount; i++ {
+			rowSrc, rowLim := rowChunk(i, processorCount, sampleDB.RowSize)
+			worker := &ChunkWorker{
+				rng: rand.New(rand.NewSource(int64(2*(pass*processorCount+i) + 1))),
+				progressFunction: func(subProgress int) {
+					progressMutex.Lock()
+					defer progressMutex.Unlock()
+					curProgress += subProgress
+					progressFunction(curProgress, totalSamples)
+				},
+				maxDepth: options.MaxDepth,
+				imgRows:  sampleDB.RowSize,
+				imgCols:  sampleDB.ColSize,
+				rowSrc:   rowSrc,
+				rowLim:   rowLim,
+				colSrc:   0,
+				colLim:   sampleDB.ColSize,
+				scene:    scene,
+				cancel:   options.Cancel,
+			}
+			worker.sampleDB = sampleDB.Cut(worker.rowSrc, worker.rowLim, 0, sampleDB.ColSize)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				worker.renderPhotonPass(pass, photonMaps, radius)
+
+				progressMutex.Lock()
+				defer progressMutex.Unlock()
+
+				sampleDB.Paste(worker.sampleDB, worker.rowSrc, worker.colSrc)
+			}()
+		}
+		wg.Wait()
+
+		radiusSquared *= (float64(pass+1) + options.PhotonRadiusAlpha) / float64(pass+2)
+	}
+}
+
+// renderPhotonPass adds a photon-mapped sample to every entry of the worker's
+// sample DB that has no more than pass samples.
+func (w *ChunkWorker) renderPhotonPass(pass int, photonMaps []*photonmap.PhotonMap, radius float64) {
+	samplesCollected := 0
+	for cr := w.rowSrc; cr < w.rowLim; cr++ {
+		for cc := w.colSrc; cc < w.colLim; cc++ {
+			for cw := 0; cw < w.sampleDB.WavelengthSize; cw++ {
+				r := cr - w.rowSrc
+				c := cc - w.colSrc
+
+				samp := w.sampleDB.ReadSample(r, c, cw)
+				if int(samp.PowerDensityCount) > pass {
+					continue
+				}
+
+				curWavelength := samp.WavelengthLo + w.rng.Float32()*(samp.WavelengthHi-samp.WavelengthLo)
+				curQuery, weight := cameraRay(w.scene.Cameras[0], cr, w.imgRows, cc, w.imgCols, curWavelength, w.rng)
+
+				binWidth := samp.WavelengthHi - samp.WavelengthLo
+				sampledPower := float32(0.0)
+				if weight != 0.0 {
+					sampledPower = weight * w.scene.GatherRay(curQuery, curWavelength, photonMaps, cw, binWidth, radius, w.rng, w.maxDepth)
+				}
+				w.sampleDB.RecordSample(r, c, cw, sampledPower)
+				samplesCollected++
+			}
+		}
+
+		w.progressFunction(samplesCollected)
+		samplesCollected = 0
+
+		if w.cancelled() {
+			return
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package scene
+
+import (
+	"math/rand"
+
+	"row-major/harpoon/camera"
+	"row-major/harpoon/material"
+	"row-major/harpoon/polarization"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// cameraReference is the Stokes reference vector for light arriving at cam
+// along the reverse of slope: the image's horizontal axis, so that positive Q
+// is horizontally polarized light.  Cameras that don't know which way is left
+// get an arbitrary reference.
+func cameraReference(cam camera.Camera, slope vec3.T) vec3.T {
+	if oriented, ok := cam.(interface{ Left() vec3.T }); ok {
+		ref := vec3.Reject(slope, oriented.Left())
+		if ref.Norm() > 1e-9 {
+			return vec3.Normalize(ref)
+		}
+	}
+	return polarization.PerpendicularTo(slope)
+}
+
+// SampleRayPolarized is SampleRay, but tracks the polarization of the light
+// along the path, returning the Stokes vector of the light arriving back along
+// initialQuery, measured against the reference vector ref.
+//
+// The path carries the Mueller matrix that takes light leaving the current
+// contact to light arriving at the camera.  Materials that implement
+// material.PolarizedShader contribute their own Mueller matrices; all other
+// materials, and all light sources, are unpolarized.
+func (s *Scene) SampleRayPolarized(initialQuery ray.Ray, ref vec3.T, curWavelength float32, rng *rand.Rand, depthLim int) polarization.Stokes {
+	accum := polarization.Stokes{}
+	curM := polarization.Identity()
+	curRef := ref
+	curRay := initialQuery
+
+	lightSamples := make([]lightSample, 0, len(s.Lights))
+
+	// addUnpolarized accumulates unpolarized light with intensity i leaving
+	// the current contact.
+	addUnpolarized := func(i float32) {
+		if i == 0.0 {
+			return
+		}
+		accum = polarization.AddSS(accum, polarization.MulMS(curM, polarization.Unpolarized(float64(i))))
+	}
+
+	for i := 0; i < depthLim; i++ {
+		c, m, _ := s.rayContact(curRay)
+
+		if directlyLit(m) && len(s.Lights) != 0 {
+			lightSamples = s.sampleLights(c, rng, lightSamples[:0])
+			addUnpolarized(directPower(m, c, lightSamples, curWavelength, rng))
+		}
+
+		var shading material.ShadeInfo
+		if polarizer, ok := m.(material.PolarizedShader); ok {
+			shading = polarizer.ShadePolarized(c, curWavelength, rng)
+		} else {
+			shading = m.Shade(c, curWavelength, rng)
+		}
+		addUnpolarized(shading.EmittedPower)
+
+		if p := shading.Polarization; p != nil {
+			// Light leaves the contact back along the ray that found it.
+			leaving := vec3.MulVS(curRay.Slope, -1)
+			curM = polarization.MulMM(curM, polarization.MulMM(polarization.Reframe(p.OutRef, curRef, leaving), p.Mueller))
+			curRef = p.InRef
+		} else {
+			curM = polarization.MulMM(curM, polarization.Depolarizer(float64(shading.PropagationK)))
+			curRef = polarization.PerpendicularTo(shading.IncidentRay.Slope)
+		}
+
+		// Nothing that arrives at the contact can reach the camera.
+		if curM[0] == 0.0 && curM[4] == 0.0 && curM[8] == 0.0 && curM[12] == 0.0 {
+			break
+		}
+		curRay = shading.IncidentRay
+
+		if shading.IncidentFreq != 0.0 {
+			curWavelength = shading.IncidentFreq
+		}
+	}
+
+	return accum
+}
+
+// renderPolarized is Render, but using SampleRayPolarized.  Intensity is
+// recorded in the sample DB as usual, and the rest of the Stokes vector in the
+// Stokes DBs, if there are any.
+func (w *ChunkWorker) renderPolarized() {
+	cam := w.scene.Cameras[0]
+
+	samplesCollected := 0
+	for cr := w.rowSrc; cr < w.rowLim; cr++ {
+		for cc := w.colSrc; cc < w.colLim; cc++ {
+			for cw := 0; cw < w.sampleDB.WavelengthSize; cw++ {
+				r := cr - w.rowSrc
+				c := cc - w.colSrc
+
+				samp := w.sampleDB.ReadSample(r, c, cw)
+				if int(samp.PowerDensityCount) > w.targetSamples {
+					continue
+				}
+				samplesToAdd := w.targetSamples - int(samp.PowerDensityCount)
+
+				for cs := 0; cs < samplesToAdd; cs++ {
+					curWavelength, _ := w.sampleDB.WavelengthBin(cw)
+					curQuery, weight := cameraRay(cam, cr, w.imgRows, cc, w.imgCols, curWavelength, w.rng)
+					ref := cameraReference(cam, curQuery.Slope)
+
+					var stokes polarization.Stokes
+					if weight != 0.0 {
+						stokes = polarization.MulSS(w.scene.SampleRayPolarized(curQuery, ref, curWavelength, w.rng, w.maxDepth), float64(weight))
+					}
+					w.sampleDB.RecordSample(r, c, cw, float32(stokes[0]))
+					for i, db := range w.stokesDBs {
+						if db != nil {
+							db.RecordSample(r, c, cw, float32(stokes[i+1]))
+						}
+					}
+					samplesCollected++
+				}
+			}
+		}
+
+		w.progressFunction(samplesCollected)
+		samplesCollected = 0
+
+		if w.cancelled() {
+			return
+		}
+	}
+}
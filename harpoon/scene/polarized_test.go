@@ -0,0 +1,148 @@
+package scene
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"row-major/harpoon/affinetransform"
+	"row-major/harpoon/camera"
+	"row-major/harpoon/geometry"
+	"row-major/harpoon/material"
+	"row-major/harpoon/ray"
+	"row-major/harpoon/spectralimage"
+	"row-major/harpoon/vmath/mat33"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// polarizerScene is a camera at the origin, looking along +X at a uniform sky
+// through thin polarizing sheets with the given axes, listed from the camera
+// outwards.
+func polarizerScene(axes ...vec3.T) *Scene {
+	s := &Scene{}
+	s.InfinityMaterialIndex = s.AddMaterial(&material.Emitter{
+		Emissivity: material.ConstantScalar(1),
+	})
+
+	for i, axis := range axes {
+		x := float64(i + 1)
+		sheet := s.AddGeometry(&geometry.Box{Spans: [3]ray.Span{{Lo: x, Hi: x + 0.01}, {Lo: -10, Hi: 10}, {Lo: -10, Hi: 10}}})
+		polarizer := s.AddMaterial(&material.LinearPolarizer{
+			Axis:          axis,
+			Transmittance: material.ConstantScalar(1),
+		})
+		s.AddElement(&SceneElement{
+			GeometryIndex: sheet,
+			MaterialIndex: polarizer,
+			ModelToWorld:  affinetransform.Identity(),
+		})
+	}
+
+	s.AddCamera(&camera.PinholeCamera{
+		ApertureToWorld: mat33.T{1, 0, 0, 0, 1, 0, 0, 0, 1},
+		Aperture:        vec3.T{0.02, 0.01, 0.01},
+	})
+	return s
+}
+
+func TestPolarizers(t *testing.T) {
+	horizontal := vec3.T{0, 1, 0}
+	vertical := vec3.T{0, 0, 1}
+	// Up and to the left, as seen from the camera.
+	falling := vec3.T{0, 1, 1}
+
+	testCases := []struct {
+		name    string
+		axes    []vec3.T
+		wantI   float64
+		wantQ   float64
+		wantU   float64
+		wantDoP float64
+	}{
+		{name: "none", wantI: 1},
+		{name: "horizontal", axes: []vec3.T{horizontal}, wantI: 0.5, wantQ: 0.5, wantDoP: 1},
+		{name: "parallel", axes: []vec3.T{vertical, vertical}, wantI: 0.5, wantQ: -0.5, wantDoP: 1},
+		{name: "crossed", axes: []vec3.T{horizontal, vertical}},
+		{name: "diagonal analyzer", axes: []vec3.T{falling, horizontal}, wantI: 0.25, wantU: -0.25, wantDoP: 1},
+		{name: "horizontal analyzer", axes: []vec3.T{horizontal, falling}, wantI: 0.25, wantQ: 0.25, wantDoP: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := polarizerScene(tc.axes...)
+			s.Crush(0)
+
+			r := ray.Ray{Point: vec3.T{0, 0, 0}, Slope: vec3.T{1, 0, 0}}
+			ref := cameraReference(s.Cameras[0], r.Slope)
+			got := s.SampleRayPolarized(r, ref, 550, rand.New(rand.NewSource(1)), 10)
+
+			const tol = 1e-6
+			if math.Abs(got[0]-tc.wantI) > tol || math.Abs(got[1]-tc.wantQ) > tol || math.Abs(got[2]-tc.wantU) > tol || math.Abs(got[3]) > tol {
+				t.Errorf("got Stokes vector %v, want [%v %v %v 0]", got, tc.wantI, tc.wantQ, tc.wantU)
+			}
+			if got[0] != 0 && math.Abs(got.DegreeOfPolarization()-tc.wantDoP) > tol {
+				t.Errorf("got degree of polarization %v, want %v", got.DegreeOfPolarization(), tc.wantDoP)
+			}
+		})
+	}
+}
+
+func TestSampleRayPolarizedMatchesSampleRayWithoutPolarizers(t *testing.T) {
+	// The demo scene without its glass box only has depolarizing materials,
+	// so the polarized integrator should make exactly the same choices.
+	s := DemoScene()
+	s.Elements = s.Elements[:len(s.Elements)-1]
+	s.Crush(0)
+
+	cam := s.Cameras[0]
+	for i := 0; i < 50; i++ {
+		r := cam.ImageToRay(i%5, 5, i/5, 10, rand.New(rand.NewSource(int64(i))))
+
+		want := s.SampleRay(r, 550, rand.New(rand.NewSource(int64(i))), 5)
+		got := s.SampleRayPolarized(r, cameraReference(cam, r.Slope), 550, rand.New(rand.NewSource(int64(i))), 5)
+
+		if math.Abs(got[0]-float64(want)) > 1e-4*math.Max(1, float64(want)) {
+			t.Errorf("path %d: got intensity %v, want %v", i, got[0], want)
+		}
+		if got[1] != 0 || got[2] != 0 || got[3] != 0 {
+			t.Errorf("path %d: got polarized light %v from unpolarized materials", i, got)
+		}
+	}
+}
+
+func TestRenderPolarized(t *testing.T) {
+	s := polarizerScene(vec3.T{0, 1, 0})
+	s.Crush(0)
+
+	newDB := func() *spectralimage.SpectralImage {
+		db := &spectralimage.SpectralImage{WavelengthMin: 400, WavelengthMax: 700}
+		db.Resize(4, 4, 2)
+		return db
+	}
+	sampleDB := newDB()
+	options := &RenderOptions{
+		MaxDepth:         4,
+		TargetSubsamples: 2,
+		HeroWavelength:   true,
+		Polarized:        true,
+		StokesDBs:        [3]*spectralimage.SpectralImage{newDB(), nil, newDB()},
+	}
+	RenderScene(s, options, sampleDB, func(int, int) {})
+
+	for i := range sampleDB.PowerDensitySums {
+		if got := sampleDB.PowerDensitySums[i] / sampleDB.PowerDensityCounts[i]; math.Abs(float64(got)-0.5) > 1e-4 {
+			t.Fatalf("entry %d: got intensity %v, want 0.5", i, got)
+		}
+
+		// The camera rays aren't quite along X, so the polarizer's axis
+		// isn't quite horizontal in every pixel.
+		q := options.StokesDBs[0]
+		if got := q.PowerDensitySums[i] / q.PowerDensityCounts[i]; math.Abs(float64(got)-0.5) > 1e-3 {
+			t.Fatalf("entry %d: got Q %v, want 0.5", i, got)
+		}
+		v := options.StokesDBs[2]
+		if v.PowerDensityCounts[i] != sampleDB.PowerDensityCounts[i] {
+			t.Fatalf("entry %d: V has %v samples, want %v", i, v.PowerDensityCounts[i], sampleDB.PowerDensityCounts[i])
+		}
+	}
+}
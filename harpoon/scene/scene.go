@@ -2,6 +2,7 @@ package scene
 
 import (
 	"math"
+	"math/bits"
 	"math/rand"
 	"runtime"
 	"sync"
@@ -12,6 +13,7 @@ import (
 	"row-major/harpoon/contact"
 	"row-major/harpoon/geometry"
 	"row-major/harpoon/kdtree"
+	"row-major/harpoon/light"
 	"row-major/harpoon/material"
 	"row-major/harpoon/ray"
 	"row-major/harpoon/spectralimage"
@@ -20,6 +22,10 @@ import (
 	"row-major/harpoon/vmath/vec3"
 )
 
+// kdSplitCost is the cost of visiting a node of the query accelerator,
+// relative to testing an element.
+const kdSplitCost = 1.0
+
 type SceneElement struct {
 	GeometryIndex int
 	MaterialIndex int
@@ -56,6 +62,10 @@ type Scene struct {
 
 	Cameras []camera.Camera
 
+	// Lights that integrators sample directly.  These are in addition to any
+	// elements with emitting materials.
+	Lights []light.Light
+
 	QueryAccelerator *kdtree.KDTree
 }
 
@@ -83,6 +93,15 @@ func (s *Scene) AddCamera(c camera.Camera) int {
 	return len(s.Cameras) - 1
 }
 
+func (s *Scene) AddLight(l light.Light) int {
+	s.Lights = append(s.Lights, l)
+	return len(s.Lights) - 1
+}
+
+// Crush prepares the scene for rendering at the given time, building its
+// query accelerator.  Crushing again (say, at another time) starts over, so it
+// can be called any number of times.  Scenes that Validate finds errors in may
+// make it panic.
 func (s *Scene) Crush(time float64) {
 	// Geometry, materials, and material maps are crushed in a dependency-based
 	// fashion, whith each crushing its own dependencies.  To prevent redundant
@@ -97,6 +116,11 @@ func (s *Scene) Crush(time float64) {
 		m.Crush(time)
 	}
 
+	for _, l := range s.Lights {
+		l.Crush(time)
+	}
+
+	s.CrushedElements = make([]*CrushedSceneElement, 0, len(s.Elements))
 	kdElements := []kdtree.KDElement{}
 	for i, element := range s.Elements {
 		g := s.Geometries[element.GeometryIndex]
@@ -119,32 +143,64 @@ func (s *Scene) Crush(time float64) {
 	}
 
 	s.QueryAccelerator = kdtree.NewKDTree(kdElements)
-	s.QueryAccelerator.RefineViaSurfaceAreaHeuristic(1.0, 0.9)
+	s.QueryAccelerator.RefineViaSurfaceAreaHeuristic(kdSplitCost, 0.9)
+}
+
+// intersect finds the first contact between the element and worldQuery, in
+// world coordinates.
+func (elt *CrushedSceneElement) intersect(worldQuery ray.RaySegment) (contact.Contact, bool) {
+	mdlQuery := worldQuery.Transform(elt.WorldToModel)
+	inSegment := func(c contact.Contact) bool {
+		return !math.IsNaN(c.T) && mdlQuery.TheSegment.Lo <= c.T && c.T <= mdlQuery.TheSegment.Hi
+	}
+
+	// The entry and exit can come in either order.  A ray that starts
+	// inside a non-convex element can leave it before it next enters it.
+	entryContact := elt.TheGeometry.RayInto(mdlQuery)
+	exitContact := elt.TheGeometry.RayExit(mdlQuery)
+	entryOK, exitOK := inSegment(entryContact), inSegment(exitContact)
+
+	var c contact.Contact
+	switch {
+	case entryOK && exitOK:
+		c = entryContact
+		if exitContact.T < entryContact.T {
+			c = exitContact
+		}
+	case entryOK:
+		c = entryContact
+	case exitOK:
+		c = exitContact
+	default:
+		return contact.Contact{}, false
+	}
+	return c.Transform(elt.ModelToWorld, elt.ModelToWorldNormals), true
 }
 
 func (s *Scene) SceneRayIntersect(worldQuery ray.RaySegment) (contact.Contact, int) {
+	return s.sceneRayIntersect(worldQuery, nil)
+}
+
+// sceneRayIntersect is SceneRayIntersect, counting its work in stats if it's
+// non-nil.
+func (s *Scene) sceneRayIntersect(worldQuery ray.RaySegment, stats *RayStats) (contact.Contact, int) {
 	minContact := contact.Contact{}
 	minElementIndex := -1
 
 	selector := func(b aabox.AABox) bool {
+		if stats != nil {
+			stats.NodeVisits++
+		}
 		return !aabox.RayTestAABox(worldQuery, b).IsNaN()
 	}
 
 	visitor := func(i int) {
-		elt := s.CrushedElements[i]
-		mdlQuery := worldQuery.Transform(elt.WorldToModel)
-		entryContact := elt.TheGeometry.RayInto(mdlQuery)
-		if !math.IsNaN(entryContact.T) && mdlQuery.TheSegment.Lo <= entryContact.T && entryContact.T <= mdlQuery.TheSegment.Hi {
-			worldEntryContact := entryContact.Transform(elt.ModelToWorld, elt.ModelToWorldNormals)
-			worldQuery.TheSegment.Hi = worldEntryContact.T
-			minContact = worldEntryContact
-			minElementIndex = i
+		if stats != nil {
+			stats.IntersectionTests++
 		}
-		exitContact := elt.TheGeometry.RayExit(mdlQuery)
-		if !math.IsNaN(exitContact.T) && mdlQuery.TheSegment.Lo <= exitContact.T && exitContact.T <= mdlQuery.TheSegment.Hi {
-			worldExitContact := exitContact.Transform(elt.ModelToWorld, elt.ModelToWorldNormals)
-			worldQuery.TheSegment.Hi = worldExitContact.T
-			minContact = worldExitContact
+		if c, ok := s.CrushedElements[i].intersect(worldQuery); ok {
+			worldQuery.TheSegment.Hi = c.T
+			minContact = c
 			minElementIndex = i
 		}
 	}
@@ -154,7 +210,53 @@ func (s *Scene) SceneRayIntersect(worldQuery ray.RaySegment) (contact.Contact, i
 	return minContact, minElementIndex
 }
 
-func (s *Scene) ShadeRay(reflectedRay ray.Ray, curWavelength float32, rng *rand.Rand) material.ShadeInfo {
+// SceneRayIntersectPacket is SceneRayIntersect for up to ray.PacketWidth
+// queries at once.  The results for queries[i] are written to contacts[i] and
+// indices[i].
+//
+// The queries are traced through the accelerator together, so this is faster
+// than tracing them one by one when they are coherent, like camera rays
+// through nearby pixels.
+func (s *Scene) SceneRayIntersectPacket(queries []ray.RaySegment, contacts []contact.Contact, indices []int) {
+	packet := ray.NewPacket(queries)
+	cur := [ray.PacketWidth]ray.RaySegment{}
+	copy(cur[:], queries)
+	for i := range queries {
+		contacts[i] = contact.Contact{}
+		indices[i] = -1
+	}
+
+	selector := func(b aabox.AABox, active uint32) uint32 {
+		return aabox.PacketTestAABox(&packet, b, active)
+	}
+
+	visitor := func(i int, active uint32) {
+		elt := s.CrushedElements[i]
+
+		// Nodes can be much bigger than their elements, so it's worth
+		// checking the element's own bounds before intersecting rays one by
+		// one.
+		active = aabox.PacketTestAABox(&packet, elt.WorldBounds, active)
+		for active != 0 {
+			j := bits.TrailingZeros32(active)
+			active &= active - 1
+
+			if c, ok := elt.intersect(cur[j]); ok {
+				cur[j].TheSegment.Hi = c.T
+				packet.SetHi(j, c.T)
+				contacts[j] = c
+				indices[j] = i
+			}
+		}
+	}
+
+	s.QueryAccelerator.QueryPacket(packet.Active, selector, visitor)
+}
+
+// rayContact finds the first contact along reflectedRay, and the material that
+// should shade it.  If the ray escapes the scene, the contact is placed at
+// infinity, shaded by the infinity material, and hit is false.
+func (s *Scene) rayContact(reflectedRay ray.Ray) (c contact.Contact, m material.Material, hit bool) {
 	reflectedQuery := ray.RaySegment{
 		TheRay:     reflectedRay,
 		TheSegment: ray.Span{0.0001, math.Inf(1)},
@@ -162,19 +264,28 @@ func (s *Scene) ShadeRay(reflectedRay ray.Ray, curWavelength float32, rng *rand.
 
 	glbContact, hitIndex := s.SceneRayIntersect(reflectedQuery)
 	if hitIndex == -1 {
-		p := reflectedRay.Eval(math.Inf(1))
-		c := contact.Contact{
-			T:    math.Inf(1),
-			R:    reflectedRay,
-			P:    p,
-			N:    vec3.MulVS(reflectedRay.Slope, -1.0),
-			Mtl2: vec2.T{math.Atan2(reflectedRay.Slope[0], reflectedRay.Slope[1]), math.Acos(reflectedRay.Slope[2])},
-			Mtl3: p,
-		}
-		return s.Materials[s.InfinityMaterialIndex].Shade(c, curWavelength, rng)
+		return infinityContact(reflectedRay), s.Materials[s.InfinityMaterialIndex], false
+	}
+
+	return glbContact, s.CrushedElements[hitIndex].TheMaterial, true
+}
+
+// infinityContact is the contact seen by a ray that escapes the scene.
+func infinityContact(r ray.Ray) contact.Contact {
+	p := r.Eval(math.Inf(1))
+	return contact.Contact{
+		T:    math.Inf(1),
+		R:    r,
+		P:    p,
+		N:    vec3.MulVS(r.Slope, -1.0),
+		Mtl2: vec2.T{math.Atan2(r.Slope[0], r.Slope[1]), math.Acos(r.Slope[2])},
+		Mtl3: p,
 	}
+}
 
-	return s.CrushedElements[hitIndex].TheMaterial.Shade(glbContact, curWavelength, rng)
+func (s *Scene) ShadeRay(reflectedRay ray.Ray, curWavelength float32, rng *rand.Rand) material.ShadeInfo {
+	c, m, _ := s.rayContact(reflectedRay)
+	return m.Shade(c, curWavelength, rng)
 }
 
 func (s *Scene) SampleRay(initialQuery ray.Ray, curWavelength float32, rng *rand.Rand, depthLim int) float32 {
@@ -182,27 +293,149 @@ func (s *Scene) SampleRay(initialQuery ray.Ray, curWavelength float32, rng *rand
 	var curK float32 = 1.0
 	curRay := initialQuery
 
+	lightSamples := make([]lightSample, 0, len(s.Lights))
+
 	for i := 0; i < depthLim; i++ {
-		shading := s.ShadeRay(curRay, curWavelength, rng)
+		c, m, _ := s.rayContact(curRay)
+
+		if directlyLit(m) && len(s.Lights) != 0 {
+			lightSamples = s.sampleLights(c, rng, lightSamples[:0])
+			accumPower += curK * directPower(m, c, lightSamples, curWavelength, rng)
+		}
+
+		shading := m.Shade(c, curWavelength, rng)
 		accumPower += curK * shading.EmittedPower
 
-		curK = shading.PropagationK
-		if shading.PropagationK == 0.0 {
-			continue
+		curK *= shading.PropagationK
+		if curK == 0.0 {
+			break
 		}
 		curRay = shading.IncidentRay
+
+		// A fluorescent material can send the path off looking for light
+		// of a different wavelength.  Whatever it finds is still counted
+		// toward the wavelength the path started with.
+		if shading.IncidentFreq != 0.0 {
+			curWavelength = shading.IncidentFreq
+		}
 	}
 
 	return accumPower
 }
 
+// SampleRayHero traces a single path that carries all of the wavelengths in
+// freqs, writing the power sampled for each wavelength into accumPower.
+//
+// freqs[0] is the hero wavelength, which makes all of the sampling decisions
+// along the path.  The remaining wavelengths follow the hero for as long as the
+// materials along the path allow it (see material.SecondaryShader).  At the
+// first dispersive event, the secondary wavelengths are terminated and the
+// hero's subsequent contributions are scaled up by len(freqs).  As long as the
+// hero is chosen uniformly among the wavelengths, each wavelength's estimate
+// stays unbiased.
+//
+// Materials that shift wavelengths are always dispersive events.  After the
+// collapse, the hero may continue at a different wavelength, but its power is
+// still recorded in accumPower[0].
+func (s *Scene) SampleRayHero(initialQuery ray.Ray, freqs []float32, rng *rand.Rand, depthLim int, accumPower []float32) {
+	c, m, _ := s.rayContact(initialQuery)
+	s.sampleRayHeroFrom(c, m, freqs, rng, depthLim, accumPower)
+}
+
+// sampleRayHeroFrom is SampleRayHero, starting from the first contact c of the
+// initial ray, which is shaded by m.
+func (s *Scene) sampleRayHeroFrom(c contact.Contact, m material.Material, freqs []float32, rng *rand.Rand, depthLim int, accumPower []float32) {
+	curK := make([]float32, len(freqs))
+	for i := range freqs {
+		accumPower[i] = 0.0
+		curK[i] = 1.0
+	}
+
+	secondaries := make([]material.ShadeInfo, len(freqs))
+	collapsed := len(freqs) == 1
+	var curRay ray.Ray
+	heroFreq := freqs[0]
+
+	lightSamples := make([]lightSample, 0, len(s.Lights))
+
+	for i := 0; i < depthLim; i++ {
+		if i != 0 {
+			c, m, _ = s.rayContact(curRay)
+		}
+
+		// The light samples don't depend on wavelength, so every live
+		// wavelength can share them.
+		if directlyLit(m) && len(s.Lights) != 0 {
+			lightSamples = s.sampleLights(c, rng, lightSamples[:0])
+			for j := range freqs {
+				freq := freqs[j]
+				if j == 0 {
+					freq = heroFreq
+				}
+				if curK[j] != 0.0 {
+					accumPower[j] += curK[j] * directPower(m, c, lightSamples, freq, rng)
+				}
+			}
+		}
+
+		hero := m.Shade(c, heroFreq, rng)
+
+		if !collapsed {
+			ss, ok := m.(material.SecondaryShader)
+			if _, reradiates := m.(material.Reradiator); reradiates {
+				ok = false
+			}
+			for j := 1; ok && j < len(freqs); j++ {
+				secondaries[j], ok = ss.ShadeSecondary(c, heroFreq, hero, freqs[j])
+			}
+
+			if ok {
+				for j := 1; j < len(freqs); j++ {
+					accumPower[j] += curK[j] * secondaries[j].EmittedPower
+					curK[j] *= secondaries[j].PropagationK
+				}
+			} else {
+				collapsed = true
+				for j := 1; j < len(freqs); j++ {
+					curK[j] = 0.0
+				}
+				curK[0] *= float32(len(freqs))
+			}
+		}
+
+		accumPower[0] += curK[0] * hero.EmittedPower
+		curK[0] *= hero.PropagationK
+
+		live := false
+		for j := range curK {
+			if curK[j] != 0.0 {
+				live = true
+				break
+			}
+		}
+		if !live {
+			break
+		}
+		curRay = hero.IncidentRay
+		if hero.IncidentFreq != 0.0 {
+			heroFreq = hero.IncidentFreq
+		}
+	}
+}
+
 type ChunkWorker struct {
 	sampleDB         *spectralimage.SpectralImage
 	rng              *rand.Rand
 	progressFunction func(int)
 
-	maxDepth      int
-	targetSamples int
+	maxDepth        int
+	targetSamples   int
+	heroWavelength  bool
+	packetTraversal bool
+	polarized       bool
+
+	// Receive Q, U, and V for polarized renders.  Entries may be nil.
+	stokesDBs [3]*spectralimage.SpectralImage
 
 	// These are the dimensions of the overall image, not just
 	imgRows int
@@ -214,9 +447,39 @@ type ChunkWorker struct {
 	colSrc int
 	colLim int
 	scene  *Scene
+
+	// If non-nil, the worker stops at the end of the current row once cancel
+	// is closed.
+	cancel <-chan struct{}
+}
+
+// cancelled reports whether the worker has been asked to stop.
+func (w *ChunkWorker) cancelled() bool {
+	select {
+	case <-w.cancel:
+		return true
+	default:
+		return false
+	}
 }
 
 func (w *ChunkWorker) Render() {
+	if w.polarized {
+		w.renderPolarized()
+		return
+	}
+	// Rays from a spectral camera differ by wavelength, so they can't share a
+	// packet.
+	_, spectralCamera := w.scene.Cameras[0].(camera.SpectralCamera)
+	if w.heroWavelength && w.packetTraversal && !spectralCamera {
+		w.renderHeroPackets()
+		return
+	}
+	if w.heroWavelength {
+		w.renderHero()
+		return
+	}
+
 	samplesCollected := 0
 	for cr := w.rowSrc; cr < w.rowLim; cr++ {
 		for cc := w.colSrc; cc < w.colLim; cc++ {
@@ -232,10 +495,13 @@ func (w *ChunkWorker) Render() {
 
 				for cs := 0; cs < samplesToAdd; cs++ {
 					curWavelength, _ := w.sampleDB.WavelengthBin(cw)
-					curQuery := w.scene.Cameras[0].ImageToRay(cr, w.imgRows, cc, w.imgCols, w.rng)
+					curQuery, weight := cameraRay(w.scene.Cameras[0], cr, w.imgRows, cc, w.imgCols, curWavelength, w.rng)
 
 					// We get a power density sample in W / m^2
-					sampledPower := w.scene.SampleRay(curQuery, curWavelength, w.rng, w.maxDepth)
+					sampledPower := float32(0.0)
+					if weight != 0.0 {
+						sampledPower = weight * w.scene.SampleRay(curQuery, curWavelength, w.rng, w.maxDepth)
+					}
 					w.sampleDB.RecordSample(r, c, cw, sampledPower)
 					samplesCollected++
 				}
@@ -244,17 +510,286 @@ func (w *ChunkWorker) Render() {
 
 		w.progressFunction(samplesCollected)
 		samplesCollected = 0
+
+		if w.cancelled() {
+			return
+		}
 	}
 }
 
+// renderHero is Render, but using hero-wavelength sampling.  Each path records
+// one sample into every wavelength bin.
+func (w *ChunkWorker) renderHero() {
+	wavelengthSize := w.sampleDB.WavelengthSize
+	freqs := make([]float32, wavelengthSize)
+	bins := make([]int, wavelengthSize)
+	sampledPower := make([]float32, wavelengthSize)
+
+	samplesCollected := 0
+	for cr := w.rowSrc; cr < w.rowLim; cr++ {
+		for cc := w.colSrc; cc < w.colLim; cc++ {
+			r := cr - w.rowSrc
+			c := cc - w.colSrc
+
+			// Every path adds a sample to every bin, so the number of paths
+			// is governed by the bin with the fewest samples.
+			minCount := math.MaxInt32
+			for cw := 0; cw < wavelengthSize; cw++ {
+				samp := w.sampleDB.ReadSample(r, c, cw)
+				if int(samp.PowerDensityCount) < minCount {
+					minCount = int(samp.PowerDensityCount)
+				}
+			}
+			if minCount >= w.targetSamples {
+				continue
+			}
+			samplesToAdd := w.targetSamples - minCount
+
+			for cs := 0; cs < samplesToAdd; cs++ {
+				w.heroWavelengths(w.rng.Float32(), freqs, bins)
+				w.sampleHero(cr, cc, freqs, sampledPower)
+				for i := range bins {
+					w.sampleDB.RecordSample(r, c, bins[i], sampledPower[i])
+				}
+				samplesCollected += wavelengthSize
+			}
+		}
+
+		w.progressFunction(samplesCollected)
+		samplesCollected = 0
+
+		if w.cancelled() {
+			return
+		}
+	}
+}
+
+// sampleHero traces a hero-wavelength path through the given pixel.  A
+// spectral camera sends each wavelength along a different ray, so it's a
+// dispersive event: only the hero is traced, and it stands in for all of the
+// wavelengths, as in SampleRayHero.
+func (w *ChunkWorker) sampleHero(cr, cc int, freqs, sampledPower []float32) {
+	cam := w.scene.Cameras[0]
+	spectral, ok := cam.(camera.SpectralCamera)
+	if !ok {
+		curQuery := cam.ImageToRay(cr, w.imgRows, cc, w.imgCols, w.rng)
+		w.scene.SampleRayHero(curQuery, freqs, w.rng, w.maxDepth, sampledPower)
+		return
+	}
+
+	for i := range sampledPower {
+		sampledPower[i] = 0.0
+	}
+	curQuery, weight := spectral.ImageToRaySpectral(cr, w.imgRows, cc, w.imgCols, float64(freqs[0]), w.rng)
+	if weight == 0.0 {
+		return
+	}
+	w.scene.SampleRayHero(curQuery, freqs[:1], w.rng, w.maxDepth, sampledPower[:1])
+	sampledPower[0] *= float32(weight) * float32(len(freqs))
+}
+
+// cameraRay returns cam's ray through the given pixel at the given wavelength,
+// and the weight to give the power sampled along it.  Only a spectral camera's
+// rays depend on the wavelength, and only its weights differ from 1.
+func cameraRay(cam camera.Camera, curRow, imgRows, curCol, imgCols int, wavelength float32, rng *rand.Rand) (ray.Ray, float32) {
+	if spectral, ok := cam.(camera.SpectralCamera); ok {
+		r, weight := spectral.ImageToRaySpectral(curRow, imgRows, curCol, imgCols, float64(wavelength), rng)
+		return r, float32(weight)
+	}
+	return cam.ImageToRay(curRow, imgRows, curCol, imgCols, rng), 1.0
+}
+
+// heroPacket collects camera rays for renderHeroPackets, along with the pixel
+// and wavelengths each one is sampling.
+type heroPacket struct {
+	n int
+
+	rows, cols [ray.PacketWidth]int
+	queries    [ray.PacketWidth]ray.RaySegment
+	freqs      [ray.PacketWidth][]float32
+	bins       [ray.PacketWidth][]int
+
+	contacts [ray.PacketWidth]contact.Contact
+	indices  [ray.PacketWidth]int
+}
+
+// renderHeroPackets is renderHero, but tracing the camera rays in packets.
+// Camera rays for neighboring pixels are coherent, so they can share a walk
+// through the query accelerator.  Each path continues on its own after its
+// first contact.
+func (w *ChunkWorker) renderHeroPackets() {
+	wavelengthSize := w.sampleDB.WavelengthSize
+	sampledPower := make([]float32, wavelengthSize)
+
+	packet := &heroPacket{}
+	for i := range packet.freqs {
+		packet.freqs[i] = make([]float32, wavelengthSize)
+		packet.bins[i] = make([]int, wavelengthSize)
+	}
+
+	flush := func() {
+		if packet.n == 0 {
+			return
+		}
+
+		n := packet.n
+		w.scene.SceneRayIntersectPacket(packet.queries[:n], packet.contacts[:n], packet.indices[:n])
+		for k := 0; k < n; k++ {
+			c := packet.contacts[k]
+			m := w.scene.Materials[w.scene.InfinityMaterialIndex]
+			if packet.indices[k] == -1 {
+				c = infinityContact(packet.queries[k].TheRay)
+			} else {
+				m = w.scene.CrushedElements[packet.indices[k]].TheMaterial
+			}
+
+			w.scene.sampleRayHeroFrom(c, m, packet.freqs[k], w.rng, w.maxDepth, sampledPower)
+			for i, bin := range packet.bins[k] {
+				w.sampleDB.RecordSample(packet.rows[k], packet.cols[k], bin, sampledPower[i])
+			}
+		}
+		packet.n = 0
+	}
+
+	samplesCollected := 0
+	for cr := w.rowSrc; cr < w.rowLim; cr++ {
+		for cc := w.colSrc; cc < w.colLim; cc++ {
+			r := cr - w.rowSrc
+			c := cc - w.colSrc
+
+			minCount := math.MaxInt32
+			for cw := 0; cw < wavelengthSize; cw++ {
+				samp := w.sampleDB.ReadSample(r, c, cw)
+				if int(samp.PowerDensityCount) < minCount {
+					minCount = int(samp.PowerDensityCount)
+				}
+			}
+			if minCount >= w.targetSamples {
+				continue
+			}
+			samplesToAdd := w.targetSamples - minCount
+
+			for cs := 0; cs < samplesToAdd; cs++ {
+				k := packet.n
+				w.heroWavelengths(w.rng.Float32(), packet.freqs[k], packet.bins[k])
+				packet.rows[k] = r
+				packet.cols[k] = c
+				packet.queries[k] = ray.RaySegment{
+					TheRay:     w.scene.Cameras[0].ImageToRay(cr, w.imgRows, cc, w.imgCols, w.rng),
+					TheSegment: ray.Span{Lo: 0.0001, Hi: math.Inf(1)},
+				}
+				packet.n++
+				samplesCollected += wavelengthSize
+
+				if packet.n == ray.PacketWidth {
+					flush()
+				}
+			}
+		}
+
+		flush()
+		w.progressFunction(samplesCollected)
+		samplesCollected = 0
+
+		if w.cancelled() {
+			return
+		}
+	}
+}
+
+// heroWavelengths picks a stratified set of wavelengths, one in each bin of the
+// sample DB, by rotating u through the wavelength range.  freqs[0] is the hero
+// wavelength.  The bin of each wavelength is written into bins.
+func (w *ChunkWorker) heroWavelengths(u float32, freqs []float32, bins []int) {
+	wavelengthSize := w.sampleDB.WavelengthSize
+	wavelengthMin := w.sampleDB.WavelengthMin
+	wavelengthMax := w.sampleDB.WavelengthMax
+
+	for i := 0; i < wavelengthSize; i++ {
+		t := u + float32(i)/float32(wavelengthSize)
+		if t >= 1.0 {
+			t -= 1.0
+		}
+
+		freqs[i] = wavelengthMin + t*(wavelengthMax-wavelengthMin)
+
+		bins[i] = int(t * float32(wavelengthSize))
+		if bins[i] >= wavelengthSize {
+			bins[i] = wavelengthSize - 1
+		}
+	}
+}
+
+// Integrator selects the light transport algorithm used by RenderScene.
+type Integrator int
+
+const (
+	// IntegratorPathTracing traces paths from the camera until they reach a
+	// light source.
+	IntegratorPathTracing Integrator = iota
+
+	// IntegratorPhotonMapping uses progressive photon mapping.  Photons are
+	// traced from the light sources, and gathered at the first non-specular
+	// surface seen from the camera.  This resolves caustics that the path
+	// tracer can barely find.
+	IntegratorPhotonMapping
+)
+
 type RenderOptions struct {
 	MaxDepth         int
 	TargetSubsamples int
+
+	// HeroWavelength enables hero-wavelength sampling, where each path carries
+	// one wavelength from every wavelength bin, rather than just one.  Only
+	// used by IntegratorPathTracing.
+	HeroWavelength bool
+
+	// PacketTraversal traces camera rays through the query accelerator in
+	// packets, which is faster for most scenes.  Only used by
+	// IntegratorPathTracing with HeroWavelength, and not for spectral
+	// cameras, whose rays differ by wavelength.
+	PacketTraversal bool
+
+	// Polarized traces paths that carry the polarization of light (see
+	// material.PolarizedShader), instead of treating all light as
+	// unpolarized.  Paths are traced one wavelength at a time, so
+	// HeroWavelength and PacketTraversal are ignored.  Only used by
+	// IntegratorPathTracing.
+	Polarized bool
+
+	// StokesDBs receive the Q, U, and V Stokes parameters of the light
+	// arriving at each pixel, measured against the image's horizontal axis:
+	// positive Q is horizontal polarization, and positive U is polarization
+	// along the image's rising diagonal.  The sample DB receives the
+	// intensity, I, as usual.  Entries may be
+	// nil.  Only used with Polarized.
+	StokesDBs [3]*spectralimage.SpectralImage
+
+	Integrator Integrator
+
+	// Options for IntegratorPhotonMapping.  Each pass (one per subsample)
+	// traces PhotonsPerPass photons, and gathers them over a radius that
+	// starts at PhotonInitialRadius.  The radius shrinks after every pass, at
+	// a rate controlled by PhotonRadiusAlpha, in (0, 1).  Smaller values shrink
+	// the radius faster.
+	PhotonsPerPass      int
+	PhotonInitialRadius float64
+	PhotonRadiusAlpha   float64
+
+	// If non-nil, closing Cancel makes RenderScene return early.  The samples
+	// collected so far are still recorded in the sample DB, so the render can
+	// be resumed later.
+	Cancel <-chan struct{}
 }
 
 type ProgressFunction func(int, int)
 
 func RenderScene(scene *Scene, options *RenderOptions, sampleDB *spectralimage.SpectralImage, progressFunction ProgressFunction) {
+	if options.Integrator == IntegratorPhotonMapping {
+		renderPhotonMapping(scene, options, sampleDB, progressFunction)
+		return
+	}
+
 	curProgress := 0
 
 	// progressMutex locks both curProgress and sampleDB.
@@ -278,15 +813,10 @@ func RenderScene(scene *Scene, options *RenderOptions, sampleDB *spectralimage.S
 
 	processorCount := runtime.NumCPU()
 
-	// We chunk work by rows.
-	workUnit := sampleDB.RowSize / processorCount
-
 	var wg sync.WaitGroup
 	for i := 0; i < processorCount; i++ {
-		rowLim := (i + 1) * workUnit
-		if rowLim > sampleDB.RowSize {
-			rowLim = sampleDB.RowSize
-		}
+		// We chunk work by rows.
+		rowSrc, rowLim := rowChunk(i, processorCount, sampleDB.RowSize)
 
 		worker := &ChunkWorker{
 			// TODO(ahmedtd): Think about how to make this more repeatable.
@@ -297,17 +827,28 @@ func RenderScene(scene *Scene, options *RenderOptions, sampleDB *spectralimage.S
 				curProgress += subProgress
 				progressFunction(curProgress, totalSamples)
 			},
-			maxDepth:      options.MaxDepth,
-			targetSamples: options.TargetSubsamples,
-			imgRows:       sampleDB.RowSize,
-			imgCols:       sampleDB.ColSize,
-			rowSrc:        i * workUnit,
-			rowLim:        rowLim,
-			colSrc:        0,
-			colLim:        sampleDB.ColSize,
-			scene:         scene,
+			maxDepth:        options.MaxDepth,
+			targetSamples:   options.TargetSubsamples,
+			heroWavelength:  options.HeroWavelength,
+			packetTraversal: options.PacketTraversal,
+			polarized:       options.Polarized,
+			imgRows:         sampleDB.RowSize,
+			imgCols:         sampleDB.ColSize,
+			rowSrc:          rowSrc,
+			rowLim:          rowLim,
+			colSrc:          0,
+			colLim:          sampleDB.ColSize,
+			scene:           scene,
+			cancel:          options.Cancel,
 		}
 		worker.sampleDB = sampleDB.Cut(worker.rowSrc, worker.rowLim, 0, sampleDB.ColSize)
+		if options.Polarized {
+			for j, db := range options.StokesDBs {
+				if db != nil {
+					worker.stokesDBs[j] = db.Cut(worker.rowSrc, worker.rowLim, 0, db.ColSize)
+				}
+			}
+		}
 
 		wg.Add(1)
 		go func() {
@@ -318,8 +859,18 @@ func RenderScene(scene *Scene, options *RenderOptions, sampleDB *spectralimage.S
 			defer progressMutex.Unlock()
 
 			sampleDB.Paste(worker.sampleDB, worker.rowSrc, worker.colSrc)
+			for j, db := range worker.stokesDBs {
+				if db != nil {
+					options.StokesDBs[j].Paste(db, worker.rowSrc, worker.colSrc)
+				}
+			}
 		}()
 	}
 
 	wg.Wait()
 }
+
+// rowChunk returns the range of rows handled by worker i of n.
+func rowChunk(i, n, rows int) (int, int) {
+	return i * rows / n, (i + 1) * rows / n
+}
@@ -0,0 +1,322 @@
+package scene
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"row-major/harpoon/aabox"
+	"row-major/harpoon/camera"
+	"row-major/harpoon/geometry"
+	"row-major/harpoon/material"
+	"row-major/harpoon/vmath/mat33"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// Severity is how much a Diagnostic matters.
+type Severity int
+
+const (
+	// SeverityWarning is for scenes that render, but probably not as their
+	// author meant them to.
+	SeverityWarning Severity = iota
+
+	// SeverityError is for scenes that can't be rendered: Crush or the
+	// integrators would panic, or every sample would be garbage.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Diagnostic is a problem that Validate found with part of a scene.
+type Diagnostic struct {
+	Severity Severity
+
+	// Subject is the part of the scene with the problem, like "element 3"
+	// or "camera 0".
+	Subject string
+
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s: %s", d.Severity, d.Subject, d.Message)
+}
+
+// Diagnostics are everything Validate found wrong with a scene.
+type Diagnostics []Diagnostic
+
+// Errors returns the diagnostics that make the scene unrenderable.
+func (ds Diagnostics) Errors() Diagnostics {
+	return ds.withSeverity(SeverityError)
+}
+
+// Warnings returns the rest.
+func (ds Diagnostics) Warnings() Diagnostics {
+	return ds.withSeverity(SeverityWarning)
+}
+
+func (ds Diagnostics) withSeverity(s Severity) Diagnostics {
+	var result Diagnostics
+	for _, d := range ds {
+		if d.Severity == s {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+// Err returns a *ValidationError holding the errors, or nil if there aren't
+// any.
+func (ds Diagnostics) Err() error {
+	errs := ds.Errors()
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Diagnostics: errs}
+}
+
+// ValidationError is returned for scenes that failed validation.
+type ValidationError struct {
+	Diagnostics Diagnostics
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Diagnostics))
+	for i, d := range e.Diagnostics {
+		parts[i] = d.Subject + ": " + d.Message
+	}
+	return "invalid scene: " + strings.Join(parts, "; ")
+}
+
+// frameTolerance is how far a camera's frame can be from orthonormal before
+// Validate warns about it.
+const frameTolerance = 1e-6
+
+// Validate checks the scene for mistakes that would crash the renderer, or
+// make it draw something other than what was meant.  Loaders run it on every
+// scene they load.  Scenes with errors shouldn't be crushed or rendered.
+//
+// Validate may crush geometries, to find their bounds.
+func (s *Scene) Validate() Diagnostics {
+	v := &validator{}
+
+	for i, g := range s.Geometries {
+		v.geometry(fmt.Sprintf("geometry %d", i), g)
+	}
+
+	for i, m := range s.Materials {
+		if m == nil {
+			v.errorf(fmt.Sprintf("material %d", i), "material is nil")
+		}
+	}
+
+	if s.InfinityMaterialIndex < 0 || s.InfinityMaterialIndex >= len(s.Materials) {
+		v.errorf("infinity material", "material index %d is out of range (the scene has %d materials)", s.InfinityMaterialIndex, len(s.Materials))
+	} else if m := s.Materials[s.InfinityMaterialIndex]; m != nil && !isEmitter(m) {
+		v.warnf("infinity material", "material %d is a %T, which doesn't emit; rays that leave the scene will be shaded as if they hit it", s.InfinityMaterialIndex, m)
+	}
+
+	for i, e := range s.Elements {
+		v.element(fmt.Sprintf("element %d", i), e, len(s.Geometries), len(s.Materials))
+	}
+
+	if len(s.Cameras) == 0 {
+		v.errorf("scene", "scene has no cameras")
+	}
+	for i, c := range s.Cameras {
+		v.camera(fmt.Sprintf("camera %d", i), c)
+	}
+
+	for i, l := range s.Lights {
+		if l == nil {
+			v.errorf(fmt.Sprintf("light %d", i), "light is nil")
+		}
+	}
+
+	return v.diagnostics
+}
+
+type validator struct {
+	diagnostics Diagnostics
+}
+
+func (v *validator) errorf(subject, format string, args ...interface{}) {
+	v.diagnostics = append(v.diagnostics, Diagnostic{SeverityError, subject, fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) warnf(subject, format string, args ...interface{}) {
+	v.diagnostics = append(v.diagnostics, Diagnostic{SeverityWarning, subject, fmt.Sprintf(format, args...)})
+}
+
+func isEmitter(m material.Material) bool {
+	switch m.(type) {
+	case *material.Emitter, *material.DirectionalEmitter:
+		return true
+	}
+	return false
+}
+
+func (v *validator) geometry(subject string, g geometry.Geometry) {
+	if g == nil {
+		v.errorf(subject, "geometry is nil")
+		return
+	}
+
+	// A mesh with bad indices would panic when finding its bounds.
+	if m, ok := g.(*geometry.TriangleMesh); ok && !v.mesh(subject, m) {
+		return
+	}
+
+	b := g.GetAABox()
+	if anyNaN(b.X.Lo, b.X.Hi, b.Y.Lo, b.Y.Hi, b.Z.Lo, b.Z.Hi) {
+		v.errorf(subject, "bounding box %v is NaN", b)
+	} else if emptyBox(b) {
+		v.warnf(subject, "geometry is empty")
+	}
+}
+
+// mesh checks that a mesh's vertices are finite, and that its indices and
+// per-vertex attributes line up with them.
+func (v *validator) mesh(subject string, m *geometry.TriangleMesh) bool {
+	ok := true
+	if len(m.Triangles) == 0 {
+		v.warnf(subject, "mesh has no triangles")
+	}
+	for i, p := range m.Vertices {
+		if !finite(p[:]...) {
+			v.errorf(subject, "vertex %d %v is not finite", i, p)
+			ok = false
+			break
+		}
+	}
+	for t, tri := range m.Triangles {
+		for _, i := range tri {
+			if i < 0 || i >= len(m.Vertices) {
+				v.errorf(subject, "triangle %d refers to vertex %d, but the mesh has %d vertices", t, i, len(m.Vertices))
+				ok = false
+				break
+			}
+		}
+	}
+	if len(m.Normals) != 0 && len(m.Normals) != len(m.Vertices) {
+		v.errorf(subject, "mesh has %d normals for %d vertices", len(m.Normals), len(m.Vertices))
+		ok = false
+	}
+	if len(m.TexCoords) != 0 && len(m.TexCoords) != len(m.Vertices) {
+		v.errorf(subject, "mesh has %d texture coordinates for %d vertices", len(m.TexCoords), len(m.Vertices))
+		ok = false
+	}
+	return ok
+}
+
+func (v *validator) element(subject string, e *SceneElement, geometries, materials int) {
+	if e == nil {
+		v.errorf(subject, "element is nil")
+		return
+	}
+	if e.GeometryIndex < 0 || e.GeometryIndex >= geometries {
+		v.errorf(subject, "geometry index %d is out of range (the scene has %d geometries)", e.GeometryIndex, geometries)
+	}
+	if e.MaterialIndex < 0 || e.MaterialIndex >= materials {
+		v.errorf(subject, "material index %d is out of range (the scene has %d materials)", e.MaterialIndex, materials)
+	}
+
+	t := e.ModelToWorld
+	if !finite(t.Linear[:]...) || !finite(t.Offset[:]...) {
+		v.errorf(subject, "transform %v has non-finite entries", t)
+		return
+	}
+	if degenerate(t.Linear) {
+		v.errorf(subject, "transform %v is degenerate, so it can't be inverted", t.Linear)
+	}
+}
+
+// degenerate reports whether m flattens space, relative to the lengths of its
+// columns.
+func degenerate(m mat33.T) bool {
+	scale := 1.0
+	for col := 0; col < 3; col++ {
+		scale *= vec3.T{m[col], m[3+col], m[6+col]}.Norm()
+	}
+	return scale == 0 || math.Abs(mat33.Determinant(m)) <= 1e-12*scale
+}
+
+func anyNaN(xs ...float64) bool {
+	for _, x := range xs {
+		if math.IsNaN(x) {
+			return true
+		}
+	}
+	return false
+}
+
+func finite(xs ...float64) bool {
+	for _, x := range xs {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *validator) camera(subject string, c camera.Camera) {
+	switch c := c.(type) {
+	case nil:
+		v.errorf(subject, "camera is nil")
+	case *camera.PinholeCamera:
+		v.cameraFrame(subject, c.Center, c.ApertureToWorld)
+		if !finite(c.Aperture[:]...) || c.Aperture[0] <= 0 || c.Aperture[1] == 0 || c.Aperture[2] == 0 {
+			v.errorf(subject, "aperture %v must be finite, with a positive depth and nonzero width and height", c.Aperture)
+		}
+	case *camera.LensSystem:
+		v.cameraFrame(subject, c.Center, c.ApertureToWorld)
+		if len(c.Surfaces) == 0 {
+			v.errorf(subject, "lens has no surfaces")
+		}
+		if !(c.FilmWidth > 0 && c.FilmHeight > 0) {
+			v.errorf(subject, "film is %vx%vmm; it must have a positive size", c.FilmWidth, c.FilmHeight)
+		}
+	}
+}
+
+// cameraFrame checks that a camera's eye, left, and up vectors make a
+// right-handed orthonormal frame, as SetEye and SetUp leave them.
+func (v *validator) cameraFrame(subject string, center vec3.T, m mat33.T) {
+	if !finite(center[:]...) {
+		v.errorf(subject, "center %v is not finite", center)
+	}
+	if !finite(m[:]...) || degenerate(m) {
+		v.errorf(subject, "frame %v is degenerate", m)
+		return
+	}
+
+	cols := [3]vec3.T{}
+	for col := range cols {
+		cols[col] = vec3.T{m[col], m[3+col], m[6+col]}
+	}
+	for i, c := range cols {
+		if math.Abs(c.Norm()-1) > frameTolerance {
+			v.warnf(subject, "frame column %d %v isn't a unit vector", i, c)
+		}
+		for _, d := range cols[i+1:] {
+			if math.Abs(vec3.IProd(c, d)) > frameTolerance {
+				v.warnf(subject, "frame %v isn't orthogonal, so the image will be skewed", m)
+				return
+			}
+		}
+	}
+	if mat33.Determinant(m) < 0 {
+		v.warnf(subject, "frame %v is left-handed, so the image will be mirrored", m)
+	}
+}
+
+// emptyBox reports whether b holds nothing, like the bounds of an empty mesh.
+func emptyBox(b aabox.AABox) bool {
+	return b.X.Lo > b.X.Hi || b.Y.Lo > b.Y.Hi || b.Z.Lo > b.Z.Hi
+}
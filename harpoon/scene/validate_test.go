@@ -0,0 +1,188 @@
+package scene
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"row-major/harpoon/affinetransform"
+	"row-major/harpoon/camera"
+	"row-major/harpoon/geometry"
+	"row-major/harpoon/material"
+	"row-major/harpoon/vmath/mat33"
+	"row-major/harpoon/vmath/vec3"
+)
+
+func TestValidateAcceptsGoodScenes(t *testing.T) {
+	for name, s := range map[string]*Scene{
+		"demo":    DemoScene(),
+		"cornell": cornellBoxScene(),
+		"glass":   glassSphereScene(),
+	} {
+		if d := s.Validate(); len(d) != 0 {
+			t.Errorf("%s: got diagnostics %v, want none", name, d)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name     string
+		modify   func(s *Scene)
+		severity Severity
+		subject  string
+		message  string
+	}{
+		{
+			name:     "geometry index",
+			modify:   func(s *Scene) { s.Elements[0].GeometryIndex = 7 },
+			severity: SeverityError,
+			subject:  "element 0",
+			message:  "geometry index 7",
+		},
+		{
+			name:     "material index",
+			modify:   func(s *Scene) { s.Elements[0].MaterialIndex = -1 },
+			severity: SeverityError,
+			subject:  "element 0",
+			message:  "material index -1",
+		},
+		{
+			name:     "degenerate transform",
+			modify:   func(s *Scene) { s.Elements[0].ModelToWorld = affinetransform.Scale(0) },
+			severity: SeverityError,
+			subject:  "element 0",
+			message:  "degenerate",
+		},
+		{
+			name: "flattening transform",
+			modify: func(s *Scene) {
+				s.Elements[0].ModelToWorld.Linear = mat33.T{1, 0, 0, 0, 1, 0, 1, 1, 0}
+			},
+			severity: SeverityError,
+			subject:  "element 0",
+			message:  "degenerate",
+		},
+		{
+			name:     "infinity material index",
+			modify:   func(s *Scene) { s.InfinityMaterialIndex = 9 },
+			severity: SeverityError,
+			subject:  "infinity material",
+			message:  "out of range",
+		},
+		{
+			name:     "non-emitting sky",
+			modify:   func(s *Scene) { s.InfinityMaterialIndex = s.Elements[0].MaterialIndex },
+			severity: SeverityWarning,
+			subject:  "infinity material",
+			message:  "doesn't emit",
+		},
+		{
+			name: "NaN vertex",
+			modify: func(s *Scene) {
+				s.Geometries[s.Elements[0].GeometryIndex] = &geometry.TriangleMesh{
+					Vertices:  []vec3.T{{0, 0, 0}, {1, 0, 0}, {0, math.NaN(), 0}},
+					Triangles: [][3]int{{0, 1, 2}},
+				}
+			},
+			severity: SeverityError,
+			subject:  "geometry 0",
+			message:  "not finite",
+		},
+		{
+			name: "mesh index",
+			modify: func(s *Scene) {
+				s.Geometries[s.Elements[0].GeometryIndex] = &geometry.TriangleMesh{
+					Vertices:  []vec3.T{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}},
+					Triangles: [][3]int{{0, 1, 3}},
+				}
+			},
+			severity: SeverityError,
+			subject:  "geometry 0",
+			message:  "vertex 3",
+		},
+		{
+			name:     "empty mesh",
+			modify:   func(s *Scene) { s.Geometries[s.Elements[0].GeometryIndex] = &geometry.TriangleMesh{} },
+			severity: SeverityWarning,
+			subject:  "geometry 0",
+			message:  "no triangles",
+		},
+		{
+			name:     "no cameras",
+			modify:   func(s *Scene) { s.Cameras = nil },
+			severity: SeverityError,
+			subject:  "scene",
+			message:  "no cameras",
+		},
+		{
+			name: "skewed camera",
+			modify: func(s *Scene) {
+				s.Cameras[0].(*camera.PinholeCamera).ApertureToWorld = mat33.T{1, 0.1, 0, 0, 1, 0, 0, 0, 1}
+			},
+			severity: SeverityWarning,
+			subject:  "camera 0",
+			message:  "orthogonal",
+		},
+		{
+			name: "mirrored camera",
+			modify: func(s *Scene) {
+				m := &s.Cameras[0].(*camera.PinholeCamera).ApertureToWorld
+				m[1], m[4], m[7] = -m[1], -m[4], -m[7]
+			},
+			severity: SeverityWarning,
+			subject:  "camera 0",
+			message:  "mirrored",
+		},
+		{
+			name: "flat aperture",
+			modify: func(s *Scene) {
+				s.Cameras[0].(*camera.PinholeCamera).Aperture[2] = 0
+			},
+			severity: SeverityError,
+			subject:  "camera 0",
+			message:  "aperture",
+		},
+	}
+
+	for _, tc := range cases {
+		s := furnaceScene(0.5)
+		tc.modify(s)
+
+		found := false
+		for _, d := range s.Validate() {
+			if d.Severity == tc.severity && d.Subject == tc.subject && strings.Contains(d.Message, tc.message) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: got diagnostics %v, want a %v for %s mentioning %q", tc.name, s.Validate(), tc.severity, tc.subject, tc.message)
+		}
+
+		err := s.Validate().Err()
+		var verr *ValidationError
+		if gotErr := errors.As(err, &verr); gotErr != (tc.severity == SeverityError) {
+			t.Errorf("%s: Err() returned %v", tc.name, err)
+		}
+	}
+}
+
+func TestCrushIsIdempotent(t *testing.T) {
+	s := cornellBoxScene()
+	s.Crush(0)
+	s.Crush(0)
+	if got, want := len(s.CrushedElements), len(s.Elements); got != want {
+		t.Errorf("after crushing twice, got %d crushed elements, want %d", got, want)
+	}
+
+	s.AddElement(&SceneElement{
+		GeometryIndex: s.AddGeometry(&geometry.Sphere{}),
+		MaterialIndex: s.AddMaterial(&material.MonteCarloLambert{Reflectance: material.ConstantScalar(0.5)}),
+		ModelToWorld:  affinetransform.Identity(),
+	})
+	s.Crush(0)
+	if got, want := len(s.CrushedElements), len(s.Elements); got != want {
+		t.Errorf("after adding an element, got %d crushed elements, want %d", got, want)
+	}
+}
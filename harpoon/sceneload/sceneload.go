@@ -0,0 +1,58 @@
+// Package sceneload loads scenes from files, in any of the formats harpoon
+// understands.
+package sceneload
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"row-major/harpoon/gltf"
+	"row-major/harpoon/scene"
+	"row-major/harpoon/scenepack"
+)
+
+// IsSceneFile reports whether fileName has the extension of a scene format
+// that LoadFile understands.
+func IsSceneFile(fileName string) bool {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".scenepack", ".gltf", ".glb":
+		return true
+	default:
+		return false
+	}
+}
+
+// LoadFile loads a glTF file (.gltf or .glb), or a scenepack (anything else),
+// based on the file's extension, and validates it.  It also returns warnings
+// about parts of the file that couldn't be represented faithfully, and any
+// that validation raised.  Scenes that fail validation are an error.
+func LoadFile(fileName string) (*scene.Scene, []string, error) {
+	var s *scene.Scene
+	var warnings []string
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".gltf", ".glb":
+		var report *gltf.Report
+		var err error
+		s, report, err = gltf.LoadScene(fileName)
+		if err != nil {
+			return nil, nil, err
+		}
+		warnings = report.Warnings
+	default:
+		var err error
+		s, err = scenepack.LoadScene(fileName)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	diagnostics := s.Validate()
+	if err := diagnostics.Err(); err != nil {
+		return nil, nil, fmt.Errorf("while validating %s: %w", fileName, err)
+	}
+	for _, d := range diagnostics.Warnings() {
+		warnings = append(warnings, d.Subject+": "+d.Message)
+	}
+	return s, warnings, nil
+}
@@ -2,12 +2,16 @@ package scenepack
 
 import (
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"row-major/harpoon/affinetransform"
 	"row-major/harpoon/camera"
 	"row-major/harpoon/densesignal"
 	"row-major/harpoon/geometry"
+	"row-major/harpoon/light"
 	"row-major/harpoon/material"
 	"row-major/harpoon/ray"
 	"row-major/harpoon/scene"
@@ -18,6 +22,8 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+// LoadScene reads a scenepack.  Files that the scenepack refers to (measured
+// spectra and IES profiles) are resolved relative to the scenepack's directory.
 func LoadScene(fileName string) (*scene.Scene, error) {
 	fileBytes, err := os.ReadFile(fileName)
 	if err != nil {
@@ -29,43 +35,107 @@ func LoadScene(fileName string) (*scene.Scene, error) {
 		return nil, fmt.Errorf("while unmarshiling scenepack header: %w", err)
 	}
 
+	dir := filepath.Dir(fileName)
 	realScene := &scene.Scene{}
 
-	for _, g := range protoScene.Geometry {
+	for i, g := range protoScene.Geometry {
 		switch {
-		case g.Sphere != nil:
-
+		case g.GetSphere() != nil:
 			realScene.AddGeometry(&geometry.Sphere{
-				TheMaterialCoordsMode: convertMaterialCoordsMode(g.Sphere.MaterialCoordsMode),
+				TheMaterialCoordsMode: convertMaterialCoordsMode(g.GetSphere().MaterialCoordsMode),
 			})
 
-		case g.Box != nil:
+		case g.GetBox() != nil:
+			box := g.GetBox()
 			realScene.AddGeometry(&geometry.Box{
 				Spans: [3]ray.Span{
-					{Lo: g.Box.XLo, Hi: g.Box.XHi},
-					{Lo: g.Box.YLo, Hi: g.Box.YHi},
-					{Lo: g.Box.ZLo, Hi: g.Box.ZHi},
+					{Lo: box.XLo, Hi: box.XHi},
+					{Lo: box.YLo, Hi: box.YHi},
+					{Lo: box.ZLo, Hi: box.ZHi},
 				},
 			})
+
+		case g.GetSdf() != nil:
+			root, err := convertSDFNode(g.GetSdf().Root)
+			if err != nil {
+				return nil, fmt.Errorf("while converting SDF geometry %d: %w", i, err)
+			}
+			realScene.AddGeometry(&geometry.SDF{
+				Root:     root,
+				Epsilon:  g.GetSdf().Epsilon,
+				MaxSteps: int(g.GetSdf().MaxSteps),
+			})
+
+		case g.GetHeightfield() != nil:
+			hf := g.GetHeightfield()
+			h, err := geometry.LoadHeightfieldFile(resolvePath(dir, hf.ElevationFile), int(hf.Columns))
+			if err != nil {
+				return nil, fmt.Errorf("while loading heightfield geometry %d: %w", i, err)
+			}
+			realScene.AddGeometry(h)
+
+		case g.GetCurves() != nil:
+			cv := g.GetCurves()
+			c, err := geometry.LoadCyHairFile(resolvePath(dir, cv.HairFile))
+			if err != nil {
+				return nil, fmt.Errorf("while loading curves geometry %d: %w", i, err)
+			}
+			c.Kind = convertCurveKind(cv.Kind)
+			if cv.WidthScale != 0 {
+				for _, strand := range c.Strands {
+					for j := range strand.Widths {
+						strand.Widths[j] *= cv.WidthScale
+					}
+				}
+			}
+			realScene.AddGeometry(c)
 		}
 	}
 
 	// TODO: Figure out a good way to express material maps.
-	for _, m := range protoScene.Material {
+	for i, m := range protoScene.Material {
 		switch {
-		case m.Emitter != nil:
+		case m.GetEmitter() != nil:
+			emissivity := densesignal.CIED65Emission(300)
+			if m.GetEmitter().Emissivity != nil {
+				var err error
+				emissivity, err = convertSpectrum(m.GetEmitter().Emissivity, dir)
+				if err != nil {
+					return nil, fmt.Errorf("while converting emissivity of material %d: %w", i, err)
+				}
+			}
 			realScene.AddMaterial(&material.Emitter{
-				Emissivity: material.ConstantSpectrum(densesignal.CIED65Emission(300)),
+				Emissivity: material.ConstantSpectrum(emissivity),
 			})
-		case m.GaussianRoughNonConductive != nil:
+		case m.GetGaussianRoughNonConductive() != nil:
 			realScene.AddMaterial(&material.GaussianRoughNonConductive{
 				Variance: material.ConstantScalar(0.5),
 			})
-		case m.NonConductiveSmooth != nil:
+		case m.GetNonConductiveSmooth() != nil:
 			realScene.AddMaterial(&material.NonConductiveSmooth{
 				InteriorIndexOfRefraction: material.ConstantSpectrum(densesignal.VisibleSpectrumRamp(1.7, 1.5)),
 				ExteriorIndexOfRefraction: material.ConstantScalar(1.0),
 			})
+		case m.GetThinFilmSmooth() != nil:
+			film := m.GetThinFilmSmooth()
+			if film.FilmIndexOfRefraction <= 0 {
+				return nil, fmt.Errorf("film index of refraction of material %d must be positive, got %v", i, film.FilmIndexOfRefraction)
+			}
+			if film.FilmThickness < 0 {
+				return nil, fmt.Errorf("film thickness of material %d must not be negative, got %v", i, film.FilmThickness)
+			}
+			interior := film.InteriorIndexOfRefraction
+			if interior == 0 {
+				interior = 1.0
+			}
+			realScene.AddMaterial(&material.ThinFilmSmooth{
+				InteriorIndexOfRefraction: material.ConstantScalar(interior),
+				ExteriorIndexOfRefraction: material.ConstantScalar(1.0),
+				FilmIndexOfRefraction:     material.ConstantScalar(film.FilmIndexOfRefraction),
+				FilmThickness:             material.ConstantScalar(film.FilmThickness),
+			})
+		case m.GetHair() != nil:
+			realScene.AddMaterial(convertHair(m.GetHair()))
 		}
 	}
 
@@ -79,21 +149,289 @@ func LoadScene(fileName string) (*scene.Scene, error) {
 		})
 	}
 
-	for _, c := range protoScene.Camera {
+	for i, c := range protoScene.Camera {
 		switch {
-		case c.PinholeCamera != nil:
-			realCamera := &camera.PinholeCamera{}
-			realCamera.SetEye(convertVec3(c.GetEye()))
-			realCamera.SetUp(convertVec3(c.GetUp()))
-			realCamera.Center = convertVec3(c.GetCenter())
-			realCamera.Aperture = convertVec3(c.GetAperture())
+		case c.GetPinholeCamera() != nil:
+			pc := c.GetPinholeCamera()
+			realCamera := &camera.PinholeCamera{
+				ApertureToWorld: mat33.T{1, 0, 0, 0, 1, 0, 0, 0, 1},
+			}
+			realCamera.SetEye(convertVec3(pc.GetEye()))
+			realCamera.SetUp(convertVec3(pc.GetUp()))
+			realCamera.Center = convertVec3(pc.GetCenter())
+			realCamera.Aperture = convertVec3(pc.GetAperture())
+			realScene.AddCamera(realCamera)
+		case c.GetLensCamera() != nil:
+			realCamera, err := convertLensCamera(c.GetLensCamera())
+			if err != nil {
+				return nil, fmt.Errorf("while converting camera %d: %w", i, err)
+			}
 			realScene.AddCamera(realCamera)
 		}
 	}
 
+	for i, l := range protoScene.Light {
+		realLight, err := convertLight(l, dir)
+		if err != nil {
+			return nil, fmt.Errorf("while converting light %d: %w", i, err)
+		}
+		realScene.AddLight(realLight)
+	}
+
 	return realScene, nil
 }
 
+func convertSDFNode(in *headerproto.SDFNode) (geometry.SDFNode, error) {
+	switch {
+	case in.GetSphere() != nil:
+		if in.GetSphere().Radius <= 0 {
+			return nil, fmt.Errorf("sphere radius must be positive, got %v", in.GetSphere().Radius)
+		}
+		return &geometry.SDFSphere{Radius: in.GetSphere().Radius}, nil
+
+	case in.GetBox() != nil:
+		if in.GetBox().HalfExtents == nil {
+			return nil, fmt.Errorf("box has no half extents")
+		}
+		return &geometry.SDFBox{
+			HalfExtents: convertVec3(in.GetBox().HalfExtents),
+			Rounding:    in.GetBox().Rounding,
+		}, nil
+
+	case in.GetTorus() != nil:
+		return &geometry.SDFTorus{Major: in.GetTorus().Major, Minor: in.GetTorus().Minor}, nil
+
+	case in.GetMandelbulb() != nil:
+		power := in.GetMandelbulb().Power
+		if power == 0 {
+			power = 8
+		}
+		iterations := int(in.GetMandelbulb().Iterations)
+		if iterations == 0 {
+			iterations = 16
+		}
+		return &geometry.SDFMandelbulb{Power: power, Iterations: iterations}, nil
+
+	case in.GetUnion() != nil:
+		children, err := convertSDFNodes(in.GetUnion().Child)
+		if err != nil {
+			return nil, err
+		}
+		return &geometry.SDFUnion{Children: children}, nil
+
+	case in.GetSmoothUnion() != nil:
+		children, err := convertSDFNodes(in.GetSmoothUnion().Child)
+		if err != nil {
+			return nil, err
+		}
+		return &geometry.SDFSmoothUnion{Children: children, K: in.GetSmoothUnion().K}, nil
+
+	case in.GetIntersection() != nil:
+		children, err := convertSDFNodes(in.GetIntersection().Child)
+		if err != nil {
+			return nil, err
+		}
+		return &geometry.SDFIntersection{Children: children}, nil
+
+	case in.GetSubtraction() != nil:
+		a, err := convertSDFNode(in.GetSubtraction().A)
+		if err != nil {
+			return nil, fmt.Errorf("while converting subtraction: %w", err)
+		}
+		b, err := convertSDFNode(in.GetSubtraction().B)
+		if err != nil {
+			return nil, fmt.Errorf("while converting subtraction: %w", err)
+		}
+		return &geometry.SDFSubtraction{A: a, B: b}, nil
+
+	case in.GetTranslate() != nil:
+		if in.GetTranslate().Offset == nil {
+			return nil, fmt.Errorf("translate has no offset")
+		}
+		child, err := convertSDFNode(in.GetTranslate().Child)
+		if err != nil {
+			return nil, fmt.Errorf("while converting translate: %w", err)
+		}
+		return &geometry.SDFTranslate{Offset: convertVec3(in.GetTranslate().Offset), Child: child}, nil
+
+	case in.GetScale() != nil:
+		if in.GetScale().Factor <= 0 {
+			return nil, fmt.Errorf("scale factor must be positive, got %v", in.GetScale().Factor)
+		}
+		child, err := convertSDFNode(in.GetScale().Child)
+		if err != nil {
+			return nil, fmt.Errorf("while converting scale: %w", err)
+		}
+		return &geometry.SDFScale{Factor: in.GetScale().Factor, Child: child}, nil
+
+	case in.GetTwist() != nil:
+		child, err := convertSDFNode(in.GetTwist().Child)
+		if err != nil {
+			return nil, fmt.Errorf("while converting twist: %w", err)
+		}
+		return &geometry.SDFTwist{Rate: in.GetTwist().Rate, Child: child}, nil
+
+	case in.GetRepeat() != nil:
+		r := in.GetRepeat()
+		if r.Period == nil {
+			return nil, fmt.Errorf("repeat has no period")
+		}
+		if r.CountX < 0 || r.CountY < 0 || r.CountZ < 0 {
+			return nil, fmt.Errorf("repeat counts must not be negative, got %d, %d, %d", r.CountX, r.CountY, r.CountZ)
+		}
+		child, err := convertSDFNode(r.Child)
+		if err != nil {
+			return nil, fmt.Errorf("while converting repeat: %w", err)
+		}
+		return &geometry.SDFRepeat{
+			Period: convertVec3(r.Period),
+			Count:  [3]int{int(r.CountX), int(r.CountY), int(r.CountZ)},
+			Child:  child,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("SDF node has no kind")
+}
+
+func convertSDFNodes(in []*headerproto.SDFNode) ([]geometry.SDFNode, error) {
+	if len(in) == 0 {
+		return nil, fmt.Errorf("SDF node needs at least one child")
+	}
+	result := []geometry.SDFNode{}
+	for i, c := range in {
+		child, err := convertSDFNode(c)
+		if err != nil {
+			return nil, fmt.Errorf("while converting child %d: %w", i, err)
+		}
+		result = append(result, child)
+	}
+	return result, nil
+}
+
+func convertLensCamera(in *headerproto.LensCamera) (*camera.LensSystem, error) {
+	surfaces, ok := camera.BuiltinLens(in.Lens)
+	if !ok {
+		return nil, fmt.Errorf("unknown lens %q (have %s)", in.Lens, strings.Join(camera.BuiltinLensNames(), ", "))
+	}
+
+	realCamera := &camera.LensSystem{
+		ApertureToWorld:         mat33.T{1, 0, 0, 0, 1, 0, 0, 0, 1},
+		Surfaces:                surfaces,
+		FilmWidth:               in.FilmWidth,
+		FilmHeight:              in.FilmHeight,
+		SceneUnitsPerMillimeter: in.SceneUnitsPerMillimeter,
+	}
+	if realCamera.FilmWidth == 0 && realCamera.FilmHeight == 0 {
+		realCamera.FilmWidth, realCamera.FilmHeight = 36, 24
+	}
+	realCamera.SetEye(convertVec3(in.GetEye()))
+	realCamera.SetUp(convertVec3(in.GetUp()))
+	realCamera.Center = convertVec3(in.GetCenter())
+
+	focus := in.FocusDistance
+	if focus == 0 {
+		focus = math.Inf(1)
+	}
+	if err := realCamera.Focus(focus); err != nil {
+		return nil, fmt.Errorf("while focusing: %w", err)
+	}
+	return realCamera, nil
+}
+
+func convertLight(in *headerproto.Light, dir string) (light.Light, error) {
+	switch {
+	case in.GetSpotLight() != nil:
+		sl := in.GetSpotLight()
+		intensity, err := convertSpectrum(sl.Intensity, dir)
+		if err != nil {
+			return nil, fmt.Errorf("while converting intensity: %w", err)
+		}
+		return &light.SpotLight{
+			Position:   convertVec3(sl.Position),
+			Direction:  convertVec3(sl.Direction),
+			InnerAngle: sl.InnerAngle,
+			OuterAngle: sl.OuterAngle,
+			Intensity:  material.ConstantSpectrum(intensity),
+		}, nil
+
+	case in.GetRectLight() != nil:
+		rl := in.GetRectLight()
+		radiance, err := convertSpectrum(rl.Radiance, dir)
+		if err != nil {
+			return nil, fmt.Errorf("while converting radiance: %w", err)
+		}
+		var profile *light.Goniometric
+		if rl.IesFile != "" {
+			profile, err = light.LoadIESFile(resolvePath(dir, rl.IesFile))
+			if err != nil {
+				return nil, fmt.Errorf("while loading IES profile: %w", err)
+			}
+		}
+		return &light.RectLight{
+			Corner:   convertVec3(rl.Corner),
+			Edge1:    convertVec3(rl.Edge1),
+			Edge2:    convertVec3(rl.Edge2),
+			Radiance: material.ConstantSpectrum(radiance),
+			Profile:  profile,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown light kind")
+}
+
+func convertSpectrum(in *headerproto.Spectrum, dir string) (*densesignal.DenseSignal, error) {
+	if in == nil {
+		return nil, fmt.Errorf("missing spectrum")
+	}
+	if in.Power <= 0 {
+		return nil, fmt.Errorf("spectrum power must be positive, got %v", in.Power)
+	}
+
+	var sig *densesignal.DenseSignal
+	switch kind := in.Kind.(type) {
+	case *headerproto.Spectrum_BlackbodyTemperature:
+		if kind.BlackbodyTemperature <= 0 {
+			return nil, fmt.Errorf("blackbody temperature must be positive, got %v", kind.BlackbodyTemperature)
+		}
+		sig = densesignal.Blackbody(float32(kind.BlackbodyTemperature))
+	case *headerproto.Spectrum_Named:
+		named, ok := namedSpectra[kind.Named]
+		if !ok {
+			return nil, fmt.Errorf("unknown spectrum %q", kind.Named)
+		}
+		sig = named()
+	case *headerproto.Spectrum_TabulatedFile:
+		var err error
+		sig, err = densesignal.LoadTabulatedFile(resolvePath(dir, kind.TabulatedFile))
+		if err != nil {
+			return nil, fmt.Errorf("while loading tabulated spectrum: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown spectrum kind")
+	}
+
+	sig.Normalize()
+	sig.MulS(float32(in.Power))
+	return sig, nil
+}
+
+var namedSpectra = map[string]func() *densesignal.DenseSignal{
+	"cie-a":          densesignal.CIEA,
+	"cie-d65":        densesignal.CIED65,
+	"cie-f2":         densesignal.CIEF2,
+	"cie-f7":         densesignal.CIEF7,
+	"cie-f11":        densesignal.CIEF11,
+	"led-cool-white": densesignal.LEDCoolWhite,
+	"led-warm-white": densesignal.LEDWarmWhite,
+}
+
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
 func convertMaterialCoordsMode(in headerproto.MaterialCoordsMode) geometry.MaterialCoordsMode {
 	switch in {
 	case headerproto.MaterialCoordsMode_MATERIAL_COORDS_MODE_2D:
@@ -106,6 +444,33 @@ func convertMaterialCoordsMode(in headerproto.MaterialCoordsMode) geometry.Mater
 	return geometry.MaterialCoords3D
 }
 
+func convertCurveKind(in headerproto.CurveKind) geometry.CurveKind {
+	switch in {
+	case headerproto.CurveKind_CURVE_KIND_RIBBON:
+		return geometry.CurveRibbon
+	case headerproto.CurveKind_CURVE_KIND_CYLINDER:
+		return geometry.CurveCylinder
+	}
+	return geometry.CurveFlat
+}
+
+// convertHair fills in unset parameters with those of brown human hair.
+func convertHair(in *headerproto.Hair) *material.Hair {
+	orDefault := func(v, def float64) float64 {
+		if v == 0 {
+			return def
+		}
+		return v
+	}
+	return &material.Hair{
+		Absorption:            material.MelaninAbsorption(in.Eumelanin, in.Pheomelanin),
+		IndexOfRefraction:     material.ConstantScalar(orDefault(in.IndexOfRefraction, 1.55)),
+		LongitudinalRoughness: orDefault(in.LongitudinalRoughness, 0.3),
+		AzimuthalRoughness:    orDefault(in.AzimuthalRoughness, 0.3),
+		ScaleAngle:            orDefault(in.ScaleAngle, 2),
+	}
+}
+
 func convertTransform(in *headerproto.Transform) affinetransform.AffineTransform {
 	return affinetransform.AffineTransform{
 		Linear: convertMat33(in.Linear),
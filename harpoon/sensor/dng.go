@@ -0,0 +1,173 @@
+package sensor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// TIFF field types.
+const (
+	tiffByte      = 1
+	tiffASCII     = 2
+	tiffShort     = 3
+	tiffLong      = 4
+	tiffRational  = 5
+	tiffSRational = 10
+)
+
+// tiffEntry is a tag of an image file directory, with its value already
+// encoded.
+type tiffEntry struct {
+	tag   uint16
+	kind  uint16
+	count uint32
+	value []byte
+}
+
+func shortEntry(tag uint16, vals ...uint16) tiffEntry {
+	b := &bytes.Buffer{}
+	binary.Write(b, binary.LittleEndian, vals)
+	return tiffEntry{tag, tiffShort, uint32(len(vals)), b.Bytes()}
+}
+
+func longEntry(tag uint16, vals ...uint32) tiffEntry {
+	b := &bytes.Buffer{}
+	binary.Write(b, binary.LittleEndian, vals)
+	return tiffEntry{tag, tiffLong, uint32(len(vals)), b.Bytes()}
+}
+
+func byteEntry(tag uint16, vals ...byte) tiffEntry {
+	return tiffEntry{tag, tiffByte, uint32(len(vals)), vals}
+}
+
+func asciiEntry(tag uint16, s string) tiffEntry {
+	return tiffEntry{tag, tiffASCII, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+// rationalEntry encodes vals as fractions over a fixed denominator, which is
+// plenty of precision for DNG's matrices.
+func rationalEntry(tag uint16, signed bool, vals ...float64) tiffEntry {
+	const denominator = 1 << 20
+	b := &bytes.Buffer{}
+	kind := uint16(tiffRational)
+	if signed {
+		kind = tiffSRational
+	}
+	for _, v := range vals {
+		if signed {
+			binary.Write(b, binary.LittleEndian, int32(math.Round(v*denominator)))
+		} else {
+			binary.Write(b, binary.LittleEndian, uint32(math.Round(v*denominator)))
+		}
+		binary.Write(b, binary.LittleEndian, uint32(denominator))
+	}
+	return tiffEntry{tag, kind, uint32(len(vals)), b.Bytes()}
+}
+
+// WriteDNG writes the mosaic as a DNG file: an uncompressed TIFF holding the
+// raw color filter array values, with enough metadata (black and white
+// levels, color matrix, white balance) for raw converters to develop it.
+func WriteDNG(m *Mosaic, w io.Writer) error {
+	s := m.Sensor
+
+	// DNG numbers the colors of the pattern 0, 1, 2 for red, green, blue,
+	// which is how Sensitivities is ordered.
+	cfa := []byte{}
+	for _, ch := range s.CFA {
+		cfa = append(cfa, byte(ch))
+	}
+
+	colorMatrix := s.ColorMatrix()
+	neutral := s.Neutral()
+
+	pixels := &bytes.Buffer{}
+	binary.Write(pixels, binary.LittleEndian, m.Values)
+
+	entries := []tiffEntry{
+		longEntry(254, 0),                                               // NewSubfileType: the main image.
+		longEntry(256, uint32(m.Cols)),                                  // ImageWidth
+		longEntry(257, uint32(m.Rows)),                                  // ImageLength
+		shortEntry(258, 16),                                             // BitsPerSample
+		shortEntry(259, 1),                                              // Compression: none.
+		shortEntry(262, 32803),                                          // PhotometricInterpretation: CFA.
+		asciiEntry(271, "harpoon"),                                      // Make
+		asciiEntry(272, s.Name),                                         // Model
+		longEntry(273, 0),                                               // StripOffsets, filled in below.
+		shortEntry(274, 1),                                              // Orientation: top left.
+		shortEntry(277, 1),                                              // SamplesPerPixel
+		longEntry(278, uint32(m.Rows)),                                  // RowsPerStrip
+		longEntry(279, uint32(pixels.Len())),                            // StripByteCounts
+		shortEntry(284, 1),                                              // PlanarConfiguration: chunky.
+		asciiEntry(305, "harpoon sensor"),                               // Software
+		shortEntry(33421, 2, 2),                                         // CFARepeatPatternDim
+		byteEntry(33422, cfa...),                                        // CFAPattern
+		rationalEntry(33434, false, m.Exposure.ShutterSeconds),          // ExposureTime
+		rationalEntry(33437, false, m.Exposure.FNumber),                 // FNumber
+		shortEntry(34855, uint16(math.Min(65535, m.Exposure.ISO))),      // ISOSpeedRatings
+		byteEntry(50706, 1, 4, 0, 0),                                    // DNGVersion
+		byteEntry(50707, 1, 1, 0, 0),                                    // DNGBackwardVersion
+		asciiEntry(50708, "harpoon "+s.Name),                            // UniqueCameraModel
+		longEntry(50714, uint32(s.BlackLevel)),                          // BlackLevel
+		longEntry(50717, uint32(s.WhiteLevel())),                        // WhiteLevel
+		rationalEntry(50721, true, colorMatrix[:]...),                   // ColorMatrix1
+		rationalEntry(50728, false, neutral[0], neutral[1], neutral[2]), // AsShotNeutral
+		shortEntry(50778, 21),                                           // CalibrationIlluminant1: D65.
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	// The file is the header, the directory, the values too big to fit in
+	// the directory, and then the pixels.
+	const headerSize = 8
+	dirSize := 2 + 12*len(entries) + 4
+	overflowOffset := headerSize + dirSize
+	overflowSize := 0
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			overflowSize += len(e.value) + len(e.value)%2
+		}
+	}
+	stripOffset := overflowOffset + overflowSize
+	for i := range entries {
+		if entries[i].tag == 273 {
+			entries[i] = longEntry(273, uint32(stripOffset))
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("II")
+	binary.Write(buf, binary.LittleEndian, uint16(42))
+	binary.Write(buf, binary.LittleEndian, uint32(headerSize))
+
+	overflow := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(buf, binary.LittleEndian, e.tag)
+		binary.Write(buf, binary.LittleEndian, e.kind)
+		binary.Write(buf, binary.LittleEndian, e.count)
+		if len(e.value) <= 4 {
+			val := [4]byte{}
+			copy(val[:], e.value)
+			buf.Write(val[:])
+			continue
+		}
+		binary.Write(buf, binary.LittleEndian, uint32(overflowOffset+overflow.Len()))
+		overflow.Write(e.value)
+		if len(e.value)%2 != 0 {
+			// Values have to start on word boundaries.
+			overflow.WriteByte(0)
+		}
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(0))
+
+	buf.Write(overflow.Bytes())
+	buf.Write(pixels.Bytes())
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("while writing DNG: %w", err)
+	}
+	return nil
+}
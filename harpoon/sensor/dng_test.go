@@ -0,0 +1,88 @@
+package sensor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// readIFD reads the first image file directory of a little-endian TIFF, as a
+// map from tag to the entry's raw value.
+func readIFD(t *testing.T, data []byte) map[uint16][]byte {
+	t.Helper()
+
+	if string(data[:2]) != "II" || binary.LittleEndian.Uint16(data[2:]) != 42 {
+		t.Fatalf("not a little-endian TIFF: % x", data[:4])
+	}
+
+	sizes := map[uint16]int{tiffByte: 1, tiffASCII: 1, tiffShort: 2, tiffLong: 4, tiffRational: 8, tiffSRational: 8}
+
+	result := map[uint16][]byte{}
+	offset := binary.LittleEndian.Uint32(data[4:])
+	count := int(binary.LittleEndian.Uint16(data[offset:]))
+	lastTag := uint16(0)
+	for i := 0; i < count; i++ {
+		entry := data[int(offset)+2+12*i:]
+		tag := binary.LittleEndian.Uint16(entry)
+		if tag <= lastTag {
+			t.Errorf("tag %d follows tag %d; tags must be in ascending order", tag, lastTag)
+		}
+		lastTag = tag
+
+		size := sizes[binary.LittleEndian.Uint16(entry[2:])] * int(binary.LittleEndian.Uint32(entry[4:]))
+		if size <= 4 {
+			result[tag] = entry[8 : 8+size]
+		} else {
+			at := binary.LittleEndian.Uint32(entry[8:])
+			if at%2 != 0 {
+				t.Errorf("tag %d's value is at odd offset %d", tag, at)
+			}
+			result[tag] = data[at : int(at)+size]
+		}
+	}
+	return result
+}
+
+func TestWriteDNG(t *testing.T) {
+	s, _ := Builtin("generic-cmos")
+	m := &Mosaic{
+		Rows:     2,
+		Cols:     3,
+		Values:   []uint16{512, 600, 700, 800, 900, 16383},
+		Sensor:   s,
+		Exposure: Exposure{ISO: 400, ShutterSeconds: 1.0 / 125, FNumber: 2.8},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteDNG(m, buf); err != nil {
+		t.Fatalf("WriteDNG: %v", err)
+	}
+	data := buf.Bytes()
+	ifd := readIFD(t, data)
+
+	if got := binary.LittleEndian.Uint32(ifd[256]); got != 3 {
+		t.Errorf("ImageWidth is %d, want 3", got)
+	}
+	if got := binary.LittleEndian.Uint32(ifd[257]); got != 2 {
+		t.Errorf("ImageLength is %d, want 2", got)
+	}
+	if got := binary.LittleEndian.Uint16(ifd[262]); got != 32803 {
+		t.Errorf("PhotometricInterpretation is %d, want CFA", got)
+	}
+	if got := ifd[33422]; !bytes.Equal(got, []byte{0, 1, 1, 2}) {
+		t.Errorf("CFAPattern is %v, want RGGB", got)
+	}
+	if got := binary.LittleEndian.Uint32(ifd[50717]); got != 16383 {
+		t.Errorf("WhiteLevel is %d, want 16383", got)
+	}
+	if _, ok := ifd[50721]; !ok {
+		t.Errorf("no ColorMatrix1")
+	}
+
+	strip := binary.LittleEndian.Uint32(ifd[273])
+	for i, want := range m.Values {
+		if got := binary.LittleEndian.Uint16(data[int(strip)+2*i:]); got != want {
+			t.Errorf("pixel %d is %d, want %d", i, got, want)
+		}
+	}
+}
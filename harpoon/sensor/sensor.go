@@ -0,0 +1,431 @@
+// Package sensor simulates a digital camera's image sensor looking at a
+// spectral image: the spectral sensitivities of its color filters, the
+// exposure, shot and read noise, and quantization into a raw Bayer mosaic.
+//
+// The bundled sensors are stylized, not measured from any camera.  To
+// simulate a particular camera, load its measured sensitivities with
+// LoadProfileFile, and for an accurate DNG color matrix, its calibration
+// target's measured reflectances with densesignal.LoadColorCheckerFile.
+package sensor
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"row-major/harpoon/densesignal"
+	"row-major/harpoon/spectralimage"
+	"row-major/harpoon/vmath/mat33"
+	"row-major/harpoon/vmath/vec3"
+)
+
+const (
+	planck = 6.62607015e-34
+	lightC = 299792458.0
+)
+
+// Sensor describes an image sensor: the color filter array over it, and the
+// electronics that turn the light it collects into numbers.
+type Sensor struct {
+	Name string
+
+	// The quantum efficiency of the red, green, and blue photosites: the
+	// fraction of photons at each wavelength (in nm) that become electrons.
+	Sensitivities [3]*densesignal.DenseSignal
+
+	// The layout of a 2x2 tile of the color filter array, row by row, as
+	// indices into Sensitivities.  {0, 1, 1, 2} is RGGB.
+	CFA [4]int
+
+	// The width of a photosite, in meters.
+	PixelPitch float64
+
+	// The most electrons a photosite can hold.
+	FullWell float64
+
+	// The RMS noise added when a photosite is read, in electrons.
+	ReadNoise float64
+
+	// The ISO at which a full photosite reads as WhiteLevel.
+	BaseISO float64
+
+	// The raw values are BitDepth bits, offset by BlackLevel.
+	BitDepth   int
+	BlackLevel int
+
+	// The reflectances that ColorMatrix is fit over.  If nil, it uses
+	// densesignal.ColorCheckerFromSRGB.
+	CalibrationPatches []*densesignal.DenseSignal
+}
+
+// WhiteLevel is the largest raw value.
+func (s *Sensor) WhiteLevel() int {
+	return 1<<s.BitDepth - 1
+}
+
+// gain is the number of raw units per electron at the given ISO.
+func (s *Sensor) gain(iso float64) float64 {
+	return float64(s.WhiteLevel()-s.BlackLevel) / s.FullWell * iso / s.BaseISO
+}
+
+// Exposure is how the camera is set for a shot.
+type Exposure struct {
+	ISO            float64
+	ShutterSeconds float64
+	FNumber        float64
+
+	// RadianceScale converts the power densities of the spectral image into
+	// spectral radiance, in W / (sr m^2 nm).  If zero, they're taken to be
+	// spectral radiance already.
+	RadianceScale float64
+}
+
+// photonFactor is the number of photons reaching each photosite per unit of
+// spectral radiance, per nm, per nm of wavelength: the optics and the
+// exposure, but not the sensitivity.
+func (s *Sensor) photonFactor(exp Exposure) float64 {
+	scale := exp.RadianceScale
+	if scale == 0 {
+		scale = 1
+	}
+
+	// On axis, a lens at f-number N turns radiance L into irradiance
+	// L * pi / (4 N^2) on the sensor.
+	irradiance := scale * math.Pi / (4 * exp.FNumber * exp.FNumber)
+	energy := irradiance * s.PixelPitch * s.PixelPitch * exp.ShutterSeconds
+
+	// Each photon of wavelength lambda carries h c / lambda.
+	return energy * 1e-9 / (planck * lightC)
+}
+
+// binWeights are the electrons per photon factor for each channel and
+// wavelength bin of img: the integral of quantum efficiency times
+// wavelength over the bin.
+func (s *Sensor) binWeights(img *spectralimage.SpectralImage) [3][]float64 {
+	weights := [3][]float64{}
+	for ch := range weights {
+		weights[ch] = make([]float64, img.WavelengthSize)
+		for w := range weights[ch] {
+			lo, hi := img.WavelengthBin(w)
+			weights[ch][w] = float64(s.Sensitivities[ch].Integrate(lo, hi)) * float64(lo+hi) / 2
+		}
+	}
+	return weights
+}
+
+// Mosaic is a raw image from a sensor with a color filter array: a single
+// value per photosite.
+type Mosaic struct {
+	Rows, Cols int
+
+	// Values, row by row, including the sensor's black level.
+	Values []uint16
+
+	Sensor   *Sensor
+	Exposure Exposure
+}
+
+// meanElectrons is the expected number of electrons collected by each
+// photosite of the sensor, in the same layout as Mosaic.Values.
+func (s *Sensor) meanElectrons(img *spectralimage.SpectralImage, exp Exposure) []float64 {
+	weights := s.binWeights(img)
+	factor := s.photonFactor(exp)
+
+	result := make([]float64, img.RowSize*img.ColSize)
+	for r := 0; r < img.RowSize; r++ {
+		for c := 0; c < img.ColSize; c++ {
+			ch := s.CFA[(r%2)*2+c%2]
+			total := 0.0
+			for w := 0; w < img.WavelengthSize; w++ {
+				samp := img.ReadSample(r, c, w)
+				if samp.PowerDensityCount == 0 {
+					continue
+				}
+				total += float64(samp.PowerDensitySum/samp.PowerDensityCount) * weights[ch][w]
+			}
+			result[r*img.ColSize+c] = total * factor
+		}
+	}
+	return result
+}
+
+// Expose simulates taking a picture of img.  Photon arrival (shot noise) and
+// readout (read noise) are random, drawn from rng; if rng is nil, the mosaic
+// has no noise.
+func (s *Sensor) Expose(img *spectralimage.SpectralImage, exp Exposure, rng *rand.Rand) *Mosaic {
+	electrons := s.meanElectrons(img, exp)
+	gain := s.gain(exp.ISO)
+
+	m := &Mosaic{
+		Rows:     img.RowSize,
+		Cols:     img.ColSize,
+		Values:   make([]uint16, len(electrons)),
+		Sensor:   s,
+		Exposure: exp,
+	}
+	for i, e := range electrons {
+		if rng != nil {
+			e = poisson(rng, e)
+		}
+		e = math.Min(e, s.FullWell)
+
+		v := e * gain
+		if rng != nil {
+			v += s.ReadNoise * gain * rng.NormFloat64()
+		}
+		v = math.Round(v) + float64(s.BlackLevel)
+		m.Values[i] = uint16(math.Max(0, math.Min(float64(s.WhiteLevel()), v)))
+	}
+	return m
+}
+
+// AutoShutter picks a shutter time for exp that puts the brightest highlights
+// of img (ignoring the brightest 0.1% of photosites) at 80% of the sensor's
+// full well.
+func (s *Sensor) AutoShutter(img *spectralimage.SpectralImage, exp Exposure) float64 {
+	exp.ShutterSeconds = 1
+	electrons := s.meanElectrons(img, exp)
+	sort.Float64s(electrons)
+
+	highlight := electrons[int(0.999*float64(len(electrons)-1))]
+	if highlight <= 0 {
+		return 1
+	}
+	return 0.8 * s.FullWell / highlight
+}
+
+// poisson draws a Poisson-distributed count with the given mean.
+func poisson(rng *rand.Rand, mean float64) float64 {
+	if mean <= 0 {
+		return 0
+	}
+	if mean > 64 {
+		// Close enough to normal, and much faster to draw.
+		return math.Max(0, math.Round(mean+math.Sqrt(mean)*rng.NormFloat64()))
+	}
+
+	limit := math.Exp(-mean)
+	count := 0.0
+	for p := rng.Float64(); p > limit; p *= rng.Float64() {
+		count++
+	}
+	return count
+}
+
+// response is the relative number of electrons each channel collects from a
+// spectral radiance.
+func (s *Sensor) response(radiance *densesignal.DenseSignal) vec3.T {
+	result := vec3.T{}
+	step := radiance.StepX()
+	for i, l := range radiance.Samples {
+		lambda := radiance.SrcX + (float32(i)+0.5)*step
+		for ch := 0; ch < 3; ch++ {
+			result[ch] += float64(l*s.Sensitivities[ch].Interpolate(lambda)*lambda*step) * 1e-9 / (planck * lightC)
+		}
+	}
+	return result
+}
+
+// ColorMatrix maps CIE XYZ to the sensor's raw red, green, and blue, as DNG's
+// ColorMatrix1 tag does.  It's the least-squares fit over CalibrationPatches
+// under D65, scaled so that D65 white's largest channel is 1.
+func (s *Sensor) ColorMatrix() mat33.T {
+	d65 := densesignal.CIED65()
+
+	patches := s.CalibrationPatches
+	if patches == nil {
+		patches = densesignal.ColorCheckerFromSRGB()
+	}
+
+	// Accumulate the normal equations of camera = M xyz.
+	xx := mat33.T{}
+	cx := mat33.T{}
+	for _, patch := range patches {
+		lit := &densesignal.DenseSignal{SrcX: d65.SrcX, LimX: d65.LimX, Samples: make([]float32, len(d65.Samples))}
+		for i := range lit.Samples {
+			lambda := d65.SrcX + (float32(i)+0.5)*d65.StepX()
+			lit.Samples[i] = d65.Samples[i] * patch.Interpolate(lambda)
+		}
+
+		x, y, z := densesignal.XYZ(lit)
+		xyz := vec3.T{x, y, z}
+		cam := s.response(lit)
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				xx[i*3+j] += xyz[i] * xyz[j]
+				cx[i*3+j] += cam[i] * xyz[j]
+			}
+		}
+	}
+	m := mat33.MulMM(cx, mat33.Inverse(xx))
+
+	x, y, z := densesignal.XYZ(d65)
+	white := mat33.MulMV(m, vec3.T{x / y, 1, z / y})
+	scale := math.Max(white[0], math.Max(white[1], white[2]))
+	for i := range m {
+		m[i] /= scale
+	}
+	return m
+}
+
+// Neutral is the sensor's raw response to D65 white, with its largest channel
+// scaled to 1, as DNG's AsShotNeutral tag expects.
+func (s *Sensor) Neutral() vec3.T {
+	n := s.response(densesignal.CIED65())
+	return vec3.DivVS(n, math.Max(n[0], math.Max(n[1], n[2])))
+}
+
+// newSensor makes a sensor with typical electronics for a modern CMOS sensor
+// with 4.3 micron photosites, and the given sensitivities.
+func newSensor(name string, sensitivities [3]*densesignal.DenseSignal) *Sensor {
+	return &Sensor{
+		Name:          name,
+		Sensitivities: sensitivities,
+		CFA:           [4]int{0, 1, 1, 2},
+		PixelPitch:    4.3e-6,
+		FullWell:      40000,
+		ReadNoise:     3,
+		BaseISO:       100,
+		BitDepth:      14,
+		BlackLevel:    512,
+	}
+}
+
+// sampledSensitivity samples f every 5 nm from 380 to 1000 nm.
+func sampledSensitivity(f func(lambda float64) float64) *densesignal.DenseSignal {
+	d := &densesignal.DenseSignal{SrcX: 380, LimX: 1000, Samples: make([]float32, 124)}
+	for i := range d.Samples {
+		d.Samples[i] = float32(f(float64(d.SrcX) + (float64(i)+0.5)*float64(d.StepX())))
+	}
+	return d
+}
+
+func gaussian(lambda, center, width float64) float64 {
+	return math.Exp(-0.5 * math.Pow((lambda-center)/width, 2))
+}
+
+func logistic(lambda, edge, width float64) float64 {
+	return 1 / (1 + math.Exp(-(lambda-edge)/width))
+}
+
+// bayerSensitivities are stylized silicon photosites under dyed red, green,
+// and blue filters.  The dyes all turn transparent in the near infrared, so
+// without an infrared-cut filter every channel sees it.
+func bayerSensitivities(irCut bool) [3]*densesignal.DenseSignal {
+	silicon := func(lambda float64) float64 {
+		return 0.6 * gaussian(lambda, 580, 190)
+	}
+	filter := func(lambda float64) float64 {
+		if !irCut {
+			return 1
+		}
+		return 1 - logistic(lambda, 655, 12)
+	}
+	infrared := func(lambda float64) float64 {
+		return 0.9 * logistic(lambda, 800, 20)
+	}
+
+	return [3]*densesignal.DenseSignal{
+		sampledSensitivity(func(lambda float64) float64 {
+			return silicon(lambda) * filter(lambda) * 0.9 * logistic(lambda, 585, 15)
+		}),
+		sampledSensitivity(func(lambda float64) float64 {
+			return silicon(lambda) * filter(lambda) * math.Min(1, 0.9*gaussian(lambda, 535, 40)+infrared(lambda))
+		}),
+		sampledSensitivity(func(lambda float64) float64 {
+			return silicon(lambda) * filter(lambda) * math.Min(1, 0.9*gaussian(lambda, 455, 35)+infrared(lambda))
+		}),
+	}
+}
+
+// builtins are the bundled sensors.  They're stylized rather than measured:
+// for a particular camera, load its measured sensitivities with
+// LoadProfileFile.
+var builtins = map[string]func() *Sensor{
+	// A typical consumer camera, with an infrared-cut filter.
+	"generic-cmos": func() *Sensor {
+		return newSensor("generic-cmos", bayerSensitivities(true))
+	},
+
+	// The same sensor with its infrared-cut filter removed, as in cameras
+	// converted for astrophotography or infrared work.
+	"full-spectrum": func() *Sensor {
+		return newSensor("full-spectrum", bayerSensitivities(false))
+	},
+
+	// An ideal colorimetric sensor whose filters follow the CIE 2006 color
+	// matching functions, for comparison with the CIE observer.
+	"cie-2006-xyz": func() *Sensor {
+		cmfs := [3]*densesignal.DenseSignal{densesignal.CIE2006X(), densesignal.CIE2006Y(), densesignal.CIE2006Z()}
+		for _, cmf := range cmfs {
+			// The Z function peaks near 1.8; keep it a plausible
+			// quantum efficiency.
+			cmf.MulS(0.25)
+		}
+		return newSensor("cie-2006-xyz", cmfs)
+	},
+}
+
+// BuiltinNames lists the bundled sensors.
+func BuiltinNames() []string {
+	names := []string{}
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Builtin returns the bundled sensor with the given name.
+func Builtin(name string) (*Sensor, bool) {
+	f, ok := builtins[name]
+	if !ok {
+		return nil, false
+	}
+	return f(), true
+}
+
+// ReadProfile reads a sensor's spectral sensitivities from a table of
+// (wavelength, red, green, blue) rows, in any format densesignal.
+// ReadTabulatedColumns accepts.  The values are quantum efficiencies; curves
+// normalized to peak at 1 make an unrealistically efficient sensor, which
+// only changes how much exposure it needs.
+//
+// The rest of the sensor is given typical values, which can be changed
+// afterwards.
+func ReadProfile(r io.Reader, name string) (*Sensor, error) {
+	sigs, err := densesignal.ReadTabulatedColumns(r, 3)
+	if err != nil {
+		return nil, err
+	}
+	for ch, sig := range sigs {
+		for _, v := range sig.Samples {
+			if v < 0 {
+				return nil, fmt.Errorf("channel %d has negative sensitivity %v", ch, v)
+			}
+		}
+	}
+	return newSensor(name, [3]*densesignal.DenseSignal{sigs[0], sigs[1], sigs[2]}), nil
+}
+
+// LoadProfileFile reads a sensor's spectral sensitivities from a file, as
+// ReadProfile does.  The sensor is named after the file.
+func LoadProfileFile(path string) (*Sensor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("while opening file: %w", err)
+	}
+	defer f.Close()
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	s, err := ReadProfile(f, name)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s: %w", path, err)
+	}
+	return s, nil
+}
@@ -0,0 +1,173 @@
+package sensor
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"row-major/harpoon/densesignal"
+	"row-major/harpoon/spectralimage"
+	"row-major/harpoon/vmath/mat33"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// flatImage is an image of constant spectral radiance.
+func flatImage(rows, cols int, radiance float32) *spectralimage.SpectralImage {
+	img := &spectralimage.SpectralImage{WavelengthMin: 400, WavelengthMax: 700}
+	img.Resize(rows, cols, 10)
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			for w := 0; w < 10; w++ {
+				img.RecordSample(r, c, w, radiance)
+			}
+		}
+	}
+	return img
+}
+
+// flatSensor has the same quantum efficiency at every wavelength, in every
+// channel, which makes its response easy to work out by hand.
+func flatSensor(qe float32) *Sensor {
+	flat := &densesignal.DenseSignal{SrcX: 300, LimX: 1000, Samples: []float32{qe}}
+	return newSensor("flat", [3]*densesignal.DenseSignal{flat, flat, flat})
+}
+
+func TestExposeNoiseless(t *testing.T) {
+	s := flatSensor(0.5)
+	exp := Exposure{ISO: 100, ShutterSeconds: 0.01, FNumber: 4}
+
+	// Photons: radiance * pi / (4 N^2) * pitch^2 * t * lambda / (h c), over
+	// 400 to 700 nm.  The integral of lambda is (700^2 - 400^2) / 2.
+	const radiance = 1e-3
+	photons := radiance * math.Pi / 64 * 4.3e-6 * 4.3e-6 * 0.01 * (700*700 - 400*400) / 2 * 1e-9 / (planck * lightC)
+	wantDN := math.Round(0.5*photons*float64(s.WhiteLevel()-s.BlackLevel)/s.FullWell) + float64(s.BlackLevel)
+
+	m := s.Expose(flatImage(2, 2, radiance), exp, nil)
+	for i, v := range m.Values {
+		if math.Abs(float64(v)-wantDN) > 1 {
+			t.Errorf("photosite %d: got %v, want %v", i, v, wantDN)
+		}
+	}
+
+	// Doubling the ISO doubles the signal above black.
+	exp.ISO = 200
+	m2 := s.Expose(flatImage(2, 2, radiance), exp, nil)
+	if got, want := float64(m2.Values[0])-float64(s.BlackLevel), 2*(wantDN-float64(s.BlackLevel)); math.Abs(got-want) > 2 {
+		t.Errorf("at ISO 200, got %v above black, want %v", got, want)
+	}
+
+	// Too much light clips at the white level.
+	exp.ShutterSeconds = 100
+	for i, v := range s.Expose(flatImage(2, 2, radiance), exp, nil).Values {
+		if int(v) != s.WhiteLevel() {
+			t.Errorf("overexposed photosite %d: got %v, want %v", i, v, s.WhiteLevel())
+		}
+	}
+}
+
+func TestExposeNoise(t *testing.T) {
+	s := flatSensor(0.5)
+	s.ReadNoise = 0
+	exp := Exposure{ISO: 100, FNumber: 4}
+	img := flatImage(64, 64, 1e-3)
+	exp.ShutterSeconds = s.AutoShutter(img, exp) / 8
+
+	mean := s.meanElectrons(img, exp)[0]
+	gain := s.gain(exp.ISO)
+
+	m := s.Expose(img, exp, rand.New(rand.NewSource(1)))
+	sum, sumSq := 0.0, 0.0
+	for _, v := range m.Values {
+		e := (float64(v) - float64(s.BlackLevel)) / gain
+		sum += e
+		sumSq += e * e
+	}
+	n := float64(len(m.Values))
+	gotMean := sum / n
+	gotVar := sumSq/n - gotMean*gotMean
+
+	// Shot noise has a variance equal to its mean.
+	if math.Abs(gotMean-mean)/mean > 0.01 {
+		t.Errorf("got mean %v electrons, want %v", gotMean, mean)
+	}
+	if math.Abs(gotVar-mean)/mean > 0.1 {
+		t.Errorf("got variance %v electrons^2, want %v", gotVar, mean)
+	}
+}
+
+func TestAutoShutter(t *testing.T) {
+	s := flatSensor(0.5)
+	exp := Exposure{ISO: 100, FNumber: 8}
+	img := flatImage(4, 4, 1e-3)
+	exp.ShutterSeconds = s.AutoShutter(img, exp)
+	if got, want := s.meanElectrons(img, exp)[0], 0.8*s.FullWell; math.Abs(got-want)/want > 1e-9 {
+		t.Errorf("auto exposure collects %v electrons, want %v", got, want)
+	}
+}
+
+func TestColorMatrix(t *testing.T) {
+	for _, name := range BuiltinNames() {
+		s, _ := Builtin(name)
+
+		// The matrix takes D65 white to the sensor's neutral.
+		d65 := densesignal.CIED65()
+		x, y, z := densesignal.XYZ(d65)
+		got := mat33.MulMV(s.ColorMatrix(), vec3.T{x / y, 1, z / y})
+		if want := s.Neutral(); vec3.SubVV(got, want).Norm() > 0.03 {
+			t.Errorf("%s: color matrix takes D65 to %v, but its neutral is %v", name, got, want)
+		}
+	}
+}
+
+func TestColorMatrixCalibrationPatches(t *testing.T) {
+	s, _ := Builtin("generic-cmos")
+	def := s.ColorMatrix()
+
+	// The default patches, given explicitly, fit the same matrix.
+	s.CalibrationPatches = densesignal.ColorCheckerFromSRGB()
+	if got := s.ColorMatrix(); got != def {
+		t.Errorf("with the default patches, got color matrix %v, want %v", got, def)
+	}
+
+	// Other patches fit a different one.
+	s.CalibrationPatches = s.CalibrationPatches[:18]
+	if got := s.ColorMatrix(); got == def {
+		t.Errorf("with only the chromatic patches, got the default color matrix %v", got)
+	}
+}
+
+func TestInfraredCut(t *testing.T) {
+	cut, _ := Builtin("generic-cmos")
+	full, _ := Builtin("full-spectrum")
+	for ch := 0; ch < 3; ch++ {
+		if got := cut.Sensitivities[ch].Interpolate(850); got > 0.01 {
+			t.Errorf("generic-cmos channel %d has sensitivity %v at 850 nm", ch, got)
+		}
+		if got := full.Sensitivities[ch].Interpolate(850); got < 0.1 {
+			t.Errorf("full-spectrum channel %d has sensitivity %v at 850 nm", ch, got)
+		}
+	}
+}
+
+func TestReadProfile(t *testing.T) {
+	in := `wavelength,r,g,b
+400,0.0,0.1,0.4
+500,0.1,0.4,0.2
+600,0.5,0.2,0.0
+`
+	s, err := ReadProfile(strings.NewReader(in), "test")
+	if err != nil {
+		t.Fatalf("ReadProfile: %v", err)
+	}
+	if got := s.Sensitivities[2].Interpolate(400); got != 0.4 {
+		t.Errorf("blue sensitivity at 400 nm is %v, want 0.4", got)
+	}
+	if got := s.Sensitivities[0].Interpolate(600); got != 0.5 {
+		t.Errorf("red sensitivity at 600 nm is %v, want 0.5", got)
+	}
+
+	if _, err := ReadProfile(strings.NewReader("400,0.1,0.2\n500,0.1,0.2\n"), "short"); err == nil {
+		t.Errorf("ReadProfile accepted a table with only two channels")
+	}
+}
@@ -112,3 +112,9 @@ func Inverse(m T) T {
 	SolveInplace(&m, &a)
 	return a
 }
+
+func Determinant(m T) float64 {
+	return m[0]*(m[4]*m[8]-m[5]*m[7]) -
+		m[1]*(m[3]*m[8]-m[5]*m[6]) +
+		m[2]*(m[3]*m[7]-m[4]*m[6])
+}
@@ -109,10 +109,9 @@ func CosineUnitVec3Distribution(normal T, rng *rand.Rand) T {
 			candidate[2] = -candidate[2]
 		}
 
-		// TODO: Shouldn't it be fine to use a rejection sample from [0.0, 1.0)?
-		// We know cosine is always nonnegative.
-		rejectionSample := rng.Float64()*2.0 - 1.0
-		if rejectionSample >= cosine {
+		// Accept with probability proportional to the cosine.
+		rejectionSample := rng.Float64()
+		if rejectionSample < cosine {
 			return candidate
 		}
 	}
@@ -159,3 +158,15 @@ func GaussianUnitVec3Distribution(normal T, mid float64, rng *rand.Rand) T {
 	// Dead code.
 	return T{0, 0, 0}
 }
+
+// OrthonormalBasis returns two unit vectors that, along with the unit vector n,
+// form a right-handed orthonormal basis.
+func OrthonormalBasis(n T) (T, T) {
+	a := T{1, 0, 0}
+	if math.Abs(n[0]) > 0.9 {
+		a = T{0, 1, 0}
+	}
+	u := Normalize(CProd(a, n))
+	v := CProd(n, u)
+	return u, v
+}
@@ -0,0 +1,89 @@
+// Package vec3soa holds groups of 3-vectors in struct-of-arrays form, with
+// float32 components.
+//
+// Keeping each component of a group in its own array lets code that works on
+// the whole group (like testing a packet of rays against a box) run as simple
+// loops over contiguous float32s, without chasing pointers or converting
+// between layouts.
+package vec3soa
+
+import "row-major/harpoon/vmath/vec3"
+
+// Width is the number of vectors in a group.
+const Width = 8
+
+type T struct {
+	X, Y, Z [Width]float32
+}
+
+// Set stores v as the i'th vector of the group.
+func (t *T) Set(i int, v vec3.T) {
+	t.X[i] = float32(v[0])
+	t.Y[i] = float32(v[1])
+	t.Z[i] = float32(v[2])
+}
+
+// Get returns the i'th vector of the group.
+func (t *T) Get(i int) vec3.T {
+	return vec3.T{float64(t.X[i]), float64(t.Y[i]), float64(t.Z[i])}
+}
+
+// Splat returns a group where every vector is v.
+func Splat(v vec3.T) T {
+	result := T{}
+	for i := 0; i < Width; i++ {
+		result.Set(i, v)
+	}
+	return result
+}
+
+func AddVV(a, b *T) T {
+	result := T{}
+	for i := 0; i < Width; i++ {
+		result.X[i] = a.X[i] + b.X[i]
+		result.Y[i] = a.Y[i] + b.Y[i]
+		result.Z[i] = a.Z[i] + b.Z[i]
+	}
+	return result
+}
+
+func SubVV(a, b *T) T {
+	result := T{}
+	for i := 0; i < Width; i++ {
+		result.X[i] = a.X[i] - b.X[i]
+		result.Y[i] = a.Y[i] - b.Y[i]
+		result.Z[i] = a.Z[i] - b.Z[i]
+	}
+	return result
+}
+
+// MulVV multiplies a and b componentwise.
+func MulVV(a, b *T) T {
+	result := T{}
+	for i := 0; i < Width; i++ {
+		result.X[i] = a.X[i] * b.X[i]
+		result.Y[i] = a.Y[i] * b.Y[i]
+		result.Z[i] = a.Z[i] * b.Z[i]
+	}
+	return result
+}
+
+func IProd(a, b *T) [Width]float32 {
+	result := [Width]float32{}
+	for i := 0; i < Width; i++ {
+		result[i] = a.X[i]*b.X[i] + a.Y[i]*b.Y[i] + a.Z[i]*b.Z[i]
+	}
+	return result
+}
+
+// Reciprocal returns the componentwise reciprocal of a.  Zero components
+// become infinities.
+func Reciprocal(a *T) T {
+	result := T{}
+	for i := 0; i < Width; i++ {
+		result.X[i] = 1 / a.X[i]
+		result.Y[i] = 1 / a.Y[i]
+		result.Z[i] = 1 / a.Z[i]
+	}
+	return result
+}
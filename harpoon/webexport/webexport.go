@@ -0,0 +1,312 @@
+// Package webexport converts harpoon scenes into a JSON scene description for
+// the browser-side previewer in webalator's webgl-raytracer article.
+//
+// The previewer is a quick, RGB, direct-lighting approximation meant for
+// framing cameras, so the export only keeps what it needs to draw something
+// recognizable: the camera, the layout of the elements, and a representative
+// color for each material.  Anything it can't represent is approximated, and
+// listed in the description's warnings.
+package webexport
+
+import (
+	"fmt"
+	"math"
+
+	"row-major/harpoon/affinetransform"
+	"row-major/harpoon/camera"
+	"row-major/harpoon/geometry"
+	"row-major/harpoon/light"
+	"row-major/harpoon/material"
+	"row-major/harpoon/scene"
+	"row-major/harpoon/vmath/vec2"
+	"row-major/harpoon/vmath/vec3"
+)
+
+// Scene is the JSON scene description.
+type Scene struct {
+	// Camera is the scene's first camera, or nil if it doesn't have one that
+	// the previewer can represent.
+	Camera *Camera `json:"camera,omitempty"`
+
+	Materials        []Material `json:"materials"`
+	InfinityMaterial int        `json:"infinity_material"`
+
+	Elements []Element `json:"elements"`
+	Lights   []Light   `json:"lights"`
+
+	// Warnings lists the parts of the scene that the description only
+	// approximates.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Camera is a pinhole camera, in the same form as camera.PinholeCamera: rays
+// leave Center, through the aperture spanned by Eye, Left, and Up, scaled by
+// Aperture.
+type Camera struct {
+	Center   [3]float64 `json:"center"`
+	Eye      [3]float64 `json:"eye"`
+	Left     [3]float64 `json:"left"`
+	Up       [3]float64 `json:"up"`
+	Aperture [3]float64 `json:"aperture"`
+}
+
+// Material kinds.
+const (
+	KindEmitter = "emitter"
+	KindDiffuse = "diffuse"
+	KindGlass   = "glass"
+	KindMirror  = "mirror"
+	KindRough   = "rough"
+	KindUnknown = "unknown"
+)
+
+// Material is a material's kind, and an RGB color representative of it, with
+// components in [0, 1].  Emitters' colors are normalized so that their
+// brightest component is 1.
+type Material struct {
+	Kind  string     `json:"kind"`
+	Color [3]float64 `json:"color"`
+}
+
+// Geometry kinds.
+const (
+	// GeometrySphere is the unit sphere.
+	GeometrySphere = "sphere"
+
+	// GeometryBox is the box between Lo and Hi.
+	GeometryBox = "box"
+
+	// GeometryBounds stands in for geometry the previewer can't draw, with
+	// its bounding box between Lo and Hi.
+	GeometryBounds = "bounds"
+)
+
+// Geometry describes an element's shape, in model space.
+type Geometry struct {
+	Kind string      `json:"kind"`
+	Lo   *[3]float64 `json:"lo,omitempty"`
+	Hi   *[3]float64 `json:"hi,omitempty"`
+}
+
+// Transform is an affine transform.  Linear is in row-major order.
+type Transform struct {
+	Linear [9]float64 `json:"linear"`
+	Offset [3]float64 `json:"offset"`
+}
+
+// Element is an instance of a geometry in the scene.  Both directions of its
+// transform are included, since inverting matrices is awkward in shaders.
+type Element struct {
+	Geometry     Geometry  `json:"geometry"`
+	Material     int       `json:"material"`
+	ModelToWorld Transform `json:"model_to_world"`
+	WorldToModel Transform `json:"world_to_model"`
+}
+
+// Light kinds.
+const (
+	LightSpot = "spot"
+	LightRect = "rect"
+)
+
+// Light is a light source, reduced to a point at Position, with a color
+// normalized like an emitter's.
+type Light struct {
+	Kind     string     `json:"kind"`
+	Position [3]float64 `json:"position"`
+	Color    [3]float64 `json:"color"`
+}
+
+// previewFreqs are the wavelengths, in nanometers, sampled for the red, green,
+// and blue components of preview colors.
+var previewFreqs = [3]float32{610, 550, 465}
+
+type exporter struct {
+	out *Scene
+}
+
+func (e *exporter) warnf(format string, args ...interface{}) {
+	e.out.Warnings = append(e.out.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Export describes s for the previewer.  The scene doesn't need to be
+// crushed.
+func Export(s *scene.Scene) *Scene {
+	e := &exporter{
+		out: &Scene{
+			Materials:        []Material{},
+			InfinityMaterial: s.InfinityMaterialIndex,
+			Elements:         []Element{},
+			Lights:           []Light{},
+		},
+	}
+
+	e.exportCamera(s)
+	for i, m := range s.Materials {
+		e.out.Materials = append(e.out.Materials, e.exportMaterial(i, m))
+	}
+	for i, elt := range s.Elements {
+		e.out.Elements = append(e.out.Elements, e.exportElement(i, elt, s.Geometries[elt.GeometryIndex]))
+	}
+	for i, l := range s.Lights {
+		if exported, ok := e.exportLight(i, l); ok {
+			e.out.Lights = append(e.out.Lights, exported)
+		}
+	}
+
+	return e.out
+}
+
+func (e *exporter) exportCamera(s *scene.Scene) {
+	if len(s.Cameras) == 0 {
+		e.warnf("no cameras")
+		return
+	}
+	if len(s.Cameras) > 1 {
+		e.warnf("scene has %d cameras; only the first was exported", len(s.Cameras))
+	}
+
+	cam, ok := s.Cameras[0].(*camera.PinholeCamera)
+	if !ok {
+		e.warnf("camera 0: %T is not supported", s.Cameras[0])
+		return
+	}
+
+	e.out.Camera = &Camera{
+		Center:   cam.Center,
+		Eye:      cam.Eye(),
+		Left:     cam.Left(),
+		Up:       cam.Up(),
+		Aperture: cam.Aperture,
+	}
+}
+
+// sampleRGB evaluates m at the preview wavelengths, at the origin of material
+// coordinates.
+func sampleRGB(m material.MaterialMap) [3]float64 {
+	result := [3]float64{}
+	for i, freq := range previewFreqs {
+		result[i] = m(material.MaterialCoords{
+			Mtl2: vec2.T{0, 0},
+			Mtl3: vec3.T{0, 0, 0},
+			Freq: freq,
+		})
+	}
+	return result
+}
+
+// reflectanceRGB is sampleRGB, clamped to [0, 1].
+func reflectanceRGB(m material.MaterialMap) [3]float64 {
+	result := sampleRGB(m)
+	for i, v := range result {
+		if math.IsNaN(v) {
+			v = 0
+		}
+		result[i] = math.Max(0, math.Min(1, v))
+	}
+	return result
+}
+
+// emissionRGB is sampleRGB, normalized so that its brightest component is 1.
+func emissionRGB(m material.MaterialMap) [3]float64 {
+	result := sampleRGB(m)
+	max := 0.0
+	for _, v := range result {
+		if v > max {
+			max = v
+		}
+	}
+	if max == 0 || math.IsInf(max, 0) {
+		return [3]float64{0, 0, 0}
+	}
+	for i, v := range result {
+		result[i] = math.Max(0, v/max)
+	}
+	return result
+}
+
+func (e *exporter) exportMaterial(index int, m material.Material) Material {
+	switch m := m.(type) {
+	case *material.Emitter:
+		return Material{Kind: KindEmitter, Color: emissionRGB(m.Emissivity)}
+	case *material.DirectionalEmitter:
+		return Material{Kind: KindEmitter, Color: emissionRGB(m.Emissivity)}
+	case *material.MonteCarloLambert:
+		return Material{Kind: KindDiffuse, Color: reflectanceRGB(m.Reflectance)}
+	case *material.Fluorescent:
+		e.warnf("material %d: fluorescence ignored", index)
+		return Material{Kind: KindDiffuse, Color: reflectanceRGB(m.Reflectance)}
+	case *material.PerfectlyConductiveSmooth:
+		return Material{Kind: KindMirror, Color: reflectanceRGB(m.Reflectance)}
+	case *material.NonConductiveSmooth:
+		return Material{Kind: KindGlass, Color: [3]float64{1, 1, 1}}
+	case *material.ThinFilmSmooth:
+		e.warnf("material %d: thin-film interference ignored", index)
+		return Material{Kind: KindGlass, Color: [3]float64{1, 1, 1}}
+	case *material.LinearPolarizer:
+		return Material{Kind: KindGlass, Color: [3]float64{0.5, 0.5, 0.5}}
+	case *material.Retarder:
+		return Material{Kind: KindGlass, Color: [3]float64{1, 1, 1}}
+	case *material.GaussianRoughNonConductive:
+		return Material{Kind: KindRough, Color: [3]float64{0.8, 0.8, 0.8}}
+	default:
+		e.warnf("material %d: %T is not supported; shown as gray", index, m)
+		return Material{Kind: KindUnknown, Color: [3]float64{0.5, 0.5, 0.5}}
+	}
+}
+
+func exportTransform(t affinetransform.AffineTransform) Transform {
+	return Transform{
+		Linear: t.Linear,
+		Offset: t.Offset,
+	}
+}
+
+func (e *exporter) exportElement(index int, elt *scene.SceneElement, g geometry.Geometry) Element {
+	result := Element{
+		Material:     elt.MaterialIndex,
+		ModelToWorld: exportTransform(elt.ModelToWorld),
+		WorldToModel: exportTransform(elt.ModelToWorld.Invert()),
+	}
+
+	switch g := g.(type) {
+	case *geometry.Sphere:
+		result.Geometry = Geometry{Kind: GeometrySphere}
+	case *geometry.Box:
+		result.Geometry = Geometry{
+			Kind: GeometryBox,
+			Lo:   &[3]float64{g.Spans[0].Lo, g.Spans[1].Lo, g.Spans[2].Lo},
+			Hi:   &[3]float64{g.Spans[0].Hi, g.Spans[1].Hi, g.Spans[2].Hi},
+		}
+	default:
+		e.warnf("element %d: %T is shown as its bounding box", index, g)
+		box := g.GetAABox()
+		result.Geometry = Geometry{
+			Kind: GeometryBounds,
+			Lo:   &[3]float64{box.X.Lo, box.Y.Lo, box.Z.Lo},
+			Hi:   &[3]float64{box.X.Hi, box.Y.Hi, box.Z.Hi},
+		}
+	}
+
+	return result
+}
+
+func (e *exporter) exportLight(index int, l light.Light) (Light, bool) {
+	switch l := l.(type) {
+	case *light.SpotLight:
+		return Light{
+			Kind:     LightSpot,
+			Position: l.Position,
+			Color:    emissionRGB(l.Intensity),
+		}, true
+	case *light.RectLight:
+		return Light{
+			Kind:     LightRect,
+			Position: vec3.AddVV(l.Corner, vec3.MulVS(vec3.AddVV(l.Edge1, l.Edge2), 0.5)),
+			Color:    emissionRGB(l.Radiance),
+		}, true
+	default:
+		e.warnf("light %d: %T is not supported", index, l)
+		return Light{}, false
+	}
+}
@@ -0,0 +1,124 @@
+package webexport
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+
+	"row-major/harpoon/affinetransform"
+	"row-major/harpoon/geometry"
+	"row-major/harpoon/material"
+	"row-major/harpoon/scene"
+	"row-major/harpoon/vmath/vec2"
+	"row-major/harpoon/vmath/vec3"
+)
+
+func TestExportDemoScene(t *testing.T) {
+	s := scene.DemoScene()
+	got := Export(s)
+
+	if got.Camera == nil {
+		t.Fatalf("no camera exported")
+	}
+	if len(got.Elements) != len(s.Elements) {
+		t.Errorf("got %d elements, want %d", len(got.Elements), len(s.Elements))
+	}
+	if len(got.Materials) != len(s.Materials) {
+		t.Errorf("got %d materials, want %d", len(got.Materials), len(s.Materials))
+	}
+	if got.InfinityMaterial != s.InfinityMaterialIndex {
+		t.Errorf("got infinity material %d, want %d", got.InfinityMaterial, s.InfinityMaterialIndex)
+	}
+	if len(got.Warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", got.Warnings)
+	}
+
+	// Each element's transforms should be inverses of each other.
+	for i, elt := range got.Elements {
+		p := vec3.T{0.3, -0.7, 1.1}
+		q := apply(elt.WorldToModel, apply(elt.ModelToWorld, p))
+		if vec3.SubVV(p, q).Norm() > 1e-9 {
+			t.Errorf("element %d: transforms don't round-trip: %v -> %v", i, p, q)
+		}
+	}
+
+	if _, err := json.Marshal(got); err != nil {
+		t.Errorf("marshaling: %v", err)
+	}
+}
+
+func apply(t Transform, p vec3.T) vec3.T {
+	result := t.Offset
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			result[r] += t.Linear[3*r+c] * p[c]
+		}
+	}
+	return result
+}
+
+func TestExportApproximations(t *testing.T) {
+	s := &scene.Scene{}
+
+	red := s.AddMaterial(&material.MonteCarloLambert{
+		Reflectance: func(c material.MaterialCoords) float64 {
+			if c.Freq > 600 {
+				return 0.9
+			}
+			return 0.1
+		},
+	})
+	sky := s.AddMaterial(&material.Emitter{
+		Emissivity: material.ConstantScalar(50),
+	})
+	s.InfinityMaterialIndex = sky
+
+	mesh := s.AddGeometry(&geometry.TriangleMesh{
+		Vertices:  []vec3.T{{0, 0, 0}, {1, 0, 0}, {0, 2, 3}},
+		Triangles: [][3]int{{0, 1, 2}},
+		TexCoords: []vec2.T{{0, 0}, {1, 0}, {0, 1}},
+	})
+	s.AddElement(&scene.SceneElement{
+		GeometryIndex: mesh,
+		MaterialIndex: red,
+		ModelToWorld:  affinetransform.Translate(vec3.T{1, 2, 3}),
+	})
+
+	got := Export(s)
+
+	if got.Camera != nil {
+		t.Errorf("exported a camera from a scene without one")
+	}
+
+	if c := got.Materials[red].Color; c != [3]float64{0.9, 0.1, 0.1} {
+		t.Errorf("got diffuse color %v, want [0.9 0.1 0.1]", c)
+	}
+	if m := got.Materials[sky]; m.Kind != KindEmitter || m.Color != [3]float64{1, 1, 1} {
+		t.Errorf("got sky %+v, want a white emitter", m)
+	}
+
+	g := got.Elements[0].Geometry
+	if g.Kind != GeometryBounds || *g.Lo != [3]float64{0, 0, 0} || *g.Hi != [3]float64{1, 2, 3} {
+		t.Errorf("got mesh geometry %+v %v %v, want its bounding box", g, g.Lo, g.Hi)
+	}
+	if got.Elements[0].ModelToWorld.Offset != [3]float64{1, 2, 3} {
+		t.Errorf("got offset %v, want [1 2 3]", got.Elements[0].ModelToWorld.Offset)
+	}
+
+	warnings := strings.Join(got.Warnings, "\n")
+	for _, want := range []string{"no cameras", "bounding box"} {
+		if !strings.Contains(warnings, want) {
+			t.Errorf("warnings %q don't mention %q", warnings, want)
+		}
+	}
+}
+
+func TestEmissionRGBHandlesDarkness(t *testing.T) {
+	if got := emissionRGB(material.ConstantScalar(0)); got != [3]float64{0, 0, 0} {
+		t.Errorf("got %v for a black emitter, want zeros", got)
+	}
+	if got := emissionRGB(material.ConstantScalar(math.Inf(1))); got != [3]float64{0, 0, 0} {
+		t.Errorf("got %v for an infinite emitter, want zeros", got)
+	}
+}
@@ -2,12 +2,19 @@ package contentpack
 
 import (
 	"archive/zip"
+	"bytes"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
+	"path"
 	"row-major/webalator/packer/manifestpb"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 )
@@ -21,32 +28,208 @@ type staticServable struct {
 	sp              string
 	contentPackPath string
 	mimeType        string
+
+	member *packMember
+
+	// etag is a strong entity tag, derived from the file's contents.
+	etag string
+
+	// variants are precompressed copies of the file, in order of preference.
+	variants []*encodedVariant
+}
+
+type encodedVariant struct {
+	contentEncoding string
+	member          *packMember
+
+	// etag differs from the original's: a cache must not answer a request
+	// for one encoding with another.
+	etag string
 }
 
 func (s *staticServable) servingPath() string {
 	return s.sp
 }
 
+// serveHTTP leaves conditional requests and byte ranges to http.ServeContent,
+// which answers them from the ETag and the member's modification time.  Ranges
+// of an encoded variant are ranges of its encoded bytes, as HTTP has them.
 func (s *staticServable) serveHTTP(zr *zip.Reader, w http.ResponseWriter, r *http.Request) error {
-	w.Header().Add("Content-Type", s.mimeType)
+	member, etag := s.member, s.etag
+	if len(s.variants) != 0 {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if v := s.negotiateVariant(r.Header.Get("Accept-Encoding")); v != nil {
+			member, etag = v.member, v.etag
+			w.Header().Set("Content-Encoding", v.contentEncoding)
+		}
+	}
 
-	zf, err := zr.Open(s.contentPackPath)
+	content, err := member.openSeekable()
 	if err != nil {
 		http.Error(w, "Internal Error", http.StatusInternalServerError)
-		return fmt.Errorf("while opening content pack member %v: %w", s.contentPackPath, err)
+		return fmt.Errorf("while opening content pack member %v: %w", member.Name, err)
 	}
-	defer zf.Close()
 
-	if _, err := io.Copy(w, zf); err != nil {
-		return fmt.Errorf("while copying from content pack member %v to response: %w", s.contentPackPath, err)
+	// ServeContent guesses missing types from the name, so it's given the
+	// original's, not the variant's.
+	if s.mimeType != "" {
+		w.Header().Set("Content-Type", s.mimeType)
 	}
-
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, s.contentPackPath, memberModified(member.File), content)
 	return nil
 }
 
+// negotiateVariant picks the variant to serve for an Accept-Encoding header,
+// or nil to serve the original.  It picks the variant whose encoding the
+// client gives the highest quality, breaking ties by the pack's preference,
+// and only if the client doesn't prefer the original to it.  The original is
+// always acceptable, but a client that doesn't give it a quality (directly or
+// through "*") is taken to prefer any encoding it accepts.
+func (s *staticServable) negotiateVariant(acceptEncoding string) *encodedVariant {
+	qualities := parseAcceptEncoding(acceptEncoding)
+	quality := func(coding string) float64 {
+		if q, ok := qualities[coding]; ok {
+			return q
+		}
+		if q, ok := qualities["*"]; ok {
+			return q
+		}
+		return 0
+	}
+
+	var best *encodedVariant
+	bestQ := 0.0
+	for _, v := range s.variants {
+		if q := quality(v.contentEncoding); q > bestQ {
+			best, bestQ = v, q
+		}
+	}
+	if best == nil || bestQ < quality("identity") {
+		return nil
+	}
+	return best
+}
+
+// parseAcceptEncoding parses an Accept-Encoding header into a quality for each
+// content coding it lists.  Malformed qualities count as 0.
+func parseAcceptEncoding(header string) map[string]float64 {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				parsed = 0
+			}
+			q = parsed
+		}
+		qualities[coding] = q
+	}
+	return qualities
+}
+
+// packMember is a member of the content pack that statics are served from.
+type packMember struct {
+	*zip.File
+
+	// Compressed members are decompressed once, on first use, and kept for
+	// later requests.
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// openSeekable opens the member so that it can be seeked, for byte ranges.
+// Members stored without compression (as the packer stores media and encoded
+// variants) are read in place; others are served from memory.
+func (m *packMember) openSeekable() (io.ReadSeeker, error) {
+	if m.Method == zip.Store {
+		if raw, err := m.OpenRaw(); err == nil {
+			if rs, ok := raw.(io.ReadSeeker); ok {
+				return rs, nil
+			}
+		}
+	}
+
+	m.once.Do(func() {
+		m.data, m.err = m.decompress()
+	})
+	if m.err != nil {
+		return nil, m.err
+	}
+	return bytes.NewReader(m.data), nil
+}
+
+func (m *packMember) decompress() ([]byte, error) {
+	rc, err := m.Open()
+	if err != nil {
+		return nil, fmt.Errorf("while opening: %w", err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("while reading: %w", err)
+	}
+	return data, nil
+}
+
 type goTemplateServable struct {
 	sp       string
 	template *template.Template
+	data     *templateData
+}
+
+// templateData is what templates are executed with.
+type templateData struct {
+	Page *page
+	Site *site
+}
+
+// page describes a page, from its front matter.
+type page struct {
+	Path  string
+	Title string
+
+	// Date is zero for undated pages.
+	Date time.Time
+
+	Tags []string
+}
+
+// site is shared by every template in a content pack.
+type site struct {
+	BuildVersion string
+
+	// Articles are the listed pages with dates, oldest first.
+	Articles []*page
+}
+
+func newPage(servingPath string, pd *manifestpb.PageData) (*page, error) {
+	p := &page{
+		Path:  servingPath,
+		Title: pd.GetTitle(),
+		Tags:  pd.GetTags(),
+	}
+	if pd.GetDate() != "" {
+		date, err := time.Parse(manifestpb.PageDateLayout, pd.GetDate())
+		if err != nil {
+			return nil, fmt.Errorf("while parsing date: %w", err)
+		}
+		p.Date = date
+	}
+	return p, nil
 }
 
 func (s *goTemplateServable) servingPath() string {
@@ -54,7 +237,7 @@ func (s *goTemplateServable) servingPath() string {
 }
 
 func (s *goTemplateServable) serveHTTP(zr *zip.Reader, w http.ResponseWriter, r *http.Request) error {
-	if err := s.template.Execute(w, nil); err != nil {
+	if err := s.template.Execute(w, s.data); err != nil {
 		return fmt.Errorf("while writing http response: %w", err)
 	}
 	return nil
@@ -78,6 +261,10 @@ type Handler struct {
 	zr *zip.Reader
 
 	servables map[string]servable
+
+	cachePolicies []*manifestpb.CachePolicy
+
+	site *site
 }
 
 func NewHandler(zr *zip.Reader) (*Handler, error) {
@@ -99,17 +286,31 @@ func NewHandler(zr *zip.Reader) (*Handler, error) {
 	}
 
 	h := &Handler{
-		zr:        zr,
-		servables: map[string]servable{},
+		zr:            zr,
+		servables:     map[string]servable{},
+		cachePolicies: manifest.CachePolicies,
+		site: &site{
+			BuildVersion: manifest.GetSiteData().GetBuildVersion(),
+		},
+	}
+
+	for _, policy := range h.cachePolicies {
+		if _, err := path.Match(policy.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("while checking cache policy pattern %q: %w", policy.Pattern, err)
+		}
+	}
+
+	members := map[string]*packMember{}
+	for _, f := range zr.File {
+		members[f.Name] = &packMember{File: f}
 	}
 
 	for _, servable := range manifest.Servables {
 		switch e := servable.Entry.(type) {
 		case *manifestpb.Servable_Static:
-			sv := &staticServable{
-				sp:              e.Static.ServingPath,
-				contentPackPath: e.Static.ContentPackPath,
-				mimeType:        e.Static.MimeType,
+			sv, err := newStaticServable(e.Static, members)
+			if err != nil {
+				return nil, fmt.Errorf("while loading static: %w", err)
 			}
 			if err := h.registerServable(sv); err != nil {
 				return nil, fmt.Errorf("while registering static: %w", err)
@@ -127,45 +328,110 @@ func NewHandler(zr *zip.Reader) (*Handler, error) {
 		}
 	}
 
+	sort.SliceStable(h.site.Articles, func(i, j int) bool {
+		a, b := h.site.Articles[i], h.site.Articles[j]
+		if !a.Date.Equal(b.Date) {
+			return a.Date.Before(b.Date)
+		}
+		return a.Path < b.Path
+	})
+
 	return h, nil
 }
 
-func (h *Handler) registerGoTemplateServable(gt *manifestpb.GoTemplate) error {
-	baseTemplateReader, err := h.zr.Open(gt.BaseContentPackPath)
-	if err != nil {
-		return fmt.Errorf("while opening base template from content pack: %w", err)
+func newStaticServable(st *manifestpb.Static, members map[string]*packMember) (*staticServable, error) {
+	member, ok := members[st.ContentPackPath]
+	if !ok {
+		return nil, fmt.Errorf("content pack has no member %v", st.ContentPackPath)
 	}
-	defer baseTemplateReader.Close()
 
-	baseTemplateBytes, err := io.ReadAll(baseTemplateReader)
+	// Packs from older packers don't record hashes.  The member's CRC-32 is
+	// still a fine way to tell versions of a file apart.
+	etag := fmt.Sprintf(`"%08x-%d"`, member.CRC32, member.UncompressedSize64)
+	if st.Sha256 != "" {
+		if uint64(st.Size) != member.UncompressedSize64 {
+			return nil, fmt.Errorf("manifest says %v is %d bytes, but it's %d", st.ContentPackPath, st.Size, member.UncompressedSize64)
+		}
+		etag = `"` + st.Sha256 + `"`
+	}
+
+	sv := &staticServable{
+		sp:              st.ServingPath,
+		contentPackPath: st.ContentPackPath,
+		mimeType:        st.MimeType,
+		member:          member,
+		etag:            etag,
+	}
+
+	for _, ev := range st.EncodedVariants {
+		variantMember, ok := members[ev.ContentPackPath]
+		if !ok {
+			return nil, fmt.Errorf("content pack has no member %v", ev.ContentPackPath)
+		}
+		if uint64(ev.Size) != variantMember.UncompressedSize64 {
+			return nil, fmt.Errorf("manifest says %v is %d bytes, but it's %d", ev.ContentPackPath, ev.Size, variantMember.UncompressedSize64)
+		}
+		if ev.ContentEncoding == "" || ev.ContentEncoding == "identity" {
+			return nil, fmt.Errorf("variant %v has bad content encoding %q", ev.ContentPackPath, ev.ContentEncoding)
+		}
+
+		sv.variants = append(sv.variants, &encodedVariant{
+			contentEncoding: ev.ContentEncoding,
+			member:          variantMember,
+			etag:            strings.TrimSuffix(etag, `"`) + "-" + ev.ContentEncoding + `"`,
+		})
+	}
+
+	return sv, nil
+}
+
+func (h *Handler) registerGoTemplateServable(gt *manifestpb.GoTemplate) error {
+	baseTemplateText, err := h.readMember(gt.BaseContentPackPath)
 	if err != nil {
 		return fmt.Errorf("while reading base template from content pack: %w", err)
 	}
 
-	baseTemplate, err := template.New("").Parse(string(baseTemplateBytes))
+	baseTemplate, err := template.New("").Parse(baseTemplateText)
 	if err != nil {
 		return fmt.Errorf("while parsing base template: %w", err)
 	}
 
-	specializationTemplateReader, err := h.zr.Open(gt.SpecializationContentPackPath)
-	if err != nil {
-		return fmt.Errorf("while opening specialization template from content pack: %w", err)
+	for _, partial := range gt.Partials {
+		partialText, err := h.readMember(partial.ContentPackPath)
+		if err != nil {
+			return fmt.Errorf("while reading partial %v from content pack: %w", partial.Name, err)
+		}
+
+		if _, err := baseTemplate.New(partial.Name).Parse(partialText); err != nil {
+			return fmt.Errorf("while parsing partial %v: %w", partial.Name, err)
+		}
 	}
-	defer specializationTemplateReader.Close()
 
-	specializationTemplateBytes, err := io.ReadAll(specializationTemplateReader)
+	specializationTemplateText, err := h.readMember(gt.SpecializationContentPackPath)
 	if err != nil {
 		return fmt.Errorf("while reading specialization template from content pack: %w", err)
 	}
 
-	specializationTemplate, err := baseTemplate.Parse(string(specializationTemplateBytes))
+	specializationTemplate, err := baseTemplate.Parse(specializationTemplateText)
 	if err != nil {
 		return fmt.Errorf("while parsing specialization template: %w", err)
 	}
 
+	p, err := newPage(gt.ServingPath, gt.PageData)
+	if err != nil {
+		return fmt.Errorf("while loading page data: %w", err)
+	}
+	if !p.Date.IsZero() && !gt.GetPageData().GetUnlisted() {
+		h.site.Articles = append(h.site.Articles, p)
+	}
+
 	sv := &goTemplateServable{
 		sp:       gt.ServingPath,
 		template: specializationTemplate,
+		data: &templateData{
+			Page: p,
+			Site: h.site,
+		},
 	}
 	if err := h.registerServable(sv); err != nil {
 		return fmt.Errorf("while registering servable: %w", err)
@@ -174,6 +440,21 @@ func (h *Handler) registerGoTemplateServable(gt *manifestpb.GoTemplate) error {
 	return nil
 }
 
+// readMember reads a member of the content pack.
+func (h *Handler) readMember(name string) (string, error) {
+	r, err := h.zr.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("while opening %v: %w", name, err)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("while reading %v: %w", name, err)
+	}
+	return string(b), nil
+}
+
 func (h *Handler) registerRedirectServable(r *manifestpb.Redirect) error {
 	sv := &redirectServable{
 		sp:       r.ServingPath,
@@ -205,9 +486,59 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if cacheControl, ok := h.cacheControl(r.URL.Path); ok {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+
 	if err := servable.serveHTTP(h.zr, w, r); err != nil {
 		log.Printf("Error while executing servable for %v: %v", r.URL.Path, err)
 		// Servable is required to write an error response.
 		return
 	}
 }
+
+// cacheControl returns the Cache-Control header of the first cache policy
+// that matches servingPath.
+func (h *Handler) cacheControl(servingPath string) (string, bool) {
+	for _, policy := range h.cachePolicies {
+		if matchPathPattern(policy.Pattern, servingPath) {
+			return policy.CacheControl, true
+		}
+	}
+	return "", false
+}
+
+// msDOSEpoch is the earliest time a zip member's MS-DOS timestamp can hold.
+var msDOSEpoch = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// memberModified is the modification time to serve a member with.  The packer
+// leaves modification times unset so that packs are reproducible, and those
+// members read back from before msDOSEpoch.  They're served without
+// Last-Modified, leaving revalidation to the ETag.
+func memberModified(f *zip.File) time.Time {
+	if f.Modified.Before(msDOSEpoch) {
+		return time.Time{}
+	}
+	return f.Modified
+}
+
+// matchPathPattern matches a serving path against a path.Match pattern, or
+// against a directory pattern ending in "/**", which matches the directory and
+// everything under it.
+func matchPathPattern(pattern, servingPath string) bool {
+	if !strings.HasSuffix(pattern, "/**") {
+		matched, _ := path.Match(pattern, servingPath)
+		return matched
+	}
+	dir := strings.TrimSuffix(pattern, "/**")
+
+	// Match the directory against each leading part of the path.
+	for i := 0; i <= len(servingPath); i++ {
+		if i == len(servingPath) || servingPath[i] == '/' {
+			if matched, _ := path.Match(dir, servingPath[:i]); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,626 @@
+package contentpack
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"row-major/webalator/packer/manifestpb"
+)
+
+const (
+	textContent = "hello, world"
+	textSha256  = "09ca7e4eaa6e8ae9c7d261167129184883644d07dfba7cbfbc4c8a2e08360d5b"
+	textETag    = `"` + textSha256 + `"`
+
+	binContent = "0123456789"
+	// binETag comes from the member's CRC-32, as the manifest has no hash.
+	binETag = `"a684c7c6-10"`
+)
+
+// makeStaticHandler serves /a.txt, which is compressed in the pack, and
+// /b.bin, which is stored.
+func makeStaticHandler(t *testing.T) *Handler {
+	t.Helper()
+	manifest := &manifestpb.Manifest{
+		Servables: []*manifestpb.Servable{
+			{Entry: &manifestpb.Servable_Static{Static: &manifestpb.Static{
+				ServingPath:     "/a.txt",
+				ContentPackPath: "a.txt",
+				MimeType:        "text/plain; charset=utf-8",
+				Sha256:          textSha256,
+				Size:            int64(len(textContent)),
+			}}},
+			{Entry: &manifestpb.Servable_Static{Static: &manifestpb.Static{
+				ServingPath:     "/b.bin",
+				ContentPackPath: "b.bin",
+			}}},
+		},
+		CachePolicies: []*manifestpb.CachePolicy{
+			{Pattern: "/*.txt", CacheControl: "no-cache"},
+		},
+	}
+	h, err := loadHandler(makePack(t, manifest,
+		testMember{name: "a.txt", content: textContent},
+		testMember{name: "b.bin", content: binContent, store: true},
+	))
+	if err != nil {
+		t.Fatalf("loading pack: %v", err)
+	}
+	return h
+}
+
+func TestStaticServing(t *testing.T) {
+	h := makeStaticHandler(t)
+
+	httpDate := func(t time.Time) string { return t.UTC().Format(http.TimeFormat) }
+
+	testCases := []struct {
+		name   string
+		path   string
+		header map[string]string
+
+		wantStatus       int
+		wantBody         string
+		wantETag         string
+		wantContentRange string
+	}{
+		{
+			name:       "compressed member",
+			path:       "/a.txt",
+			wantStatus: http.StatusOK,
+			wantBody:   textContent,
+			wantETag:   textETag,
+		},
+		{
+			name:       "stored member",
+			path:       "/b.bin",
+			wantStatus: http.StatusOK,
+			wantBody:   binContent,
+			wantETag:   binETag,
+		},
+		{
+			name:       "If-None-Match matches",
+			path:       "/a.txt",
+			header:     map[string]string{"If-None-Match": `"other", ` + textETag},
+			wantStatus: http.StatusNotModified,
+			wantETag:   textETag,
+		},
+		{
+			name:       "If-None-Match doesn't match",
+			path:       "/a.txt",
+			header:     map[string]string{"If-None-Match": binETag},
+			wantStatus: http.StatusOK,
+			wantBody:   textContent,
+			wantETag:   textETag,
+		},
+		{
+			name:       "If-Modified-Since at modification",
+			path:       "/b.bin",
+			header:     map[string]string{"If-Modified-Since": httpDate(packModified)},
+			wantStatus: http.StatusNotModified,
+			wantETag:   binETag,
+		},
+		{
+			name:       "If-Modified-Since before modification",
+			path:       "/b.bin",
+			header:     map[string]string{"If-Modified-Since": httpDate(packModified.Add(-time.Hour))},
+			wantStatus: http.StatusOK,
+			wantBody:   binContent,
+			wantETag:   binETag,
+		},
+		{
+			name:       "If-None-Match wins over If-Modified-Since",
+			path:       "/a.txt",
+			header:     map[string]string{"If-None-Match": binETag, "If-Modified-Since": httpDate(packModified)},
+			wantStatus: http.StatusOK,
+			wantBody:   textContent,
+			wantETag:   textETag,
+		},
+		{
+			name:             "range of compressed member",
+			path:             "/a.txt",
+			header:           map[string]string{"Range": "bytes=7-"},
+			wantStatus:       http.StatusPartialContent,
+			wantBody:         "world",
+			wantETag:         textETag,
+			wantContentRange: "bytes 7-11/12",
+		},
+		{
+			name:             "range of stored member",
+			path:             "/b.bin",
+			header:           map[string]string{"Range": "bytes=2-4"},
+			wantStatus:       http.StatusPartialContent,
+			wantBody:         "234",
+			wantETag:         binETag,
+			wantContentRange: "bytes 2-4/10",
+		},
+		{
+			name:             "If-Range matches",
+			path:             "/a.txt",
+			header:           map[string]string{"Range": "bytes=0-4", "If-Range": textETag},
+			wantStatus:       http.StatusPartialContent,
+			wantBody:         "hello",
+			wantETag:         textETag,
+			wantContentRange: "bytes 0-4/12",
+		},
+		{
+			name:       "If-Range is stale",
+			path:       "/a.txt",
+			header:     map[string]string{"Range": "bytes=0-4", "If-Range": `"old"`},
+			wantStatus: http.StatusOK,
+			wantBody:   textContent,
+			wantETag:   textETag,
+		},
+		{
+			name:             "unsatisfiable range",
+			path:             "/b.bin",
+			header:           map[string]string{"Range": "bytes=20-30"},
+			wantStatus:       http.StatusRequestedRangeNotSatisfiable,
+			wantContentRange: "bytes */10",
+		},
+		{
+			name:       "missing",
+			path:       "/c.txt",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			for k, v := range tc.header {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tc.wantStatus)
+			}
+			if tc.wantBody != "" && w.Body.String() != tc.wantBody {
+				t.Errorf("got body %q, want %q", w.Body.String(), tc.wantBody)
+			}
+			// Whether ServeContent keeps the ETag on an error depends on
+			// the Go version, so it's only checked when one is wanted.
+			if got := w.Header().Get("ETag"); tc.wantETag != "" && got != tc.wantETag {
+				t.Errorf("got ETag %q, want %q", got, tc.wantETag)
+			}
+			if got := w.Header().Get("Content-Range"); got != tc.wantContentRange {
+				t.Errorf("got Content-Range %q, want %q", got, tc.wantContentRange)
+			}
+		})
+	}
+}
+
+func TestStaticServingHeaders(t *testing.T) {
+	h := makeStaticHandler(t)
+
+	testCases := []struct {
+		path             string
+		wantContentType  string
+		wantCacheControl string
+	}{
+		{"/a.txt", "text/plain; charset=utf-8", "no-cache"},
+		{"/b.bin", "", ""},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if tc.wantContentType != "" {
+			if got := w.Header().Get("Content-Type"); got != tc.wantContentType {
+				t.Errorf("%s: got Content-Type %q, want %q", tc.path, got, tc.wantContentType)
+			}
+		}
+		if got := w.Header().Get("Cache-Control"); got != tc.wantCacheControl {
+			t.Errorf("%s: got Cache-Control %q, want %q", tc.path, got, tc.wantCacheControl)
+		}
+	}
+}
+
+func TestStaticServingWithoutModificationTime(t *testing.T) {
+	manifest := &manifestpb.Manifest{
+		Servables: []*manifestpb.Servable{
+			{Entry: &manifestpb.Servable_Static{Static: &manifestpb.Static{
+				ServingPath:     "/b.bin",
+				ContentPackPath: "b.bin",
+			}}},
+		},
+	}
+	h, err := loadHandler(makePack(t, manifest, testMember{name: "b.bin", content: binContent, unmodified: true}))
+	if err != nil {
+		t.Fatalf("loading pack: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/b.bin", nil)
+	req.Header.Set("If-Modified-Since", time.Now().UTC().Format(http.TimeFormat))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d for If-Modified-Since, want 200", w.Code)
+	}
+	if got := w.Header().Get("Last-Modified"); got != "" {
+		t.Errorf("got Last-Modified %q, want none", got)
+	}
+	if got := w.Header().Get("ETag"); got != binETag {
+		t.Errorf("got ETag %q, want %q", got, binETag)
+	}
+}
+
+func TestCompressedMembersDecompressOnce(t *testing.T) {
+	h := makeStaticHandler(t)
+	text := h.servables["/a.txt"].(*staticServable).member
+	bin := h.servables["/b.bin"].(*staticServable).member
+
+	for i := 0; i < 2; i++ {
+		for path, want := range map[string]string{"/a.txt": textContent, "/b.bin": binContent} {
+			if got := getBody(t, h, path); got != want {
+				t.Errorf("request %d for %s: got %q, want %q", i, path, got, want)
+			}
+		}
+		if string(text.data) != textContent {
+			t.Errorf("after request %d, compressed member holds %q, want %q", i, text.data, textContent)
+		}
+		if bin.data != nil {
+			t.Errorf("after request %d, stored member was copied into memory", i)
+		}
+	}
+}
+
+func TestNewHandlerRejectsBadStatics(t *testing.T) {
+	testCases := []struct {
+		name   string
+		static *manifestpb.Static
+	}{
+		{
+			name:   "missing member",
+			static: &manifestpb.Static{ServingPath: "/a.txt", ContentPackPath: "missing.txt"},
+		},
+		{
+			name:   "wrong size",
+			static: &manifestpb.Static{ServingPath: "/a.txt", ContentPackPath: "a.txt", Sha256: textSha256, Size: 3},
+		},
+		{
+			name: "identity variant",
+			static: &manifestpb.Static{
+				ServingPath:     "/a.txt",
+				ContentPackPath: "a.txt",
+				EncodedVariants: []*manifestpb.EncodedVariant{{ContentEncoding: "identity", ContentPackPath: "a.txt", Size: int64(len(textContent))}},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		manifest := &manifestpb.Manifest{
+			Servables: []*manifestpb.Servable{{Entry: &manifestpb.Servable_Static{Static: tc.static}}},
+		}
+		if _, err := loadHandler(makePack(t, manifest, testMember{name: "a.txt", content: textContent})); err == nil {
+			t.Errorf("%s: pack loaded", tc.name)
+		}
+	}
+}
+
+func TestMatchPathPattern(t *testing.T) {
+	testCases := []struct {
+		pattern     string
+		servingPath string
+		want        bool
+	}{
+		{"/index.html", "/index.html", true},
+		{"/index.html", "/index.htm", false},
+		{"/*.css", "/main.css", true},
+		{"/*.css", "/css/main.css", false},
+		{"/media/*", "/media/a.png", true},
+		{"/media/*", "/media/2020/a.png", false},
+		{"/media/**", "/media", true},
+		{"/media/**", "/media/", true},
+		{"/media/**", "/media/a.png", true},
+		{"/media/**", "/media/2020/a.png", true},
+		{"/media/**", "/mediaeval/a.png", false},
+		{"/media/**", "/other/media/a.png", false},
+		{"/*/fonts/**", "/static/fonts/a.woff2", true},
+		{"/*/fonts/**", "/static/img/a.png", false},
+		{"/**", "/anything/at/all", true},
+		{"[", "/index.html", false},
+	}
+	for _, tc := range testCases {
+		if got := matchPathPattern(tc.pattern, tc.servingPath); got != tc.want {
+			t.Errorf("matchPathPattern(%q, %q) = %v, want %v", tc.pattern, tc.servingPath, got, tc.want)
+		}
+	}
+}
+
+func TestParseAcceptEncoding(t *testing.T) {
+	testCases := []struct {
+		header string
+		want   map[string]float64
+	}{
+		{"", map[string]float64{}},
+		{"gzip", map[string]float64{"gzip": 1}},
+		{"gzip, deflate, br", map[string]float64{"gzip": 1, "deflate": 1, "br": 1}},
+		{"br;q=0.9, gzip;q=0.8", map[string]float64{"br": 0.9, "gzip": 0.8}},
+		{"BR ; Q=0.5", map[string]float64{"br": 0.5}},
+		{"identity;q=0, *", map[string]float64{"identity": 0, "*": 1}},
+		{"gzip;q=abc, br;q=2, zstd;q=-1", map[string]float64{"gzip": 0, "br": 0, "zstd": 0}},
+		{"gzip;level=9;q=0.3", map[string]float64{"gzip": 0.3}},
+		{" , gzip,,", map[string]float64{"gzip": 1}},
+	}
+	for _, tc := range testCases {
+		got := parseAcceptEncoding(tc.header)
+		if len(got) != len(tc.want) {
+			t.Errorf("parseAcceptEncoding(%q) = %v, want %v", tc.header, got, tc.want)
+			continue
+		}
+		for coding, q := range tc.want {
+			if gotQ, ok := got[coding]; !ok || gotQ != q {
+				t.Errorf("parseAcceptEncoding(%q) = %v, want %v", tc.header, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestNegotiateVariant(t *testing.T) {
+	s := &staticServable{
+		variants: []*encodedVariant{
+			{contentEncoding: "br"},
+			{contentEncoding: "gzip"},
+		},
+	}
+
+	testCases := []struct {
+		acceptEncoding string
+		want           string // "" for the original
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"br", "br"},
+		{"gzip, br", "br"},
+		{"gzip, deflate, br, zstd", "br"},
+		{"br;q=0.8, gzip;q=0.9", "gzip"},
+		{"br;q=0.9, gzip;q=0.8", "br"},
+		{"BR", "br"},
+		{"*", "br"},
+		{"*;q=0.5, gzip", "gzip"},
+		{"*;q=0", ""},
+		{"br;q=0, gzip;q=0", ""},
+		{"br;q=0, *", "gzip"},
+		{"deflate", ""},
+		{"gzip;q=0.5", "gzip"},
+		{"gzip;q=0.5, identity", ""},
+		{"gzip;q=0.5, identity;q=0.4", "gzip"},
+		{"gzip;q=0.5, identity;q=0", "gzip"},
+		{"br;q=0.5, identity;q=0.5", "br"},
+		{"identity;q=0", ""},
+		{"gzip;q=abc", ""},
+	}
+	for _, tc := range testCases {
+		got := ""
+		if v := s.negotiateVariant(tc.acceptEncoding); v != nil {
+			got = v.contentEncoding
+		}
+		if got != tc.want {
+			t.Errorf("negotiateVariant(%q) picked %q, want %q", tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+func TestEncodedVariantServing(t *testing.T) {
+	const (
+		cssContent = "body { color: black; }"
+		brContent  = "br bytes"
+		gzContent  = "gzip bytes"
+	)
+	manifest := &manifestpb.Manifest{
+		Servables: []*manifestpb.Servable{
+			{Entry: &manifestpb.Servable_Static{Static: &manifestpb.Static{
+				ServingPath:     "/main.css",
+				ContentPackPath: "main.css",
+				MimeType:        "text/css; charset=utf-8",
+				Sha256:          "c55",
+				Size:            int64(len(cssContent)),
+				EncodedVariants: []*manifestpb.EncodedVariant{
+					{ContentEncoding: "br", ContentPackPath: "main.css.br", Size: int64(len(brContent))},
+					{ContentEncoding: "gzip", ContentPackPath: "main.css.gz", Size: int64(len(gzContent))},
+				},
+			}}},
+			{Entry: &manifestpb.Servable_Static{Static: &manifestpb.Static{
+				ServingPath:     "/plain.txt",
+				ContentPackPath: "plain.txt",
+			}}},
+		},
+	}
+	h, err := loadHandler(makePack(t, manifest,
+		testMember{name: "main.css", content: cssContent},
+		testMember{name: "main.css.br", content: brContent, store: true},
+		testMember{name: "main.css.gz", content: gzContent, store: true},
+		testMember{name: "plain.txt", content: "plain"},
+	))
+	if err != nil {
+		t.Fatalf("loading pack: %v", err)
+	}
+
+	testCases := []struct {
+		name   string
+		path   string
+		header map[string]string
+
+		wantStatus          int
+		wantBody            string
+		wantContentEncoding string
+		wantETag            string
+		wantVary            string
+	}{
+		{
+			name:       "original",
+			path:       "/main.css",
+			wantStatus: http.StatusOK,
+			wantBody:   cssContent,
+			wantETag:   `"c55"`,
+			wantVary:   "Accept-Encoding",
+		},
+		{
+			name:                "br preferred over gzip",
+			path:                "/main.css",
+			header:              map[string]string{"Accept-Encoding": "gzip, deflate, br"},
+			wantStatus:          http.StatusOK,
+			wantBody:            brContent,
+			wantContentEncoding: "br",
+			wantETag:            `"c55-br"`,
+			wantVary:            "Accept-Encoding",
+		},
+		{
+			name:                "gzip",
+			path:                "/main.css",
+			header:              map[string]string{"Accept-Encoding": "gzip"},
+			wantStatus:          http.StatusOK,
+			wantBody:            gzContent,
+			wantContentEncoding: "gzip",
+			wantETag:            `"c55-gzip"`,
+			wantVary:            "Accept-Encoding",
+		},
+		{
+			name:       "variant's ETag matches",
+			path:       "/main.css",
+			header:     map[string]string{"Accept-Encoding": "br", "If-None-Match": `"c55-br"`},
+			wantStatus: http.StatusNotModified,
+			wantETag:   `"c55-br"`,
+			wantVary:   "Accept-Encoding",
+		},
+		{
+			name:                "another variant's ETag doesn't match",
+			path:                "/main.css",
+			header:              map[string]string{"Accept-Encoding": "gzip", "If-None-Match": `"c55-br"`},
+			wantStatus:          http.StatusOK,
+			wantBody:            gzContent,
+			wantContentEncoding: "gzip",
+			wantETag:            `"c55-gzip"`,
+			wantVary:            "Accept-Encoding",
+		},
+		{
+			name:       "original's ETag doesn't match a variant",
+			path:       "/main.css",
+			header:     map[string]string{"Accept-Encoding": "identity", "If-None-Match": `"c55-gzip"`},
+			wantStatus: http.StatusOK,
+			wantBody:   cssContent,
+			wantETag:   `"c55"`,
+			wantVary:   "Accept-Encoding",
+		},
+		{
+			name:                "range of a variant",
+			path:                "/main.css",
+			header:              map[string]string{"Accept-Encoding": "br", "Range": "bytes=3-"},
+			wantStatus:          http.StatusPartialContent,
+			wantBody:            "bytes",
+			wantContentEncoding: "br",
+			wantETag:            `"c55-br"`,
+			wantVary:            "Accept-Encoding",
+		},
+		{
+			name:       "no variants",
+			path:       "/plain.txt",
+			header:     map[string]string{"Accept-Encoding": "gzip, br"},
+			wantStatus: http.StatusOK,
+			wantBody:   "plain",
+			wantETag:   `"` + fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte("plain"))) + `-5"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			for k, v := range tc.header {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tc.wantStatus)
+			}
+			if tc.wantBody != "" && w.Body.String() != tc.wantBody {
+				t.Errorf("got body %q, want %q", w.Body.String(), tc.wantBody)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tc.wantContentEncoding {
+				t.Errorf("got Content-Encoding %q, want %q", got, tc.wantContentEncoding)
+			}
+			// Whether ServeContent keeps the ETag on an error depends on
+			// the Go version, so it's only checked when one is wanted.
+			if got := w.Header().Get("ETag"); tc.wantETag != "" && got != tc.wantETag {
+				t.Errorf("got ETag %q, want %q", got, tc.wantETag)
+			}
+			if got := w.Header().Get("Vary"); got != tc.wantVary {
+				t.Errorf("got Vary %q, want %q", got, tc.wantVary)
+			}
+			// Variants are served with the original's type.
+			if tc.path == "/main.css" && tc.wantStatus != http.StatusNotModified {
+				if got := w.Header().Get("Content-Type"); got != "text/css; charset=utf-8" {
+					t.Errorf("got Content-Type %q, want the original's", got)
+				}
+			}
+		})
+	}
+}
+
+func TestSiteArticles(t *testing.T) {
+	pages := []struct {
+		servingPath string
+		pageData    *manifestpb.PageData
+	}{
+		{"/", nil},
+		{"/articles/newest/", &manifestpb.PageData{Title: "Newest", Date: "2021-01-01"}},
+		{"/articles/oldest/", &manifestpb.PageData{Title: "Oldest", Date: "2019-07-21"}},
+		{"/articles/hidden/", &manifestpb.PageData{Title: "Hidden", Date: "2020-04-01", Unlisted: true}},
+		{"/articles/undated/", &manifestpb.PageData{Title: "Undated"}},
+		{"/articles/tie-b/", &manifestpb.PageData{Title: "Tie B", Date: "2020-02-22"}},
+		{"/articles/tie-a/", &manifestpb.PageData{Title: "Tie A", Date: "2020-02-22"}},
+	}
+
+	manifest := &manifestpb.Manifest{}
+	for _, p := range pages {
+		manifest.Servables = append(manifest.Servables, &manifestpb.Servable{
+			Entry: &manifestpb.Servable_GoTemplate{GoTemplate: &manifestpb.GoTemplate{
+				ServingPath:                   p.servingPath,
+				BaseContentPackPath:           "base.html.tmpl",
+				SpecializationContentPackPath: "page.html.tmpl",
+				PageData:                      p.pageData,
+			}},
+		})
+	}
+	h, err := loadHandler(makePack(t, manifest,
+		testMember{name: "base.html.tmpl", content: `{{.Page.Title}}:{{range .Site.Articles}} {{.Date.Format "2006-01-02"}} {{.Title}};{{end}}`},
+		testMember{name: "page.html.tmpl", content: ""},
+	))
+	if err != nil {
+		t.Fatalf("loading pack: %v", err)
+	}
+
+	want := ": 2019-07-21 Oldest; 2020-02-22 Tie A; 2020-02-22 Tie B; 2021-01-01 Newest;"
+	if got := getBody(t, h, "/"); got != want {
+		t.Errorf("got index %q, want %q", got, want)
+	}
+
+	// Unlisted pages are still served.
+	if got := getBody(t, h, "/articles/hidden/"); !strings.HasPrefix(got, "Hidden:") {
+		t.Errorf("got unlisted page %q, want it rendered", got)
+	}
+}
+
+func TestNewHandlerRejectsBadPageDate(t *testing.T) {
+	manifest := &manifestpb.Manifest{
+		Servables: []*manifestpb.Servable{
+			{Entry: &manifestpb.Servable_GoTemplate{GoTemplate: &manifestpb.GoTemplate{
+				ServingPath:                   "/",
+				BaseContentPackPath:           "base.html.tmpl",
+				SpecializationContentPackPath: "base.html.tmpl",
+				PageData:                      &manifestpb.PageData{Date: "2020-09-19T00:00:00Z"},
+			}}},
+		},
+	}
+	if _, err := loadHandler(makePack(t, manifest, testMember{name: "base.html.tmpl", content: "base"})); err == nil {
+		t.Errorf("pack with a badly formatted page date loaded")
+	}
+}
@@ -0,0 +1,148 @@
+package contentpack
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reloader serves the latest content pack from a Source.  New packs are swapped
+// in atomically: requests already being served finish with the pack they
+// started with, and no request sees a half-loaded pack.  If a new pack can't be
+// loaded, the previous one keeps being served.
+type Reloader struct {
+	source Source
+
+	// current holds the *Handler being served.
+	current atomic.Value
+
+	// lock serializes reloads.
+	lock    sync.Mutex
+	version string
+
+	// failedVersion is the last version that couldn't be loaded.  It's passed
+	// to the source as a known version, so polling doesn't keep fetching and
+	// retrying it.
+	failedVersion string
+}
+
+// NewReloader loads the content pack from source.  Unlike later reloads, the
+// first load has no previous pack to fall back on, so failing is an error.
+func NewReloader(ctx context.Context, source Source) (*Reloader, error) {
+	r := &Reloader{source: source}
+	if _, err := r.Reload(ctx, true); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload fetches the content pack, and starts serving it if it has changed (or
+// always, if force is set).  It reports whether a new pack was swapped in.  On
+// error, the previous pack is still served.
+func (r *Reloader) Reload(ctx context.Context, force bool) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var known []string
+	if !force {
+		for _, version := range []string{r.version, r.failedVersion} {
+			if version != "" {
+				known = append(known, version)
+			}
+		}
+	}
+	data, version, err := r.source.Fetch(ctx, known)
+	if err != nil {
+		return false, fmt.Errorf("while fetching content pack: %w", err)
+	}
+	// Sources that can't tell a version before fetching it still return the
+	// failed version's data.
+	if data == nil || (!force && version == r.failedVersion) {
+		return false, nil
+	}
+
+	h, err := loadHandler(data)
+	if err != nil {
+		r.failedVersion = version
+		return false, fmt.Errorf("while loading content pack version %s (still serving version %s): %w", version, r.version, err)
+	}
+
+	r.current.Store(h)
+	r.version = version
+	r.failedVersion = ""
+	log.Printf("Serving content pack version %s", version)
+	return true, nil
+}
+
+func loadHandler(data []byte) (*Handler, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("while opening zip: %w", err)
+	}
+	h, err := NewHandler(zr)
+	if err != nil {
+		return nil, fmt.Errorf("while creating handler: %w", err)
+	}
+	return h, nil
+}
+
+// Version is the version of the content pack being served.
+func (r *Reloader) Version() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.version
+}
+
+// Poll reloads the content pack every interval, until ctx is done.
+func (r *Reloader) Poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := r.Reload(ctx, false); err != nil {
+			log.Printf("Error while polling content pack: %v", err)
+		}
+	}
+}
+
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.current.Load().(*Handler).ServeHTTP(w, req)
+}
+
+// ReloadHandler triggers a reload on POST, for deploy scripts to call after
+// uploading a new pack.  A reload of an unchanged pack is a no-op unless the
+// request has force=true.
+func (r *Reloader) ReloadHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		swapped, err := r.Reload(req.Context(), req.FormValue("force") == "true")
+		if err != nil {
+			log.Printf("Error while reloading content pack: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if swapped {
+			fmt.Fprintf(w, "Reloaded content pack; now serving version %s\n", r.Version())
+		} else {
+			fmt.Fprintf(w, "Content pack unchanged; still serving version %s\n", r.Version())
+		}
+	})
+}
@@ -0,0 +1,268 @@
+package contentpack
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"row-major/webalator/packer/manifestpb"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/proto"
+)
+
+// testMember is a file in a content pack built by makePack.
+type testMember struct {
+	name    string
+	content string
+
+	// store keeps the member uncompressed.
+	store bool
+
+	// unmodified leaves the member's modification time unset, as the packer
+	// does.
+	unmodified bool
+}
+
+// packModified is the modification time of members of packs from makePack.
+var packModified = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// makePack builds a content pack from a manifest and its members.
+func makePack(t *testing.T, manifest *manifestpb.Manifest, members ...testMember) []byte {
+	t.Helper()
+
+	mb, err := proto.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("marshalling manifest: %v", err)
+	}
+	members = append(members, testMember{name: "manifest", content: string(mb)})
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, m := range members {
+		method := zip.Deflate
+		if m.store {
+			method = zip.Store
+		}
+		header := &zip.FileHeader{Name: m.name, Method: method, Modified: packModified}
+		if m.unmodified {
+			header.Modified = time.Time{}
+		}
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatalf("creating %v: %v", m.name, err)
+		}
+		if _, err := io.WriteString(w, m.content); err != nil {
+			t.Fatalf("writing %v: %v", m.name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("closing zip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// makeTextPack builds a content pack that serves content at /index.txt.
+func makeTextPack(t *testing.T, content string) []byte {
+	t.Helper()
+	manifest := &manifestpb.Manifest{
+		Servables: []*manifestpb.Servable{
+			{Entry: &manifestpb.Servable_Static{Static: &manifestpb.Static{
+				ServingPath:     "/index.txt",
+				ContentPackPath: "index.txt",
+				MimeType:        "text/plain",
+			}}},
+		},
+	}
+	return makePack(t, manifest, testMember{name: "index.txt", content: content})
+}
+
+// fakeSource serves one pack at a time, and records what it was asked for.
+type fakeSource struct {
+	data    []byte
+	version string
+
+	// bodyFetches counts the fetches that returned data.
+	bodyFetches int
+	lastKnown   []string
+}
+
+func (s *fakeSource) Fetch(ctx context.Context, known []string) ([]byte, string, error) {
+	s.lastKnown = known
+	if isKnown(known, s.version) {
+		return nil, s.version, nil
+	}
+	s.bodyFetches++
+	return s.data, s.version, nil
+}
+
+func getBody(t *testing.T, h http.Handler, target string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %v: got status %d", target, w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestReloader(t *testing.T) {
+	source := &fakeSource{data: makeTextPack(t, "one"), version: "v1"}
+	r, err := NewReloader(context.Background(), source)
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+
+	steps := []struct {
+		name string
+
+		// data and version, if set, replace the source's pack.
+		data    []byte
+		version string
+		force   bool
+
+		wantSwapped     bool
+		wantErr         bool
+		wantKnown       []string
+		wantBodyFetches int
+		wantVersion     string
+		wantBody        string
+	}{
+		{
+			name:            "unchanged",
+			wantKnown:       []string{"v1"},
+			wantBodyFetches: 1,
+			wantVersion:     "v1",
+			wantBody:        "one",
+		},
+		{
+			name:            "new pack",
+			data:            makeTextPack(t, "two"),
+			version:         "v2",
+			wantSwapped:     true,
+			wantKnown:       []string{"v1"},
+			wantBodyFetches: 2,
+			wantVersion:     "v2",
+			wantBody:        "two",
+		},
+		{
+			name:            "bad pack rolls back",
+			data:            []byte("not a zip"),
+			version:         "v3",
+			wantErr:         true,
+			wantKnown:       []string{"v2"},
+			wantBodyFetches: 3,
+			wantVersion:     "v2",
+			wantBody:        "two",
+		},
+		{
+			name:            "failed version isn't fetched again",
+			wantKnown:       []string{"v2", "v3"},
+			wantBodyFetches: 3,
+			wantVersion:     "v2",
+			wantBody:        "two",
+		},
+		{
+			name:            "force retries failed version",
+			force:           true,
+			wantErr:         true,
+			wantBodyFetches: 4,
+			wantVersion:     "v2",
+			wantBody:        "two",
+		},
+		{
+			name:            "manifest without its members",
+			data:            makePack(t, &manifestpb.Manifest{Servables: []*manifestpb.Servable{{Entry: &manifestpb.Servable_Static{Static: &manifestpb.Static{ServingPath: "/missing", ContentPackPath: "missing"}}}}}),
+			version:         "v4",
+			wantErr:         true,
+			wantKnown:       []string{"v2", "v3"},
+			wantBodyFetches: 5,
+			wantVersion:     "v2",
+			wantBody:        "two",
+		},
+		{
+			name:            "good pack after failure",
+			data:            makeTextPack(t, "five"),
+			version:         "v5",
+			wantSwapped:     true,
+			wantKnown:       []string{"v2", "v4"},
+			wantBodyFetches: 6,
+			wantVersion:     "v5",
+			wantBody:        "five",
+		},
+		{
+			name:            "failed version forgotten after success",
+			wantKnown:       []string{"v5"},
+			wantBodyFetches: 6,
+			wantVersion:     "v5",
+			wantBody:        "five",
+		},
+	}
+
+	for _, step := range steps {
+		if step.version != "" {
+			source.data, source.version = step.data, step.version
+		}
+
+		swapped, err := r.Reload(context.Background(), step.force)
+		if (err != nil) != step.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", step.name, err, step.wantErr)
+		}
+		if swapped != step.wantSwapped {
+			t.Errorf("%s: got swapped %v, want %v", step.name, swapped, step.wantSwapped)
+		}
+		if diff := cmp.Diff(step.wantKnown, source.lastKnown); diff != "" {
+			t.Errorf("%s: known versions mismatch (-want +got):\n%s", step.name, diff)
+		}
+		if source.bodyFetches != step.wantBodyFetches {
+			t.Errorf("%s: got %d body fetches, want %d", step.name, source.bodyFetches, step.wantBodyFetches)
+		}
+		if got := r.Version(); got != step.wantVersion {
+			t.Errorf("%s: serving version %q, want %q", step.name, got, step.wantVersion)
+		}
+		if got := getBody(t, r, "/index.txt"); got != step.wantBody {
+			t.Errorf("%s: served %q, want %q", step.name, got, step.wantBody)
+		}
+	}
+}
+
+func TestNewReloaderFailsOnBadPack(t *testing.T) {
+	source := &fakeSource{data: []byte("not a zip"), version: "v1"}
+	if _, err := NewReloader(context.Background(), source); err == nil {
+		t.Errorf("NewReloader succeeded with a bad pack")
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	source := &fakeSource{data: makeTextPack(t, "one"), version: "v1"}
+	r, err := NewReloader(context.Background(), source)
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	h := r.ReloadHandler()
+
+	testCases := []struct {
+		method     string
+		target     string
+		wantStatus int
+	}{
+		{http.MethodGet, "/reload", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/reload", http.StatusOK},
+		{http.MethodPost, "/reload?force=true", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, nil))
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.target, w.Code, tc.wantStatus)
+		}
+	}
+	if source.bodyFetches != 2 {
+		t.Errorf("got %d body fetches, want 2 (the first load, and the forced reload)", source.bodyFetches)
+	}
+}
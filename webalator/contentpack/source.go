@@ -0,0 +1,195 @@
+package contentpack
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Source fetches a content pack from wherever it's kept.
+type Source interface {
+	// Fetch returns the content pack, and a version string that changes
+	// whenever the pack does.  If the pack is at one of the known versions,
+	// Fetch may return nil data instead of fetching it again.
+	Fetch(ctx context.Context, known []string) (data []byte, version string, err error)
+}
+
+// NewSource returns a source for the content pack at rawURL, which is a
+// file://, gs://, or https:// URL.
+func NewSource(ctx context.Context, rawURL string) (Source, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing content pack URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return &fileSource{path: strings.TrimPrefix(rawURL, "file://")}, nil
+	case "gs":
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("while creating GCS client: %w", err)
+		}
+		return &gcsSource{
+			object: client.Bucket(u.Host).Object(strings.TrimPrefix(u.Path, "/")),
+		}, nil
+	case "https", "http":
+		return &httpSource{url: rawURL, client: http.DefaultClient}, nil
+	default:
+		return nil, fmt.Errorf("unsupported content pack URL scheme %q", u.Scheme)
+	}
+}
+
+// isKnown reports whether version is one of the known versions.
+func isKnown(known []string, version string) bool {
+	for _, k := range known {
+		if k == version {
+			return true
+		}
+	}
+	return false
+}
+
+type fileSource struct {
+	path string
+}
+
+func (s *fileSource) Fetch(ctx context.Context, known []string) ([]byte, string, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, "", fmt.Errorf("while checking content pack: %w", err)
+	}
+
+	version := fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+	if isKnown(known, version) {
+		return nil, version, nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, "", fmt.Errorf("while reading content pack: %w", err)
+	}
+	return data, version, nil
+}
+
+type gcsSource struct {
+	object *storage.ObjectHandle
+}
+
+// Fetch uses the object's generation as its version, and reads that
+// generation, so that an upload racing with the fetch can't mix two packs.
+func (s *gcsSource) Fetch(ctx context.Context, known []string) ([]byte, string, error) {
+	attrs, err := s.object.Attrs(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("while getting content pack attributes: %w", err)
+	}
+
+	version := strconv.FormatInt(attrs.Generation, 10)
+	if isKnown(known, version) {
+		return nil, version, nil
+	}
+
+	r, err := s.object.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("while opening content pack: %w", err)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("while reading content pack: %w", err)
+	}
+	return data, version, nil
+}
+
+type httpSource struct {
+	url    string
+	client *http.Client
+}
+
+// Versions of packs fetched over HTTP come from the response's validators, so
+// that known packs can be checked for with a conditional request.  Servers
+// without validators get a hash of the pack instead, which can only be checked
+// after fetching it.
+const (
+	etagVersionPrefix         = "etag:"
+	lastModifiedVersionPrefix = "last-modified:"
+	hashVersionPrefix         = "sha256:"
+)
+
+// Fetch asks for the pack unless it matches one of the known versions.  All
+// known entity tags go in If-None-Match; of the known modification times, only
+// the latest can go in If-Modified-Since.
+func (s *httpSource) Fetch(ctx context.Context, known []string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("while creating request: %w", err)
+	}
+
+	var etags []string
+	var lastModified string
+	var lastModifiedTime time.Time
+	for _, version := range known {
+		switch {
+		case strings.HasPrefix(version, etagVersionPrefix):
+			etags = append(etags, strings.TrimPrefix(version, etagVersionPrefix))
+		case strings.HasPrefix(version, lastModifiedVersionPrefix):
+			t, err := http.ParseTime(strings.TrimPrefix(version, lastModifiedVersionPrefix))
+			if err == nil && t.After(lastModifiedTime) {
+				lastModified, lastModifiedTime = version, t
+			}
+		}
+	}
+	if len(etags) != 0 {
+		req.Header.Set("If-None-Match", strings.Join(etags, ", "))
+	} else if lastModified != "" {
+		req.Header.Set("If-Modified-Since", strings.TrimPrefix(lastModified, lastModifiedVersionPrefix))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("while fetching content pack: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		// The response names the entity tag that matched; servers that
+		// don't are assumed to mean the first.
+		if len(etags) == 0 {
+			return nil, lastModified, nil
+		}
+		if version := etagVersionPrefix + resp.Header.Get("ETag"); isKnown(known, version) {
+			return nil, version, nil
+		}
+		return nil, etagVersionPrefix + etags[0], nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("while fetching content pack: got status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("while reading content pack: %w", err)
+	}
+
+	var version string
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		version = etagVersionPrefix + etag
+	} else if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		version = lastModifiedVersionPrefix + lastModified
+	} else {
+		sum := sha256.Sum256(data)
+		version = hashVersionPrefix + hex.EncodeToString(sum[:])
+	}
+	return data, version, nil
+}
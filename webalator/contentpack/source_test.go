@@ -0,0 +1,224 @@
+package contentpack
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// packServer serves a pack the way a web server or object store would, with
+// whichever validators it's configured with.
+type packServer struct {
+	data         []byte
+	etag         string
+	lastModified time.Time
+
+	// status, if set, is returned instead of the pack.
+	status int
+
+	lastQuery http.Header
+}
+
+func (s *packServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lastQuery = r.Header.Clone()
+	if s.status != 0 {
+		http.Error(w, http.StatusText(s.status), s.status)
+		return
+	}
+	if s.etag == "" && s.lastModified.IsZero() {
+		w.Write(s.data)
+		return
+	}
+	if s.etag != "" {
+		w.Header().Set("ETag", s.etag)
+	}
+	http.ServeContent(w, r, "", s.lastModified, bytes.NewReader(s.data))
+}
+
+func TestHTTPSourceFetch(t *testing.T) {
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	lastModifiedVersion := "last-modified:" + modified.Format(http.TimeFormat)
+	hashVersion := "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+	testCases := []struct {
+		name   string
+		server *packServer
+		known  []string
+
+		wantIfNoneMatch     string
+		wantIfModifiedSince string
+		wantData            bool
+		wantVersion         string
+		wantErr             bool
+	}{
+		{
+			name:        "etag, first fetch",
+			server:      &packServer{data: []byte("foo"), etag: `"a"`},
+			wantData:    true,
+			wantVersion: `etag:"a"`,
+		},
+		{
+			name:            "etag, unchanged",
+			server:          &packServer{data: []byte("foo"), etag: `"a"`},
+			known:           []string{`etag:"a"`},
+			wantIfNoneMatch: `"a"`,
+			wantVersion:     `etag:"a"`,
+		},
+		{
+			name:            "etag, changed",
+			server:          &packServer{data: []byte("foo"), etag: `"b"`},
+			known:           []string{`etag:"a"`},
+			wantIfNoneMatch: `"a"`,
+			wantData:        true,
+			wantVersion:     `etag:"b"`,
+		},
+		{
+			name:            "etag, at a failed version",
+			server:          &packServer{data: []byte("foo"), etag: `"b"`},
+			known:           []string{`etag:"a"`, `etag:"b"`},
+			wantIfNoneMatch: `"a", "b"`,
+			wantVersion:     `etag:"b"`,
+		},
+		{
+			name:        "last-modified, first fetch",
+			server:      &packServer{data: []byte("foo"), lastModified: modified},
+			wantData:    true,
+			wantVersion: lastModifiedVersion,
+		},
+		{
+			name:                "last-modified, unchanged",
+			server:              &packServer{data: []byte("foo"), lastModified: modified},
+			known:               []string{lastModifiedVersion},
+			wantIfModifiedSince: modified.Format(http.TimeFormat),
+			wantVersion:         lastModifiedVersion,
+		},
+		{
+			name:                "last-modified, changed",
+			server:              &packServer{data: []byte("foo"), lastModified: modified.Add(time.Hour)},
+			known:               []string{lastModifiedVersion},
+			wantIfModifiedSince: modified.Format(http.TimeFormat),
+			wantData:            true,
+			wantVersion:         "last-modified:" + modified.Add(time.Hour).Format(http.TimeFormat),
+		},
+		{
+			name:   "last-modified, at a failed version",
+			server: &packServer{data: []byte("foo"), lastModified: modified},
+			known: []string{
+				"last-modified:" + modified.Add(-time.Hour).Format(http.TimeFormat),
+				lastModifiedVersion,
+			},
+			wantIfModifiedSince: modified.Format(http.TimeFormat),
+			wantVersion:         lastModifiedVersion,
+		},
+		{
+			name:        "no validators",
+			server:      &packServer{data: []byte("foo")},
+			wantData:    true,
+			wantVersion: hashVersion,
+		},
+		{
+			name:        "no validators, unchanged",
+			server:      &packServer{data: []byte("foo")},
+			known:       []string{hashVersion},
+			wantData:    true,
+			wantVersion: hashVersion,
+		},
+		{
+			name:    "error status",
+			server:  &packServer{status: http.StatusForbidden},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(tc.server)
+			defer server.Close()
+
+			s := &httpSource{url: server.URL, client: server.Client()}
+			data, version, err := s.Fetch(context.Background(), tc.known)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+
+			if got := tc.server.lastQuery.Get("If-None-Match"); got != tc.wantIfNoneMatch {
+				t.Errorf("got If-None-Match %q, want %q", got, tc.wantIfNoneMatch)
+			}
+			if got := tc.server.lastQuery.Get("If-Modified-Since"); got != tc.wantIfModifiedSince {
+				t.Errorf("got If-Modified-Since %q, want %q", got, tc.wantIfModifiedSince)
+			}
+			if tc.wantData && string(data) != "foo" {
+				t.Errorf("got data %q, want foo", data)
+			}
+			if !tc.wantData && data != nil {
+				t.Errorf("got data %q, want none", data)
+			}
+			if version != tc.wantVersion {
+				t.Errorf("got version %q, want %q", version, tc.wantVersion)
+			}
+		})
+	}
+}
+
+func TestHTTPSourceWithReloader(t *testing.T) {
+	server := &packServer{data: makeTextPack(t, "one"), etag: `"1"`}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	r, err := NewReloader(context.Background(), &httpSource{url: ts.URL, client: ts.Client()})
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+
+	server.data, server.etag = []byte("not a zip"), `"2"`
+	if _, err := r.Reload(context.Background(), false); err == nil {
+		t.Fatalf("Reload of a bad pack succeeded")
+	}
+
+	// Polling again shouldn't fetch the bad pack's body.
+	if swapped, err := r.Reload(context.Background(), false); swapped || err != nil {
+		t.Errorf("got swapped %v, error %v on the second poll; want false, nil", swapped, err)
+	}
+	if got, want := server.lastQuery.Get("If-None-Match"), `"1", "2"`; got != want {
+		t.Errorf("got If-None-Match %q, want %q", got, want)
+	}
+	if got := r.Version(); got != `etag:"1"` {
+		t.Errorf("serving version %q, want etag:\"1\"", got)
+	}
+	if got := getBody(t, r, "/index.txt"); got != "one" {
+		t.Errorf("served %q, want one", got)
+	}
+}
+
+func TestFileSourceFetch(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "pack.zip")
+	if err := os.WriteFile(fileName, []byte("foo"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fileSource{path: fileName}
+	data, version, err := s.Fetch(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if string(data) != "foo" || !strings.HasSuffix(version, "-3") {
+		t.Errorf("got data %q, version %q; want foo, a 3-byte version", data, version)
+	}
+
+	data, again, err := s.Fetch(context.Background(), []string{"other", version})
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if data != nil || again != version {
+		t.Errorf("got data %q, version %q for a known version; want none, %q", data, again, version)
+	}
+}
@@ -0,0 +1,173 @@
+// Package harpoonscenes serves harpoon scene files as JSON scene descriptions,
+// for the previewer in the webgl-raytracer article.
+//
+// Routes, relative to the path prefix:
+//
+//	/          JSON list of the names of the scenes in the scene directory.
+//	/{name}    The scene description for the named scene file.
+package harpoonscenes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"row-major/harpoon/sceneload"
+	"row-major/harpoon/webexport"
+)
+
+type Site struct {
+	pathPrefix string
+	sceneDir   string
+
+	// Exported scenes, reused until their files change.  Scene files are
+	// edited while cameras are being framed, so the cache is keyed on
+	// modification time.
+	cacheMutex sync.Mutex
+	cache      map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	modTime time.Time
+	data    []byte
+}
+
+func New(pathPrefix, sceneDir string) (*Site, error) {
+	if len(pathPrefix) > 0 && pathPrefix[len(pathPrefix)-1] == '/' {
+		return nil, fmt.Errorf("pathPrefix should not end in /")
+	}
+
+	info, err := os.Stat(sceneDir)
+	if err != nil {
+		return nil, fmt.Errorf("while checking scene dir: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("scene dir %q is not a directory", sceneDir)
+	}
+
+	return &Site{
+		pathPrefix: pathPrefix,
+		sceneDir:   sceneDir,
+		cache:      map[string]cacheEntry{},
+	}, nil
+}
+
+func (s *Site) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefix := s.pathPrefix + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+
+	if name == "" {
+		s.handlerListScenes(w, r)
+		return
+	}
+
+	s.handlerGetScene(name, w, r)
+}
+
+func writeJSON(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error while writing http response: %v", err)
+	}
+}
+
+func (s *Site) handlerListScenes(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(s.sceneDir)
+	if err != nil {
+		log.Printf("harpoonscenes: while listing scene dir: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	names := []string{}
+	for _, e := range entries {
+		if e.Type().IsRegular() && sceneload.IsSceneFile(e.Name()) && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	data, err := json.Marshal(names)
+	if err != nil {
+		log.Printf("harpoonscenes: while marshaling scene list: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, data)
+}
+
+func (s *Site) handlerGetScene(name string, w http.ResponseWriter, r *http.Request) {
+	// Only serve scene files directly inside the scene dir.
+	if strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") || !sceneload.IsSceneFile(name) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := s.exportScene(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("harpoonscenes: %v", err)
+		http.Error(w, fmt.Sprintf("Error loading scene %q", name), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, data)
+}
+
+// exportScene loads and exports the named scene file, or returns the cached
+// export if the file hasn't changed since.
+func (s *Site) exportScene(name string) ([]byte, error) {
+	path := filepath.Join(s.sceneDir, name)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cacheMutex.Lock()
+	entry, ok := s.cache[name]
+	s.cacheMutex.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) {
+		return entry.data, nil
+	}
+
+	theScene, warnings, err := sceneload.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("while loading scene %q: %w", name, err)
+	}
+
+	exported := webexport.Export(theScene)
+	exported.Warnings = append(warnings, exported.Warnings...)
+
+	data, err := json.Marshal(exported)
+	if err != nil {
+		return nil, fmt.Errorf("while marshaling scene %q: %w", name, err)
+	}
+
+	s.cacheMutex.Lock()
+	s.cache[name] = cacheEntry{modTime: info.ModTime(), data: data}
+	s.cacheMutex.Unlock()
+
+	return data, nil
+}
@@ -1,20 +1,19 @@
 package main
 
 import (
-	"archive/zip"
 	"context"
 	"flag"
 	"net/http"
 	"os"
 	"os/signal"
 	"row-major/webalator/contentpack"
+	"row-major/webalator/harpoonscenes"
 	"row-major/webalator/healthz"
 	"row-major/webalator/httpmetrics"
 	"row-major/webalator/imgalator"
 	"row-major/webalator/mdredir"
 	"row-major/webalator/proxyipreflect"
 	"row-major/webalator/site"
-	"strings"
 	"syscall"
 	"time"
 
@@ -29,7 +28,9 @@ import (
 var (
 	listen      = flag.String("listen", "0.0.0.0:8080", "Where should we listen for incoming connections?")
 	debugListen = flag.String("debug-listen", "0.0.0.0:8081", "Where should we listen for the debug interface?")
-	contentPack = flag.String("content-pack", "", "URL of the content pack to serve.")
+	contentPack = flag.String("content-pack", "", "URL of the content pack to serve: file://, gs://, or https://.")
+
+	contentPackPollInterval = flag.Duration("content-pack-poll-interval", 0, "How often to check the content pack for changes; if zero, it's only reloaded by POSTing to /reload-content-pack on the debug listener")
 
 	enableProfiling = flag.Bool("enable-profiling", false, "")
 	enableTracing   = flag.Bool("enable-tracing", false, "")
@@ -37,6 +38,8 @@ var (
 	enableMetrics   = flag.Bool("enable-metrics", false, "")
 
 	imgalatorBucket = flag.String("imgalator-bucket", "", "Bucket to access using imgalator")
+
+	harpoonSceneDir = flag.String("harpoon-scene-dir", "", "Directory of harpoon scene files to serve to the webgl-raytracer previewer; if empty, they aren't served")
 )
 
 func main() {
@@ -48,14 +51,16 @@ func main() {
 	glog.Infof("listen: %v", *listen)
 	glog.Infof("debug-listen: %v", *debugListen)
 	glog.Infof("content-pack: %v", *contentPack)
+	glog.Infof("content-pack-poll-interval: %v", *contentPackPollInterval)
 	glog.Infof("enable-profiling: %v", *enableProfiling)
 	glog.Infof("enable-tracing: %v", *enableTracing)
 	glog.Infof("tracing-ratio: %v", *tracingRatio)
 	glog.Infof("enable-metrics: %v", *enableMetrics)
 
 	glog.Infof("imgalator-bucket: %v", *imgalatorBucket)
+	glog.Infof("harpoon-scene-dir: %v", *harpoonSceneDir)
 
-	_, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// Cloud Profiler initialization, best done as early as possible.
@@ -100,25 +105,20 @@ func main() {
 	}
 	glog.Infof("Running from: %s", dir)
 
-	var contentPackReader *zip.ReadCloser
-	if strings.HasPrefix(*contentPack, "file://") {
-		filePath := strings.TrimPrefix(*contentPack, "file://")
-		reader, err := zip.OpenReader(filePath)
-		if err != nil {
-			glog.Fatalf("Error opening content pack: %v", err)
-		}
-		contentPackReader = reader
-	} else {
-		glog.Fatalf("Unsupported content pack: %v", *contentPack)
+	contentPackSource, err := contentpack.NewSource(ctx, *contentPack)
+	if err != nil {
+		glog.Fatalf("Error opening content pack: %v", err)
 	}
-	defer contentPackReader.Close()
 
-	contentPackHandler, err := contentpack.NewHandler(&contentPackReader.Reader)
+	contentPackReloader, err := contentpack.NewReloader(ctx, contentPackSource)
 	if err != nil {
-		glog.Fatalf("Error while creating content pack handler: %v", err)
+		glog.Fatalf("Error while loading content pack: %v", err)
+	}
+	if *contentPackPollInterval > 0 {
+		go contentPackReloader.Poll(ctx, *contentPackPollInterval)
 	}
 
-	site, err := site.New(contentPackHandler)
+	site, err := site.New(contentPackReloader)
 	if err != nil {
 		glog.Fatalf("Error creating site: %v", err)
 	}
@@ -130,6 +130,7 @@ func main() {
 
 	debugServeMux := http.NewServeMux()
 	debugServeMux.Handle("/healthz", healthz.New())
+	debugServeMux.Handle("/reload-content-pack", contentPackReloader.ReloadHandler())
 	debugServer := &http.Server{
 		Addr:    *debugListen,
 		Handler: debugServeMux,
@@ -142,6 +143,13 @@ func main() {
 	serveMux := http.NewServeMux()
 	serveMux.Handle("/", site.Mux)
 	serveMux.Handle("/imgalator/", imgalator)
+	if *harpoonSceneDir != "" {
+		harpoonScenes, err := harpoonscenes.New("/harpoon-scenes", *harpoonSceneDir)
+		if err != nil {
+			glog.Fatalf("Error creating harpoon scene server: %v", err)
+		}
+		serveMux.Handle("/harpoon-scenes/", harpoonScenes)
+	}
 	serveMux.Handle("/metadata-redirect", mdredir.New())
 	serveMux.Handle("/proxy-ip-reflect", proxyipreflect.New())
 	serveMux.Handle("/healthz", healthz.New())
@@ -9,6 +9,10 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
@@ -16,10 +20,13 @@ import (
 	"mime"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"row-major/webalator/packer/manifestpb"
 
+	"github.com/andybalholm/brotli"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -29,12 +36,18 @@ var (
 	staticFileTrimPrefix   = flag.String("static_file_trim_prefix", "", "Prefix to trim from static files.")
 	templateFiles          = &StringSliceFlag{}
 	templateFileTrimPrefix = flag.String("template_file_trim_prefix", "", "Prefix to trim from template files.")
-	templateBaseFile       = flag.String("template_base_file", "", "Base file for all templates.")
+	templateBaseFiles      = &StringSliceFlag{}
+	templatePartialFiles   = &StringSliceFlag{}
+	buildVersion           = flag.String("build_version", "", "Build version to show in templates.  Defaults to a hash of the pack's inputs.")
+	cachePolicies          = &StringSliceFlag{}
 )
 
 func init() {
 	flag.Var(staticFiles, "static_file", "A raw file to add to the content pack.")
 	flag.Var(templateFiles, "template_file", "A golang html template to add to the content pack.")
+	flag.Var(templateBaseFiles, "template_base_file", "A base template, for the templates in its directory and below.")
+	flag.Var(templatePartialFiles, "template_partial_file", "A partial template, for the templates in its directory and below.")
+	flag.Var(cachePolicies, "cache_policy", "PATTERN=CACHE_CONTROL: the Cache-Control header to serve for paths matching PATTERN.  The first matching policy applies.")
 }
 
 // StringSliceFlag is a flag.Value that collects string values from multiple
@@ -62,7 +75,18 @@ type Packer struct {
 
 	TemplateFiles          []string
 	TemplateFileTrimPrefix string
-	TemplateBaseFile       string
+
+	// Each template is parsed over the base template in the nearest
+	// directory at or above it, and the partials in all of those
+	// directories.
+	TemplateBaseFiles    []string
+	TemplatePartialFiles []string
+
+	// BuildVersion defaults to a hash of the pack's inputs.
+	BuildVersion string
+
+	// CachePolicies are PATTERN=CACHE_CONTROL pairs.
+	CachePolicies []string
 }
 
 func (p *Packer) Do() error {
@@ -77,23 +101,44 @@ func (p *Packer) Do() error {
 
 	manifest := &manifestpb.Manifest{}
 
-	if err := p.addStatics(zw, manifest); err != nil {
+	for _, policy := range p.CachePolicies {
+		pattern, cacheControl, ok := strings.Cut(policy, "=")
+		if !ok {
+			return fmt.Errorf("cache policy %q isn't of the form PATTERN=CACHE_CONTROL", policy)
+		}
+		manifest.CachePolicies = append(manifest.CachePolicies, &manifestpb.CachePolicy{
+			Pattern:      pattern,
+			CacheControl: cacheControl,
+		})
+	}
+
+	inputsHash := sha256.New()
+
+	if err := p.addStatics(zw, manifest, inputsHash); err != nil {
 		return fmt.Errorf("while adding statics: %w", err)
 	}
 
-	// Add single base template to content pack.
-	//
-	// TODO: Support building content packs with multiple base templates.  The
-	// manifest format already supports it, we just need packer and the Bazel
-	// rules to let us specify a per-template base.
-	if err := p.addBaseTemplate(zw, manifest); err != nil {
-		return fmt.Errorf("while adding base template: %w", err)
+	bases, err := p.addBaseTemplates(zw, inputsHash)
+	if err != nil {
+		return fmt.Errorf("while adding base templates: %w", err)
+	}
+
+	partials, err := p.addPartials(zw, inputsHash)
+	if err != nil {
+		return fmt.Errorf("while adding partials: %w", err)
 	}
 
-	if err := p.addGoTemplates(zw, manifest); err != nil {
+	if err := p.addGoTemplates(zw, manifest, bases, partials, inputsHash); err != nil {
 		return fmt.Errorf("while adding go templates: %w", err)
 	}
 
+	manifest.SiteData = &manifestpb.SiteData{
+		BuildVersion: p.BuildVersion,
+	}
+	if manifest.SiteData.BuildVersion == "" {
+		manifest.SiteData.BuildVersion = hex.EncodeToString(inputsHash.Sum(nil))[:12]
+	}
+
 	manifestBytes, err := proto.Marshal(manifest)
 	if err != nil {
 		return fmt.Errorf("while marshalling manifest: %w", err)
@@ -111,14 +156,10 @@ func (p *Packer) Do() error {
 	return nil
 }
 
-func (p *Packer) addStatics(zw *zip.Writer, manifest *manifestpb.Manifest) error {
+func (p *Packer) addStatics(zw *zip.Writer, manifest *manifestpb.Manifest, inputsHash io.Writer) error {
 	for _, staticPath := range p.StaticFiles {
 		trimmedPath := strings.TrimPrefix(staticPath, p.StaticFileTrimPrefix)
-
-		w, err := zw.Create(trimmedPath)
-		if err != nil {
-			return fmt.Errorf("while creating zip static file member %v: %w", trimmedPath, err)
-		}
+		mimeType := mime.TypeByExtension(path.Ext(trimmedPath))
 
 		r, err := os.Open(staticPath)
 		if err != nil {
@@ -126,17 +167,52 @@ func (p *Packer) addStatics(zw *zip.Writer, manifest *manifestpb.Manifest) error
 		}
 		defer r.Close()
 
-		if _, err := io.Copy(w, r); err != nil {
+		// Only the name and method go in the header, like members added with
+		// zw.Create.  The file's modification time and mode would make the
+		// pack differ on every build of the same content.
+		header := &zip.FileHeader{
+			Name:   trimmedPath,
+			Method: zip.Deflate,
+		}
+		if isCompressed(mimeType) {
+			// Compressing these again wouldn't save anything, and stored
+			// members can be served in byte ranges without decompressing.
+			header.Method = zip.Store
+		}
+
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return fmt.Errorf("while creating zip static file member %v: %w", trimmedPath, err)
+		}
+
+		hash := sha256.New()
+		size, err := io.Copy(io.MultiWriter(w, hash), r)
+		if err != nil {
 			return fmt.Errorf("while writing zip static file member %v: %w", staticPath, err)
 		}
 
+		static := &manifestpb.Static{
+			ServingPath:     "/" + trimmedPath,
+			ContentPackPath: trimmedPath,
+			MimeType:        mimeType,
+			Sha256:          hex.EncodeToString(hash.Sum(nil)),
+			Size:            size,
+		}
+		fmt.Fprintf(inputsHash, "static %s %s\n", static.ContentPackPath, static.Sha256)
+
+		// Variants are served under the original's Content-Type, so files
+		// without a known one don't get any.
+		if mimeType != "" && !isCompressed(mimeType) {
+			variants, err := addEncodedVariants(zw, header, staticPath)
+			if err != nil {
+				return fmt.Errorf("while adding encoded variants of %v: %w", staticPath, err)
+			}
+			static.EncodedVariants = variants
+		}
+
 		manifest.Servables = append(manifest.Servables, &manifestpb.Servable{
 			Entry: &manifestpb.Servable_Static{
-				Static: &manifestpb.Static{
-					ServingPath:     "/" + trimmedPath,
-					ContentPackPath: trimmedPath,
-					MimeType:        mime.TypeByExtension(path.Ext(trimmedPath)),
-				},
+				Static: static,
 			},
 		})
 	}
@@ -144,46 +220,181 @@ func (p *Packer) addStatics(zw *zip.Writer, manifest *manifestpb.Manifest) error
 	return nil
 }
 
-func (p *Packer) addBaseTemplate(zw *zip.Writer, manifest *manifestpb.Manifest) error {
-	trimmedPath := strings.TrimPrefix(p.TemplateBaseFile, p.TemplateFileTrimPrefix)
+// contentEncoders are the encodings that statics are precompressed with, in
+// the order that the server prefers them.
+var contentEncoders = []struct {
+	contentEncoding string
+	extension       string
+	newWriter       func(w io.Writer) io.WriteCloser
+}{
+	{
+		contentEncoding: "br",
+		extension:       ".br",
+		newWriter: func(w io.Writer) io.WriteCloser {
+			return brotli.NewWriterLevel(w, brotli.BestCompression)
+		},
+	},
+	{
+		contentEncoding: "gzip",
+		extension:       ".gz",
+		newWriter: func(w io.Writer) io.WriteCloser {
+			zw, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+			return zw
+		},
+	},
+}
 
-	w, err := zw.Create(trimmedPath)
+// addEncodedVariants adds precompressed copies of a static file to the pack,
+// next to the original.  Variants that don't save at least a tenth of the
+// original's size aren't worth the bytes in the pack, and are dropped.
+func addEncodedVariants(zw *zip.Writer, header *zip.FileHeader, staticPath string) ([]*manifestpb.EncodedVariant, error) {
+	data, err := os.ReadFile(staticPath)
 	if err != nil {
-		return fmt.Errorf("while creating zip member %v: %w", trimmedPath, err)
+		return nil, fmt.Errorf("while reading static file: %w", err)
+	}
+
+	var variants []*manifestpb.EncodedVariant
+	for _, encoder := range contentEncoders {
+		buf := &bytes.Buffer{}
+		ew := encoder.newWriter(buf)
+		if _, err := ew.Write(data); err != nil {
+			return nil, fmt.Errorf("while encoding with %v: %w", encoder.contentEncoding, err)
+		}
+		if err := ew.Close(); err != nil {
+			return nil, fmt.Errorf("while encoding with %v: %w", encoder.contentEncoding, err)
+		}
+
+		if buf.Len() > len(data)-len(data)/10 {
+			continue
+		}
+
+		// Store the variant as-is, so that it can be served in byte ranges
+		// without decompressing anything.
+		variantHeader := &zip.FileHeader{
+			Name:   header.Name + encoder.extension,
+			Method: zip.Store,
+		}
+		w, err := zw.CreateHeader(variantHeader)
+		if err != nil {
+			return nil, fmt.Errorf("while creating zip member %v: %w", variantHeader.Name, err)
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return nil, fmt.Errorf("while writing zip member %v: %w", variantHeader.Name, err)
+		}
+
+		variants = append(variants, &manifestpb.EncodedVariant{
+			ContentEncoding: encoder.contentEncoding,
+			ContentPackPath: variantHeader.Name,
+			Size:            int64(buf.Len()),
+		})
+	}
+	return variants, nil
+}
+
+// isCompressed reports whether files of the given MIME type are already
+// compressed.
+func isCompressed(mimeType string) bool {
+	mediaType, _, _ := strings.Cut(mimeType, ";")
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "video/"), strings.HasPrefix(mediaType, "audio/"):
+		return true
+	}
+	switch mediaType {
+	case "application/pdf", "application/zip", "application/gzip", "font/woff", "font/woff2":
+		return true
 	}
+	return false
+}
 
-	r, err := os.Open(p.TemplateBaseFile)
+// addTemplateMember copies a template file into the content pack, and returns
+// its content pack path and contents.
+func (p *Packer) addTemplateMember(zw *zip.Writer, templatePath string, inputsHash io.Writer) (string, []byte, error) {
+	trimmedPath := strings.TrimPrefix(templatePath, p.TemplateFileTrimPrefix)
+
+	data, err := os.ReadFile(templatePath)
 	if err != nil {
-		return fmt.Errorf("while reading %v: %w", p.TemplateBaseFile, err)
+		return "", nil, fmt.Errorf("while reading %v: %w", templatePath, err)
 	}
-	defer r.Close()
 
-	if _, err := io.Copy(w, r); err != nil {
-		return fmt.Errorf("while writing zip member %v: %w", trimmedPath, err)
+	w, err := zw.Create(trimmedPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("while creating zip member %v: %w", trimmedPath, err)
 	}
 
-	// Don't add the base template to the manifest.
+	if _, err := w.Write(data); err != nil {
+		return "", nil, fmt.Errorf("while writing zip member %v: %w", trimmedPath, err)
+	}
 
-	return nil
+	fmt.Fprintf(inputsHash, "template %s %x\n", trimmedPath, sha256.Sum256(data))
+	return trimmedPath, data, nil
 }
 
-func (p *Packer) addGoTemplates(zw *zip.Writer, manifest *manifestpb.Manifest) error {
-	for _, templatePath := range p.TemplateFiles {
-		trimmedPath := strings.TrimPrefix(templatePath, p.TemplateFileTrimPrefix)
-
-		w, err := zw.Create(trimmedPath)
+// addBaseTemplates adds the base templates to the content pack, and returns
+// their content pack paths by directory.
+func (p *Packer) addBaseTemplates(zw *zip.Writer, inputsHash io.Writer) (map[string]string, error) {
+	bases := map[string]string{}
+	for _, basePath := range p.TemplateBaseFiles {
+		trimmedPath, _, err := p.addTemplateMember(zw, basePath, inputsHash)
 		if err != nil {
-			return fmt.Errorf("while creating zip template member %v: %w", trimmedPath, err)
+			return nil, fmt.Errorf("while adding base template: %w", err)
 		}
 
-		r, err := os.Open(templatePath)
+		dir := path.Dir(trimmedPath)
+		if other, ok := bases[dir]; ok {
+			return nil, fmt.Errorf("directory %v has two base templates, %v and %v", dir, other, trimmedPath)
+		}
+		bases[dir] = trimmedPath
+	}
+
+	// Don't add the base templates to the manifest.
+
+	return bases, nil
+}
+
+// addPartials adds the partial templates to the content pack, and returns them
+// by directory.  A partial is named for its file, without the leading
+// underscore or extensions: _article-list.html.tmpl is "article-list".
+func (p *Packer) addPartials(zw *zip.Writer, inputsHash io.Writer) (map[string][]*manifestpb.Partial, error) {
+	partials := map[string][]*manifestpb.Partial{}
+	for _, partialPath := range p.TemplatePartialFiles {
+		trimmedPath, _, err := p.addTemplateMember(zw, partialPath, inputsHash)
 		if err != nil {
-			return fmt.Errorf("while reading template %v: %w", templatePath, err)
+			return nil, fmt.Errorf("while adding partial: %w", err)
 		}
-		defer r.Close()
 
-		if _, err := io.Copy(w, r); err != nil {
-			return fmt.Errorf("while writing zip template member %v: %w", templatePath, err)
+		name, _, _ := strings.Cut(strings.TrimPrefix(path.Base(trimmedPath), "_"), ".")
+		dir := path.Dir(trimmedPath)
+		partials[dir] = append(partials[dir], &manifestpb.Partial{
+			Name:            name,
+			ContentPackPath: trimmedPath,
+		})
+	}
+	return partials, nil
+}
+
+// ancestorDirs returns the directories that contain a content pack path, from
+// the root down.
+func ancestorDirs(contentPackPath string) []string {
+	var dirs []string
+	for dir := path.Dir(contentPackPath); ; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == "." || dir == "/" {
+			break
+		}
+	}
+	for i, j := 0, len(dirs)-1; i < j; i, j = i+1, j-1 {
+		dirs[i], dirs[j] = dirs[j], dirs[i]
+	}
+	return dirs
+}
+
+func (p *Packer) addGoTemplates(zw *zip.Writer, manifest *manifestpb.Manifest, bases map[string]string, partials map[string][]*manifestpb.Partial, inputsHash io.Writer) error {
+	for _, templatePath := range p.TemplateFiles {
+		trimmedPath, data, err := p.addTemplateMember(zw, templatePath, inputsHash)
+		if err != nil {
+			return fmt.Errorf("while adding template: %w", err)
 		}
 
 		servingPath := ""
@@ -199,13 +410,30 @@ func (p *Packer) addGoTemplates(zw *zip.Writer, manifest *manifestpb.Manifest) e
 			return fmt.Errorf("template %v doesn't have extension .tmpl", templatePath)
 		}
 
+		// The nearest base template wins, and partials from nearer
+		// directories come later, so that they can override farther ones.
+		gt := &manifestpb.GoTemplate{
+			ServingPath:                   servingPath,
+			SpecializationContentPackPath: trimmedPath,
+		}
+		for _, dir := range ancestorDirs(trimmedPath) {
+			if base, ok := bases[dir]; ok {
+				gt.BaseContentPackPath = base
+			}
+			gt.Partials = append(gt.Partials, partials[dir]...)
+		}
+		if gt.BaseContentPackPath == "" {
+			return fmt.Errorf("template %v has no base template in its directory or above", templatePath)
+		}
+
+		gt.PageData, err = parseFrontMatter(string(data))
+		if err != nil {
+			return fmt.Errorf("while parsing front matter of %v: %w", templatePath, err)
+		}
+
 		manifest.Servables = append(manifest.Servables, &manifestpb.Servable{
 			Entry: &manifestpb.Servable_GoTemplate{
-				GoTemplate: &manifestpb.GoTemplate{
-					ServingPath:                   servingPath,
-					BaseContentPackPath:           strings.TrimPrefix(p.TemplateBaseFile, p.TemplateFileTrimPrefix),
-					SpecializationContentPackPath: trimmedPath,
-				},
+				GoTemplate: gt,
 			},
 		})
 
@@ -225,6 +453,74 @@ func (p *Packer) addGoTemplates(zw *zip.Writer, manifest *manifestpb.Manifest) e
 	return nil
 }
 
+// Front matter is a template comment at the very start of a page, holding
+// "key: value" lines:
+//
+//	{{/* ---
+//	title: Fluid Simulation
+//	date: 2020-09-19
+//	tags: simulation, webgl
+//	--- */}}
+//
+// Setting "unlisted: true" leaves a dated page out of the site's articles.
+//
+// Being a comment, it doesn't change what the template renders.
+const (
+	frontMatterStart = "{{/* ---\n"
+	frontMatterEnd   = "--- */}}"
+)
+
+// parseFrontMatter returns the page data from a template's front matter, or
+// nil if it has none.
+func parseFrontMatter(text string) (*manifestpb.PageData, error) {
+	if !strings.HasPrefix(text, frontMatterStart) {
+		return nil, nil
+	}
+	body, _, ok := strings.Cut(strings.TrimPrefix(text, frontMatterStart), frontMatterEnd)
+	if !ok {
+		return nil, fmt.Errorf("front matter isn't closed with %q", frontMatterEnd)
+	}
+
+	data := &manifestpb.PageData{}
+	for i, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("front matter line %d isn't of the form key: value", i+1)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		switch key {
+		case "title":
+			data.Title = value
+		case "date":
+			if _, err := time.Parse(manifestpb.PageDateLayout, value); err != nil {
+				return nil, fmt.Errorf("while parsing date: %w", err)
+			}
+			data.Date = value
+		case "unlisted":
+			unlisted, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("while parsing unlisted: %w", err)
+			}
+			data.Unlisted = unlisted
+		case "tags":
+			for _, tag := range strings.Split(value, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					data.Tags = append(data.Tags, tag)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown front matter key %q", key)
+		}
+	}
+	return data, nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -234,7 +530,10 @@ func main() {
 		StaticFileTrimPrefix:   *staticFileTrimPrefix,
 		TemplateFiles:          templateFiles.Slice,
 		TemplateFileTrimPrefix: *templateFileTrimPrefix,
-		TemplateBaseFile:       *templateBaseFile,
+		TemplateBaseFiles:      templateBaseFiles.Slice,
+		TemplatePartialFiles:   templatePartialFiles.Slice,
+		BuildVersion:           *buildVersion,
+		CachePolicies:          cachePolicies.Slice,
 	}
 
 	if err := p.Do(); err != nil {
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"row-major/webalator/packer/manifestpb"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseFrontMatter(t *testing.T) {
+	testCases := []struct {
+		name    string
+		text    string
+		want    *manifestpb.PageData
+		wantErr bool
+	}{
+		{
+			name: "none",
+			text: "{{define \"title\"}}Home{{end}}",
+		},
+		{
+			name: "not at the start",
+			text: "\n{{/* ---\ntitle: Late\n--- */}}",
+		},
+		{
+			name: "all keys",
+			text: "{{/* ---\ntitle: Fluid Simulation\ndate: 2020-09-19\ntags: simulation, wasm\nunlisted: false\n--- */}}\n{{define \"content\"}}{{end}}",
+			want: &manifestpb.PageData{Title: "Fluid Simulation", Date: "2020-09-19", Tags: []string{"simulation", "wasm"}},
+		},
+		{
+			name: "blank lines and spacing",
+			text: "{{/* ---\n\n  title :  Spaced: Out  \n\ntags: , a,,b , \n--- */}}",
+			want: &manifestpb.PageData{Title: "Spaced: Out", Tags: []string{"a", "b"}},
+		},
+		{
+			name: "unlisted",
+			text: "{{/* ---\ndate: 2020-04-01\nunlisted: true\n--- */}}",
+			want: &manifestpb.PageData{Date: "2020-04-01", Unlisted: true},
+		},
+		{
+			name: "empty",
+			text: "{{/* ---\n--- */}}",
+			want: &manifestpb.PageData{},
+		},
+		{
+			name:    "not closed",
+			text:    "{{/* ---\ntitle: Open\n",
+			wantErr: true,
+		},
+		{
+			name:    "line without a colon",
+			text:    "{{/* ---\ntitle: Fine\njust words\n--- */}}",
+			wantErr: true,
+		},
+		{
+			name:    "unknown key",
+			text:    "{{/* ---\nauthor: Someone\n--- */}}",
+			wantErr: true,
+		},
+		{
+			name:    "date in another layout",
+			text:    "{{/* ---\ndate: September 19, 2020\n--- */}}",
+			wantErr: true,
+		},
+		{
+			name:    "date out of range",
+			text:    "{{/* ---\ndate: 2020-13-01\n--- */}}",
+			wantErr: true,
+		},
+		{
+			name:    "bad unlisted",
+			text:    "{{/* ---\nunlisted: sometimes\n--- */}}",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseFrontMatter(tc.text)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if !proto.Equal(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAncestorDirs(t *testing.T) {
+	testCases := []struct {
+		contentPackPath string
+		want            []string
+	}{
+		{"index.html.tmpl", []string{"."}},
+		{"articles/index.html.tmpl", []string{".", "articles"}},
+		{"articles/2020-09-19-fluid/index.html.tmpl", []string{".", "articles", "articles/2020-09-19-fluid"}},
+	}
+	for _, tc := range testCases {
+		if diff := cmp.Diff(tc.want, ancestorDirs(tc.contentPackPath)); diff != "" {
+			t.Errorf("ancestorDirs(%q) mismatch (-want +got):\n%s", tc.contentPackPath, diff)
+		}
+	}
+}
+
+// writeFiles writes files (by slash-separated path) under dir, and returns
+// their paths.
+func writeFiles(t *testing.T, dir string, files map[string]string) map[string]string {
+	t.Helper()
+	paths := map[string]string{}
+	for name, content := range files {
+		fileName := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fileName), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fileName, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths[name] = fileName
+	}
+	return paths
+}
+
+// readManifest reads the manifest of a content pack.
+func readManifest(t *testing.T, fileName string) *manifestpb.Manifest {
+	t.Helper()
+	zr, err := zip.OpenReader(fileName)
+	if err != nil {
+		t.Fatalf("opening pack: %v", err)
+	}
+	defer zr.Close()
+
+	f, err := zr.Open("manifest")
+	if err != nil {
+		t.Fatalf("opening manifest: %v", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("reading manifest: %v", err)
+	}
+
+	manifest := &manifestpb.Manifest{}
+	if err := proto.Unmarshal(data, manifest); err != nil {
+		t.Fatalf("unmarshalling manifest: %v", err)
+	}
+	return manifest
+}
+
+func TestPackTemplates(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeFiles(t, filepath.Join(dir, "content"), map[string]string{
+		"base.html.tmpl":                       "root base",
+		"_article-items.html.tmpl":             "root items",
+		"_footer.tmpl":                         "root footer",
+		"index.html.tmpl":                      "{{/* ---\ntitle: Home\n--- */}}",
+		"articles/base.html.tmpl":              "articles base",
+		"articles/_article-items.html.tmpl":    "articles items",
+		"articles/a/index.html.tmpl":           "{{/* ---\ntitle: A\ndate: 2020-01-02\ntags: x\n--- */}}",
+		"articles/a/deeper/_no.extension.tmpl": "deep partial",
+		"articles/a/deeper/index.html.tmpl":    "deeper",
+		"toys/index.html.tmpl":                 "toys",
+		"articles/b/index.html.tmpl":           "{{/* ---\ndate: 2020-01-03\nunlisted: true\n--- */}}",
+	})
+
+	p := &Packer{
+		Output:                 filepath.Join(dir, "pack.zip"),
+		TemplateFileTrimPrefix: filepath.Join(dir, "content") + string(filepath.Separator),
+		BuildVersion:           "test",
+	}
+	for name, fileName := range paths {
+		base := filepath.Base(name)
+		switch {
+		case base == "base.html.tmpl":
+			p.TemplateBaseFiles = append(p.TemplateBaseFiles, fileName)
+		case strings.HasPrefix(base, "_"):
+			p.TemplatePartialFiles = append(p.TemplatePartialFiles, fileName)
+		default:
+			p.TemplateFiles = append(p.TemplateFiles, fileName)
+		}
+	}
+	sort.Strings(p.TemplateBaseFiles)
+	sort.Strings(p.TemplatePartialFiles)
+	sort.Strings(p.TemplateFiles)
+
+	if err := p.Do(); err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+
+	templates := map[string]*manifestpb.GoTemplate{}
+	redirects := map[string]string{}
+	for _, sv := range readManifest(t, p.Output).Servables {
+		switch e := sv.Entry.(type) {
+		case *manifestpb.Servable_GoTemplate:
+			templates[e.GoTemplate.ServingPath] = e.GoTemplate
+		case *manifestpb.Servable_Redirect:
+			redirects[e.Redirect.ServingPath] = e.Redirect.Location
+		}
+	}
+
+	testCases := []struct {
+		servingPath  string
+		wantBase     string
+		wantPartials []string // name=content pack path
+		wantPageData *manifestpb.PageData
+	}{
+		{
+			servingPath:  "/",
+			wantBase:     "base.html.tmpl",
+			wantPartials: []string{"article-items=_article-items.html.tmpl", "footer=_footer.tmpl"},
+			wantPageData: &manifestpb.PageData{Title: "Home"},
+		},
+		{
+			servingPath:  "/toys/",
+			wantBase:     "base.html.tmpl",
+			wantPartials: []string{"article-items=_article-items.html.tmpl", "footer=_footer.tmpl"},
+		},
+		{
+			servingPath: "/articles/a/",
+			wantBase:    "articles/base.html.tmpl",
+			wantPartials: []string{
+				"article-items=_article-items.html.tmpl",
+				"footer=_footer.tmpl",
+				"article-items=articles/_article-items.html.tmpl",
+			},
+			wantPageData: &manifestpb.PageData{Title: "A", Date: "2020-01-02", Tags: []string{"x"}},
+		},
+		{
+			servingPath:  "/articles/b/",
+			wantBase:     "articles/base.html.tmpl",
+			wantPartials: []string{"article-items=_article-items.html.tmpl", "footer=_footer.tmpl", "article-items=articles/_article-items.html.tmpl"},
+			wantPageData: &manifestpb.PageData{Date: "2020-01-03", Unlisted: true},
+		},
+		{
+			servingPath: "/articles/a/deeper/",
+			wantBase:    "articles/base.html.tmpl",
+			wantPartials: []string{
+				"article-items=_article-items.html.tmpl",
+				"footer=_footer.tmpl",
+				"article-items=articles/_article-items.html.tmpl",
+				"no=articles/a/deeper/_no.extension.tmpl",
+			},
+		},
+	}
+	if len(templates) != len(testCases) {
+		t.Errorf("got %d templates, want %d", len(templates), len(testCases))
+	}
+	for _, tc := range testCases {
+		gt, ok := templates[tc.servingPath]
+		if !ok {
+			t.Errorf("no template served at %q", tc.servingPath)
+			continue
+		}
+		if gt.BaseContentPackPath != tc.wantBase {
+			t.Errorf("%s: got base %q, want %q", tc.servingPath, gt.BaseContentPackPath, tc.wantBase)
+		}
+		var partials []string
+		for _, partial := range gt.Partials {
+			partials = append(partials, partial.Name+"="+partial.ContentPackPath)
+		}
+		if diff := cmp.Diff(tc.wantPartials, partials); diff != "" {
+			t.Errorf("%s: partials mismatch (-want +got):\n%s", tc.servingPath, diff)
+		}
+		if !proto.Equal(gt.PageData, tc.wantPageData) {
+			t.Errorf("%s: got page data %v, want %v", tc.servingPath, gt.PageData, tc.wantPageData)
+		}
+	}
+
+	for from, to := range map[string]string{"/toys": "/toys/", "/articles/a": "/articles/a/"} {
+		if got := redirects[from]; got != to {
+			t.Errorf("got redirect from %q to %q, want %q", from, got, to)
+		}
+	}
+}
+
+func TestPackTemplatesErrors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		files map[string]string
+	}{
+		{
+			name: "no base template above",
+			files: map[string]string{
+				"articles/base.html.tmpl": "base",
+				"index.html.tmpl":         "index",
+			},
+		},
+		{
+			name: "bad front matter",
+			files: map[string]string{
+				"base.html.tmpl":  "base",
+				"index.html.tmpl": "{{/* ---\ntitle: Unclosed\n",
+			},
+		},
+		{
+			name: "bad date",
+			files: map[string]string{
+				"base.html.tmpl":  "base",
+				"index.html.tmpl": "{{/* ---\ndate: 2020-02-30\n--- */}}",
+			},
+		},
+		{
+			name: "template without .tmpl",
+			files: map[string]string{
+				"base.html.tmpl": "base",
+				"index.html":     "index",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		dir := t.TempDir()
+		paths := writeFiles(t, filepath.Join(dir, "content"), tc.files)
+
+		p := &Packer{
+			Output:                 filepath.Join(dir, "pack.zip"),
+			TemplateFileTrimPrefix: filepath.Join(dir, "content") + string(filepath.Separator),
+		}
+		for name, fileName := range paths {
+			if filepath.Base(name) == "base.html.tmpl" {
+				p.TemplateBaseFiles = append(p.TemplateBaseFiles, fileName)
+			} else {
+				p.TemplateFiles = append(p.TemplateFiles, fileName)
+			}
+		}
+
+		if err := p.Do(); err == nil {
+			t.Errorf("%s: Do succeeded", tc.name)
+		}
+	}
+}
+
+func TestPackRejectsTwoBasesInOneDirectory(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeFiles(t, dir, map[string]string{
+		"one/base.html.tmpl": "one",
+		"two/base.html.tmpl": "two",
+	})
+
+	p := &Packer{
+		Output:                 filepath.Join(dir, "pack.zip"),
+		TemplateFileTrimPrefix: dir + string(filepath.Separator),
+		TemplateBaseFiles:      []string{paths["one/base.html.tmpl"], paths["two/base.html.tmpl"]},
+	}
+	if err := p.Do(); err != nil {
+		t.Fatalf("Do with bases in different directories: %v", err)
+	}
+
+	p.TemplateBaseFiles = []string{paths["one/base.html.tmpl"], paths["one/base.html.tmpl"]}
+	if err := p.Do(); err == nil {
+		t.Errorf("Do accepted two base templates in one directory")
+	}
+}
+
+func TestPackIsReproducible(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeFiles(t, filepath.Join(dir, "static"), map[string]string{
+		"main.css":  strings.Repeat("body { margin: 0; }\n", 100),
+		"photo.jpg": "not really a jpeg",
+	})
+
+	p := &Packer{
+		StaticFiles:          []string{paths["main.css"], paths["photo.jpg"]},
+		StaticFileTrimPrefix: filepath.Join(dir, "static") + string(filepath.Separator),
+	}
+	pack := func(output string) []byte {
+		t.Helper()
+		p.Output = filepath.Join(dir, output)
+		if err := p.Do(); err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+		data, err := os.ReadFile(p.Output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	first := pack("first.zip")
+
+	// A rebuild touches the files and might check them out with a different
+	// mode, without changing their content.
+	later := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, fileName := range paths {
+		if err := os.Chtimes(fileName, later, later); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(fileName, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !bytes.Equal(pack("second.zip"), first) {
+		t.Errorf("packs of the same content differ after touching the files")
+	}
+}
@@ -0,0 +1,4 @@
+package manifestpb
+
+// PageDateLayout is the time layout of PageData.Date.
+const PageDateLayout = "2006-01-02"
@@ -6,12 +6,17 @@ def _webalator_content_pack_impl(ctx):
     args.add_all(ctx.files.static_files, format_each='--static_file=%s')
     args.add("--static_file_trim_prefix", ctx.attr.static_file_trim_prefix)
     args.add_all(ctx.files.template_files, format_each='--template_file=%s')
-    args.add("--template_base_file", ctx.file.template_base_file)
+    args.add_all(ctx.files.template_base_files, format_each='--template_base_file=%s')
+    args.add_all(ctx.files.template_partial_files, format_each='--template_partial_file=%s')
     args.add("--template_file_trim_prefix", ctx.attr.template_file_trim_prefix)
+    if ctx.attr.build_version:
+        args.add("--build_version", ctx.attr.build_version)
+    for pattern, cache_control in ctx.attr.cache_policies.items():
+        args.add("--cache_policy={}={}".format(pattern, cache_control))
 
     ctx.actions.run(
         outputs = [output_file],
-        inputs = depset(ctx.files.static_files + ctx.files.template_files + [ctx.file.template_base_file]),
+        inputs = depset(ctx.files.static_files + ctx.files.template_files + ctx.files.template_base_files + ctx.files.template_partial_files),
         executable = ctx.executable._packer,
         arguments = [args],
         progress_message = "Packing {}".format(output_file.short_path),
@@ -29,8 +34,17 @@ webalator_content_pack = rule(
         "static_files": attr.label_list(allow_files = True),
         "static_file_trim_prefix": attr.string(),
         "template_files": attr.label_list(allow_files = True),
-        "template_base_file": attr.label(allow_single_file = True),
+        # Each template uses the base template in the nearest directory at or
+        # above it, and the partials in all of those directories.
+        "template_base_files": attr.label_list(allow_files = True),
+        "template_partial_files": attr.label_list(allow_files = True),
         "template_file_trim_prefix": attr.string(),
+        # Shown to templates as .Site.BuildVersion.  Defaults to a hash of the
+        # pack's inputs.
+        "build_version": attr.string(),
+        # Cache-Control headers by serving path pattern, in order of
+        # precedence.  See CachePolicy in manifest.proto.
+        "cache_policies": attr.string_dict(),
         "_packer": attr.label(
             default = Label("//webalator/packer:packer"),
             allow_single_file = True,
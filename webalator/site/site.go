@@ -10,12 +10,13 @@ import (
 
 type Site struct {
 	Mux         *http.ServeMux
-	ContentPack *contentpack.Handler
+	ContentPack *contentpack.Reloader
 }
 
-func New(contentPack *contentpack.Handler) (*Site, error) {
+func New(contentPack *contentpack.Reloader) (*Site, error) {
 	s := &Site{
-		Mux: http.NewServeMux(),
+		Mux:         http.NewServeMux(),
+		ContentPack: contentPack,
 	}
 
 	s.Mux.Handle("/", contentPack)
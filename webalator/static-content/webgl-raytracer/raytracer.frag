@@ -11,6 +11,10 @@ uniform vec2 viewport;
 #define MATERIAL_MODE_SKIP    0
 #define MATERIAL_MODE_EXECUTE 1
 
+// Most instructions the scene and material interpreters will execute.  GLSL
+// ES needs a constant loop bound.
+#define MAX_INSTRUCTIONS 1024
+
 struct tform
 {
     mat3 l;
@@ -52,6 +56,11 @@ ray tapply(tform t, ray r)
     return ray(tapply(t, r.point), normalize(t.l * r.slope));
 }
 
+tform tidentity()
+{
+    return tform(mat3(1.0), vec3(0.0));
+}
+
 // Convert screen-space coordinates to camera space coordinates.
 //
 // In camera space, the camera is looking along the first (x) axis, the second
@@ -189,8 +198,8 @@ contact test_sphere(sphere mdl, ray ms_ray)
             return contact(
                 CONTACT_TYPE_EXIT,
                 t_max,
-                normalize(eval(ms_ray, t_min)),
-                eval(ms_ray, t_min)
+                normalize(eval(ms_ray, t_max)),
+                eval(ms_ray, t_max)
             );
         }
         else /* t_max < 0.0 */
@@ -201,6 +210,56 @@ contact test_sphere(sphere mdl, ray ms_ray)
     }
 }
 
+struct box
+{
+    vec3 lo;
+    vec3 hi;
+};
+
+contact test_box(box mdl, ray ms_ray)
+{
+    // Nudge zero slopes, so that the slab distances are infinite rather than
+    // NaN.
+    vec3 slope = ms_ray.slope + vec3(equal(ms_ray.slope, vec3(0.0))) * 1e-20;
+    vec3 inv_slope = 1.0 / slope;
+
+    vec3 t_lo = (mdl.lo - ms_ray.point) * inv_slope;
+    vec3 t_hi = (mdl.hi - ms_ray.point) * inv_slope;
+    vec3 t_near = min(t_lo, t_hi);
+    vec3 t_far = max(t_lo, t_hi);
+
+    float t_min = max(max(t_near.x, t_near.y), t_near.z);
+    float t_max = min(min(t_far.x, t_far.y), t_far.z);
+
+    if(t_max < t_min || t_max < 0.0)
+    {
+        // Missed the box, or it's behind us.
+        return contact_make_miss();
+    }
+    else if(0.0 < t_min)
+    {
+        // Entering the box through the face of the slab we entered last.
+        vec3 normal = -sign(slope) * vec3(equal(t_near, vec3(t_min)));
+        return contact(
+            CONTACT_TYPE_ENTR,
+            t_min,
+            normal,
+            eval(ms_ray, t_min)
+        );
+    }
+    else
+    {
+        // Exiting the box through the face of the slab we exit first.
+        vec3 normal = sign(slope) * vec3(equal(t_far, vec3(t_max)));
+        return contact(
+            CONTACT_TYPE_EXIT,
+            t_max,
+            normal,
+            eval(ms_ray, t_max)
+        );
+    }
+}
+
 vec4 checkerboard_mtl3(vec3 mtl3)
 {
     // float period = 100.0;
@@ -227,7 +286,7 @@ ivec2 scenedesc_advance_ip(ivec2 ip, int amount)
     ivec2 new_ip = ip;
 
     new_ip.x += amount;
-    if(new_ip.x > scenedesc_dim)
+    if(new_ip.x >= scenedesc_dim)
     {
         new_ip.x = new_ip.x - scenedesc_dim;
         ++new_ip.y;
@@ -236,9 +295,10 @@ ivec2 scenedesc_advance_ip(ivec2 ip, int amount)
     return new_ip;
 }
 
+// Sample at texel centers, so that rounding can't pick a neighboring texel.
 float scenedesc_decode_raw(ivec2 ip)
 {
-    float val = texture2D(scenedesc, vec2(ip) / vec2(scenedesc_dim, scenedesc_dim)).a;
+    float val = texture2D(scenedesc, (vec2(ip) + 0.5) / vec2(scenedesc_dim, scenedesc_dim)).a;
     return val;
 }
 
@@ -259,7 +319,7 @@ ivec2 materialdesc_advance_ip(ivec2 ip, int amount)
     ivec2 new_ip = ip;
 
     new_ip.x += amount;
-    if(new_ip.x > materialdesc_dim)
+    if(new_ip.x >= materialdesc_dim)
     {
         new_ip.x = new_ip.x - materialdesc_dim;
         ++new_ip.y;
@@ -270,7 +330,7 @@ ivec2 materialdesc_advance_ip(ivec2 ip, int amount)
 
 float materialdesc_decode_raw(ivec2 ip)
 {
-    float val = texture2D(materialdesc, vec2(ip) / vec2(scenedesc_dim, scenedesc_dim)).a;
+    float val = texture2D(materialdesc, (vec2(ip) + 0.5) / vec2(materialdesc_dim, materialdesc_dim)).a;
     return val;
 }
 
@@ -286,11 +346,35 @@ float materialdesc_decode_float(ivec2 ip)
     return (val - 1.0/2.0) * 2.0 * 65536.0;
 }
 
-contact test_dispatcher(inout ivec2 ip, ray cur_ray)
+// Decode a transform stored as twelve raw floats: the linear part in row-major
+// order, then the offset.
+tform scenedesc_decode_tform(inout ivec2 ip)
+{
+    tform result;
+    for(int r = 0; r < 3; ++r)
+    {
+        for(int c = 0; c < 3; ++c)
+        {
+            result.l[c][r] = scenedesc_decode_raw(ip);
+            ip = scenedesc_advance_ip(ip, 1);
+        }
+    }
+    result.o.x = scenedesc_decode_raw(ip); ip = scenedesc_advance_ip(ip, 1);
+    result.o.y = scenedesc_decode_raw(ip); ip = scenedesc_advance_ip(ip, 1);
+    result.o.z = scenedesc_decode_raw(ip); ip = scenedesc_advance_ip(ip, 1);
+    return result;
+}
+
+// Test geometry against a world-space ray.  The geometry is defined in model
+// space, related to world space by ws_to_ms and ms_to_ws.  The returned
+// contact is in world space.
+contact test_dispatcher(inout ivec2 ip, ray ws_ray, tform ws_to_ms, tform ms_to_ws)
 {
     int geom_type = scenedesc_decode_int(ip);
     ip = scenedesc_advance_ip(ip, 1);
 
+    ray cur_ray = tapply(ws_to_ms, ws_ray);
+
     contact test_result = contact_make_miss();
 
     if(geom_type == 0)
@@ -308,11 +392,35 @@ contact test_dispatcher(inout ivec2 ip, ray cur_ray)
         sphere decode_sphere;
         test_result = test_sphere(decode_sphere, cur_ray);
     }
+    else if(geom_type == 2)
+    {
+        // Box.  Corners are stored as raw floats.
+
+        box decode_box;
+        decode_box.lo.x = scenedesc_decode_raw(ip); ip = scenedesc_advance_ip(ip, 1);
+        decode_box.lo.y = scenedesc_decode_raw(ip); ip = scenedesc_advance_ip(ip, 1);
+        decode_box.lo.z = scenedesc_decode_raw(ip); ip = scenedesc_advance_ip(ip, 1);
+        decode_box.hi.x = scenedesc_decode_raw(ip); ip = scenedesc_advance_ip(ip, 1);
+        decode_box.hi.y = scenedesc_decode_raw(ip); ip = scenedesc_advance_ip(ip, 1);
+        decode_box.hi.z = scenedesc_decode_raw(ip); ip = scenedesc_advance_ip(ip, 1);
+        test_result = test_box(decode_box, cur_ray);
+    }
     else
     {
         // Unknown geom type.
     }
 
+    if(test_result.type != CONTACT_TYPE_MISS)
+    {
+        // Model space t isn't world space t, unless the transform is rigid.
+        // Measure the world space distance to the contact point.
+        vec3 ws_point = tapply(ms_to_ws, eval(cur_ray, test_result.t));
+        test_result.t = dot(ws_point - ws_ray.point, ws_ray.slope);
+
+        // Normals transform by the inverse transpose.
+        test_result.normal = normalize(test_result.normal * ws_to_ms.l);
+    }
+
     return test_result;
 }
 
@@ -333,9 +441,11 @@ search_scene_result scene_interpreter(ray ws_query)
 
     // State held during execution of the floatcode stream.
     int cur_material_identifier = 0;
+    tform cur_ws_to_ms = tidentity();
+    tform cur_ms_to_ws = tidentity();
 
     ivec2 ip = ivec2(0,0);
-    for(int fake_ip = 0; fake_ip < 32; ++fake_ip)
+    for(int fake_ip = 0; fake_ip < MAX_INSTRUCTIONS; ++fake_ip)
     {
         int ins = scenedesc_decode_int(ip);
         ip = scenedesc_advance_ip(ip, 1);
@@ -358,7 +468,7 @@ search_scene_result scene_interpreter(ray ws_query)
         {
             // Test geometry.
 
-            contact test_contact = test_dispatcher(ip, ws_query);
+            contact test_contact = test_dispatcher(ip, ws_query, cur_ws_to_ms, cur_ms_to_ws);
 
             if(CONTACT_TYPE_MISS != test_contact.type
                && test_contact.t < min_contact.t)
@@ -373,6 +483,12 @@ search_scene_result scene_interpreter(ray ws_query)
             cur_material_identifier = scenedesc_decode_int(ip);
             ip = scenedesc_advance_ip(ip, 1);
         }
+        else if(ins == 3)
+        {
+            // Set current transform: world to model, then model to world.
+            cur_ws_to_ms = scenedesc_decode_tform(ip);
+            cur_ms_to_ws = scenedesc_decode_tform(ip);
+        }
         else
         {
             // Unknown instruction.
@@ -489,7 +605,7 @@ shade_result material_interpreter(int selected_identifier, ray outbound_ray, con
 {
     int cur_identifier = 0;
     ivec2 ip = ivec2(0,0);
-    for(int fake_ip = 0; fake_ip < 32; ++fake_ip)
+    for(int fake_ip = 0; fake_ip < MAX_INSTRUCTIONS; ++fake_ip)
     {
         int ins = materialdesc_decode_int(ip);
         ip = materialdesc_advance_ip(ip, 1);
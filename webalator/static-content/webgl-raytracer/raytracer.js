@@ -33,6 +33,27 @@ var rt_prog_materialdesc_tex; // The texture object.
 var material_code_fragments;
 var material_code;
 
+// The harpoon scene description being previewed, if the page was loaded with
+// ?scene=NAME.  Descriptions are served by webalator's /harpoon-scenes/
+// handler.
+var harpoon_scene = null;
+
+// The camera, in the same form as harpoon's PinholeCamera: rays leave center,
+// through the aperture spanned by eye, left, and up, scaled by aperture.
+var camera = {
+    center: [-5, 0, 1],
+    eye: [1, 0, 0],
+    left: [0, 1, 0],
+    up: [0, 0, 1],
+    aperture: [0.02, 0.0192, 0.0108]
+};
+
+// The direction the camera orbits around, when looking left and right.
+var camera_world_up = [0, 0, 1];
+
+// How far one keypress moves the camera.
+var camera_step = 0.1;
+
 function rt_prog_encode_int(val)
 {
     return val / 65536.0;
@@ -73,6 +94,85 @@ function rt_prog_floatcode_material_lambert(base_color, ambient, light_pos)
     return lambert_code;
 }
 
+function rt_prog_floatcode_set_material(id)
+{
+    return [
+        rt_prog_encode_int(2), // Set material.
+        rt_prog_encode_int(id)
+    ];
+}
+
+// Transforms are harpoon AffineTransforms, as exported in scene descriptions.
+// They're stored as raw floats, which keep full precision in a float texture.
+function rt_prog_floatcode_set_transform(ws_to_ms, ms_to_ws)
+{
+    return [rt_prog_encode_int(3)].concat(
+        ws_to_ms.linear, ws_to_ms.offset,
+        ms_to_ws.linear, ms_to_ws.offset
+    );
+}
+
+function rt_prog_floatcode_test_sphere()
+{
+    return [
+        rt_prog_encode_int(1), // Test geometry.
+        rt_prog_encode_int(1)  //     type: 1 (sphere)
+    ];
+}
+
+function rt_prog_floatcode_test_box(lo, hi)
+{
+    return [
+        rt_prog_encode_int(1), // Test geometry.
+        rt_prog_encode_int(2), //     type: 2 (box)
+        lo[0], lo[1], lo[2],   //     corners, as raw floats.
+        hi[0], hi[1], hi[2]
+    ];
+}
+
+// Translate a harpoon scene description into scene floatcode fragments.
+function harpoon_scene_floatcode(desc)
+{
+    var fragments = [];
+    for(var i in desc.elements)
+    {
+        var elt = desc.elements[i];
+        fragments.push(rt_prog_floatcode_set_material(elt.material));
+        fragments.push(rt_prog_floatcode_set_transform(elt.world_to_model, elt.model_to_world));
+        if(elt.geometry.kind == "sphere")
+            fragments.push(rt_prog_floatcode_test_sphere());
+        else
+            // Boxes, and the bounds of anything we can't draw.
+            fragments.push(rt_prog_floatcode_test_box(elt.geometry.lo, elt.geometry.hi));
+    }
+
+    // The final material is applied to infinity.
+    fragments.push(rt_prog_floatcode_set_material(desc.infinity_material));
+    return fragments;
+}
+
+// Translate a harpoon scene description's materials into material floatcode
+// fragments.  Only emitters keep their own look; everything else is shaded as
+// a Lambertian surface of its representative color, lit by the scene's first
+// light (or, failing that, a light at the camera).
+function harpoon_material_floatcode(desc)
+{
+    var light_pos = camera.center;
+    if(desc.lights.length > 0)
+        light_pos = desc.lights[0].position;
+
+    var fragments = [];
+    for(var i in desc.materials)
+    {
+        var mtl = desc.materials[i];
+        if(mtl.kind == "emitter")
+            fragments.push(rt_prog_floatcode_material_constant(mtl.color));
+        else
+            fragments.push(rt_prog_floatcode_material_lambert(mtl.color, 0.2, light_pos));
+    }
+    return fragments;
+}
+
 function floatcode_write(texture_data, program_bits)
 {
     var cur_offset = 0;
@@ -121,22 +221,29 @@ function rt_prog_setup()
     rt_prog_materialdesc_dim = gl.getUniformLocation(rt_prog, "materialdesc_dim");
 
     // Scene description bytecode.
-    var scene_code = new Float32Array([
-        rt_prog_encode_int(2), // Set material 1.
-        rt_prog_encode_int(1),
-        rt_prog_encode_int(1), // Test sphere.
-        rt_prog_encode_int(1),
-        rt_prog_encode_int(2), // Set material 2.
-        rt_prog_encode_int(2),
-        rt_prog_encode_int(1), // Test plane.
-        rt_prog_encode_int(0),
-        rt_prog_encode_int(2), // Set material 0 (final material is applied to infinity).
-        rt_prog_encode_int(0),
-        rt_prog_encode_int(0)  // Halt.
-    ]);
-
     var scene_code_full = new Float32Array(512*512);
-    scene_code_full.set(scene_code);
+    if(harpoon_scene)
+    {
+        floatcode_write(scene_code_full, harpoon_scene_floatcode(harpoon_scene));
+    }
+    else
+    {
+        var scene_code = new Float32Array([
+            rt_prog_encode_int(2), // Set material 1.
+            rt_prog_encode_int(1),
+            rt_prog_encode_int(1), // Test sphere.
+            rt_prog_encode_int(1),
+            rt_prog_encode_int(2), // Set material 2.
+            rt_prog_encode_int(2),
+            rt_prog_encode_int(1), // Test plane.
+            rt_prog_encode_int(0),
+            rt_prog_encode_int(2), // Set material 0 (final material is applied to infinity).
+            rt_prog_encode_int(0),
+            rt_prog_encode_int(0)  // Halt.
+        ]);
+
+        scene_code_full.set(scene_code);
+    }
 
     // Create the texture that will contain geometry data.
     rt_prog_scenedesc_tex = gl.createTexture();
@@ -148,11 +255,18 @@ function rt_prog_setup()
     gl.texParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE);
     gl.bindTexture(gl.TEXTURE_2D, null);
 
-    material_code_fragments = [
-        rt_prog_floatcode_material_constant([0.8, 0.8, 1.0]),
-        rt_prog_floatcode_material_lambert([1.0, 0.0, 1.0], 0.1, [1, 0, 2]),
-        rt_prog_floatcode_material_lambert([0.0, 1.0, 0.0], 0.1, [1, 0, 2])
-    ];
+    if(harpoon_scene)
+    {
+        material_code_fragments = harpoon_material_floatcode(harpoon_scene);
+    }
+    else
+    {
+        material_code_fragments = [
+            rt_prog_floatcode_material_constant([0.8, 0.8, 1.0]),
+            rt_prog_floatcode_material_lambert([1.0, 0.0, 1.0], 0.1, [1, 0, 2]),
+            rt_prog_floatcode_material_lambert([0.0, 1.0, 0.0], 0.1, [1, 0, 2])
+        ];
+    }
 
     material_code = new Float32Array(512*512);
     floatcode_write(material_code, material_code_fragments);
@@ -194,6 +308,181 @@ function rt_prog_set_cs_to_ws(linear, offset)
     gl.uniform3fv(rt_prog_cs_to_ws_offset, offset);
 }
 
+// Load the camera into the shader.  The columns of the camera-to-world linear
+// transform are the eye, left, and up vectors, and uniformMatrix3fv takes
+// columns, so the vectors can be passed as-is.
+function rt_prog_set_camera(cam)
+{
+    rt_prog_set_cam_aperture(new Float32Array(cam.aperture));
+    rt_prog_set_cs_to_ws(
+        new Float32Array(cam.eye.concat(cam.left, cam.up)),
+        new Float32Array(cam.center)
+    );
+}
+
+function vec3_add(a, b) { return [a[0]+b[0], a[1]+b[1], a[2]+b[2]]; }
+function vec3_scale(a, s) { return [a[0]*s, a[1]*s, a[2]*s]; }
+function vec3_dot(a, b) { return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]; }
+function vec3_cross(a, b)
+{
+    return [
+        a[1]*b[2] - a[2]*b[1],
+        a[2]*b[0] - a[0]*b[2],
+        a[0]*b[1] - a[1]*b[0]
+    ];
+}
+function vec3_normalize(a) { return vec3_scale(a, 1.0 / Math.sqrt(vec3_dot(a, a))); }
+
+// Rotate v by angle radians around the unit vector axis.
+function vec3_rotate(v, axis, angle)
+{
+    var c = Math.cos(angle);
+    var s = Math.sin(angle);
+    return vec3_add(
+        vec3_add(vec3_scale(v, c), vec3_scale(vec3_cross(axis, v), s)),
+        vec3_scale(axis, vec3_dot(axis, v) * (1 - c))
+    );
+}
+
+// Point the camera along eye, keeping up as close to the world up as
+// possible.  This matches PinholeCamera.SetEye followed by SetUp.
+function camera_set_eye(cam, eye)
+{
+    cam.eye = vec3_normalize(eye);
+    var up = vec3_add(camera_world_up, vec3_scale(cam.eye, -vec3_dot(cam.eye, camera_world_up)));
+    cam.up = vec3_normalize(up);
+    cam.left = vec3_cross(cam.up, cam.eye);
+}
+
+function camera_show()
+{
+    var params = document.getElementById("camera-params");
+    if(!params)
+        return;
+
+    var round = function(v) {
+        return v.map(function(x) { return Number(x.toFixed(4)); });
+    };
+    params.textContent = JSON.stringify({
+        center: round(camera.center),
+        eye: round(camera.eye),
+        up: round(camera.up),
+        aperture: round(camera.aperture)
+    });
+}
+
+// Drag to look around, scroll to zoom, and W/A/S/D/R/F to move forward, left,
+// back, right, up, and down.  Hold shift to move faster.
+function camera_controls_setup()
+{
+    var dragging = false;
+    var last_x = 0;
+    var last_y = 0;
+
+    canvas.addEventListener("mousedown", function(e) {
+        dragging = true;
+        last_x = e.clientX;
+        last_y = e.clientY;
+    });
+    window.addEventListener("mouseup", function(e) {
+        dragging = false;
+    });
+    window.addEventListener("mousemove", function(e) {
+        if(!dragging)
+            return;
+
+        var yaw = -(e.clientX - last_x) * 0.005;
+        var pitch = (e.clientY - last_y) * 0.005;
+        last_x = e.clientX;
+        last_y = e.clientY;
+
+        var eye = vec3_rotate(camera.eye, camera_world_up, yaw);
+        var pitched = vec3_rotate(eye, vec3_rotate(camera.left, camera_world_up, yaw), pitch);
+
+        // Don't pitch over the pole.
+        if(Math.abs(vec3_dot(pitched, camera_world_up)) < 0.99)
+            eye = pitched;
+
+        camera_set_eye(camera, eye);
+        camera_show();
+    });
+
+    canvas.addEventListener("wheel", function(e) {
+        e.preventDefault();
+        var zoom = Math.pow(1.1, e.deltaY < 0 ? 1 : -1);
+        camera.aperture = [camera.aperture[0] * zoom, camera.aperture[1], camera.aperture[2]];
+        camera_show();
+    });
+
+    canvas.tabIndex = 0;
+    canvas.addEventListener("keydown", function(e) {
+        var moves = {
+            "w": camera.eye,
+            "s": vec3_scale(camera.eye, -1),
+            "a": camera.left,
+            "d": vec3_scale(camera.left, -1),
+            "r": camera_world_up,
+            "f": vec3_scale(camera_world_up, -1)
+        };
+        var dir = moves[e.key.toLowerCase()];
+        if(!dir)
+            return;
+
+        e.preventDefault();
+        var step = camera_step * (e.shiftKey ? 10 : 1);
+        camera.center = vec3_add(camera.center, vec3_scale(dir, step));
+        camera_show();
+    });
+}
+
+// Start previewing a harpoon scene description.
+function harpoon_scene_load(desc)
+{
+    harpoon_scene = desc;
+
+    if(desc.camera)
+    {
+        camera = {
+            center: desc.camera.center,
+            eye: desc.camera.eye,
+            left: desc.camera.left,
+            up: desc.camera.up,
+            aperture: desc.camera.aperture
+        };
+        camera_world_up = desc.camera.up;
+
+        // Match the canvas to the camera's aspect ratio.
+        canvas.height = Math.round(canvas.width * camera.aperture[2] / camera.aperture[1]);
+    }
+
+    // Step about a hundredth of the way across the scene.
+    var lo = [Infinity, Infinity, Infinity];
+    var hi = [-Infinity, -Infinity, -Infinity];
+    for(var i in desc.elements)
+    {
+        var o = desc.elements[i].model_to_world.offset;
+        for(var j = 0; j < 3; ++j)
+        {
+            lo[j] = Math.min(lo[j], o[j]);
+            hi[j] = Math.max(hi[j], o[j]);
+        }
+    }
+    var extent = Math.max(hi[0] - lo[0], hi[1] - lo[1], hi[2] - lo[2]);
+    if(isFinite(extent) && extent > 0)
+        camera_step = extent / 100;
+
+    var warnings = document.getElementById("scene-warnings");
+    if(warnings)
+    {
+        for(var i in desc.warnings)
+        {
+            var item = document.createElement("li");
+            item.textContent = desc.warnings[i];
+            warnings.appendChild(item);
+        }
+    }
+}
+
 // Promise adapter around XMLHttpRequest.
 function load_text(url)
 {
@@ -229,14 +518,21 @@ function load_text(url)
 
 function start()
 {
-    // Asynchronously load shader texts from server and compile them.
-    Promise.all(
-        [load_text("./raytracer.vert"),
-         load_text("./raytracer.frag")]
-    ).then(
+    // Asynchronously load shader texts (and the harpoon scene, if one was
+    // requested) from server and compile them.
+    var loads = [load_text("./raytracer.vert"), load_text("./raytracer.frag")];
+
+    var scene_name = new URLSearchParams(window.location.search).get("scene");
+    if(scene_name)
+        loads.push(load_text("/harpoon-scenes/" + encodeURIComponent(scene_name)));
+
+    Promise.all(loads).then(
         function(texts) {
             canvas = document.getElementById("glcanvas");
 
+            if(texts.length > 2)
+                harpoon_scene_load(JSON.parse(texts[2]));
+
             // Load WebGL.
             try
             {
@@ -267,6 +563,8 @@ function start()
                 return;
 
             rt_prog_setup();
+            camera_controls_setup();
+            camera_show();
 
             gl.clearColor(1.0, 0.0, 0.0, 1.0);
             gl.clear(gl.COLOR_BUFFER_BIT);
@@ -275,7 +573,7 @@ function start()
         }
     ).catch(
         function(err) {
-            console.log("Error async loading shaders: " + err);
+            console.log("Error async loading shaders or scene: " + err);
             rt_prog = null;
         }
     );
@@ -324,16 +622,8 @@ function draw_scene()
 
     if(first)
     {
+        gl.viewport(0, 0, canvas.width, canvas.height);
         rt_prog_set_viewport(new Float32Array([canvas.width, canvas.height]));
-        rt_prog_set_cam_aperture(new Float32Array([0.02, 0.0192, 0.0108]));
-        rt_prog_set_cs_to_ws(
-            new Float32Array([
-                1, 0, 0,
-                0, 1, 0,
-                0, 0, 1
-            ]),
-            new Float32Array([-5, 0, 1])
-        );
 
         gl.uniform1i(rt_prog_scenedesc, 0);
         gl.uniform1i(rt_prog_scenedesc_dim, 512);
@@ -344,14 +634,20 @@ function draw_scene()
         first = false;
     }
 
-    cur_time += 0.030;
-    light_x = Math.cos(cur_time);
-    light_y = Math.sin(cur_time);
+    rt_prog_set_camera(camera);
 
-    material_code_fragments[1] = rt_prog_floatcode_material_lambert([1.0, 0.0, 1.0], 0.1, [light_x, light_y, 2]);
-    material_code_fragments[2] = rt_prog_floatcode_material_lambert([0.0, 1.0, 0.0], 0.1, [light_x, light_y, 2]);
+    // The demo scene's light circles the sphere.
+    if(!harpoon_scene)
+    {
+        cur_time += 0.030;
+        light_x = Math.cos(cur_time);
+        light_y = Math.sin(cur_time);
+
+        material_code_fragments[1] = rt_prog_floatcode_material_lambert([1.0, 0.0, 1.0], 0.1, [light_x, light_y, 2]);
+        material_code_fragments[2] = rt_prog_floatcode_material_lambert([0.0, 1.0, 0.0], 0.1, [light_x, light_y, 2]);
 
-    material_code = floatcode_write(material_code, material_code_fragments);
+        material_code = floatcode_write(material_code, material_code_fragments);
+    }
 
     gl.activeTexture(gl.TEXTURE0);
     gl.bindTexture(gl.TEXTURE_2D, rt_prog_scenedesc_tex);